@@ -0,0 +1,83 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkAtomicArg rejects the options which write the existing file in place, then `--atomic` would be ignored.
+func checkAtomicArg(opts *TransferOptions) error {
+	if !opts.Atomic {
+		return nil
+	}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{
+		{opts.Resume, "-r"},
+		{opts.Patch, "--patch"},
+		{opts.Audit || opts.AuditPull, "--audit"},
+		{opts.Checksum, "--checksum"},
+	} {
+		if opt.set {
+			return fmt.Errorf("--atomic can't be used with %s", opt.name)
+		}
+	}
+	return nil
+}
+
+// commitAtomicFile renames the temporary file to the final path after the file is received and verified.
+// The attributes are applied to the temporary file before, so the final file is never seen without them.
+// If another file is created at the final path meanwhile, a new name is assigned unless overwriting.
+func (t *TrzszTransfer) commitAtomicFile(attrs *fileAttrs) (string, error) {
+	if err := t.applyFileAttrs(t.atomicTmpPath, attrs); err != nil {
+		return "", err
+	}
+	finalPath := t.atomicPath
+	if !t.keepLocalName() {
+		dir, name := filepath.Split(finalPath)
+		newName, err := getNewName(dir, name, t.transferConfig.RenameScheme)
+		if err != nil {
+			return "", err
+		}
+		finalPath = filepath.Join(dir, newName)
+	}
+	if err := os.Rename(t.atomicTmpPath, finalPath); err != nil {
+		return "", err
+	}
+	t.atomicPath, t.atomicTmpPath = "", ""
+	return finalPath, nil
+}
+
+// removeAtomicFile removes the temporary file if the transfer is failed before it's renamed.
+func (t *TrzszTransfer) removeAtomicFile() {
+	if len(t.atomicTmpPath) > 0 {
+		_ = os.Remove(t.atomicTmpPath)
+		t.atomicPath, t.atomicTmpPath = "", ""
+	}
+}
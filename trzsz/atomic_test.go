@@ -0,0 +1,169 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAtomicTransfer(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "new a.txt")
+	writeTestFile(t, filepath.Join(src, "dir", "b.txt"), "new dir/b.txt")
+
+	for _, protocol := range []int{1, 2} {
+		for _, directory := range []bool{false, true} {
+			paths := []string{filepath.Join(src, "a.txt")}
+			if directory {
+				paths = append(paths, filepath.Join(src, "dir"))
+			}
+			files, err := checkPathsReadable(paths, directory)
+			require.Nil(t, err)
+
+			dest := t.TempDir()
+			writeTestFile(t, filepath.Join(dest, "a.txt"), "old a.txt")
+			args := newDefaultArgsForTest()
+			args.Directory = directory
+			args.Atomic = true
+			result := transferFilesForTest(t, args, protocol, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+
+			// the existing file is kept, and no temporary file is left
+			assert.Equal("a.txt.0", result.localNames[0])
+			assertFileContent(t, filepath.Join(dest, "a.txt"), "old a.txt")
+			assertFileContent(t, filepath.Join(dest, "a.txt.0"), "new a.txt")
+			if directory {
+				assertFileContent(t, filepath.Join(dest, "dir", "b.txt"), "new dir/b.txt")
+			}
+			err = filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+				assert.False(strings.HasSuffix(path, ".tmp"), path)
+				return err
+			})
+			require.Nil(t, err)
+		}
+	}
+}
+
+func TestAtomicTransferCollision(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "new a.txt")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	originalWriteFile := writeFileFunc
+	defer func() { writeFileFunc = originalWriteFile }()
+	dest := t.TempDir()
+	writeFileFunc = func(file *os.File, data []byte) (int, error) {
+		// another file is created at the final path while receiving
+		writeTestFile(t, filepath.Join(dest, "a.txt"), "other a.txt")
+		return file.Write(data)
+	}
+
+	args := newDefaultArgsForTest()
+	args.Atomic = true
+	result := transferFilesForTest(t, args, 1, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	assert.Equal([]string{"a.txt.0"}, result.localNames)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), "other a.txt")
+	assertFileContent(t, filepath.Join(dest, "a.txt.0"), "new a.txt")
+}
+
+func TestAtomicTransferAttrs(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "new a.txt")
+	mtime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.Local)
+	require.Nil(t, os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime))
+	if !IsWindows() {
+		require.Nil(t, os.Chmod(filepath.Join(src, "a.txt"), 0640))
+	}
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	originalTimeNow := timeNowFunc
+	defer func() { timeNowFunc = originalTimeNow }()
+	dest := t.TempDir()
+	timeNowFunc = func() time.Time {
+		// the final file is never seen without the attributes
+		if stat, err := os.Stat(filepath.Join(dest, "a.txt")); err == nil {
+			assert.True(stat.ModTime().Equal(mtime), stat.ModTime())
+		}
+		return originalTimeNow()
+	}
+
+	args := newDefaultArgsForTest()
+	args.Atomic = true
+	args.Preserve = true
+	result := transferFilesForTest(t, args, 2, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	stat, err := os.Stat(filepath.Join(dest, "a.txt"))
+	require.Nil(t, err)
+	assert.True(stat.ModTime().Equal(mtime))
+	if !IsWindows() {
+		assert.Equal(os.FileMode(0640), stat.Mode().Perm())
+	}
+}
+
+func TestAtomicArg(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(checkAtomicArg(&TransferOptions{Checksum: true}))
+	assert.Nil(checkAtomicArg(&TransferOptions{Atomic: true, Directory: true, Preserve: true}))
+	assert.EqualError(checkAtomicArg(&TransferOptions{Atomic: true, Resume: true}), "--atomic can't be used with -r")
+	assert.EqualError(checkAtomicArg(&TransferOptions{Atomic: true, AuditPull: true}), "--atomic can't be used with --audit")
+	assert.EqualError(checkAtomicArg(&TransferOptions{Atomic: true, Checksum: true}), "--atomic can't be used with --checksum")
+	assert.EqualError(checkTrzAtomicArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Atomic: true}}, PatchBase: "base"}),
+		"--atomic can't be used with --patch-base")
+
+	// the peer without the support receives the files in place
+	for _, supported := range []bool{false, true} {
+		client, server := newLoopbackTransfers()
+		require.Nil(t, client.sendAction(true, false))
+		action, err := server.RecvAction()
+		require.Nil(t, err)
+		action.SupportAtomic = supported
+		require.Nil(t, server.SendConfig(TransferOptions{Atomic: true}, action))
+		config, err := client.recvConfig()
+		require.Nil(t, err)
+		assert.Equal(supported, config.Atomic)
+	}
+	client, server := newLoopbackTransfers()
+	require.Nil(t, client.sendAction(true, false))
+	action, err := server.RecvAction()
+	require.Nil(t, err)
+	assert.EqualError(server.SendConfig(TransferOptions{Atomic: true, Checksum: true}, action),
+		"--atomic can't be used with --checksum")
+}
@@ -0,0 +1,205 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// AuditReport is the reconciliation of the incoming files against the existing files of the destination.
+// The paths are relative to the destination, and the extra files are only reported in directory mode.
+type AuditReport struct {
+	Matched   []string
+	Differing []string
+	Missing   []string
+	Extra     []string
+}
+
+func (r *AuditReport) String() string {
+	return fmt.Sprintf("Audit: %d matched, %d differing, %d missing, %d extra",
+		len(r.Matched), len(r.Differing), len(r.Missing), len(r.Extra))
+}
+
+// GetAuditReport returns the reconciliation of the last received files, or nil if not in audit mode.
+func (t *TrzszTransfer) GetAuditReport() *AuditReport {
+	return t.auditReport
+}
+
+func (t *TrzszTransfer) auditDigest(file *os.File) ([]byte, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hasher, err := hashNew(t.transferConfig.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// sendFileAudit sends the checksum of the file, and returns whether the receiver wants the file data.
+func (t *TrzszTransfer) sendFileAudit(file *os.File) (bool, error) {
+	digest, err := t.auditDigest(file)
+	if err != nil {
+		return false, err
+	}
+	if err := t.sendBinary("AUDIT", digest); err != nil {
+		return false, err
+	}
+	verdict, err := t.recvString("SUCC", false)
+	if err != nil {
+		return false, err
+	}
+	return verdict == "pull", nil
+}
+
+// openAuditFile opens the existing file read-only for the audit, or the null device if it's missing.
+// Nothing is created or truncated until the file is to be pulled, see `recvFileAudit`.
+func (t *TrzszTransfer) openAuditFile(path string) (*os.File, error) {
+	t.auditPath = path
+	file, err := os.Open(path)
+	t.auditMissing = errors.Is(err, os.ErrNotExist)
+	if t.auditMissing {
+		return os.Open(os.DevNull)
+	}
+	return file, err
+}
+
+// isAuditFile tells whether the file is the existing file opened read-only for the audit, which is never removed.
+func (t *TrzszTransfer) isAuditFile(file *os.File) bool {
+	return t.transferConfig.Audit && len(t.auditPath) > 0 && file.Name() == t.auditPath
+}
+
+// createDirectory creates the directory of the received entry, but in audit mode, the missing directories
+// are created only when the files under them are to be pulled, and the existing path is only checked.
+func (t *TrzszTransfer) createDirectory(path string) error {
+	if !t.transferConfig.Audit {
+		return doCreateDirectory(path, t.getDirMode())
+	}
+	if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+		return newTrzszError(fmt.Sprintf("Not a directory: %s", path))
+	}
+	return nil
+}
+
+// recvFileAudit compares the existing file with the incoming one, and returns the file created to receive
+// the data if it's to be pulled, or nil to skip the file data.
+func (t *TrzszTransfer) recvFileAudit(path string, file *os.File, size int64) (*os.File, error) {
+	digest, err := t.recvBinary("AUDIT", false, nil)
+	if err != nil {
+		return nil, err
+	}
+	relPath := localRelPath(path, t.auditPath)
+
+	matched := false
+	if t.auditMissing {
+		t.auditReport.Missing = append(t.auditReport.Missing, relPath)
+	} else {
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if stat.Size() == size {
+			localDigest, err := t.auditDigest(file)
+			if err != nil {
+				return nil, err
+			}
+			matched = bytes.Equal(localDigest, digest)
+		}
+		if matched {
+			t.auditReport.Matched = append(t.auditReport.Matched, relPath)
+		} else {
+			t.auditReport.Differing = append(t.auditReport.Differing, relPath)
+		}
+	}
+
+	var pulled *os.File
+	verdict := "skip"
+	if !matched && t.transferConfig.AuditPull {
+		file.Close()
+		if err := doCreateDirectory(filepath.Dir(t.auditPath), t.getDirMode()); err != nil {
+			return nil, err
+		}
+		if pulled, err = doCreateFile(t.auditPath); err != nil {
+			return nil, err
+		}
+		t.auditPath = ""
+		verdict = "pull"
+	}
+	if err := t.sendString("SUCC", verdict); err != nil {
+		if pulled != nil {
+			pulled.Close()
+		}
+		return nil, err
+	}
+	return pulled, nil
+}
+
+// auditExtraFiles reports the existing files under the received directories which are not in the transfer.
+func (t *TrzszTransfer) auditExtraFiles(path string, localNames []string) error {
+	if !t.transferConfig.Directory {
+		return nil
+	}
+	audited := make(map[string]bool)
+	for _, list := range [][]string{t.auditReport.Matched, t.auditReport.Differing, t.auditReport.Missing} {
+		for _, p := range list {
+			audited[p] = true
+		}
+	}
+	for _, name := range localNames {
+		err := filepath.WalkDir(filepath.Join(path, name), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if relPath := localRelPath(path, p); !audited[relPath] {
+				t.auditReport.Extra = append(t.auditReport.Extra, relPath)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Strings(t.auditReport.Extra)
+	return nil
+}
@@ -26,6 +26,8 @@ package trzsz
 
 import (
 	"bytes"
+	"fmt"
+	"math"
 	"time"
 )
 
@@ -35,6 +37,7 @@ type TrzszBuffer struct {
 	nextBuf []byte
 	nextIdx int
 	readBuf bytes.Buffer
+	pauses  *pauseState
 }
 
 func NewTrzszBuffer() *TrzszBuffer {
@@ -52,6 +55,14 @@ func (b *TrzszBuffer) stopBuffer() {
 	}
 }
 
+// resetStop clears the stop left by the previous transfer, which may not be consumed by any read.
+func (b *TrzszBuffer) resetStop() {
+	select {
+	case <-b.stopCh:
+	default:
+	}
+}
+
 func (b *TrzszBuffer) drainBuffer() {
 	for {
 		select {
@@ -83,14 +94,25 @@ func (b *TrzszBuffer) nextBuffer(timeout <-chan time.Time) ([]byte, error) {
 	if b.nextBuf != nil && b.nextIdx < len(b.nextBuf) {
 		return b.nextBuf[b.nextIdx:], nil
 	}
-	select {
-	case b.nextBuf = <-b.bufCh:
-		b.nextIdx = 0
-		return b.nextBuf, nil
-	case <-b.stopCh:
-		return nil, newTrzszError("Stopped")
-	case <-timeout:
-		return nil, newTrzszError("Receive data timeout")
+	var pauseCount int64
+	if b.pauses != nil {
+		pauseCount = b.pauses.count.Load()
+	}
+	for {
+		select {
+		case b.nextBuf = <-b.bufCh:
+			b.nextIdx = 0
+			return b.nextBuf, nil
+		case <-b.stopCh:
+			return nil, newTrzszErrorCode(ErrCancelled, "Stopped")
+		case <-timeout:
+			if b.pauses == nil || !b.pauses.pausedSince(pauseCount) {
+				return nil, newTrzszErrorCode(ErrTimeout, "Receive data timeout")
+			}
+			// the timeout is restarted, as the transfer has been paused while waiting
+			pauseCount = b.pauses.count.Load()
+			timeout = b.pauses.newTimeout()
+		}
 	}
 }
 
@@ -109,7 +131,7 @@ func (b *TrzszBuffer) readLine(mayHasJunk bool, timeout <-chan time.Time) ([]byt
 			b.nextIdx += len(buf)
 		}
 		if bytes.IndexByte(buf, '\x03') >= 0 { // `ctrl + c` to interrupt
-			return nil, newTrzszError("Interrupted")
+			return nil, newTrzszErrorCode(ErrCancelled, "Interrupted")
 		}
 		b.readBuf.Write(buf)
 		if newLineIdx >= 0 {
@@ -122,7 +144,17 @@ func (b *TrzszBuffer) readLine(mayHasJunk bool, timeout <-chan time.Time) ([]byt
 	}
 }
 
-func (b *TrzszBuffer) readBinary(size int, timeout <-chan time.Time) ([]byte, error) {
+// maxBinarySize is the max size of the binary data read at once, i.e., 2G on the 32-bit platforms.
+// It's replaced in tests to check the 32-bit boundary on the 64-bit platforms.
+var maxBinarySize int64 = math.MaxInt
+
+// readBinary reads the binary data of the size sent by the peer, which is checked before converting to int,
+// as it may overflow on the 32-bit platforms.
+func (b *TrzszBuffer) readBinary(size64 int64, timeout <-chan time.Time) ([]byte, error) {
+	if size64 < 0 || size64 > maxBinarySize {
+		return nil, newTrzszError(fmt.Sprintf("Invalid binary data size %d", size64))
+	}
+	size := int(size64)
 	b.readBuf.Reset()
 	if b.readBuf.Cap() < size {
 		b.readBuf.Grow(size)
@@ -186,7 +218,7 @@ func (b *TrzszBuffer) readLineOnWindows(timeout <-chan time.Time) ([]byte, error
 		for i := 0; i < len(buf); i++ {
 			c := buf[i]
 			if c == '\x03' { // `ctrl + c` to interrupt
-				return nil, newTrzszError("Interrupted")
+				return nil, newTrzszErrorCode(ErrCancelled, "Interrupted")
 			}
 			if c == '\n' {
 				hasNewline = true
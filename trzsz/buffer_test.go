@@ -26,11 +26,14 @@ package trzsz
 
 import (
 	"bytes"
+	"fmt"
+	"math"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBufferReadLine(t *testing.T) {
@@ -118,7 +121,7 @@ func TestBufferReadJunk(t *testing.T) {
 func TestBufferReadBinary(t *testing.T) {
 	assert := assert.New(t)
 	tb := NewTrzszBuffer()
-	assertReadSucc := func(size int, data []byte) {
+	assertReadSucc := func(size int64, data []byte) {
 		t.Helper()
 		buf, err := tb.readBinary(size, nil)
 		assert.Nil(err)
@@ -157,6 +160,44 @@ func TestBufferReadBinary(t *testing.T) {
 	assertReadSucc(200, data[:200])
 }
 
+func TestBufferReadBinarySize(t *testing.T) {
+	assert := assert.New(t)
+	originalMaxSize := maxBinarySize
+	defer func() { maxBinarySize = originalMaxSize }()
+	// as on the 32-bit platforms
+	maxBinarySize = math.MaxInt32
+
+	tb := NewTrzszBuffer()
+	tb.addBuffer([]byte("abc"))
+	for _, size := range []int64{math.MaxInt32 + 1, 1 << 32, -1} {
+		_, err := tb.readBinary(size, nil)
+		assert.EqualError(err, fmt.Sprintf("Invalid binary data size %d", size))
+	}
+	buf, err := tb.readBinary(3, nil)
+	assert.Nil(err)
+	assert.Equal([]byte("abc"), buf)
+
+	// the chunk size near the boundary from the peer is rejected instead of overflowing
+	client, server := newLoopbackTransfers()
+	args := newDefaultArgsForTest()
+	args.Binary = true
+	handshakeForTest(t, client, server, args, kProtocolVersion)
+	require.Nil(t, client.writeAll([]byte("#DATA:2147483648\n")))
+	_, err = server.recvData()
+	assert.EqualError(err, "Invalid binary data size 2147483648")
+
+	// the buffer size from the peer is bounded
+	client, server = newLoopbackTransfers()
+	require.Nil(t, client.sendAction(true, false))
+	action, err := server.recvAction()
+	require.Nil(t, err)
+	opts := NewTransferOptions()
+	opts.Bufsize.Size = 4 * 1024 * 1024 * 1024
+	require.Nil(t, server.sendConfig(&opts, action, nil, NoTmux, -1))
+	_, err = client.recvConfig()
+	assert.EqualError(err, "invalid bufsize 4294967296, greater than 1G")
+}
+
 func TestBufferReadOnWin(t *testing.T) {
 	assert := assert.New(t)
 	tb := NewTrzszBuffer()
@@ -227,6 +268,7 @@ func TestBufferOthers(t *testing.T) {
 	beginTime := time.Now()
 	_, err := tb.readLine(false, timeout)
 	assert.EqualError(err, "Receive data timeout")
+	assert.Equal(ErrTimeout, err.(*TrzszError).Code())
 	assert.GreaterOrEqual(time.Now().Sub(beginTime), 100*time.Millisecond)
 
 	// read line interrupted
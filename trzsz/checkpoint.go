@@ -0,0 +1,55 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+)
+
+// passCheckpoint returns whether a checkpoint is passed when the data goes from prev to step,
+// only the files to be verified have the running hash to check.
+func (t *TrzszTransfer) passCheckpoint(prev, step int64) bool {
+	every := t.transferConfig.CheckEvery
+	return every > 0 && t.verifyFile && step/every > prev/every
+}
+
+// sendCheckpoint sends the running hash of the sent data, so that the receiver fails fast on corruption.
+func (t *TrzszTransfer) sendCheckpoint(hasher hash.Hash) error {
+	return t.sendBinary("CHK", hasher.Sum(nil))
+}
+
+// recvCheckpoint compares the running hash of the received data with the sender's.
+func (t *TrzszTransfer) recvCheckpoint(hasher hash.Hash, step int64) error {
+	expectDigest, err := t.recvBinary("CHK", false, t.getNewTimeout())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hasher.Sum(nil), expectDigest) {
+		return newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Check %s failed at offset %d", t.getHashName(), step))
+	}
+	return nil
+}
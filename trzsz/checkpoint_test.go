@@ -0,0 +1,109 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferCheckpoints(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("trzsz checkpoint ", 1000)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{2, 3} {
+		for _, binary := range []bool{false, true} {
+			args := newDefaultArgsForTest()
+			args.Binary = binary
+			args.Bufsize = BufferSize{4096}
+			args.CheckEvery = BufferSize{1024}
+			client, server := newLoopbackTransfers()
+			var checkpoints atomic.Int32
+			client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+				if bytes.HasPrefix(buf, []byte("#CHK:")) {
+					checkpoints.Add(1)
+				}
+				return buf
+			}
+			handshakeForTest(t, client, server, args, protocol)
+			dest := t.TempDir()
+			result := runTransferForTest(client, server, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+			assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+
+			// the protocol 2 peers don't know the checkpoints
+			if protocol < 3 {
+				assert.Equal(int64(0), server.Config().CheckEvery)
+				assert.Equal(int32(0), checkpoints.Load())
+			} else {
+				assert.Equal(int64(1024), server.Config().CheckEvery)
+				assert.True(checkpoints.Load() > 1)
+			}
+		}
+	}
+}
+
+func TestCheckpointMismatch(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("a", 100*1024)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	args := newDefaultArgsForTest()
+	args.Binary = true
+	args.Bufsize = BufferSize{4096}
+	args.CheckEvery = BufferSize{1024}
+	client, server := newLoopbackTransfers()
+	dataCount := 0
+	client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+		// corrupt a byte of the third chunk of the binary data
+		if !bytes.HasPrefix(buf, []byte("#")) {
+			dataCount++
+			if dataCount == 3 {
+				buf[0] = 'b'
+			}
+		}
+		return buf
+	}
+	handshakeForTest(t, client, server, args, 3)
+	result := runTransferForTest(client, server, files, t.TempDir())
+	require.NotNil(t, result.recvErr)
+	assert.Contains(result.recvErr.Error(), "Check MD5 failed at offset")
+	assert.NotContains(result.recvErr.Error(), "at offset 102400")
+	require.NotNil(t, result.sendErr)
+}
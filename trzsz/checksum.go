@@ -0,0 +1,85 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"os"
+)
+
+// sendFileChecksum sends the checksum of the existing file in checksum mode, or an empty one if the file
+// doesn't exist or the size is different, and returns whether the sender is going to send the file data.
+func (t *TrzszTransfer) sendFileChecksum(file *os.File, size int64) (bool, error) {
+	var digest []byte
+	if !t.checksumMissing {
+		stat, err := file.Stat()
+		if err != nil {
+			return false, err
+		}
+		if stat.Size() == size {
+			digest, err = t.auditDigest(file)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := t.sendBinary("HASH", digest); err != nil {
+		return false, err
+	}
+	changed, err := t.recvFileVerdict()
+	if err != nil {
+		return false, err
+	}
+	if changed && !t.checksumMissing {
+		if err := file.Truncate(0); err != nil {
+			return false, err
+		}
+	}
+	if !changed {
+		t.logger.Infof("file %s unchanged", file.Name())
+	}
+	return changed, nil
+}
+
+// recvFileChecksum compares the checksum of the receiver's existing file with the local one,
+// and returns whether the file data should be sent.
+func (t *TrzszTransfer) recvFileChecksum(file *os.File) (bool, error) {
+	digest, err := t.recvBinary("HASH", false, nil)
+	if err != nil {
+		return false, err
+	}
+	changed := true
+	if len(digest) > 0 {
+		localDigest, err := t.auditDigest(file)
+		if err != nil {
+			return false, err
+		}
+		changed = !bytes.Equal(localDigest, digest)
+	}
+	if err := t.sendFileVerdict(!changed); err != nil {
+		return false, err
+	}
+	return changed, nil
+}
@@ -0,0 +1,89 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumUnchanged(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	for _, p := range []string{"same.txt", "differ.txt", "resize.txt", "missing.txt", "dir/same.txt", "dir/differ.txt"} {
+		writeTestFile(t, filepath.Join(src, p), "new "+p)
+	}
+
+	for _, protocol := range []int{1, 2} {
+		for _, directory := range []bool{false, true} {
+			paths := []string{filepath.Join(src, "same.txt"), filepath.Join(src, "differ.txt"),
+				filepath.Join(src, "resize.txt"), filepath.Join(src, "missing.txt")}
+			if directory {
+				paths = append(paths, filepath.Join(src, "dir"))
+			}
+			files, err := checkPathsReadable(paths, directory)
+			require.Nil(t, err)
+
+			dest := t.TempDir()
+			writeTestFile(t, filepath.Join(dest, "same.txt"), "new same.txt")
+			writeTestFile(t, filepath.Join(dest, "differ.txt"), "old differ.txt")
+			writeTestFile(t, filepath.Join(dest, "resize.txt"), "old")
+			writeTestFile(t, filepath.Join(dest, "dir", "same.txt"), "new dir/same.txt")
+			writeTestFile(t, filepath.Join(dest, "dir", "differ.txt"), "old dir/differ.txt")
+
+			args := newDefaultArgsForTest()
+			args.Directory = directory
+			args.Checksum = true
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, protocol)
+			result := runTransferForTest(client, server, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+
+			// the existing files are not renamed, and the changed ones are overwritten
+			assert.ElementsMatch([]string{"same.txt", "differ.txt", "resize.txt", "missing.txt"}, result.localNames[:4])
+			for _, p := range []string{"same.txt", "differ.txt", "resize.txt", "missing.txt"} {
+				assertFileContent(t, filepath.Join(dest, p), "new "+p)
+			}
+			expectedSizes := map[string]int64{"same.txt": 0, "differ.txt": 14, "resize.txt": 14, "missing.txt": 15}
+			if directory {
+				assertFileContent(t, filepath.Join(dest, "dir", "same.txt"), "new dir/same.txt")
+				assertFileContent(t, filepath.Join(dest, "dir", "differ.txt"), "new dir/differ.txt")
+				expectedSizes["dir/same.txt"] = 0
+				expectedSizes["dir/differ.txt"] = 18
+			}
+
+			// the unchanged files are not streamed by the sender
+			sentSizes := make(map[string]int64)
+			for _, f := range client.GetTransferResult().Files {
+				sentSizes[f.Name] = f.Size
+			}
+			assert.Equal(expectedSizes, sentSizes)
+		}
+	}
+}
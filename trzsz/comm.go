@@ -27,9 +27,15 @@ package trzsz
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/exec"
@@ -40,7 +46,14 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/term"
+	"golang.org/x/text/unicode/norm"
 )
 
 var isLinux bool = (runtime.GOOS == "linux")
@@ -65,39 +78,257 @@ type PtyIO interface {
 	Close() error
 }
 
+type nopHasher struct{}
+
+func (h nopHasher) Write(p []byte) (int, error) { return len(p), nil }
+func (h nopHasher) Sum(b []byte) []byte         { return b }
+func (h nopHasher) Reset()                      {}
+func (h nopHasher) Size() int                   { return 0 }
+func (h nopHasher) BlockSize() int              { return 1 }
+
+// kSupportedHashes are the hash algorithms for the file integrity check, md5 is the default.
+var kSupportedHashes = []string{"md5", "sha1", "sha256", "sha512"}
+
+// hashNew creates a hasher of the named algorithm, the empty name means md5 for compatibility.
+func hashNew(name string) (hash.Hash, error) {
+	switch name {
+	case "", "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash %s, should be one of %s", name, strings.Join(kSupportedHashes, ", "))
+	}
+}
+
+// ProgressCallback receives the progress of the transfer. It can be implemented by the library users,
+// e.g., to be notified when each file is done, and combined with the others by `MultiProgress`.
 type ProgressCallback interface {
-	onNum(num int64)
-	onName(name string)
-	onSize(size int64)
-	onStep(step int64)
-	onDone()
+	OnNum(num int64)
+	OnName(name string)
+	// OnSize is called with -1 for a stream of unknown size, and called again with the size once the stream ends.
+	OnSize(size int64)
+	OnStep(step int64)
+	OnDone()
+}
+
+// SkipCallback is optionally implemented by the ProgressCallback to be notified that the current file
+// is skipped, e.g., by --update, its data is received but discarded.
+type SkipCallback interface {
+	OnSkip()
+}
+
+// UnchangedCallback is optionally implemented by the ProgressCallback to be notified that the current file
+// is skipped as unchanged in checksum mode. It's called before `OnDone`.
+type UnchangedCallback interface {
+	OnUnchanged()
+}
+
+// ErrorCallback is optionally implemented by the ProgressCallback to be notified of the failed file
+// in keep-going mode, and the transfer goes on with the next file. It's called in place of `OnName` if the file
+// fails to be opened or created, or in place of `OnDone` if it fails to be written or finished after `OnSize`.
+type ErrorCallback interface {
+	OnError(name string, err error)
+}
+
+// FileDoneCallback is optionally implemented by the ProgressCallback to be notified after the file
+// is transferred and verified, with the local path of the file.
+type FileDoneCallback interface {
+	OnFileDone(localName string, size int64)
+}
+
+// FileHashCallback is optionally implemented by the ProgressCallback to be notified of the digest of the file
+// once the peer agrees on it, e.g., to log the checksums. It's called before `OnFileDone` with the same name.
+// The algo is the lower case name of the hash, e.g., md5. It's not called for the files not verified.
+type FileHashCallback interface {
+	OnFileHash(localName string, algo string, digest []byte)
+}
+
+// SpeedCallback is optionally implemented by the ProgressCallback to be notified of the speed of the current file
+// in bytes per second on each step, once any time has elapsed. It's computed by the same sliding window as the
+// text progress bar, so the library users don't need to compute it again.
+type SpeedCallback interface {
+	OnSpeed(bytesPerSec float64)
 }
 
 type BufferSize struct {
 	Size int64
 }
 
+type UnicodeForm struct {
+	Form string
+}
+
+type ConflictMode struct {
+	Mode string
+}
+
+type RenameScheme struct {
+	Scheme string
+}
+
+type QuotaSize struct {
+	Size int64
+}
+
+type HashName struct {
+	Name string
+}
+
+type CompressName struct {
+	Name string
+}
+
+type ChunkSizes struct {
+	Sizes []int64
+}
+
+// DirMode is the permissions of the directories created by the receiver, which should be
+// writable and searchable by the owner.
+type DirMode struct {
+	Mode os.FileMode
+}
+
+// Verbosity is what the client shows during the transfer, see `kVerbosityProgress` and the others.
+type Verbosity struct {
+	Level int
+}
+
+const (
+	// kVerbosityProgress shows the progress bar, which is the default.
+	kVerbosityProgress = 0
+	// kVerbositySummary shows only a summary line after all the file(s) are done.
+	kVerbositySummary = 1
+	// kVerbositySilent shows nothing, the same as `-q`.
+	kVerbositySilent = 2
+)
+
+// SampleRate is the percentage of the files to be verified. It's stored as the percentage to be skipped,
+// so that the zero value verifies all the files.
+type SampleRate struct {
+	Skip int
+}
+
+// EscapeBytes is the extra control characters to be escaped in binary mode, besides the defaults.
+type EscapeBytes struct {
+	Bytes []byte
+}
+
+// TransferOptions are the options of a transfer, which are negotiated with the peer by the side who
+// sends the config, see `NewTransferOptions` for the defaults. They're separated from the command line
+// args, so the library users can set them directly.
+type TransferOptions struct {
+	Quiet          bool         `arg:"-q" help:"quiet (hide progress bar), the same as --verbosity 2"`
+	Verbosity      Verbosity    `arg:"--verbosity" placeholder:"N" help:"0: show the progress bar, 1: show only a summary line after\nthe file(s) are done, 2: show nothing. (default: 0)"`
+	Overwrite      bool         `arg:"-y" help:"yes, overwrite existing file(s)"`
+	OnConflict     ConflictMode `arg:"--on-conflict" placeholder:"MODE" help:"rename, skip or force (same as -y) the existing file(s). (default: rename)"`
+	RenameScheme   RenameScheme `arg:"--rename-scheme" placeholder:"NAME" help:"rename the existing file(s) as dot: name.ext.0, or\nparen: name (1).ext. (default: dot)"`
+	Update         bool         `arg:"--update" help:"only overwrite the existing file(s) older than the source one(s)"`
+	Atomic         bool         `arg:"--atomic" help:"write to a temporary .name.tmp file and rename it when verified,\nnot with -r, --patch, --audit or --checksum"`
+	Dedup          bool         `arg:"--dedup" help:"send the identical file(s) only once, the others are hard linked\nor copied by the receiver"`
+	Checksum       bool         `arg:"--checksum" help:"skip the existing file(s) with the same size and checksum,\nthe unchanged files won't be transferred again. the files are\nchecked one by one, so --parallel is not used then"`
+	FollowSymlinks bool         `arg:"--follow-symlinks" help:"transfer the targets of the symlinks under the directories,\ninstead of transferring them as links"`
+	Exclude        []string     `arg:"--exclude,separate" placeholder:"PATTERN" help:"exclude the file(s) and directories matching PATTERN,\ne.g., *.log, node_modules, src/*/gen. can be repeated"`
+	Include        []string     `arg:"--include,separate" placeholder:"PATTERN" help:"only transfer the file(s) matching any PATTERN, the directories\nare always walked. --exclude is applied first and wins"`
+	KeepGoing      bool         `arg:"--keep-going" help:"skip the file(s) failed to read or write, instead of aborting"`
+	SkipSpecial    bool         `arg:"--skip-special" help:"skip the special files, e.g., named pipes, sockets and devices"`
+	Binary         bool         `arg:"-b" help:"binary transfer mode, faster for binary files"`
+	Directory      bool         `arg:"-d" help:"transfer directories and files"`
+	Bufsize        BufferSize   `arg:"-B" placeholder:"N" default:"10M" help:"max buffer chunk size (1K<=N<=1G). (default: 10M)"`
+	Timeout        int          `arg:"-t" placeholder:"N" default:"20" help:"timeout ( N seconds ) for each buffer chunk.\nN <= 0 means never timeout. (default: 20)"`
+	ConnectTimeout int          `arg:"--connect-timeout" placeholder:"N" default:"-1" help:"timeout ( N seconds ) for the handshake, including choosing\nthe file(s) on the client. N = 0 means never timeout.\n(default: same as -t)"`
+	Parallel       int          `arg:"--parallel" placeholder:"N" help:"transfer up to N file(s) in flight, faster for many small files.\nnot with --patch, --audit, -r, --update, --checksum,\n--atomic, --dedup, --keep-going, --retries, --check-every\nor --on-conflict skip. (default: 1)"`
+	CheckEvery     BufferSize   `arg:"--check-every" placeholder:"N" help:"check the running hash every N bytes, e.g., 64M, to fail fast\non corruption instead of at the end. not with --retries.\nthe data is sent one chunk at a time without the pipeline"`
+	ChunkRetries   int          `arg:"--retries" placeholder:"N" help:"resend a buffer chunk up to N times on timeout. the data\nis sent one chunk at a time without the pipeline then.\n(default: 0)"`
+	AckWindow      int          `arg:"--ack-window" placeholder:"N" help:"send up to N buffer chunks before waiting for the acks, faster\non a high-latency link. the bytes in flight are limited by -B,\nthe chunks are acked one by one with --retries or --check-every,\nor if the peer doesn't support it. (default: 1)"`
+	Adaptive       bool         `arg:"--adaptive" help:"slow down sending when the terminal becomes unresponsive"`
+	Limit          BufferSize   `arg:"--limit" placeholder:"N" help:"limit the sending speed to N bytes per second, e.g., 512K"`
+	MinSpeed       BufferSize   `arg:"--min-speed" placeholder:"N" help:"extend the timeout of a large buffer chunk on a slow link,\nonly timeout if slower than N bytes per second, e.g., 10K"`
+	StartAt        int          `arg:"--start-at" placeholder:"N" help:"skip the first N file(s) to resume an interrupted batch.\nbetter to be used with -y to overwrite the same destination."`
+	Preview        bool         `arg:"--preview" help:"confirm the file count and total size before transferring"`
+	PreviewTimeout int          `arg:"--preview-timeout" placeholder:"N" help:"auto accept the preview after N seconds.\nN <= 0 means waiting for the answer. (default: 0)"`
+	VerifySample   SampleRate   `arg:"--verify-sample" placeholder:"P" help:"only verify the checksum of P% randomly selected files. (default: 100)"`
+	VerifyAbove    BufferSize   `arg:"--verify-above" placeholder:"N" help:"always verify the checksum of files larger than N when sampling"`
+	NoCheck        bool         `arg:"--no-check" help:"skip the checksum of all the file(s), trading the integrity for\nspeed on a trusted link, e.g., an encrypted SSH channel. only\nthe sizes are checked then, overrides --verify-sample"`
+	Stats          bool         `arg:"--stats" help:"show transfer statistics when done"`
+	Normalize      UnicodeForm  `arg:"--normalize" placeholder:"FORM" help:"normalize the received file names to nfc or nfd form"`
+	Patch          bool         `arg:"--patch" help:"only send the changed ranges of files against the existing files\nof the receiver, and patch them in place. the receiver may\ncompare with the prior versions in its own --patch DIR"`
+	Audit          bool         `arg:"--audit" help:"compare the existing files with the incoming ones and report\nthe matched, differing, missing and extra files only"`
+	AuditPull      bool         `arg:"--audit-pull" help:"like --audit, but also receive the differing and missing files"`
+	WriteTimeout   int          `arg:"--write-timeout" placeholder:"N" default:"20" help:"give up if writing to the terminal is blocked for N seconds.\nN <= 0 means never timeout. (default: 20)"`
+	Preserve       bool         `arg:"-p" help:"preserve the modification time and permissions of file(s) and\ndirectories, and the owner if privileged (not on Windows)"`
+	Xattrs         bool         `arg:"--xattrs" help:"with -p, also preserve the extended attributes of file(s) and\ndirectories, skipped if not supported (not on Windows)"`
+	Resume         bool         `arg:"-r" help:"resume the partially received file(s) by only sending the\nmissing tail, the existing file(s) won't be renamed"`
+	NoCompress     bool         `arg:"--no-compress" help:"send the data without compression, good for compressed files.\notherwise it's disabled automatically if the data is incompressible"`
+	VerifyEscape   bool         `arg:"--verify-escape" help:"check that the terminal passes all the bytes intact in binary\nmode before any file data, to fail fast with the bytes mangled"`
+	BinaryCompress bool         `arg:"--binary-compress" help:"also compress the data in binary mode, good for text files\non a slow link, but a waste of CPU for compressed files"`
+	Compress       CompressName `arg:"--compress" placeholder:"NAME" help:"compress algorithm of the data in text mode: zlib, zstd\nor none. (default: zstd, or zlib if the data is sent\none chunk at a time)"`
+	Tar            bool         `arg:"--tar" help:"pack the file(s) into a tar stream on the fly, which is extracted\nby the receiver, faster for many tiny files. not with -p, -r,\n--update, --checksum, --atomic, --dedup, --patch, --audit,\n--keep-going, --retries, --check-every, --start-at or --preview"`
+	Hash           HashName     `arg:"--hash" placeholder:"NAME" help:"hash algorithm to check the file integrity: md5, sha1,\nsha256 or sha512. (default: md5)"`
+	ChunkSizes     ChunkSizes   `arg:"--chunk-sizes" placeholder:"N,..." help:"send the chunks in the sizes cycling through the list,\ninstead of adjusting the chunk size adaptively, each up to -B"`
+	// Stream is set by `tsz --name`, the data of unknown size is sent from stdin.
+	Stream bool `arg:"-"`
+}
+
+// NewTransferOptions returns the options with the same defaults as the command line.
+func NewTransferOptions() TransferOptions {
+	opts := TransferOptions{Timeout: kDefaultTimeout, ConnectTimeout: -1, WriteTimeout: kDefaultTimeout}
+	opts.setDefaults()
+	return opts
+}
+
+// setDefaults sets the zero values which can't be given on the command line, so they mean the same on both.
+// The other zero values, e.g., the timeout 0 means never timeout, are kept as they are.
+func (o *TransferOptions) setDefaults() {
+	if o.Bufsize.Size == 0 {
+		o.Bufsize.Size = kDefaultBufSize
+	}
+}
+
 type Args struct {
-	Quiet     bool       `arg:"-q" help:"quiet (hide progress bar)"`
-	Overwrite bool       `arg:"-y" help:"yes, overwrite existing file(s)"`
-	Binary    bool       `arg:"-b" help:"binary transfer mode, faster for binary files"`
-	Escape    bool       `arg:"-e" help:"escape all known control characters"`
-	Directory bool       `arg:"-d" help:"transfer directories and files"`
-	Bufsize   BufferSize `arg:"-B" placeholder:"N" default:"10M" help:"max buffer chunk size (1K<=N<=1G). (default: 10M)"`
-	Timeout   int        `arg:"-t" placeholder:"N" default:"20" help:"timeout ( N seconds ) for each buffer chunk.\nN <= 0 means never timeout. (default: 20)"`
+	TransferOptions
+	Escape           bool        `arg:"-e" help:"escape all known control characters"`
+	EscapeBytes      EscapeBytes `arg:"--escape-bytes" placeholder:"HEX,..." help:"also escape the control characters in binary mode, e.g.,\n11,13 for XON and XOFF, which are mangled by some middleboxes"`
+	HandshakeRetries int         `arg:"--handshake-retries" placeholder:"N" help:"re-emit the handshake up to N times if the client\ndoesn't respond in time, doubling the timeout each time"`
+	SummaryFormat    string      `arg:"--summary-format" placeholder:"FMT" help:"write a compact summary when done, e.g., \"{direction} {files}f {size} {duration}\".\nplaceholders: {direction}, {files}, {bytes}, {size}, {duration}"`
+	SummaryFile      string      `arg:"--summary-file" placeholder:"PATH" help:"write the compact summary to PATH. (default: stderr)"`
+	NoTty            bool        `arg:"--no-tty" help:"transfer over stdin and stdout as a plain pipe or socket,\nwithout tmux, the console or the raw mode, e.g., in CI"`
+}
+
+// getHandshakeTimeout returns the handshake timeout of the config, where 0 means the same as -t,
+// and N < 0 means never timeout. The connect timeout N < 0 means it's not set, and 0 means never timeout.
+func (o *TransferOptions) getHandshakeTimeout() int {
+	if o.ConnectTimeout < 0 {
+		return 0
+	}
+	if o.ConnectTimeout == 0 {
+		return -1
+	}
+	return o.ConnectTimeout
+}
+
+// getRetryTimeout returns the timeout to re-emit the handshake, the connect timeout if set, or the chunk timeout.
+func (a *Args) getRetryTimeout() time.Duration {
+	if timeout := a.getHandshakeTimeout(); timeout != 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return time.Duration(a.Timeout) * time.Second
 }
 
 var sizeRegexp = regexp.MustCompile("(?i)^(\\d+)(b|k|m|g|kb|mb|gb)?$")
 
-func (b *BufferSize) UnmarshalText(buf []byte) error {
-	str := string(buf)
+func parseSize(str string) (int64, error) {
 	match := sizeRegexp.FindStringSubmatch(str)
 	if len(match) < 2 {
-		return fmt.Errorf("invalid size %s", str)
+		return 0, fmt.Errorf("invalid size %s", str)
 	}
 	sizeValue, err := strconv.ParseInt(match[1], 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid size %s", str)
+		return 0, fmt.Errorf("invalid size %s", str)
 	}
 	if len(match) > 2 {
 		unitSuffix := strings.ToLower(match[2])
@@ -110,9 +341,17 @@ func (b *BufferSize) UnmarshalText(buf []byte) error {
 		} else if unitSuffix == "g" || unitSuffix == "gb" {
 			sizeValue *= 1024 * 1024 * 1024
 		} else {
-			return fmt.Errorf("invalid size %s", str)
+			return 0, fmt.Errorf("invalid size %s", str)
 		}
 	}
+	return sizeValue, nil
+}
+
+func (b *BufferSize) UnmarshalText(buf []byte) error {
+	sizeValue, err := parseSize(string(buf))
+	if err != nil {
+		return err
+	}
 	if sizeValue < 1024 {
 		return fmt.Errorf("less than 1K")
 	}
@@ -123,43 +362,339 @@ func (b *BufferSize) UnmarshalText(buf []byte) error {
 	return nil
 }
 
+func (q *QuotaSize) UnmarshalText(buf []byte) error {
+	sizeValue, err := parseSize(string(buf))
+	if err != nil {
+		return err
+	}
+	q.Size = sizeValue
+	return nil
+}
+
+func (h *HashName) UnmarshalText(buf []byte) error {
+	name := strings.ToLower(string(buf))
+	if _, err := hashNew(name); err != nil {
+		return err
+	}
+	h.Name = name
+	return nil
+}
+
+func (c *CompressName) UnmarshalText(buf []byte) error {
+	name := strings.ToLower(string(buf))
+	if !containsString(kSupportedCompressions, name) {
+		return fmt.Errorf("unsupported compress %s, should be one of %s", name, strings.Join(kSupportedCompressions, ", "))
+	}
+	c.Name = name
+	return nil
+}
+
+func (c *ChunkSizes) UnmarshalText(buf []byte) error {
+	var sizes []int64
+	for _, str := range strings.Split(string(buf), ",") {
+		var size BufferSize
+		if err := size.UnmarshalText([]byte(strings.TrimSpace(str))); err != nil {
+			return err
+		}
+		sizes = append(sizes, size.Size)
+	}
+	c.Sizes = sizes
+	return nil
+}
+
+func (e *EscapeBytes) UnmarshalText(buf []byte) error {
+	var escapeBytes []byte
+	for _, str := range strings.Split(string(buf), ",") {
+		str = strings.TrimSpace(str)
+		b, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(str), "0x"), 16, 8)
+		if err != nil || (b >= 0x20 && b < 0x7f) || b > 0x9f {
+			return fmt.Errorf("invalid escape byte %s, should be a control character in hex, e.g., 1b", str)
+		}
+		escapeBytes = append(escapeBytes, byte(b))
+	}
+	e.Bytes = escapeBytes
+	return nil
+}
+
+func (v *Verbosity) UnmarshalText(buf []byte) error {
+	level, err := strconv.Atoi(string(buf))
+	if err != nil || level < kVerbosityProgress || level > kVerbositySilent {
+		return fmt.Errorf("invalid verbosity %s, should be 0, 1 or 2", string(buf))
+	}
+	v.Level = level
+	return nil
+}
+
+func (r *SampleRate) UnmarshalText(buf []byte) error {
+	percent, err := strconv.Atoi(strings.TrimSuffix(string(buf), "%"))
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid percent %s, should be 0 to 100", string(buf))
+	}
+	r.Skip = 100 - percent
+	return nil
+}
+
+func (d *DirMode) UnmarshalText(buf []byte) error {
+	mode, err := strconv.ParseUint(string(buf), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %s, should be octal, e.g., 0700", string(buf))
+	}
+	if err := checkDirMode(uint32(mode)); err != nil {
+		return err
+	}
+	d.Mode = os.FileMode(mode)
+	return nil
+}
+
+func checkDirMode(mode uint32) error {
+	if mode&^0777 != 0 || mode&0300 != 0300 {
+		return fmt.Errorf("invalid mode %#o, should be writable and searchable by the owner", mode)
+	}
+	return nil
+}
+
+func (u *UnicodeForm) UnmarshalText(buf []byte) error {
+	form := strings.ToLower(string(buf))
+	if form != "nfc" && form != "nfd" {
+		return fmt.Errorf("invalid form %s, should be nfc or nfd", string(buf))
+	}
+	u.Form = form
+	return nil
+}
+
+func (c *ConflictMode) UnmarshalText(buf []byte) error {
+	mode := strings.ToLower(string(buf))
+	if mode != "rename" && mode != "skip" && mode != "force" {
+		return fmt.Errorf("invalid mode %s, should be rename, skip or force", string(buf))
+	}
+	c.Mode = mode
+	return nil
+}
+
+func (r *RenameScheme) UnmarshalText(buf []byte) error {
+	scheme := strings.ToLower(string(buf))
+	if scheme != "dot" && scheme != "paren" {
+		return fmt.Errorf("invalid scheme %s, should be dot or paren", string(buf))
+	}
+	r.Scheme = scheme
+	return nil
+}
+
+// normalizeName converts the name to the unicode normalization form, or returns it unchanged if the form is empty.
+func normalizeName(name string, form string) string {
+	switch form {
+	case "nfc":
+		return norm.NFC.String(name)
+	case "nfd":
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// toLocalName converts the received name to the one created on the local file system, normalized to the form
+// if set. The file names on Windows are UTF-16, which the os package converts to by the wide char API, and the
+// invalid UTF-8 bytes are replaced by U+FFFD one by one, so the name checked and reported is the same as on disk.
+func toLocalName(name string, form string) string {
+	name = normalizeName(name, form)
+	if isWindows && !utf8.ValidString(name) {
+		name = string([]rune(name))
+	}
+	return name
+}
+
 func encodeBytes(buf []byte) string {
-	b := bytes.NewBuffer(make([]byte, 0, len(buf)+0x10))
-	z := zlib.NewWriter(b)
-	z.Write([]byte(buf))
-	z.Close()
-	return base64.StdEncoding.EncodeToString(b.Bytes())
+	return encodeBytesWith(buf, "zlib")
 }
 
 func encodeString(str string) string {
 	return encodeBytes([]byte(str))
 }
 
-func decodeString(str string) ([]byte, error) {
+var kSupportedCompressions = []string{"zlib", "zstd", "none"}
+
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+}
+
+// compressBytes compresses the buffer with the named algorithm, the empty name means zlib for compatibility.
+func compressBytes(buf []byte, compress string) []byte {
+	switch compress {
+	case "zstd":
+		initZstd()
+		return zstdEncoder.EncodeAll(buf, make([]byte, 0, len(buf)+0x10))
+	case "none":
+		return buf
+	default:
+		b := bytes.NewBuffer(make([]byte, 0, len(buf)+0x10))
+		z := zlib.NewWriter(b)
+		z.Write(buf)
+		z.Close()
+		return b.Bytes()
+	}
+}
+
+func decompressBytes(b []byte, compress string) ([]byte, error) {
+	switch compress {
+	case "zstd":
+		initZstd()
+		return zstdDecoder.DecodeAll(b, make([]byte, 0, len(b)<<2))
+	case "none":
+		return b, nil
+	default:
+		z, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		buf := bytes.NewBuffer(make([]byte, 0, len(b)<<2))
+		if _, err := io.Copy(buf, z); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+func encodeBytesWith(buf []byte, compress string) string {
+	return base64.StdEncoding.EncodeToString(compressBytes(buf, compress))
+}
+
+func decodeStringWith(str string, compress string) ([]byte, error) {
 	b, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
 		return nil, err
 	}
-	z, err := zlib.NewReader(bytes.NewReader(b))
+	return decompressBytes(b, compress)
+}
+
+const (
+	kChunkCompressed byte = 'C'
+	kChunkStored     byte = 'S'
+)
+
+// encodeChunk prefixes a header byte to mark whether the payload is compressed or stored as is.
+func encodeChunk(header byte, payload []byte) string {
+	buf := make([]byte, 0, len(payload)+1)
+	buf = append(buf, header)
+	return base64.StdEncoding.EncodeToString(append(buf, payload...))
+}
+
+func decodeChunk(str string, compress string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
 		return nil, err
 	}
-	defer z.Close()
-	buf := bytes.NewBuffer(make([]byte, 0, len(b)<<2))
-	if _, err := io.Copy(buf, z); err != nil {
-		return nil, err
+	return decodeChunkBytes(b, compress)
+}
+
+func decodeChunkBytes(b []byte, compress string) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, newTrzszError("Empty data chunk without header")
+	}
+	switch b[0] {
+	case kChunkStored:
+		return b[1:], nil
+	case kChunkCompressed:
+		return decompressBytes(b[1:], compress)
+	default:
+		return nil, newTrzszError(fmt.Sprintf("Unknown data chunk header: %d", b[0]))
+	}
+}
+
+// kBlockPrefixSize is the size of the length prefix of a data block in binary mode.
+const kBlockPrefixSize = 4
+
+// encodeBlock frames the chunk as a block in binary mode, the length prefix is of the header and the payload,
+// so the blocks can be split from the data of the pipeline, which is cut anywhere.
+func encodeBlock(header byte, payload []byte) []byte {
+	buf := make([]byte, kBlockPrefixSize+1, kBlockPrefixSize+1+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)+1))
+	buf[kBlockPrefixSize] = header
+	return append(buf, payload...)
+}
+
+// blockDecoder splits the blocks from the data, and keeps the incomplete block until the rest of it arrives.
+type blockDecoder struct {
+	compress string
+	buffer   []byte
+}
+
+// decode returns the data of the complete blocks so far.
+func (d *blockDecoder) decode(data []byte) ([][]byte, error) {
+	d.buffer = append(d.buffer, data...)
+	var blocks [][]byte
+	for len(d.buffer) >= kBlockPrefixSize {
+		size := int(binary.BigEndian.Uint32(d.buffer))
+		if len(d.buffer) < kBlockPrefixSize+size {
+			break
+		}
+		block, err := decodeChunkBytes(d.buffer[kBlockPrefixSize:kBlockPrefixSize+size], d.compress)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+		d.buffer = d.buffer[kBlockPrefixSize+size:]
 	}
-	return buf.Bytes(), nil
+	return blocks, nil
+}
+
+// finish returns an error if the last block is incomplete.
+func (d *blockDecoder) finish() error {
+	if len(d.buffer) > 0 {
+		return newTrzszError(fmt.Sprintf("Incomplete data block: %d bytes left", len(d.buffer)))
+	}
+	return nil
+}
+
+func decodeString(str string) ([]byte, error) {
+	return decodeStringWith(str, "zlib")
 }
 
+// ErrorCode is the stable code of a `TrzszError` for the programmatic handling, while the message is for humans.
+type ErrorCode int
+
+const (
+	// ErrUnknown is the code of the errors not classified yet.
+	ErrUnknown ErrorCode = iota
+	// ErrTimeout means no data is received or written in time.
+	ErrTimeout
+	// ErrChecksum means the hash of the received data doesn't match the sender's, or the data is corrupted.
+	ErrChecksum
+	// ErrNoSpace means no space left on the device to save the file.
+	ErrNoSpace
+	// ErrPermission means no permission to read or write the file.
+	ErrPermission
+	// ErrCancelled means the transfer is cancelled, stopped or interrupted, locally or by the peer.
+	ErrCancelled
+	// ErrRemoteExit means the peer exits with a message, e.g., the tsz or trz exits.
+	ErrRemoteExit
+)
+
+// TrzszError is the error of the transfer, use `errors.As` and `Code` to branch on the kind of it.
 type TrzszError struct {
 	message string
 	errType string
 	trace   bool
+	cause   error
+	code    ErrorCode
 }
 
 func NewTrzszError(message string, errType string, trace bool) *TrzszError {
+	code := ErrUnknown
 	if errType == "fail" || errType == "FAIL" || errType == "EXIT" {
+		// the code of the peer is appended after a colon, which is never in the base64 message
+		if idx := strings.LastIndexByte(message, ':'); idx >= 0 {
+			if c, err := strconv.Atoi(message[idx+1:]); err == nil {
+				code = ErrorCode(c)
+			}
+			message = message[:idx]
+		}
 		msg, err := decodeString(message)
 		if err != nil {
 			message = fmt.Sprintf("decode [%s] error: %s", message, err)
@@ -169,10 +704,18 @@ func NewTrzszError(message string, errType string, trace bool) *TrzszError {
 	} else if len(errType) > 0 {
 		message = fmt.Sprintf("[TrzszError] %s: %s", errType, message)
 	}
-	err := &TrzszError{message, errType, trace}
+	err := &TrzszError{message, errType, trace, nil, code}
 	if err.isTraceBack() {
 		err.message = fmt.Sprintf("%s\n%s", err.message, string(debug.Stack()))
 	}
+	if code != ErrUnknown {
+		return err
+	}
+	if err.isRemoteExit() {
+		err.code = ErrRemoteExit
+	} else if err.isRemoteFail() && err.message == "Cancelled" {
+		err.code = ErrCancelled
+	}
 	return err
 }
 
@@ -180,10 +723,43 @@ func newTrzszError(message string) *TrzszError {
 	return NewTrzszError(message, "", false)
 }
 
+func newTrzszErrorCode(code ErrorCode, message string) *TrzszError {
+	err := newTrzszError(message)
+	err.code = code
+	return err
+}
+
+// wrapTrzszError wraps the cause with the message, the code is of the cause if it's classified, otherwise it's the given one.
+func wrapTrzszError(code ErrorCode, cause error, message string) *TrzszError {
+	var e *TrzszError
+	if errors.As(cause, &e) && e.code != ErrUnknown {
+		code = e.code
+	} else if isNoSpaceError(cause) {
+		code = ErrNoSpace
+	} else if errors.Is(cause, os.ErrPermission) {
+		code = ErrPermission
+	} else if errors.Is(cause, os.ErrDeadlineExceeded) {
+		code = ErrTimeout
+	}
+	err := newTrzszErrorCode(code, message)
+	err.cause = cause
+	return err
+}
+
 func (e *TrzszError) Error() string {
 	return e.message
 }
 
+// Code returns the code of the error, which is `ErrUnknown` if it's not classified.
+func (e *TrzszError) Code() ErrorCode {
+	return e.code
+}
+
+// Unwrap returns the cause of the error, e.g., `context.Canceled` if the transfer is cancelled by the context.
+func (e *TrzszError) Unwrap() error {
+	return e.cause
+}
+
 func (e *TrzszError) isTraceBack() bool {
 	if e.errType == "fail" || e.errType == "EXIT" {
 		return false
@@ -191,6 +767,17 @@ func (e *TrzszError) isTraceBack() bool {
 	return e.trace
 }
 
+func (e *TrzszError) isTimeout() bool {
+	return e.errType == "" && e.message == "Receive data timeout"
+}
+
+func isTimeoutError(err error) bool {
+	if e, ok := err.(*TrzszError); ok {
+		return e.isTimeout()
+	}
+	return false
+}
+
 func (e *TrzszError) isRemoteExit() bool {
 	return e.errType == "EXIT"
 }
@@ -210,30 +797,140 @@ func checkPathWritable(path string) error {
 		return newTrzszError(fmt.Sprintf("Not a directory: %s", path))
 	}
 	if syscallAccessWok(path) != nil {
-		return newTrzszError(fmt.Sprintf("No permission to write: %s", path))
+		return newTrzszErrorCode(ErrPermission, fmt.Sprintf("No permission to write: %s", path))
 	}
 	return nil
 }
 
 type TrzszFile struct {
-	PathID  int      `json:"path_id"`
-	AbsPath string   `json:"-"`
-	RelPath []string `json:"path_name"`
-	IsDir   bool     `json:"is_dir"`
+	PathID      int        `json:"path_id"`
+	AbsPath     string     `json:"-"`
+	RelPath     []string   `json:"path_name"`
+	IsDir       bool       `json:"is_dir"`
+	ModTime     int64      `json:"mtime"`
+	ModTimeNano int64      `json:"mtime_nano,omitempty"`
+	Mode        uint32     `json:"mode"`
+	IsLink      bool       `json:"is_link,omitempty"`
+	LinkTarget  string     `json:"link_target,omitempty"`
+	Owner       *fileOwner `json:"-"`
+	HardLink    *int       `json:"hard_link,omitempty"`
+	// Reader is the data source of a stream of unknown size, e.g., stdin, instead of opening the `AbsPath`.
+	Reader io.ReadCloser `json:"-"`
+}
+
+// hasData returns whether the data of the file follows its name, i.e., it's neither a directory nor a link.
+func (f *TrzszFile) hasData() bool {
+	return !f.IsDir && !f.IsLink && f.HardLink == nil
+}
+
+// pathFilter selects the files under the directories. The exclude patterns are matched first and win on conflict,
+// the excluded directories are pruned. Then if any include pattern is given, only the matched files are selected,
+// while the directories are always walked, and only kept if any file beneath them is selected.
+// The special files, e.g., FIFOs, sockets and devices, are omitted and counted if `skipSpecial`.
+type pathFilter struct {
+	exclude      []string
+	include      []string
+	skipSpecial  bool
+	specialCount int
+}
+
+func newPathFilter(exclude, include []string, skipSpecial bool) *pathFilter {
+	if len(exclude) == 0 && len(include) == 0 && !skipSpecial {
+		return nil
+	}
+	return &pathFilter{exclude: exclude, include: include, skipSpecial: skipSpecial}
+}
+
+func (f *pathFilter) skipsSpecial() bool {
+	if f == nil || !f.skipSpecial {
+		return false
+	}
+	f.specialCount++
+	return true
 }
 
-func checkPathReadable(pathID int, path string, info os.FileInfo, list *[]*TrzszFile, relPath []string, visitedDir map[string]bool) error {
+// getSpecialFileType returns the type name of the file which is neither a regular file nor a directory.
+func getSpecialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	default:
+		return "irregular file"
+	}
+}
+
+func (f *pathFilter) isExcluded(relPath []string) (bool, error) {
+	if f == nil {
+		return false, nil
+	}
+	return matchPatterns(f.exclude, relPath, "exclude")
+}
+
+func (f *pathFilter) isIncluded(relPath []string) (bool, error) {
+	if f == nil || len(f.include) == 0 {
+		return true, nil
+	}
+	return matchPatterns(f.include, relPath, "include")
+}
+
+// matchPatterns matches the patterns without a separator against the name, and the others against the relative path
+// under the top-level directory. The ancestors have been matched already, as the excluded directories are pruned.
+func matchPatterns(patterns []string, relPath []string, kind string) (bool, error) {
+	name := relPath[len(relPath)-1]
+	rel := filepath.Join(relPath[1:]...)
+	for _, pattern := range patterns {
+		pattern = filepath.FromSlash(pattern)
+		target := name
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			target = rel
+		}
+		matched, err := filepath.Match(pattern, target)
+		if err != nil {
+			return false, newTrzszError(fmt.Sprintf("Invalid %s pattern: %s", kind, pattern))
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkPathReadable records the symlinks under the directories as links if not following them,
+// the paths given by the user are always followed and never excluded.
+func checkPathReadable(pathID int, path string, info os.FileInfo, list *[]*TrzszFile, relPath []string,
+	visitedDir map[string]bool, inodes map[fileInode]int, opts *pathOptions) error {
+	filter := opts.filter
+	if info.Mode()&os.ModeSymlink != 0 || isReparsePoint(info) {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		*list = append(*list, &TrzszFile{pathID, path, relPath, false, info.ModTime().Unix(), info.ModTime().UnixNano(),
+			uint32(info.Mode().Perm()), true, filepath.ToSlash(target), nil, nil, nil})
+		return nil
+	}
 	if !info.IsDir() {
 		if !info.Mode().IsRegular() {
-			return newTrzszError(fmt.Sprintf("Not a regular file: %s", path))
+			if filter.skipsSpecial() {
+				return nil
+			}
+			return newTrzszError(fmt.Sprintf("Not a regular file, but a %s: %s", getSpecialFileType(info.Mode()), path))
 		}
 		if syscallAccessRok(path) != nil {
-			return newTrzszError(fmt.Sprintf("No permission to read: %s", path))
+			return newTrzszErrorCode(ErrPermission, fmt.Sprintf("No permission to read: %s", path))
 		}
-		*list = append(*list, &TrzszFile{pathID, path, relPath, false})
+		hardLink := recordHardLink(info, len(*list), inodes)
+		*list = append(*list, &TrzszFile{pathID, path, relPath, false, info.ModTime().Unix(), info.ModTime().UnixNano(),
+			toUnixMode(info.Mode()), false, "", getFileOwner(info), hardLink, nil})
 		return nil
 	}
-	realPath, err := filepath.EvalSymlinks(path)
+	realPath, err := getRealPath(path)
 	if err != nil {
 		return err
 	}
@@ -241,7 +938,8 @@ func checkPathReadable(pathID int, path string, info os.FileInfo, list *[]*Trzsz
 		return newTrzszError(fmt.Sprintf("Duplicate link: %s", path))
 	}
 	visitedDir[realPath] = true
-	*list = append(*list, &TrzszFile{pathID, path, relPath, true})
+	*list = append(*list, &TrzszFile{pathID, path, relPath, true, info.ModTime().Unix(), info.ModTime().UnixNano(),
+		toUnixMode(info.Mode()), false, "", getFileOwner(info), nil, nil})
 	f, err := os.Open(path)
 	if err != nil {
 		return newTrzszError(fmt.Sprintf("Open [%s] error: %v", path, err))
@@ -251,23 +949,56 @@ func checkPathReadable(pathID int, path string, info os.FileInfo, list *[]*Trzsz
 		return newTrzszError(fmt.Sprintf("Readdir [%s] error: %v", path, err))
 	}
 	for _, file := range files {
+		r := make([]string, len(relPath))
+		copy(r, relPath)
+		r = append(r, file.Name())
+		if excluded, err := filter.isExcluded(r); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
 		p := filepath.Join(path, file.Name())
-		info, err := os.Stat(p)
+		var info os.FileInfo
+		if opts.followLinks {
+			info, err = os.Stat(p)
+		} else {
+			info, err = os.Lstat(p)
+		}
 		if err != nil {
 			return err
 		}
-		r := make([]string, len(relPath))
-		copy(r, relPath)
-		r = append(r, file.Name())
-		if err := checkPathReadable(pathID, p, info, list, r, visitedDir); err != nil {
+		if !info.IsDir() && len(r) > 1 {
+			if included, err := filter.isIncluded(r); err != nil {
+				return err
+			} else if !included {
+				continue
+			}
+		}
+		count := len(*list)
+		if err := checkPathReadable(pathID, p, info, list, r, visitedDir, inodes, opts); err != nil {
 			return err
 		}
+		if info.IsDir() && len(*list) == count+1 && filter != nil && len(filter.include) > 0 {
+			*list = (*list)[:count] // no file is included beneath the directory
+		}
 	}
 	return nil
 }
 
+// pathOptions are the options of checking the paths to be sent.
+type pathOptions struct {
+	directory   bool        // allow the directories
+	followLinks bool        // follow the symlinks under the directories instead of sending them as links
+	filter      *pathFilter // exclude or include the paths, and skip the special files
+}
+
 func checkPathsReadable(paths []string, directory bool) ([]*TrzszFile, error) {
+	return checkPathsReadableWith(paths, pathOptions{directory: directory, followLinks: true})
+}
+
+func checkPathsReadableWith(paths []string, opts pathOptions) ([]*TrzszFile, error) {
 	var list []*TrzszFile
+	inodes := make(map[fileInode]int)
 	for i, p := range paths {
 		path, err := filepath.Abs(p)
 		if err != nil {
@@ -279,17 +1010,77 @@ func checkPathsReadable(paths []string, directory bool) ([]*TrzszFile, error) {
 		} else if err != nil {
 			return nil, err
 		}
-		if !directory && info.IsDir() {
+		if !opts.directory && info.IsDir() {
 			return nil, newTrzszError(fmt.Sprintf("Is a directory: %s", path))
 		}
 		visitedDir := make(map[string]bool)
-		if err := checkPathReadable(i, path, info, &list, []string{info.Name()}, visitedDir); err != nil {
+		if err := checkPathReadable(i, path, info, &list, []string{info.Name()}, visitedDir, inodes, &opts); err != nil {
 			return nil, err
 		}
 	}
 	return list, nil
 }
 
+// prefixRootNames prefixes the relative paths of each file argument with its label, so the arguments of the
+// same name, e.g., /a/src and /b/src, are received in the distinct directories a/src and b/src.
+// The arguments of the same label share the path id, so they are merged under the label as the entries
+// of a tar stream, and the label is renamed only once if it exists on the receiver.
+func prefixRootNames(list []*TrzszFile, labels []string) error {
+	pathIDs := make(map[string]int)
+	roots := make(map[string]bool)
+	newIDs := make(map[int]int)
+	for _, f := range list {
+		if f.PathID < 0 || f.PathID >= len(labels) {
+			return newTrzszError(fmt.Sprintf("No label for the path id %d", f.PathID))
+		}
+		label := labels[f.PathID]
+		if label == "" || label == "." || label == ".." || label != filepath.Base(label) {
+			return newTrzszError(fmt.Sprintf("Invalid label: %s", label))
+		}
+		if len(f.RelPath) == 1 {
+			root := label + "/" + f.RelPath[0]
+			if roots[root] {
+				return newTrzszError(fmt.Sprintf("Duplicate name: %s", root))
+			}
+			roots[root] = true
+		}
+		pathID, ok := newIDs[f.PathID]
+		if !ok {
+			if pathID, ok = pathIDs[label]; !ok {
+				pathID = len(pathIDs)
+				pathIDs[label] = pathID
+			}
+			newIDs[f.PathID] = pathID
+		}
+		f.PathID = pathID
+		f.RelPath = append([]string{label}, f.RelPath...)
+	}
+	return nil
+}
+
+func expandGlobPaths(paths []string) ([]string, error) {
+	var result []string
+	for _, p := range paths {
+		if !strings.ContainsAny(p, "*?[") {
+			result = append(result, p)
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			result = append(result, p) // a literal path that happens to contain wildcard characters
+			continue
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, newTrzszError(fmt.Sprintf("Invalid pattern: %s", p))
+		}
+		if len(matches) == 0 {
+			return nil, newTrzszError(fmt.Sprintf("No such file matches: %s", p))
+		}
+		result = append(result, matches...)
+	}
+	return result, nil
+}
+
 func checkDuplicateNames(list []*TrzszFile) error {
 	m := make(map[string]bool)
 	for _, f := range list {
@@ -302,12 +1093,22 @@ func checkDuplicateNames(list []*TrzszFile) error {
 	return nil
 }
 
-func getNewName(path, name string) (string, error) {
+// getNewName appends `.0`, `.1`, ... to the existing name, or inserts ` (1)`, ` (2)`, ... before the extension
+// in the paren scheme, e.g., `name (1).ext`.
+func getNewName(path, name, scheme string) (string, error) {
 	if _, err := os.Stat(filepath.Join(path, name)); errors.Is(err, os.ErrNotExist) {
 		return name, nil
 	}
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	base := name[:len(name)-len(ext)]
 	for i := 0; i < 1000; i++ {
 		newName := fmt.Sprintf("%s.%d", name, i)
+		if scheme == "paren" {
+			newName = fmt.Sprintf("%s (%d)%s", base, i+1, ext)
+		}
 		if _, err := os.Stat(filepath.Join(path, newName)); errors.Is(err, os.ErrNotExist) {
 			return newName, nil
 		}
@@ -323,26 +1124,46 @@ const (
 	TmuxControlMode
 )
 
+// parseTmuxDisplay parses the output of `tmux display-message` for the client tty, the control mode
+// and the pane width, as many fields as available. The old tmux outputs the unknown formats as empty,
+// e.g., `client_control_mode`, so the missing fields are defaulted, and the pane width is -1 if it is
+// missing or invalid. It's in the control mode if the client tty is not an absolute path.
+func parseTmuxDisplay(output string) (TmuxMode, string, int, error) {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return NoTmux, "", -1, fmt.Errorf("tmux unexpect output: %q", output)
+	}
+	tokens := strings.SplitN(output, ":", 3)
+	tmuxTty := tokens[0]
+	if len(tokens) > 1 && tokens[1] == "1" || !strings.HasPrefix(tmuxTty, "/") {
+		return TmuxControlMode, "", -1, nil
+	}
+	paneWidth := -1
+	if len(tokens) > 2 {
+		if width, err := strconv.Atoi(tokens[2]); err == nil && width > 0 {
+			paneWidth = width
+		}
+	}
+	return TmuxNormalMode, tmuxTty, paneWidth, nil
+}
+
+// checkTmux checks if running in tmux, and returns the tty of the tmux client to bypass tmux.
+// It doesn't fail if the tmux client is unknown, but falls back to write to the stdout.
 func checkTmux() (TmuxMode, *os.File, int, error) {
 	if _, tmux := os.LookupEnv("TMUX"); !tmux {
 		return NoTmux, os.Stdout, -1, nil
 	}
 
+	// the tmux client is unknown on error, write to the stdout through tmux as in control mode,
+	// which is slower but safe
 	cmd := exec.Command("tmux", "display-message", "-p", "#{client_tty}:#{client_control_mode}:#{pane_width}")
 	cmd.Stdin = os.Stdin
 	out, err := cmd.Output()
 	if err != nil {
-		return 0, nil, -1, err
-	}
-
-	output := strings.TrimSpace(string(out))
-	tokens := strings.Split(output, ":")
-	if len(tokens) != 3 {
-		return 0, nil, -1, fmt.Errorf("tmux unexpect output: %s", output)
+		return TmuxControlMode, os.Stdout, -1, nil
 	}
-	tmuxTty, controlMode, paneWidth := tokens[0], tokens[1], tokens[2]
-
-	if controlMode == "1" || tmuxTty[0] != '/' {
+	tmuxMode, tmuxTty, paneWidth, err := parseTmuxDisplay(string(out))
+	if err != nil || tmuxMode != TmuxNormalMode {
 		return TmuxControlMode, os.Stdout, -1, nil
 	}
 	if _, err := os.Stat(tmuxTty); errors.Is(err, os.ErrNotExist) {
@@ -351,19 +1172,110 @@ func checkTmux() (TmuxMode, *os.File, int, error) {
 
 	tmuxStdout, err := os.OpenFile(tmuxTty, os.O_WRONLY, 0)
 	if err != nil {
-		return 0, nil, -1, err
+		return TmuxControlMode, os.Stdout, -1, nil
 	}
-	tmuxPaneWidth := -1
-	if len(paneWidth) > 0 {
-		tmuxPaneWidth, err = strconv.Atoi(paneWidth)
-		if err != nil {
-			return 0, nil, -1, err
+	return TmuxNormalMode, tmuxStdout, paneWidth, nil
+}
+
+// serverTerminal sets up the terminal of trz or tsz, and resets it when done. Nothing is set up with
+// `--no-tty`, as stdin and stdout are a plain pipe or socket then.
+type serverTerminal struct {
+	noTty         bool
+	tmuxMode      TmuxMode
+	realStdout    *os.File
+	tmuxPaneWidth int
+	uniqueSuffix  string
+	state         *term.State
+	resets        []func()
+}
+
+// newServerTerminal checks tmux unless `--no-tty`, and the data is written to the output if not in tmux.
+func newServerTerminal(noTty bool, output *os.File) (*serverTerminal, error) {
+	if noTty {
+		return &serverTerminal{noTty: true, tmuxMode: NoTmux, realStdout: output, tmuxPaneWidth: -1}, nil
+	}
+	tmuxMode, realStdout, tmuxPaneWidth, err := checkTmux()
+	if err != nil {
+		return nil, err
+	}
+	if realStdout == os.Stdout {
+		realStdout = output
+	}
+	return &serverTerminal{tmuxMode: tmuxMode, realStdout: realStdout, tmuxPaneWidth: tmuxPaneWidth}, nil
+}
+
+// setup enables the virtual terminal on Windows, with the console output if required,
+// or clears the line for the magic key in tmux normal mode.
+func (s *serverTerminal) setup(output *os.File, consoleOutput bool) {
+	if IsWindows() {
+		s.uniqueSuffix = "10"
+	} else if s.tmuxMode == TmuxNormalMode {
+		s.uniqueSuffix = "20"
+	} else {
+		s.uniqueSuffix = "00"
+	}
+	if s.noTty {
+		return
+	}
+
+	if IsWindows() {
+		if inMode, outMode, err := enableVirtualTerminal(); err == nil {
+			s.resets = append(s.resets, func() { resetVirtualTerminal(inMode, outMode) })
+		}
+		if consoleOutput {
+			setupConsoleOutput()
 		}
+	} else if s.tmuxMode == TmuxNormalMode {
+		if getTerminalColumns() < 40 {
+			output.WriteString("\n\n\x1b[2A\x1b[0J")
+		} else {
+			output.WriteString("\n\x1b[1A\x1b[0J")
+		}
+	}
+}
+
+// makeRaw puts the input into raw mode, which is restored by reset.
+func (s *serverTerminal) makeRaw(input *os.File) error {
+	if s.noTty {
+		return nil
+	}
+	state, err := term.MakeRaw(int(input.Fd()))
+	if err != nil {
+		return err
 	}
-	return TmuxNormalMode, tmuxStdout, tmuxPaneWidth, nil
+	s.state = state
+	s.resets = append(s.resets, func() { _ = term.Restore(int(input.Fd()), state) })
+	return nil
 }
 
+// reset restores what was set up, in reverse order.
+func (s *serverTerminal) reset() {
+	for i := len(s.resets) - 1; i >= 0; i-- {
+		s.resets[i]()
+	}
+	s.resets = nil
+}
+
+// ttyColumnsFunc gets the columns of the terminal by stdin, it's replaced in tests.
+var ttyColumnsFunc = getTtyColumns
+
+// getTerminalColumns falls back to the `COLUMNS` env if the terminal size is unknown, e.g., in some containers
+// without stty, and finally to the default width.
 func getTerminalColumns() int {
+	if columns := ttyColumnsFunc(); columns > 0 {
+		return columns
+	}
+	if columns, err := strconv.Atoi(strings.TrimSpace(os.Getenv("COLUMNS"))); err == nil && columns > 0 {
+		return columns
+	}
+	return kDefaultColumns
+}
+
+// getTtyColumns gets the size of the terminal directly, or by `stty size` as before.
+func getTtyColumns() int {
+	if width, _, err := term.GetSize(int(os.Stdin.Fd())); err == nil && width > 0 {
+		return width
+	}
 	cmd := exec.Command("stty", "size")
 	cmd.Stdin = os.Stdin
 	out, err := cmd.Output()
@@ -379,18 +1291,20 @@ func getTerminalColumns() int {
 	return cols
 }
 
-func wrapStdinInput(transfer *TrzszTransfer) {
+// wrapTransferInput feeds the input to the transfer until the reader is closed.
+func wrapTransferInput(transfer *TrzszTransfer, reader io.Reader) {
 	const bufSize = 32 * 1024
 	buffer := make([]byte, bufSize)
 	for {
-		n, err := os.Stdin.Read(buffer)
+		n, err := reader.Read(buffer)
 		if n > 0 {
 			buf := buffer[0:n]
 			transfer.addReceivedData(buf)
 			buffer = make([]byte, bufSize)
 		}
-		if err == io.EOF {
+		if err != nil {
 			transfer.stopTransferringFiles()
+			return
 		}
 	}
 }
@@ -398,12 +1312,22 @@ func wrapStdinInput(transfer *TrzszTransfer) {
 func handleServerSignal(transfer *TrzszTransfer) {
 	sigstop := make(chan os.Signal, 1)
 	signal.Notify(sigstop, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigstop
-		transfer.stopTransferringFiles()
-	}()
+	go stopOnSignal(transfer, sigstop)
 }
 
+// stopOnSignal stops the transfer on the signal, and cleans up the terminal soon, as the transfer
+// may not exit in time, e.g., the client is gone, and the terminal would be left in raw mode.
+// The input is drained shortly before restoring the terminal, or the data of the client is echoed.
+func stopOnSignal(transfer *TrzszTransfer, sigstop <-chan os.Signal) {
+	<-sigstop
+	transfer.stopTransferringFiles()
+	transfer.cleanInputUntil(kSignalCleanTimeout, time.Now().Add(2*kSignalCleanTimeout))
+	transfer.cleanupTerminal()
+}
+
+// kSignalCleanTimeout is the time of no input to restore the terminal on the signal.
+const kSignalCleanTimeout = 500 * time.Millisecond
+
 func isVT100End(b byte) bool {
 	if 'a' <= b && b <= 'z' {
 		return true
@@ -446,9 +1370,96 @@ func writeAll(dst io.Writer, data []byte) error {
 	for m < l {
 		n, err := dst.Write(data[m:])
 		if err != nil {
-			return NewTrzszError(fmt.Sprintf("WriteAll error: %v", err), "", true)
+			e := NewTrzszError(fmt.Sprintf("WriteAll error: %v", err), "", true)
+			e.cause = err
+			return e
 		}
 		m += n
 	}
 	return nil
 }
+
+// deadlineWriter is the writer supporting the write deadline, e.g., the pipes and the network connections.
+type deadlineWriter interface {
+	io.Writer
+	SetWriteDeadline(t time.Time) error
+}
+
+const kAsyncWriterIdleTimeout = time.Minute
+
+// asyncWriter owns the writer in a long-lived goroutine, so the blocked writes could be timed out without
+// leaking a goroutine per write. The goroutine exits when idle, and is restarted by the next write.
+// After a write timed out, the goroutine stays blocked in it, and the writer shouldn't be used anymore.
+type asyncWriter struct {
+	writer   io.Writer
+	mutex    sync.Mutex
+	running  bool
+	pending  int
+	requests chan *asyncWrite
+}
+
+type asyncWrite struct {
+	data   []byte
+	result chan error
+}
+
+func newAsyncWriter(writer io.Writer) *asyncWriter {
+	return &asyncWriter{writer: writer, requests: make(chan *asyncWrite)}
+}
+
+// writeAll writes the data in the goroutine, and returns `os.ErrDeadlineExceeded` if it's not done in time.
+func (w *asyncWriter) writeAll(data []byte, timeout time.Duration) error {
+	req := &asyncWrite{data, make(chan error, 1)}
+	w.mutex.Lock()
+	w.pending++
+	if !w.running {
+		w.running = true
+		go w.serve()
+	}
+	w.mutex.Unlock()
+	defer func() {
+		w.mutex.Lock()
+		w.pending--
+		w.mutex.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case w.requests <- req:
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (w *asyncWriter) serve() {
+	idle := time.NewTimer(kAsyncWriterIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case req := <-w.requests:
+			req.result <- writeAll(w.writer, req.data)
+		case <-idle.C:
+			w.mutex.Lock()
+			if w.pending == 0 {
+				w.running = false
+				w.mutex.Unlock()
+				return
+			}
+			w.mutex.Unlock()
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(kAsyncWriterIdleTimeout)
+	}
+}
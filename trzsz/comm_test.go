@@ -0,0 +1,557 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/term"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.Nil(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func assertFileContent(t *testing.T, path string, expected string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, expected, string(content))
+}
+
+func TestExpandGlobPaths(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(dir, "b.txt"), "b")
+	writeTestFile(t, filepath.Join(dir, "c.log"), "c")
+	writeTestFile(t, filepath.Join(dir, "[d].txt"), "d")
+
+	// expand to multiple files
+	paths, err := expandGlobPaths([]string{filepath.Join(dir, "*.txt")})
+	assert.Nil(err)
+	assert.Equal([]string{filepath.Join(dir, "[d].txt"), filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}, paths)
+
+	// keep paths without wildcards
+	paths, err = expandGlobPaths([]string{filepath.Join(dir, "c.log"), filepath.Join(dir, "?.txt")})
+	assert.Nil(err)
+	assert.Equal([]string{filepath.Join(dir, "c.log"), filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}, paths)
+
+	// literal path with wildcard characters
+	paths, err = expandGlobPaths([]string{filepath.Join(dir, "[d].txt")})
+	assert.Nil(err)
+	assert.Equal([]string{filepath.Join(dir, "[d].txt")}, paths)
+
+	// no match
+	paths, err = expandGlobPaths([]string{filepath.Join(dir, "*.bin")})
+	assert.Nil(paths)
+	assert.EqualError(err, "No such file matches: "+filepath.Join(dir, "*.bin"))
+}
+
+func TestEncodeWithCompress(t *testing.T) {
+	assert := assert.New(t)
+	text := []byte(strings.Repeat("hello trzsz\n", 1000))
+	for _, compress := range append([]string{""}, kSupportedCompressions...) {
+		for _, buf := range [][]byte{text, {}, {0, 1, 2, 0xff}} {
+			encoded := encodeBytesWith(buf, compress)
+			decoded, err := decodeStringWith(encoded, compress)
+			assert.Nil(err, compress)
+			assert.True(bytes.Equal(buf, decoded), compress)
+		}
+	}
+
+	// the empty name is compatible with zlib
+	assert.Equal(encodeBytes(text), encodeBytesWith(text, ""))
+	assert.Equal(encodeBytes(text), encodeBytesWith(text, "zlib"))
+	assert.Less(len(encodeBytesWith(text, "zstd")), len(encodeBytesWith(text, "none")))
+}
+
+// benchCorpus returns a text corpus and a pre-compressed blob of about the same size.
+func benchCorpus(b *testing.B) map[string][]byte {
+	b.Helper()
+	var text bytes.Buffer
+	r := rand.New(rand.NewSource(1))
+	words := []string{"trzsz", "transfer", "files", "terminal", "tmux", "ssh", "progress", "the", "a", "of"}
+	for text.Len() < 1024*1024 {
+		fmt.Fprintf(&text, "%s %s %d\n", words[r.Intn(len(words))], words[r.Intn(len(words))], r.Intn(10000))
+	}
+	random := make([]byte, text.Len())
+	r.Read(random)
+	var blob bytes.Buffer
+	z := gzip.NewWriter(&blob)
+	_, _ = z.Write(random)
+	_ = z.Close()
+	return map[string][]byte{"text": text.Bytes(), "compressed": blob.Bytes()}
+}
+
+func BenchmarkEncodeWithCompress(b *testing.B) {
+	corpus := benchCorpus(b)
+	for _, name := range []string{"text", "compressed"} {
+		for _, compress := range kSupportedCompressions {
+			buf := corpus[name]
+			b.Run(name+"/"+compress, func(b *testing.B) {
+				b.SetBytes(int64(len(buf)))
+				for i := 0; i < b.N; i++ {
+					if _, err := decodeStringWith(encodeBytesWith(buf, compress), compress); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkBinaryCompress(b *testing.B) {
+	corpus := benchCorpus(b)
+	for _, name := range []string{"text", "compressed"} {
+		for _, binaryCompress := range []bool{false, true} {
+			buf := corpus[name]
+			b.Run(fmt.Sprintf("%s/%v", name, binaryCompress), func(b *testing.B) {
+				transfer := NewTransfer(nil, nil, false)
+				transfer.transferConfig.BinaryCompress = binaryCompress
+				escapeCodes := EscapeArray{{0xee, 0xee, 0xee}, {0x7e, 0xee, 0x31}}
+				b.SetBytes(int64(len(buf)))
+				var wireSize int
+				for i := 0; i < b.N; i++ {
+					transfer.resetDataCompress()
+					wireSize = 0
+					for offset := 0; offset < len(buf); offset += 64 * 1024 {
+						chunk := buf[offset:minInt(offset+64*1024, len(buf))]
+						wireSize += len(escapeData(transfer.encodeDataBlock(chunk), escapeCodes))
+					}
+				}
+				// the bytes on the wire per byte of the data, the lower the better
+				b.ReportMetric(float64(wireSize)/float64(len(buf)), "wire/byte")
+			})
+		}
+	}
+}
+
+func TestBlockDecoder(t *testing.T) {
+	assert := assert.New(t)
+	text := []byte(strings.Repeat("hello trzsz\n", 100))
+	for _, compress := range append([]string{""}, kSupportedCompressions...) {
+		var data []byte
+		data = append(data, encodeBlock(kChunkCompressed, compressBytes(text, compress))...)
+		data = append(data, encodeBlock(kChunkStored, text[:7])...)
+		for split := 0; split <= len(data); split++ {
+			decoder := &blockDecoder{compress: compress}
+			first, err := decoder.decode(data[:split])
+			require.Nil(t, err)
+			second, err := decoder.decode(data[split:])
+			require.Nil(t, err)
+			assert.Nil(decoder.finish())
+			assert.Equal([][]byte{text, text[:7]}, append(first, second...), "%s split %d", compress, split)
+		}
+	}
+
+	decoder := &blockDecoder{}
+	blocks, err := decoder.decode(encodeBlock(kChunkStored, text)[:10])
+	assert.Nil(err)
+	assert.Empty(blocks)
+	assert.EqualError(decoder.finish(), "Incomplete data block: 10 bytes left")
+	_, err = (&blockDecoder{}).decode(encodeBlock('X', text))
+	assert.EqualError(err, "Unknown data chunk header: 88")
+}
+
+func TestEncodeChunk(t *testing.T) {
+	assert := assert.New(t)
+	text := []byte(strings.Repeat("hello trzsz\n", 100))
+	for _, compress := range append([]string{""}, kSupportedCompressions...) {
+		buf, err := decodeChunk(encodeChunk(kChunkStored, text), compress)
+		assert.Nil(err)
+		assert.Equal(text, buf)
+		buf, err = decodeChunk(encodeChunk(kChunkCompressed, compressBytes(text, compress)), compress)
+		assert.Nil(err)
+		assert.Equal(text, buf)
+	}
+
+	_, err := decodeChunk("", "")
+	assert.EqualError(err, "Empty data chunk without header")
+	_, err = decodeChunk(encodeChunk('X', text), "")
+	assert.EqualError(err, "Unknown data chunk header: 88")
+}
+
+func TestExcludePatterns(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	for _, p := range []string{"a.txt", "b.log", "node_modules/x.js", "sub/c.log", "sub/d.txt",
+		"src/x/gen/g.go", "src/y/gen/h.go", "src/y/keep.go", "src/gen/i.go"} {
+		writeTestFile(t, filepath.Join(dir, "proj", p), p)
+	}
+	writeTestFile(t, filepath.Join(dir, "top.log"), "top")
+
+	getRelPaths := func(files []*TrzszFile) []string {
+		var paths []string
+		for _, f := range files {
+			paths = append(paths, strings.Join(f.RelPath, "/"))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	// the excluded directories are pruned, and the top-level arguments are never excluded
+	files, err := checkPathsReadableWith([]string{filepath.Join(dir, "proj"), filepath.Join(dir, "top.log")},
+		pathOptions{directory: true, followLinks: true, filter: newPathFilter([]string{"*.log", "node_modules", "src/*/gen"}, nil, false)})
+	require.Nil(t, err)
+	assert.Equal([]string{"proj", "proj/a.txt", "proj/src", "proj/src/gen", "proj/src/gen/i.go", "proj/src/x",
+		"proj/src/y", "proj/src/y/keep.go", "proj/sub", "proj/sub/d.txt", "top.log"}, getRelPaths(files))
+
+	// the nested pattern matches the relative path under the top-level directory, not the absolute path
+	files, err = checkPathsReadableWith([]string{filepath.Join(dir, "proj")},
+		pathOptions{directory: true, followLinks: true, filter: newPathFilter([]string{"proj/*", "sub/*.txt"}, nil, false)})
+	require.Nil(t, err)
+	assert.NotContains(getRelPaths(files), "proj/sub/d.txt")
+	assert.Contains(getRelPaths(files), "proj/a.txt")
+
+	// invalid pattern
+	_, err = checkPathsReadableWith([]string{filepath.Join(dir, "proj")},
+		pathOptions{directory: true, followLinks: true, filter: newPathFilter([]string{"[a"}, nil, false)})
+	assert.EqualError(err, "Invalid exclude pattern: [a")
+}
+
+func TestIncludePatterns(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	for _, p := range []string{"a.go", "b.txt", "sub/c.go", "sub/c_test.go", "docs/d.md", "gen/e.go"} {
+		writeTestFile(t, filepath.Join(dir, "proj", p), p)
+	}
+	writeTestFile(t, filepath.Join(dir, "top.txt"), "top")
+
+	getRelPaths := func(files []*TrzszFile) []string {
+		var paths []string
+		for _, f := range files {
+			paths = append(paths, strings.Join(f.RelPath, "/"))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	// only the matched files are included, the directories without any included file are dropped,
+	// and the top-level arguments are never filtered
+	files, err := checkPathsReadableWith([]string{filepath.Join(dir, "proj"), filepath.Join(dir, "top.txt")},
+		pathOptions{directory: true, followLinks: true, filter: newPathFilter(nil, []string{"*.go"}, false)})
+	require.Nil(t, err)
+	assert.Equal([]string{"proj", "proj/a.go", "proj/gen", "proj/gen/e.go", "proj/sub", "proj/sub/c.go",
+		"proj/sub/c_test.go", "top.txt"}, getRelPaths(files))
+
+	// exclude wins on conflict with include
+	files, err = checkPathsReadableWith([]string{filepath.Join(dir, "proj")},
+		pathOptions{directory: true, followLinks: true, filter: newPathFilter([]string{"*_test.go", "gen"}, []string{"*.go", "docs/*.md"}, false)})
+	require.Nil(t, err)
+	assert.Equal([]string{"proj", "proj/a.go", "proj/docs", "proj/docs/d.md", "proj/sub", "proj/sub/c.go"},
+		getRelPaths(files))
+
+	// invalid pattern
+	_, err = checkPathsReadableWith([]string{filepath.Join(dir, "proj")},
+		pathOptions{directory: true, followLinks: true, filter: newPathFilter(nil, []string{"[a"}, false)})
+	assert.EqualError(err, "Invalid include pattern: [a")
+}
+
+func TestGetNewName(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	for _, p := range []string{"a.txt", "a.txt.0", "a.txt.1", "a (1).txt", "b", "b.0", "b (1)", ".bashrc", "c.tar.gz"} {
+		writeTestFile(t, filepath.Join(dir, p), p)
+	}
+
+	for _, scheme := range []string{"", "dot"} {
+		for name, expected := range map[string]string{
+			"new.txt": "new.txt", "a.txt": "a.txt.2", "b": "b.1", ".bashrc": ".bashrc.0", "c.tar.gz": "c.tar.gz.0"} {
+			newName, err := getNewName(dir, name, scheme)
+			assert.Nil(err)
+			assert.Equal(expected, newName)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"new.txt": "new.txt", "a.txt": "a (2).txt", "b": "b (2)", ".bashrc": ".bashrc (1)", "c.tar.gz": "c.tar (1).gz"} {
+		newName, err := getNewName(dir, name, "paren")
+		assert.Nil(err)
+		assert.Equal(expected, newName)
+	}
+
+	var scheme RenameScheme
+	assert.Nil(scheme.UnmarshalText([]byte("Paren")))
+	assert.Equal("paren", scheme.Scheme)
+	assert.EqualError(scheme.UnmarshalText([]byte("num")), "invalid scheme num, should be dot or paren")
+}
+
+func TestTrzszErrorCode(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(ErrUnknown, newTrzszError("Is a directory: a").Code())
+	assert.Equal(ErrTimeout, newTrzszErrorCode(ErrTimeout, "Receive data timeout").Code())
+	assert.Equal(ErrRemoteExit, NewTrzszError(encodeString("Received a.txt"), "EXIT", false).Code())
+	assert.Equal(ErrCancelled, NewTrzszError(encodeString("Cancelled"), "fail", false).Code())
+	// the code of the peer is appended to the fail message, but not by the old versions
+	e := NewTrzszError(encodeString("Check MD5 failed")+":2", "fail", false)
+	assert.Equal(ErrChecksum, e.Code())
+	assert.Equal("Check MD5 failed", e.Error())
+	assert.Equal(ErrUnknown, NewTrzszError(encodeString("Check MD5 failed"), "fail", false).Code())
+	assert.Equal(ErrNoSpace, NewTrzszError(encodeString("No space left on device: a.txt")+":3", "FAIL", false).Code())
+
+	// the code of the cause is kept, otherwise the given one is used
+	assert.Equal(ErrTimeout, wrapTrzszError(ErrChecksum, newTrzszErrorCode(ErrTimeout, "Receive data timeout"), "Read error").Code())
+	assert.Equal(ErrPermission, wrapTrzszError(ErrUnknown, os.ErrPermission, "Read file error").Code())
+	assert.Equal(ErrChecksum, wrapTrzszError(ErrChecksum, io.ErrUnexpectedEOF, "Read from zstd error").Code())
+	assert.ErrorIs(wrapTrzszError(ErrUnknown, io.ErrUnexpectedEOF, "Read file error"), io.ErrUnexpectedEOF)
+
+	// the code is kept through the wrapping errors
+	err := fmt.Errorf("send files: %w", newTrzszErrorCode(ErrChecksum, "Check MD5 failed"))
+	assert.True(errors.As(err, &e))
+	assert.Equal(ErrChecksum, e.Code())
+	assert.Equal("Check MD5 failed", e.Error())
+
+	if runtime.GOOS != "windows" && os.Getuid() != 0 {
+		dir := t.TempDir()
+		require.Nil(t, os.Chmod(dir, 0500))
+		defer os.Chmod(dir, 0700)
+		_, err := doCreateFile(filepath.Join(dir, "a.txt"))
+		require.True(t, errors.As(err, &e))
+		assert.Equal(ErrPermission, e.Code())
+		require.True(t, errors.As(checkPathWritable(dir), &e))
+		assert.Equal(ErrPermission, e.Code())
+	}
+}
+
+func TestParseTmuxDisplay(t *testing.T) {
+	assert := assert.New(t)
+	for output, expected := range map[string]struct {
+		mode      TmuxMode
+		tty       string
+		paneWidth int
+	}{
+		"/dev/pts/1:0:80\n":   {TmuxNormalMode, "/dev/pts/1", 80},
+		"/dev/pts/1::80\n":    {TmuxNormalMode, "/dev/pts/1", 80},
+		"/dev/pts/1:0:\n":     {TmuxNormalMode, "/dev/pts/1", -1},
+		"/dev/pts/1:0:0\n":    {TmuxNormalMode, "/dev/pts/1", -1},
+		"/dev/pts/1:0:abc\n":  {TmuxNormalMode, "/dev/pts/1", -1},
+		"/dev/pts/1:0:80:1\n": {TmuxNormalMode, "/dev/pts/1", -1},
+		"/dev/pts/1:0\n":      {TmuxNormalMode, "/dev/pts/1", -1},
+		"/dev/pts/1\n":        {TmuxNormalMode, "/dev/pts/1", -1},
+		"/dev/pts/1:1:80\n":   {TmuxControlMode, "", -1},
+		"pts/1:0:80\n":        {TmuxControlMode, "", -1},
+		":0:80\n":             {TmuxControlMode, "", -1},
+		"::\n":                {TmuxControlMode, "", -1},
+	} {
+		mode, tmuxTty, paneWidth, err := parseTmuxDisplay(output)
+		assert.Nil(err, output)
+		assert.Equal(expected.mode, mode, output)
+		assert.Equal(expected.tty, tmuxTty, output)
+		assert.Equal(expected.paneWidth, paneWidth, output)
+	}
+
+	for _, output := range []string{"", " \n"} {
+		_, _, _, err := parseTmuxDisplay(output)
+		assert.NotNil(err)
+	}
+}
+
+func TestGetTerminalColumns(t *testing.T) {
+	assert := assert.New(t)
+	originalTtyColumns := ttyColumnsFunc
+	defer func() { ttyColumnsFunc = originalTtyColumns }()
+
+	// neither the terminal size nor stty is available, e.g., in a container
+	ttyColumns := 0
+	ttyColumnsFunc = func() int { return ttyColumns }
+	t.Setenv("COLUMNS", "120")
+	assert.Equal(120, getTerminalColumns())
+	t.Setenv("COLUMNS", " 30 ")
+	assert.Equal(30, getTerminalColumns())
+	for _, columns := range []string{"", "abc", "0", "-1"} {
+		t.Setenv("COLUMNS", columns)
+		assert.Equal(kDefaultColumns, getTerminalColumns(), columns)
+	}
+
+	// the terminal size wins over the env
+	ttyColumns = 100
+	t.Setenv("COLUMNS", "120")
+	assert.Equal(100, getTerminalColumns())
+}
+
+func TestStopOnSignal(t *testing.T) {
+	assert := assert.New(t)
+	originalTermRestore := termRestoreFunc
+	defer func() { termRestoreFunc = originalTermRestore }()
+	var restored []*term.State
+	var idle time.Duration
+	_, server := newLoopbackTransfers()
+	termRestoreFunc = func(fd int, state *term.State) error {
+		restored = append(restored, state)
+		idle = time.Since(time.UnixMilli(server.lastInputTime.Load()))
+		return nil
+	}
+
+	state := &term.State{}
+	server.stdinState = state
+	var output bytes.Buffer
+	server.exitOutput = &output
+	cursorRestore := "\x1b8\x1b[0J"
+	if runtime.GOOS == "windows" {
+		cursorRestore = "\x1b[H\x1b[2J\x1b[?1049l"
+	}
+
+	// the terminal is restored on the signal after the input is drained, before the transfer exits
+	sigstop := make(chan os.Signal, 1)
+	sigstop <- os.Interrupt
+	go func() {
+		for i := 0; i < 3; i++ {
+			server.addReceivedData([]byte("data"))
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	stopOnSignal(server, sigstop)
+	assert.True(server.stopped.Load())
+	assert.Equal([]*term.State{state}, restored)
+	assert.GreaterOrEqual(idle, kSignalCleanTimeout-10*time.Millisecond)
+	assert.Equal(cursorRestore, output.String())
+
+	// the exit message is still shown, without restoring the terminal again
+	server.serverExit("Stopped")
+	assert.Equal([]*term.State{state}, restored)
+	assert.Equal(cursorRestore+"Stopped\r\n", output.String())
+
+	// the peer keeping sending doesn't delay restoring the terminal for long
+	_, server = newLoopbackTransfers()
+	server.stdinState = state
+	server.exitOutput = &output
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				server.addReceivedData([]byte("data"))
+			}
+		}
+	}()
+	sigstop <- os.Interrupt
+	beginTime := time.Now()
+	stopOnSignal(server, sigstop)
+	assert.Less(time.Since(beginTime), 3*kSignalCleanTimeout)
+	assert.Equal([]*term.State{state, state}, restored)
+}
+
+func TestTransferRenameScheme(t *testing.T) {
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "doc.txt"), "new doc")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "doc.txt")}, false)
+	require.Nil(t, err)
+
+	dest := t.TempDir()
+	writeTestFile(t, filepath.Join(dest, "doc.txt"), "old doc")
+	args := newDefaultArgsForTest()
+	args.RenameScheme = RenameScheme{"paren"}
+	result := transferFilesForTest(t, args, 2, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	assert.Equal(t, []string{"doc (1).txt"}, result.localNames)
+	assertFileContent(t, filepath.Join(dest, "doc.txt"), "old doc")
+	assertFileContent(t, filepath.Join(dest, "doc (1).txt"), "new doc")
+}
+
+func TestWindowsAccessCheck(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("windows only")
+	}
+	assert := assert.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	writeTestFile(t, path, "hello")
+	assert.Nil(syscallAccessRok(path))
+	assert.Nil(syscallAccessWok(path))
+	assert.Nil(syscallAccessWok(dir))
+
+	require.Nil(t, exec.Command("icacls", path, "/deny", "*S-1-1-0:(R,W)").Run())
+	defer exec.Command("icacls", path, "/remove:d", "*S-1-1-0").Run()
+	assert.NotNil(syscallAccessRok(path))
+	assert.NotNil(syscallAccessWok(path))
+	_, err := checkPathsReadableWith([]string{path}, pathOptions{})
+	assert.EqualError(err, fmt.Sprintf("No permission to read: %s", path))
+}
+
+func TestWindowsJunctionLoop(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("windows only")
+	}
+	assert := assert.New(t)
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.txt"), "hello")
+	link := filepath.Join(dir, "loop")
+	require.Nil(t, exec.Command("cmd", "/c", "mklink", "/J", link, dir).Run())
+
+	realPath, err := getRealPath(link)
+	require.Nil(t, err)
+	dirPath, err := getRealPath(dir)
+	require.Nil(t, err)
+	assert.Equal(dirPath, realPath)
+
+	// the junction is recorded as a link if not following links
+	files, err := checkPathsReadableWith([]string{dir}, pathOptions{directory: true})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(files))
+	for _, file := range files {
+		assert.Equal(file.RelPath[len(file.RelPath)-1] == "loop", file.IsLink)
+	}
+
+	// the junction loop is detected instead of walking forever
+	_, err = checkPathsReadable([]string{dir}, true)
+	assert.EqualError(err, fmt.Sprintf("Duplicate link: %s", link))
+}
+
+func TestToLocalName(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("中文😀test.txt", toLocalName("中文😀test.txt", ""))
+	assert.Equal("caf\u00e9", toLocalName("cafe\u0301", "nfc"))
+
+	original := isWindows
+	defer func() { isWindows = original }()
+	isWindows = false
+	assert.Equal("a\xff\xfeb.txt", toLocalName("a\xff\xfeb.txt", ""))
+	// the invalid bytes are replaced one by one on Windows, the same as the wide char API
+	isWindows = true
+	assert.Equal("a\ufffd\ufffdb.txt", toLocalName("a\xff\xfeb.txt", ""))
+	assert.Equal("中文😀test.txt", toLocalName("中文😀test.txt", ""))
+}
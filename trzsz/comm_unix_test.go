@@ -0,0 +1,73 @@
+//go:build !windows
+
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSkipSpecialFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "home", "a.txt"), "hello")
+	fifo := filepath.Join(dir, "home", "sub", "fifo")
+	writeTestFile(t, filepath.Join(dir, "home", "sub", "b.txt"), "world")
+	require.Nil(t, unix.Mkfifo(fifo, 0644))
+	sock := filepath.Join(dir, "home", "sock")
+	listener, err := net.Listen("unix", sock)
+	require.Nil(t, err)
+	defer listener.Close()
+
+	// the error names the type of the special file
+	_, err = checkPathsReadable([]string{fifo}, false)
+	assert.EqualError(err, "Not a regular file, but a named pipe: "+fifo)
+	_, err = checkPathsReadable([]string{sock}, false)
+	assert.EqualError(err, "Not a regular file, but a socket: "+sock)
+	_, err = checkPathsReadable([]string{"/dev/null"}, false)
+	assert.EqualError(err, "Not a regular file, but a character device: /dev/null")
+	_, err = checkPathsReadable([]string{filepath.Join(dir, "home")}, true)
+	assert.NotNil(err)
+
+	// the special files are omitted and counted
+	filter := newPathFilter(nil, nil, true)
+	files, err := checkPathsReadableWith([]string{filepath.Join(dir, "home"), "/dev/null"},
+		pathOptions{directory: true, followLinks: true, filter: filter})
+	require.Nil(t, err)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, strings.Join(f.RelPath, "/"))
+	}
+	assert.ElementsMatch([]string{"home", "home/a.txt", "home/sub", "home/sub/b.txt"}, paths)
+	assert.Equal(3, filter.specialCount)
+}
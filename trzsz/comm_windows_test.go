@@ -0,0 +1,94 @@
+//go:build windows
+
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/windows"
+)
+
+type fakeFileInfo struct {
+	mode  os.FileMode
+	attrs uint32
+}
+
+func (f *fakeFileInfo) Name() string       { return "fake" }
+func (f *fakeFileInfo) Size() int64        { return 0 }
+func (f *fakeFileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (f *fakeFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fakeFileInfo) Sys() interface{} {
+	return &syscall.Win32FileAttributeData{FileAttributes: f.attrs}
+}
+
+func TestIsReparsePoint(t *testing.T) {
+	assert := assert.New(t)
+	reparse := uint32(windows.FILE_ATTRIBUTE_REPARSE_POINT | windows.FILE_ATTRIBUTE_DIRECTORY)
+
+	// the junction reported as a directory
+	assert.True(isReparsePoint(&fakeFileInfo{os.ModeDir, reparse}))
+	assert.True(isReparsePoint(&fakeFileInfo{os.ModeDir | os.ModeIrregular, reparse}))
+	assert.False(isReparsePoint(&fakeFileInfo{os.ModeDir, windows.FILE_ATTRIBUTE_DIRECTORY}))
+	// the symlinks are checked by the mode
+	assert.False(isReparsePoint(&fakeFileInfo{os.ModeSymlink, reparse}))
+	assert.False(isReparsePoint(&fakeFileInfo{0, windows.FILE_ATTRIBUTE_ARCHIVE}))
+}
+
+func TestSetReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	writeTestFile(t, path, "read only")
+	defer os.Chmod(path, 0666)
+
+	transfer := NewTransfer(nil, nil, false)
+	require.Nil(t, transfer.applyFileAttrs(path, &fileAttrs{ModTime: 1700000000, Mode: 0444}))
+	stat, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(os.FileMode(0444), stat.Mode().Perm())
+	assert.Equal(int64(1700000000), stat.ModTime().Unix())
+
+	require.Nil(t, transfer.applyFileAttrs(path, &fileAttrs{Mode: 0644}))
+	stat, err = os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(os.FileMode(0666), stat.Mode().Perm())
+
+	// the directories are skipped
+	require.Nil(t, setReadOnly(dir, true))
+	pathp, err := windows.UTF16PtrFromString(dir)
+	require.Nil(t, err)
+	attrs, err := windows.GetFileAttributes(pathp)
+	require.Nil(t, err)
+	assert.Equal(uint32(0), attrs&windows.FILE_ATTRIBUTE_READONLY)
+}
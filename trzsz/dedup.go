@@ -0,0 +1,230 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"reflect"
+)
+
+// sameFile is the file sent before with the same content. The identity of the content is always
+// the SHA-256 digest, whatever hash is used to verify the files.
+type sameFile struct {
+	Index  int64  `json:"index"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// dedupFiles tracks the files sharing the same size with others in dedup mode, and the digests of them sent.
+type dedupFiles struct {
+	sizes   map[int]int64
+	sent    map[int64]bool
+	digests map[string]int
+}
+
+// dedupHasher computes the SHA-256 digest of the file while it's sent, besides the file hasher verified by the peer,
+// so the file is not read again to find the identical files sent after it.
+type dedupHasher struct {
+	hash.Hash
+	sha256 hash.Hash
+}
+
+func (h *dedupHasher) Write(p []byte) (int, error) {
+	h.sha256.Write(p)
+	return h.Hash.Write(p)
+}
+
+// findDuplicateFiles finds the regular files sharing the same size with others, which may be identical.
+// They are not hashed until another file of the same size has been sent, see `getSameFile`.
+func findDuplicateFiles(files []*TrzszFile) *dedupFiles {
+	sizeIndexes := make(map[int64][]int)
+	for i, f := range files {
+		if !f.hasData() {
+			continue
+		}
+		stat, err := os.Stat(f.AbsPath)
+		if err != nil || stat.Size() == 0 {
+			continue
+		}
+		sizeIndexes[stat.Size()] = append(sizeIndexes[stat.Size()], i)
+	}
+	dedup := &dedupFiles{sizes: make(map[int]int64), sent: make(map[int64]bool), digests: make(map[string]int)}
+	for size, indexes := range sizeIndexes {
+		if len(indexes) < 2 {
+			continue
+		}
+		for _, i := range indexes {
+			dedup.sizes[i] = size
+		}
+	}
+	return dedup
+}
+
+func hashDedupFile(file *os.File) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// getSameFile returns the file sent before with the same content, and the digest of the file if it's hashed.
+// The file is only hashed if another file of the same size has been sent, otherwise it's hashed while sent.
+func (d *dedupFiles) getSameFile(idx int, file *os.File) (*sameFile, string, error) {
+	same := &sameFile{Index: -1}
+	size, ok := d.sizes[idx]
+	if !ok || !d.sent[size] {
+		return same, "", nil
+	}
+	digest, err := hashDedupFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	if i, ok := d.digests[digest]; ok {
+		same.Index, same.Size, same.SHA256 = int64(i), size, digest
+	}
+	return same, digest, nil
+}
+
+// primeDedupHasher hashes the file while it's sent if it may be identical to the files after it and not hashed yet.
+func (t *TrzszTransfer) primeDedupHasher(d *dedupFiles, idx int, digest string) *dedupHasher {
+	if _, ok := d.sizes[idx]; !ok || digest != "" {
+		return nil
+	}
+	hasher := &dedupHasher{Hash: t.newFileHasher(), sha256: sha256.New()}
+	t.primedHasher = hasher
+	return hasher
+}
+
+// addSentFile records the digest of the file sent, to find the identical files after it. The identical files
+// are linked to the last one sent, as the data is sent again only if the receiver has changed the former one.
+func (d *dedupFiles) addSentFile(idx int, digest string, hasher *dedupHasher) {
+	size, ok := d.sizes[idx]
+	if !ok {
+		return
+	}
+	if hasher != nil {
+		digest = hex.EncodeToString(hasher.sha256.Sum(nil))
+	}
+	d.digests[digest] = idx
+	d.sent[size] = true
+}
+
+// sendFileSame tells the receiver the sent file with the same content, or the index -1 if none,
+// and returns whether the receiver still wants the file data.
+func (t *TrzszTransfer) sendFileSame(same *sameFile) (bool, error) {
+	sameStr, err := json.Marshal(same)
+	if err != nil {
+		return false, err
+	}
+	if err := t.sendString("SAME", string(sameStr)); err != nil {
+		return false, err
+	}
+	return t.recvFileVerdict()
+}
+
+// isSameFile checks that the local file still has the size and the SHA-256 digest of the file sent before,
+// as it may be changed or replaced since it's received.
+func isSameFile(path string, same *sameFile) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if stat, err := file.Stat(); err != nil || !stat.Mode().IsRegular() || stat.Size() != same.Size {
+		return false
+	}
+	digest, err := hashDedupFile(file)
+	return err == nil && digest == same.SHA256
+}
+
+// recvFileSame links or copies the received file with the same content, and returns whether it's done.
+// The file data is still wanted if the same file is skipped, changed since received, or the existing file is audited.
+func (t *TrzszTransfer) recvFileSame(file *os.File) (bool, error) {
+	sameStr, err := t.recvString("SAME", false)
+	if err != nil {
+		return false, err
+	}
+	var same sameFile
+	if err := json.Unmarshal([]byte(sameStr), &same); err != nil {
+		return false, err
+	}
+	samePath, ok := t.receivedPaths[same.Index]
+	linked := ok && t.skippedPath == "" && !t.transferConfig.Audit && isSameFile(samePath, &same)
+	if linked {
+		if err := t.linkSameFile(file, samePath); err != nil {
+			return false, err
+		}
+	}
+	if err := t.sendFileVerdict(linked); err != nil {
+		return false, err
+	}
+	return linked, nil
+}
+
+// linkSameFile replaces the file with a hard link to the same file, or a copy of it if the link fails,
+// or the attributes are preserved, which would be shared by the hard links otherwise.
+func (t *TrzszTransfer) linkSameFile(file *os.File, samePath string) error {
+	path := file.Name()
+	file.Close()
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return linkOrCopyFile(samePath, path, t.transferConfig.Preserve)
+}
+
+// finishSameFile completes the linked file like a received one, except that no data is received.
+func (t *TrzszTransfer) finishSameFile(file *os.File, attrs *fileAttrs, progress ProgressCallback) (string, error) {
+	localPath := file.Name()
+	if len(t.atomicTmpPath) > 0 {
+		var err error
+		localPath, err = t.commitAtomicFile(attrs)
+		if err != nil {
+			return "", err
+		}
+		attrs = nil // applied before the rename
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnDone()
+		if stat, err := os.Stat(localPath); err == nil {
+			reportFileDone(progress, localPath, stat.Size())
+		}
+	}
+	if err := t.applyFileAttrs(localPath, attrs); err != nil {
+		return "", err
+	}
+	return localPath, nil
+}
@@ -0,0 +1,165 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupIdenticalFiles(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("trzsz", 1000)
+	writeTestFile(t, filepath.Join(src, "dir", "a.bin"), content)
+	writeTestFile(t, filepath.Join(src, "dir", "b.bin"), content)
+	writeTestFile(t, filepath.Join(src, "dir", "c.bin"), strings.Repeat("TRZSZ", 1000))
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "d.bin"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		for _, preserve := range []bool{false, true} {
+			args := newDefaultArgsForTest()
+			args.Directory = true
+			args.Dedup = true
+			args.Preserve = preserve
+			dest := t.TempDir()
+			result := transferFilesForTest(t, args, protocol, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+
+			for _, p := range []string{"a.bin", "b.bin", "sub/d.bin"} {
+				assertFileContent(t, filepath.Join(dest, "dir", p), content)
+			}
+			assertFileContent(t, filepath.Join(dest, "dir", "c.bin"), strings.Repeat("TRZSZ", 1000))
+
+			// the identical files are linked, or copied to keep their own attributes
+			stat1, err := os.Stat(filepath.Join(dest, "dir", "a.bin"))
+			require.Nil(t, err)
+			stat2, err := os.Stat(filepath.Join(dest, "dir", "b.bin"))
+			require.Nil(t, err)
+			assert.Equal(!preserve, os.SameFile(stat1, stat2))
+		}
+	}
+}
+
+func TestDedupSentOnce(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.bin"), "identical")
+	writeTestFile(t, filepath.Join(src, "b.bin"), "identical")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin"), filepath.Join(src, "b.bin")}, false)
+	require.Nil(t, err)
+
+	for _, supportDedup := range []bool{true, false} {
+		args := newDefaultArgsForTest()
+		args.Dedup = true
+		client, server := newLoopbackTransfers()
+		require.Nil(t, client.sendAction(true, false))
+		action, err := server.recvAction()
+		require.Nil(t, err)
+		action.SupportDedup = supportDedup
+		require.Nil(t, server.sendConfig(&args.TransferOptions, action, getEscapeChars(args.Escape), NoTmux, -1))
+		_, err = client.recvConfig()
+		require.Nil(t, err)
+
+		dest := t.TempDir()
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assertFileContent(t, filepath.Join(dest, "a.bin"), "identical")
+		assertFileContent(t, filepath.Join(dest, "b.bin"), "identical")
+
+		// the older peers fall back to send all the files
+		sentSizes := make(map[string]int64)
+		for _, f := range client.GetTransferResult().Files {
+			sentSizes[f.Name] = f.Size
+		}
+		if supportDedup {
+			assert.Equal(map[string]int64{"a.bin": 9, "b.bin": 0}, sentSizes)
+		} else {
+			assert.Equal(map[string]int64{"a.bin": 9, "b.bin": 9}, sentSizes)
+		}
+	}
+}
+
+func TestDedupRecheckLocalFile(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.bin"), "identical")
+	writeTestFile(t, filepath.Join(src, "b.bin"), "identical")
+	writeTestFile(t, filepath.Join(src, "c.bin"), "identical")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin"), filepath.Join(src, "b.bin"),
+		filepath.Join(src, "c.bin")}, false)
+	require.Nil(t, err)
+
+	args := newDefaultArgsForTest()
+	args.Dedup = true
+	args.Hash = HashName{"md5"}
+	dest := t.TempDir()
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 2)
+	var sames []sameFile
+	client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+		if bytes.HasPrefix(buf, []byte("#SAME:")) {
+			sameStr, err := decodeString(strings.TrimSpace(string(buf[6:])))
+			require.Nil(t, err)
+			var same sameFile
+			require.Nil(t, json.Unmarshal(sameStr, &same))
+			sames = append(sames, same)
+			if len(sames) == 2 {
+				// the received file is changed before the same file b.bin is linked to it
+				writeTestFile(t, filepath.Join(dest, "a.bin"), "different")
+			}
+		}
+		return buf
+	}
+	result := runTransferForTest(client, server, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	assertFileContent(t, filepath.Join(dest, "a.bin"), "different")
+	assertFileContent(t, filepath.Join(dest, "b.bin"), "identical")
+	assertFileContent(t, filepath.Join(dest, "c.bin"), "identical")
+
+	// the same file is identified by the SHA-256 digest, whatever hash verifies the files
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("identical")))
+	assert.Equal([]sameFile{{-1, 0, ""}, {0, 9, digest}, {1, 9, digest}}, sames)
+	sentSizes := make(map[string]int64)
+	for _, f := range client.GetTransferResult().Files {
+		sentSizes[f.Name] = f.Size
+	}
+	// b.bin is sent as a.bin is changed, and c.bin is linked to b.bin
+	assert.Equal(map[string]int64{"a.bin": 9, "b.bin": 9, "c.bin": 0}, sentSizes)
+}
@@ -29,6 +29,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"golang.org/x/text/encoding/charmap"
 )
@@ -65,6 +66,31 @@ func getEscapeChars(escapeAll bool) [][]unicode {
 	return escapeChars
 }
 
+// kExtraEscapeLetters are the second bytes of the escape codes of the extra bytes, besides the ones used by `getEscapeChars`.
+const kExtraEscapeLetters = "abcdefghijklmnopqrstuvwxyzFGHIJKLMNOPQRSTUVWXYZ"
+
+// appendEscapeBytes appends the escape chars of the extra bytes, which are mangled by some terminals or middleboxes.
+// The bytes escaped already are skipped, and so are the bytes beyond the letters of the escape codes.
+func appendEscapeBytes(escapeChars [][]unicode, extraBytes []byte) [][]unicode {
+	count := 0
+	for _, b := range extraBytes {
+		c := unicode(rune(b))
+		escaped := false
+		for _, e := range escapeChars {
+			if e[0] == c {
+				escaped = true
+				break
+			}
+		}
+		if escaped || count >= len(kExtraEscapeLetters) {
+			continue
+		}
+		escapeChars = append(escapeChars, []unicode{c, "\u00ee" + unicode(kExtraEscapeLetters[count])})
+		count++
+	}
+	return escapeChars
+}
+
 func isEscapeByte(b byte) bool {
 	return b == '\xee'
 }
@@ -177,3 +203,59 @@ func unescapeData(data []byte, escapeCodes [][]byte) []byte {
 	}
 	return buf[:idx]
 }
+
+// newEscapeCanary returns every byte value, so both the escaped bytes and the bytes sent as is are checked.
+func newEscapeCanary() []byte {
+	canary := make([]byte, 256)
+	for i := range canary {
+		canary[i] = byte(i)
+	}
+	return canary
+}
+
+// sendEscapeCanary sends the canary the same way as the data in binary mode, and compares it with the echo
+// of the receiver, to fail fast before any file data if the terminal or a middlebox mangles some bytes.
+func (t *TrzszTransfer) sendEscapeCanary() error {
+	canary := newEscapeCanary()
+	buf := escapeData(canary, t.transferConfig.EscapeCodes)
+	if err := t.writeAll([]byte(fmt.Sprintf("#ESCAPE:%d\n", len(buf)))); err != nil {
+		return err
+	}
+	if err := t.writeAll(buf); err != nil {
+		return err
+	}
+	result, err := t.recvBinary("SUCC", false, t.getNewTimeout())
+	if err != nil {
+		return err
+	}
+	if len(result) != len(canary) {
+		return newTrzszError(fmt.Sprintf("Escape verification failed, expect %d bytes but got %d, "+
+			"try -e or transfer without -b", len(canary), len(result)))
+	}
+	var mangled []string
+	for i, b := range canary {
+		if result[i] != b {
+			mangled = append(mangled, fmt.Sprintf("%02x", b))
+		}
+	}
+	if len(mangled) > 0 {
+		return newTrzszError(fmt.Sprintf("Escape verification failed, the bytes mangled: %s, "+
+			"try --escape-bytes or transfer without -b", strings.Join(mangled, ",")))
+	}
+	t.logger.Debugf("escape verification passed, %d escape codes", len(t.transferConfig.EscapeCodes))
+	return nil
+}
+
+// recvEscapeCanary echoes the canary after unescaping it, which is compared by the sender.
+func (t *TrzszTransfer) recvEscapeCanary() error {
+	timeout := t.getNewTimeout()
+	size, err := t.recvInteger("ESCAPE", false, timeout)
+	if err != nil {
+		return err
+	}
+	data, err := t.buffer.readBinary(size, timeout)
+	if err != nil {
+		return err
+	}
+	return t.sendBinary("SUCC", unescapeData(data, t.transferConfig.EscapeCodes))
+}
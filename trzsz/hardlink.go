@@ -0,0 +1,112 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type fileInode struct {
+	dev uint64
+	ino uint64
+}
+
+// recordHardLink returns the index of the first file sharing the same inode, or nil if it's the first one.
+func recordHardLink(info os.FileInfo, index int, inodes map[fileInode]int) *int {
+	inode, ok := getFileInode(info)
+	if !ok {
+		return nil
+	}
+	if first, ok := inodes[inode]; ok {
+		return &first
+	}
+	inodes[inode] = index
+	return nil
+}
+
+// resolveHardLinks returns the files with the hard links indexed from the start of the batch.
+// The hard links are sent as regular files if not supported, or the first file is not in the batch.
+func (t *TrzszTransfer) resolveHardLinks(files []*TrzszFile, startAt int) []*TrzszFile {
+	resolved := make([]*TrzszFile, len(files))
+	for i, f := range files {
+		resolved[i] = f
+		if f.HardLink == nil {
+			continue
+		}
+		file := *f
+		if t.transferConfig.HardLinks && !t.useParallel() && *f.HardLink >= startAt {
+			index := *f.HardLink - startAt
+			file.HardLink = &index
+		} else {
+			file.HardLink = nil
+		}
+		resolved[i] = &file
+	}
+	return resolved
+}
+
+// createHardLink links to the received file, or copies it if linking fails, e.g., across devices.
+func (t *TrzszTransfer) createHardLink(f *TrzszFile, fullPath string) error {
+	if stat, err := os.Lstat(fullPath); err == nil {
+		if stat.IsDir() {
+			return newTrzszError(fmt.Sprintf("Is a directory: %s", fullPath))
+		}
+		if t.skipExisting(stat) {
+			return nil
+		}
+		if err := os.Remove(fullPath); err != nil {
+			return err
+		}
+	}
+	target, ok := t.receivedPaths[int64(*f.HardLink)]
+	if !ok {
+		return newTrzszError(fmt.Sprintf("Hard link target not received: %s", strings.Join(f.RelPath, "/")))
+	}
+	return linkOrCopyFile(target, fullPath, false)
+}
+
+// linkOrCopyFile creates a hard link to the source file, or a copy of it if linking fails or copying is forced.
+func linkOrCopyFile(src, dst string, forceCopy bool) error {
+	if !forceCopy {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := doCreateFile(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+	_, err = io.Copy(dstFile, srcFile)
+	return err
+}
@@ -0,0 +1,171 @@
+//go:build !windows
+
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHardLinkedFiles(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "hard linked")
+	require.Nil(t, os.MkdirAll(filepath.Join(src, "dir", "sub"), 0755))
+	require.Nil(t, os.Link(filepath.Join(src, "dir", "a.txt"), filepath.Join(src, "dir", "b.txt")))
+	require.Nil(t, os.Link(filepath.Join(src, "dir", "a.txt"), filepath.Join(src, "dir", "sub", "c.txt")))
+	files, err := checkPathsReadableWith([]string{filepath.Join(src, "dir")}, pathOptions{directory: true})
+	require.Nil(t, err)
+
+	// the later links refer to the first one of the same inode
+	first := -1
+	for i, f := range files {
+		if f.IsDir {
+			continue
+		}
+		if first < 0 {
+			first = i
+			assert.Nil(f.HardLink)
+			assert.False(f.IsLink)
+			continue
+		}
+		require.NotNil(t, f.HardLink)
+		assert.Equal(first, *f.HardLink)
+		assert.False(f.IsLink)
+	}
+	firstName := strings.Join(files[first].RelPath, "/")
+
+	for _, supportHardLink := range []bool{true, false} {
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		client, server := newLoopbackTransfers()
+		require.Nil(t, client.sendAction(true, false))
+		action, err := server.recvAction()
+		require.Nil(t, err)
+		action.SupportHardLink = supportHardLink
+		require.Nil(t, server.sendConfig(&args.TransferOptions, action, getEscapeChars(args.Escape), NoTmux, -1))
+		_, err = client.recvConfig()
+		require.Nil(t, err)
+
+		dest := t.TempDir()
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		for _, p := range []string{"a.txt", "b.txt", "sub/c.txt"} {
+			assertFileContent(t, filepath.Join(dest, "dir", p), "hard linked")
+		}
+
+		// the data is sent once and the links are recreated, or sent as regular files to the older peers
+		sentSizes := make(map[string]int64)
+		for _, f := range client.GetTransferResult().Files {
+			sentSizes[f.Name] = f.Size
+		}
+		stat1, err := os.Stat(filepath.Join(dest, firstName))
+		require.Nil(t, err)
+		for _, p := range []string{"dir/a.txt", "dir/b.txt", "dir/sub/c.txt"} {
+			if p == firstName {
+				continue
+			}
+			stat2, err := os.Stat(filepath.Join(dest, p))
+			require.Nil(t, err)
+			assert.Equal(supportHardLink, os.SameFile(stat1, stat2))
+		}
+		if supportHardLink {
+			assert.Equal(map[string]int64{firstName: 11}, sentSizes)
+		} else {
+			assert.Equal(map[string]int64{"dir/a.txt": 11, "dir/b.txt": 11, "dir/sub/c.txt": 11}, sentSizes)
+		}
+	}
+
+	// the hard links of the source files are not reset by the older peers
+	for i, f := range files {
+		if !f.IsDir && i != first {
+			assert.NotNil(f.HardLink)
+		}
+	}
+}
+
+func TestHardLinkTargetSkipped(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "hard linked")
+	require.Nil(t, os.Link(filepath.Join(src, "dir", "a.txt"), filepath.Join(src, "dir", "b.txt")))
+	files, err := checkPathsReadableWith([]string{filepath.Join(src, "dir")}, pathOptions{directory: true})
+	require.Nil(t, err)
+	var first, second string
+	for _, f := range files {
+		if f.HardLink != nil {
+			second = filepath.Join(f.RelPath...)
+		} else if !f.IsDir {
+			first = filepath.Join(f.RelPath...)
+		}
+	}
+	require.NotEmpty(t, second)
+
+	for _, protocol := range []int{1, 2} {
+		dest := t.TempDir()
+		writeTestFile(t, filepath.Join(dest, first), "existing")
+
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.OnConflict = ConflictMode{"skip"}
+		result := transferFilesForTest(t, args, protocol, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+
+		// the skipped target is kept, and still linked to
+		assertFileContent(t, filepath.Join(dest, first), "existing")
+		assertFileContent(t, filepath.Join(dest, second), "existing")
+		stat1, err := os.Stat(filepath.Join(dest, first))
+		require.Nil(t, err)
+		stat2, err := os.Stat(filepath.Join(dest, second))
+		require.Nil(t, err)
+		assert.True(os.SameFile(stat1, stat2))
+	}
+}
+
+func TestHardLinkFallbackToCopy(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.txt")
+	writeTestFile(t, src, "content")
+	require.Nil(t, linkOrCopyFile(src, filepath.Join(dir, "b.txt"), true))
+	assertFileContent(t, filepath.Join(dir, "b.txt"), "content")
+	stat1, err := os.Stat(src)
+	require.Nil(t, err)
+	stat2, err := os.Stat(filepath.Join(dir, "b.txt"))
+	require.Nil(t, err)
+	assert.False(os.SameFile(stat1, stat2))
+
+	// the missing source can't be linked or copied
+	assert.NotNil(linkOrCopyFile(filepath.Join(dir, "missing.txt"), filepath.Join(dir, "c.txt"), false))
+}
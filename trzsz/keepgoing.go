@@ -0,0 +1,136 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// fileSkip is sent as `#SKIP` in keep-going mode, in place of the `MTIME` or `NAME` by the sender
+// who fails to open the file, or in place of the `SUCC` of the name by the receiver who fails to create it,
+// or in place of the `SUCC` of the result by the receiver who fails to write or finish it, see sendFileResult.
+type fileSkip struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// fileSkipError is a failed file in keep-going mode, the batch goes on with the next file.
+type fileSkipError struct {
+	name string
+	err  error
+}
+
+func (e *fileSkipError) Error() string {
+	return e.err.Error()
+}
+
+func newFileSkipError(buf string) error {
+	str, err := decodeString(buf)
+	if err != nil {
+		return err
+	}
+	var skip fileSkip
+	if err := json.Unmarshal(str, &skip); err != nil {
+		return err
+	}
+	return &fileSkipError{skip.Name, errors.New(skip.Error)}
+}
+
+// sendFileSkip tells the peer to skip the file, and returns the error to skip it locally too.
+func (t *TrzszTransfer) sendFileSkip(name string, err error) error {
+	buf, e := json.Marshal(&fileSkip{name, err.Error()})
+	if e != nil {
+		return e
+	}
+	if e := t.sendString("SKIP", string(buf)); e != nil {
+		return e
+	}
+	return &fileSkipError{name, err}
+}
+
+// progressBeforeResult returns the progress to be told once the data is verified, or nil in keep-going mode,
+// where the file is done only after the result of the receiver.
+func (t *TrzszTransfer) progressBeforeResult(progress ProgressCallback) ProgressCallback {
+	if t.transferConfig.KeepGoing {
+		return nil
+	}
+	return progress
+}
+
+// sendFileResult tells the sender whether the file is finished after all its data is received in keep-going mode,
+// since it may still fail to be written, renamed or given the attributes, then it's skipped by both sides.
+func (t *TrzszTransfer) sendFileResult(name string, err error, progress ProgressCallback) error {
+	if err != nil {
+		return t.sendFileSkip(name, err)
+	}
+	if err := t.sendString("SUCC", "done"); err != nil {
+		return err
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnDone()
+	}
+	return nil
+}
+
+// recvFileResult waits for the receiver to finish the file in keep-going mode, the file is skipped if it fails.
+func (t *TrzszTransfer) recvFileResult(name string, progress ProgressCallback) error {
+	if _, err := t.recvString("SUCC", false); err != nil {
+		if skipErr, ok := err.(*fileSkipError); ok {
+			skipErr.name = name
+		}
+		return err
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnDone()
+	}
+	return nil
+}
+
+// onFileError counts the failed file and reports it to the progress callback.
+func (t *TrzszTransfer) onFileError(err *fileSkipError, progress ProgressCallback) {
+	t.logger.Warnf("skip file %s: %v", err.name, err.err)
+	t.failedCount++
+	reportFileError(progress, err.name, err.err)
+}
+
+func (t *TrzszTransfer) getFailedMessage() string {
+	return fmt.Sprintf("Transferred %d file(s), %d failed", t.batchCount-t.failedCount, t.failedCount)
+}
+
+// getSkipName returns the relative path of the file to be skipped by its name received.
+func (t *TrzszTransfer) getSkipName(name string) string {
+	if !t.transferConfig.Directory {
+		return name
+	}
+	var f TrzszFile
+	if err := json.Unmarshal([]byte(name), &f); err != nil || len(f.RelPath) == 0 {
+		return name
+	}
+	return strings.Join(f.RelPath, "/")
+}
@@ -0,0 +1,102 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) record(level, format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Debugf(format string, args ...interface{}) { l.record("DEBUG", format, args...) }
+
+func (l *recordLogger) Infof(format string, args ...interface{}) { l.record("INFO", format, args...) }
+
+func (l *recordLogger) Warnf(format string, args ...interface{}) { l.record("WARN", format, args...) }
+
+func (l *recordLogger) contains(prefix string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransferLogger(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	clientLogger, serverLogger := &recordLogger{}, &recordLogger{}
+	client := NewTransfer(nil, nil, false, WithLogger(clientLogger))
+	server := NewTransfer(nil, nil, false, WithLogger(serverLogger))
+	client.writer = &loopbackWriter{peer: server}
+	server.writer = &loopbackWriter{peer: client}
+	handshakeForTest(t, client, server, newDefaultArgsForTest(), 2)
+	dest := t.TempDir()
+	result := runTransferForTest(client, server, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+
+	assert.True(clientLogger.contains("DEBUG send action:"))
+	assert.True(clientLogger.contains("DEBUG received config:"))
+	assert.True(serverLogger.contains("DEBUG received action:"))
+	assert.True(serverLogger.contains("DEBUG send config:"))
+	assert.True(clientLogger.contains("INFO send file a.txt"))
+	assert.True(clientLogger.contains("INFO sent file a.txt, 11 bytes"))
+	assert.True(serverLogger.contains("INFO receive file " + filepath.Join(dest, "a.txt")))
+	assert.True(serverLogger.contains("INFO received file " + filepath.Join(dest, "a.txt") + ", 11 bytes"))
+
+	_, err = client.recvCheck("SUCC", false, time.After(100*time.Millisecond))
+	require.NotNil(t, err)
+	assert.True(clientLogger.contains("WARN receive SUCC timeout"))
+}
+
+func TestDefaultNopLogger(t *testing.T) {
+	transfer := NewTransfer(nil, nil, false, WithLogger(nil))
+	assert.Equal(t, nopLogger{}, transfer.logger)
+}
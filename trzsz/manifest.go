@@ -0,0 +1,98 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+)
+
+// manifestEntry is a received file in the manifest. The hash is the digest verified with the sender,
+// it's omitted if the file is not verified, e.g., skipped by `--verify-sample` or in a tar stream.
+type manifestEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Algo string `json:"algo,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// manifestRecorder records the received files and their digests for `--manifest`, as the progress of trz.
+// The paths are relative to the destination path, with the slashes on all platforms.
+type manifestRecorder struct {
+	path    string
+	entries []*manifestEntry
+	digests map[string]*manifestEntry
+}
+
+func newManifestRecorder(path string) *manifestRecorder {
+	return &manifestRecorder{path: path, entries: []*manifestEntry{}, digests: make(map[string]*manifestEntry)}
+}
+
+func (m *manifestRecorder) OnNum(num int64) {
+}
+
+func (m *manifestRecorder) OnName(name string) {
+}
+
+func (m *manifestRecorder) OnSize(size int64) {
+}
+
+func (m *manifestRecorder) OnStep(step int64) {
+}
+
+func (m *manifestRecorder) OnDone() {
+}
+
+// OnFileHash keeps the digest until the file is done, as it's called before `OnFileDone` with the same name.
+func (m *manifestRecorder) OnFileHash(localName string, algo string, digest []byte) {
+	m.digests[localName] = &manifestEntry{Algo: algo, Hash: hex.EncodeToString(digest)}
+}
+
+func (m *manifestRecorder) OnFileDone(localName string, size int64) {
+	entry := &manifestEntry{Path: localRelPath(m.path, localName), Size: size}
+	if digest, ok := m.digests[localName]; ok {
+		entry.Algo, entry.Hash = digest.Algo, digest.Hash
+		delete(m.digests, localName)
+	}
+	m.entries = append(m.entries, entry)
+}
+
+// write saves the manifest to a temporary file and renames it, so the manifest is either complete or absent.
+func (m *manifestRecorder) write(path string) error {
+	content, err := json.MarshalIndent(m.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
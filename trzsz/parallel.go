@@ -0,0 +1,666 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parallelHead is the header of a file in the window of the parallel mode. The name is the same as the one
+// sent by `#NAME`, and the size is -1 for the directories and links, which have no data.
+type parallelHead struct {
+	Name  string     `json:"name"`
+	Size  int64      `json:"size"`
+	Attrs *fileAttrs `json:"attrs,omitempty"`
+}
+
+// parallelFile is a file in flight of the window, identified by its index in the window.
+type parallelFile struct {
+	id             int
+	file           *os.File
+	name           string
+	resultName     string
+	size           int64
+	step           int64
+	hasher         hash.Hash
+	verify         bool
+	attrs          *fileAttrs
+	skipped        bool
+	storeData      bool
+	sampleCompress bool
+}
+
+// parallelProgress reports the files of a window one by one, while the chunks of them are interleaved.
+// The current file is the first unfinished one, its steps are reported as its chunks are transferred,
+// and the files finished ahead of it are done at once when it comes to them.
+type parallelProgress struct {
+	progress ProgressCallback
+	names    []string
+	pfiles   []*parallelFile
+	current  int
+}
+
+func newParallelProgress(progress ProgressCallback, names []string, pfiles []*parallelFile) *parallelProgress {
+	if progress == nil || reflect.ValueOf(progress).IsNil() {
+		return nil
+	}
+	p := &parallelProgress{progress: progress, names: names, pfiles: pfiles, current: -1}
+	p.advance()
+	return p
+}
+
+// advance finishes the current file if all its data is transferred, and moves on to the next one.
+// The directories and links have no data, only their names are reported.
+func (p *parallelProgress) advance() {
+	for p.current < len(p.pfiles) {
+		if p.current >= 0 {
+			if pf := p.pfiles[p.current]; pf != nil {
+				if pf.step < pf.size {
+					return
+				}
+				p.progress.OnStep(pf.size)
+				p.progress.OnDone()
+			}
+		}
+		p.current++
+		if p.current >= len(p.pfiles) {
+			return
+		}
+		p.progress.OnName(p.names[p.current])
+		if pf := p.pfiles[p.current]; pf != nil {
+			if pf.skipped {
+				reportSkip(p.progress)
+			}
+			p.progress.OnSize(pf.size)
+			if pf.step < pf.size {
+				p.progress.OnStep(pf.step)
+			}
+		}
+	}
+}
+
+func (p *parallelProgress) onChunk(pf *parallelFile) {
+	if p == nil {
+		return
+	}
+	if p.current < len(p.pfiles) && p.pfiles[p.current] == pf && pf.step < pf.size {
+		p.progress.OnStep(pf.step)
+	}
+	p.advance()
+}
+
+// useParallel tells whether to transfer the files in windows of `Parallel` files. The features negotiating
+// each file don't work in the parallel mode, then the files are transferred one by one, which is logged once.
+func (t *TrzszTransfer) useParallel() bool {
+	c := &t.transferConfig
+	if c.Parallel <= 1 {
+		return false
+	}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{
+		{c.Patch, "--patch"},
+		{c.Audit, "--audit"},
+		{c.Resume, "-r"},
+		{c.Update, "--update"},
+		{t.skipsByVerdict(), "--on-conflict skip"},
+		{c.Checksum, "--checksum"},
+		{c.Atomic, "--atomic"},
+		{c.Dedup, "--dedup"},
+		{c.KeepGoing, "--keep-going"},
+		{c.Retries > 0, "--retries"},
+		{c.CheckEvery > 0, "--check-every"},
+		{t.useTar(), "--tar"},
+	} {
+		if opt.set {
+			if !t.parallelRefused {
+				t.parallelRefused = true
+				t.logger.Warnf("transfer the files one by one, as --parallel is not with %s", opt.name)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// sendFilesParallel sends the headers of a window of files in one round trip, then the data of the files
+// interleaved, each chunk tagged with the file id, and at last the digests of the window in one round trip.
+func (t *TrzszTransfer) sendFilesParallel(ctx context.Context, files []*TrzszFile, progress ProgressCallback) ([]string, error) {
+	var remoteNames []string
+	for begin := 0; begin < len(files); begin += t.transferConfig.Parallel {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		window := files[begin:minInt(begin+t.transferConfig.Parallel, len(files))]
+		names, err := t.sendParallelWindow(ctx, begin, window, progress)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if name != "" && !containsString(remoteNames, name) {
+				remoteNames = append(remoteNames, name)
+			}
+		}
+	}
+	return remoteNames, nil
+}
+
+func closeParallelFiles(pfiles []*parallelFile) {
+	for _, pf := range pfiles {
+		if pf != nil && pf.file != nil {
+			pf.file.Close()
+		}
+	}
+}
+
+func (t *TrzszTransfer) sendParallelWindow(ctx context.Context, begin int, window []*TrzszFile,
+	progress ProgressCallback) ([]string, error) {
+	beginTime := timeNowFunc()
+	t.logger.Infof("send window of %d file(s) from %d", len(window), begin)
+	pfiles := make([]*parallelFile, len(window))
+	defer closeParallelFiles(pfiles)
+	heads := make([]*parallelHead, len(window))
+	for i, f := range window {
+		head := &parallelHead{Name: f.RelPath[0], Size: -1}
+		if t.transferConfig.Directory {
+			jsonName, err := json.Marshal(f)
+			if err != nil {
+				return nil, err
+			}
+			head.Name = string(jsonName)
+		}
+		if t.transferConfig.Preserve {
+			attrs, err := t.newFileAttrs(f)
+			if err != nil {
+				return nil, err
+			}
+			head.Attrs = attrs
+		}
+		if f.hasData() {
+			file, err := os.Open(f.AbsPath)
+			if err != nil {
+				return nil, err
+			}
+			pfiles[i] = &parallelFile{id: i, file: file, name: f.AbsPath, resultName: strings.Join(f.RelPath, "/")}
+			stat, err := file.Stat()
+			if err != nil {
+				return nil, err
+			}
+			head.Size = stat.Size()
+			pfiles[i].size = head.Size
+			pfiles[i].hasher = t.newFileHasher()
+			pfiles[i].verify = t.needVerify(int64(begin+i), head.Size)
+			pfiles[i].storeData = t.transferConfig.NoCompress
+			pfiles[i].sampleCompress = !t.transferConfig.NoCompress
+		}
+		heads[i] = head
+	}
+
+	remoteNames, err := t.sendParallelHeads(heads)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(window))
+	for i, f := range window {
+		names[i] = f.RelPath[len(f.RelPath)-1]
+	}
+	dataBeginTime := timeNowFunc()
+	if err := t.sendParallelData(ctx, pfiles, newParallelProgress(progress, names, pfiles)); err != nil {
+		return nil, err
+	}
+	if err := t.sendParallelDigests(pfiles); err != nil {
+		return nil, err
+	}
+
+	for _, pf := range pfiles {
+		if pf == nil {
+			continue
+		}
+		t.fileCount++
+		var digest []byte
+		if pf.verify {
+			t.verifiedCount++
+			digest = pf.hasher.Sum(nil)
+		}
+		t.finishSendFile(&finishedFile{localPath: pf.name, resultName: pf.resultName, size: pf.size, dataSize: pf.size,
+			digest: digest, beginTime: beginTime, dataBeginTime: dataBeginTime}, progress)
+	}
+	return remoteNames, nil
+}
+
+func (t *TrzszTransfer) sendParallelHeads(heads []*parallelHead) ([]string, error) {
+	buf, err := json.Marshal(heads)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.sendString("HEAD", string(buf)); err != nil {
+		return nil, err
+	}
+	namesStr, err := t.recvString("SUCC", false)
+	if err != nil {
+		return nil, err
+	}
+	var remoteNames []string
+	if err := json.Unmarshal([]byte(namesStr), &remoteNames); err != nil {
+		return nil, err
+	}
+	if len(remoteNames) != len(heads) {
+		return nil, newTrzszError(fmt.Sprintf("Head count %d <> %d", len(remoteNames), len(heads)))
+	}
+	return remoteNames, nil
+}
+
+// sendParallelData sends a chunk of each unfinished file in a round, then waits for the acks of the round.
+func (t *TrzszTransfer) sendParallelData(ctx context.Context, pfiles []*parallelFile, progress *parallelProgress) error {
+	policy := t.getBufferPolicy()
+	bufSize := policy.InitialSize
+	buffer := make([]byte, bufSize)
+	limiter := t.newRateLimiter()
+	for {
+		t.waitIfPaused(ctx)
+		var sent []*parallelFile
+		var lengths []int
+		var total int64
+		full := true
+		beginTime := time.Now()
+		for _, pf := range pfiles {
+			if pf == nil || pf.step >= pf.size {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n, err := readFileFunc(pf.file, buffer[:minInt64(bufSize, pf.size-pf.step)])
+			if err == io.EOF {
+				return t.sendTruncated(pf.file.Name())
+			}
+			if err != nil {
+				return err
+			}
+			data := buffer[:n]
+			if err := t.sendParallelChunk(pf, data); err != nil {
+				return err
+			}
+			if _, err := pf.hasher.Write(data); err != nil {
+				return err
+			}
+			pf.step += int64(n)
+			progress.onChunk(pf)
+			sent = append(sent, pf)
+			lengths = append(lengths, n)
+			total += int64(n)
+			if int64(n) < bufSize {
+				full = false
+			}
+		}
+		if len(sent) == 0 {
+			return nil
+		}
+		for i, pf := range sent {
+			ack, err := t.recvCheck("SUCC", false, nil)
+			if err != nil {
+				return err
+			}
+			if expect := fmt.Sprintf("%d,%d", pf.id, lengths[i]); ack != expect {
+				return NewTrzszError(fmt.Sprintf("Chunk check [%s] <> [%s]", ack, expect), "", true)
+			}
+		}
+		roundTime := time.Now().Sub(beginTime)
+		length := int64(0)
+		if full {
+			length = bufSize
+		}
+		if next := policy.nextSize(bufSize, length, roundTime); next != bufSize {
+			bufSize = next
+			buffer = make([]byte, bufSize)
+		}
+		t.updateMaxChunkTime(roundTime)
+		if limiter != nil {
+			if err := sleepContext(ctx, limiter.onChunk(total, roundTime)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendParallelChunk sends the data tagged with the file id, as `#PDATA:id,data` in base64 mode,
+// or `#PDATA:id,length` followed by the escaped data in binary mode.
+func (t *TrzszTransfer) sendParallelChunk(pf *parallelFile, data []byte) error {
+	if t.transferConfig.Binary {
+		if t.transferConfig.BinaryCompress {
+			t.storeData, t.sampleCompress = pf.storeData, pf.sampleCompress
+			data = t.encodeDataBlock(data)
+			pf.storeData, pf.sampleCompress = t.storeData, t.sampleCompress
+		}
+		buf := escapeData(data, t.transferConfig.EscapeCodes)
+		if err := t.writeAll([]byte(fmt.Sprintf("#PDATA:%d,%d\n", pf.id, len(buf)))); err != nil {
+			return err
+		}
+		return t.writeAll(buf)
+	}
+	var encoded string
+	if t.transferConfig.ChunkHeader {
+		t.storeData, t.sampleCompress = pf.storeData, pf.sampleCompress
+		encoded = t.encodeDataChunk(data)
+		pf.storeData, pf.sampleCompress = t.storeData, t.sampleCompress
+	} else {
+		encoded = encodeBytesWith(data, t.transferConfig.Compress)
+	}
+	return t.sendLine("PDATA", fmt.Sprintf("%d,%s", pf.id, encoded))
+}
+
+func getParallelDigests(pfiles []*parallelFile) map[int]string {
+	digests := make(map[int]string)
+	for _, pf := range pfiles {
+		if pf != nil && pf.verify {
+			digests[pf.id] = hex.EncodeToString(pf.hasher.Sum(nil))
+		}
+	}
+	return digests
+}
+
+func (t *TrzszTransfer) sendParallelDigests(pfiles []*parallelFile) error {
+	digests := getParallelDigests(pfiles)
+	if len(digests) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	if err := t.sendString("DIGEST", string(buf)); err != nil {
+		return err
+	}
+	return t.checkString(string(buf))
+}
+
+// recvFilesParallel receives the files in windows of `Parallel` files, see `sendFilesParallel`.
+func (t *TrzszTransfer) recvFilesParallel(ctx context.Context, path string, num int64, progress ProgressCallback) ([]string, error) {
+	var localNames []string
+	for begin := int64(0); begin < num; begin += int64(t.transferConfig.Parallel) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		count := minInt64(int64(t.transferConfig.Parallel), num-begin)
+		names, err := t.recvParallelWindow(ctx, path, begin, int(count), progress)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if name != "" && !containsString(localNames, name) {
+				localNames = append(localNames, name)
+			}
+		}
+	}
+	return localNames, nil
+}
+
+func (t *TrzszTransfer) recvParallelWindow(ctx context.Context, path string, begin int64, count int,
+	progress ProgressCallback) ([]string, error) {
+	beginTime := timeNowFunc()
+	t.logger.Infof("receive window of %d file(s) from %d", count, begin)
+	headsStr, err := t.recvString("HEAD", false)
+	if err != nil {
+		return nil, err
+	}
+	var heads []*parallelHead
+	if err := json.Unmarshal([]byte(headsStr), &heads); err != nil {
+		return nil, err
+	}
+	if len(heads) != count {
+		return nil, newTrzszError(fmt.Sprintf("Head count %d <> %d", len(heads), count))
+	}
+
+	for _, head := range heads {
+		if err := t.checkMaxFileSize(head.Size); err != nil {
+			return nil, err
+		}
+		if t.preReceiveHook != nil {
+			meta, hasData, err := t.newFileMeta(head.Name)
+			if err != nil {
+				return nil, err
+			}
+			if hasData {
+				meta.Size = head.Size
+			}
+			if err := t.checkPreReceive(meta); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if t.quota != nil {
+		var total int64
+		for _, head := range heads {
+			if head.Size > 0 {
+				total += head.Size
+			}
+		}
+		if err := t.quota.check(total); err != nil {
+			return nil, err
+		}
+	}
+
+	pfiles := make([]*parallelFile, len(heads))
+	defer closeParallelFiles(pfiles)
+	names := make([]string, len(heads))
+	localNames := make([]string, len(heads))
+	for i, head := range heads {
+		var file *os.File
+		var localName, fileName, fullPath string
+		if t.transferConfig.Directory {
+			file, localName, fileName, fullPath, err = t.createDirOrFile(path, head.Name)
+		} else {
+			file, localName, err = t.createFile(path, t.getOutputName(head.Name))
+			fileName = head.Name
+			fullPath = filepath.Join(path, localName)
+		}
+		skipped := false
+		if err == errSkipExisting {
+			skipped = true
+			file, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+		names[i] = fileName
+		localNames[i] = localName
+		if file == nil {
+			if head.Attrs != nil && fullPath != "" {
+				t.dirAttrs = append(t.dirAttrs, &dirAttrs{fullPath, head.Attrs})
+			}
+			continue
+		}
+		if head.Size < 0 {
+			file.Close()
+			return nil, newTrzszError(fmt.Sprintf("Invalid size %d of %s", head.Size, fileName))
+		}
+		pfiles[i] = &parallelFile{id: i, file: file, name: fullPath, resultName: localRelPath(path, fullPath),
+			size: head.Size, hasher: t.newFileHasher(), verify: t.needVerify(begin+int64(i), head.Size),
+			attrs: head.Attrs, skipped: skipped}
+	}
+
+	localNamesStr, err := json.Marshal(localNames)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.sendString("SUCC", string(localNamesStr)); err != nil {
+		return nil, err
+	}
+
+	dataBeginTime := timeNowFunc()
+	if err := t.recvParallelData(ctx, pfiles, newParallelProgress(progress, names, pfiles)); err != nil {
+		t.removeParallelFiles(pfiles)
+		return nil, err
+	}
+	if err := t.recvParallelDigests(pfiles); err != nil {
+		return nil, err
+	}
+
+	for i, pf := range pfiles {
+		if pf == nil {
+			continue
+		}
+		pf.file.Close()
+		t.fileCount++
+		var digest []byte
+		if pf.verify {
+			t.verifiedCount++
+			digest = pf.hasher.Sum(nil)
+		}
+		if pf.skipped {
+			t.addSkippedResult(pf.resultName, beginTime, dataBeginTime)
+			continue
+		}
+		t.receivedPaths[begin+int64(i)] = pf.name
+		if err := t.finishRecvFile(&finishedFile{localPath: pf.name, resultName: pf.resultName, size: pf.size,
+			dataSize: pf.size, digest: digest, attrs: pf.attrs, beginTime: beginTime, dataBeginTime: dataBeginTime},
+			progress); err != nil {
+			return nil, err
+		}
+	}
+	return localNames, nil
+}
+
+func (t *TrzszTransfer) recvParallelData(ctx context.Context, pfiles []*parallelFile, progress *parallelProgress) error {
+	remaining := 0
+	for _, pf := range pfiles {
+		if pf != nil && pf.size > 0 {
+			remaining++
+		}
+	}
+	for remaining > 0 {
+		t.waitIfPaused(ctx)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pf, data, err := t.recvParallelChunk(pfiles)
+		if err != nil {
+			return err
+		}
+		if pf.step+int64(len(data)) > pf.size {
+			return newTrzszError(fmt.Sprintf("Chunk of file %d exceeds the size %d", pf.id, pf.size))
+		}
+		if err := t.writeFileData(pf.file, data); err != nil {
+			return err
+		}
+		if _, err := pf.hasher.Write(data); err != nil {
+			return err
+		}
+		pf.step += int64(len(data))
+		progress.onChunk(pf)
+		if pf.step == pf.size {
+			remaining--
+		}
+		if err := t.sendLine("SUCC", fmt.Sprintf("%d,%d", pf.id, len(data))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeParallelFiles removes the unfinished files of the window, as a failed chunk breaks off the whole window.
+func (t *TrzszTransfer) removeParallelFiles(pfiles []*parallelFile) {
+	for _, pf := range pfiles {
+		if pf != nil && pf.step < pf.size {
+			t.removePartialFile(pf.file)
+		}
+	}
+}
+
+func (t *TrzszTransfer) recvParallelChunk(pfiles []*parallelFile) (*parallelFile, []byte, error) {
+	timeout := t.getNewTimeout()
+	buf, err := t.recvCheck("PDATA", false, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx := strings.IndexByte(buf, ',')
+	if idx < 0 {
+		return nil, nil, newTrzszError(fmt.Sprintf("Invalid data chunk: %s", buf))
+	}
+	id, err := strconv.Atoi(buf[:idx])
+	if err != nil {
+		return nil, nil, err
+	}
+	if id < 0 || id >= len(pfiles) || pfiles[id] == nil {
+		return nil, nil, newTrzszError(fmt.Sprintf("Invalid file id: %d", id))
+	}
+	payload := buf[idx+1:]
+	var data []byte
+	if t.transferConfig.Binary {
+		size, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		escaped, err := t.buffer.readBinary(size, timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err = t.decodeDataBlock(unescapeData(escaped, t.transferConfig.EscapeCodes))
+	} else if t.transferConfig.ChunkHeader {
+		data, err = decodeChunk(payload, t.transferConfig.Compress)
+	} else {
+		data, err = decodeStringWith(payload, t.transferConfig.Compress)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	t.lastChunkSize.Store(int64(len(data)))
+	return pfiles[id], data, nil
+}
+
+func (t *TrzszTransfer) recvParallelDigests(pfiles []*parallelFile) error {
+	digests := getParallelDigests(pfiles)
+	if len(digests) == 0 {
+		return nil
+	}
+	digestsStr, err := t.recvString("DIGEST", false)
+	if err != nil {
+		return err
+	}
+	var expectDigests map[int]string
+	if err := json.Unmarshal([]byte(digestsStr), &expectDigests); err != nil {
+		return err
+	}
+	for id, digest := range digests {
+		if expectDigests[id] != digest {
+			return newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Check %s failed: %s", t.getHashName(), pfiles[id].resultName))
+		}
+	}
+	return t.sendString("SUCC", digestsStr)
+}
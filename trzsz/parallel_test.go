@@ -0,0 +1,203 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferParallel(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	contents := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		contents[fmt.Sprintf("dir/sub%d/small%d.txt", i%3, i)] = strings.Repeat(fmt.Sprint(i), i*10)
+	}
+	large := make([]byte, 100*1024)
+	rand.Read(large)
+	contents["dir/large.bin"] = string(large)
+	contents["dir/empty.txt"] = ""
+	for p, content := range contents {
+		writeTestFile(t, filepath.Join(src, p), content)
+	}
+	require.Nil(t, os.Mkdir(filepath.Join(src, "dir", "empty"), 0755))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	transferParallel := func(protocol int, binary bool) (*transferResultForTest, string, int32, int32) {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Binary = binary
+		args.Preserve = true
+		args.Parallel = 4
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		var nameCount, headCount atomic.Int32
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if strings.HasPrefix(string(buf), "#NAME:") {
+				nameCount.Add(1)
+			} else if strings.HasPrefix(string(buf), "#HEAD:") {
+				headCount.Add(1)
+			}
+			return buf
+		}
+		return runTransferForTest(client, server, files, dest), dest, nameCount.Load(), headCount.Load()
+	}
+
+	for _, binary := range []bool{false, true} {
+		// one round trip of the headers for each window of 4 files
+		result, dest, nameCount, headCount := transferParallel(3, binary)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{"dir"}, result.localNames)
+		assert.Equal(int32(0), nameCount)
+		assert.Equal(int32((len(files)+3)/4), headCount)
+		for p, content := range contents {
+			assertFileContent(t, filepath.Join(dest, p), content)
+		}
+		assertEmptyDir(t, filepath.Join(dest, "dir", "empty"))
+
+		// fall back to serial with the protocol 2 peer
+		result, dest, nameCount, headCount = transferParallel(2, binary)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal(int32(len(files)), nameCount)
+		assert.Equal(int32(0), headCount)
+		for p, content := range contents {
+			assertFileContent(t, filepath.Join(dest, p), content)
+		}
+	}
+}
+
+func TestParallelDigestMismatch(t *testing.T) {
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "world")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	args := newDefaultArgsForTest()
+	args.Parallel = 2
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 3)
+	client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+		if strings.HasPrefix(string(buf), "#PDATA:1,") {
+			return []byte("#PDATA:1," + encodeChunk(kChunkStored, []byte("wrong")) + "\n")
+		}
+		return buf
+	}
+	result := runTransferForTest(client, server, files, t.TempDir())
+	assert.EqualError(t, result.recvErr, "Check MD5 failed: b.txt")
+}
+
+func TestParallelRefusedLogged(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "world")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	args := newDefaultArgsForTest()
+	args.Parallel = 2
+	args.Checksum = true
+	clientLogger := &recordLogger{}
+	client := NewTransfer(nil, nil, false, WithLogger(clientLogger))
+	server := NewTransfer(nil, nil, false)
+	client.writer = &loopbackWriter{peer: server}
+	server.writer = &loopbackWriter{peer: client}
+	handshakeForTest(t, client, server, args, 3)
+	result := runTransferForTest(client, server, files, t.TempDir())
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+
+	// the files are sent one by one, and it's logged only once
+	var refused []string
+	for _, line := range clientLogger.lines {
+		if strings.Contains(line, "--parallel") {
+			refused = append(refused, line)
+		}
+	}
+	assert.Equal([]string{"WARN transfer the files one by one, as --parallel is not with --checksum"}, refused)
+	assert.True(clientLogger.contains("INFO sent file a.txt, 5 bytes"))
+}
+
+func TestParallelProgress(t *testing.T) {
+	assert := assert.New(t)
+	recorder := &progressRecorder{}
+	a := &parallelFile{id: 0, size: 4}
+	b := &parallelFile{id: 1, size: 2, skipped: true}
+	c := &parallelFile{id: 3, size: 0}
+	progress := newParallelProgress(recorder, []string{"a.txt", "b.txt", "dir", "c.txt"},
+		[]*parallelFile{a, b, nil, c})
+
+	// the steps of the current file are reported as the chunks are transferred
+	a.step = 2
+	progress.onChunk(a)
+	// the file finished ahead of the current one is done when it comes to it
+	b.step = 2
+	progress.onChunk(b)
+	a.step = 4
+	progress.onChunk(a)
+	assert.Equal([]string{"name a.txt", "size 4", "step 0", "step 2", "step 4", "done",
+		"name b.txt", "skip", "size 2", "step 2", "done", "name dir", "name c.txt", "size 0", "step 0", "done"},
+		recorder.calls)
+
+	assert.Nil(newParallelProgress(nil, nil, nil))
+}
+
+func TestParallelRemovePartialFiles(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("a", 3000))
+	writeTestFile(t, filepath.Join(src, "b.txt"), strings.Repeat("b", 3000))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	dest := t.TempDir()
+	args := newDefaultArgsForTest()
+	args.Parallel = 2
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 3)
+	server.maxTotal = 4000
+	result := runTransferForTest(client, server, files, dest)
+	require.NotNil(t, result.recvErr)
+
+	// all the unfinished files of the window are removed, not only the failed one
+	for _, name := range []string{"a.txt", "b.txt"} {
+		_, err := os.Stat(filepath.Join(dest, name))
+		assert.True(os.IsNotExist(err), name)
+	}
+}
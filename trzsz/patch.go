@@ -0,0 +1,299 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+const kPatchBlockSize = 64 * 1024
+
+// PatchRange is a changed byte range of a file, which will be written in place by the receiver.
+type PatchRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+func readBlock(file *os.File, buf []byte, offset int64) (int, error) {
+	n, err := file.ReadAt(buf, offset)
+	if err == io.EOF {
+		return n, nil
+	}
+	return n, err
+}
+
+// newBlockHasher hashes the blocks by the negotiated hash, even if the checksum of the file is skipped.
+func (t *TrzszTransfer) newBlockHasher() hash.Hash {
+	if hasher, err := hashNew(t.transferConfig.Hash); err == nil {
+		return hasher
+	}
+	return md5.New()
+}
+
+// getBlockDigests returns the digests of the file block by block, a short last block is hashed as is.
+func (t *TrzszTransfer) getBlockDigests(file *os.File) ([]string, error) {
+	digests := []string{}
+	buf := make([]byte, kPatchBlockSize)
+	for offset := int64(0); ; offset += kPatchBlockSize {
+		n, err := readBlock(file, buf, offset)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return digests, nil
+		}
+		hasher := t.newBlockHasher()
+		hasher.Write(buf[:n])
+		digests = append(digests, hex.EncodeToString(hasher.Sum(nil)))
+		if n < kPatchBlockSize {
+			return digests, nil
+		}
+	}
+}
+
+// getChangedRanges compares the file with the block digests of its prior version, and merges the adjacent changed blocks.
+func (t *TrzszTransfer) getChangedRanges(baseDigests []string, file *os.File, size int64) ([]PatchRange, error) {
+	ranges := []PatchRange{}
+	buf := make([]byte, kPatchBlockSize)
+	for offset, idx := int64(0), 0; offset < size; offset, idx = offset+kPatchBlockSize, idx+1 {
+		n, err := readBlock(file, buf, offset)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, newTrzszError(fmt.Sprintf("File truncated at %d of %d", offset, size))
+		}
+		if int64(n) > size-offset {
+			n = int(size - offset)
+		}
+		if idx < len(baseDigests) {
+			hasher := t.newBlockHasher()
+			hasher.Write(buf[:n])
+			if hex.EncodeToString(hasher.Sum(nil)) == baseDigests[idx] {
+				continue
+			}
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1].Offset+ranges[len(ranges)-1].Length == offset {
+			ranges[len(ranges)-1].Length += int64(n)
+		} else {
+			ranges = append(ranges, PatchRange{offset, int64(n)})
+		}
+	}
+	return ranges, nil
+}
+
+// getPatchBasePath resolves the prior version of the received file on the receiver, it's the existing
+// file itself, or the file of the same relative path under the local `--patch-base` directory.
+func (t *TrzszTransfer) getPatchBasePath(path string, file *os.File) string {
+	if len(t.patchBase) == 0 {
+		return ""
+	}
+	return filepath.Join(t.patchBase, filepath.FromSlash(localRelPath(path, file.Name())))
+}
+
+// sendBlockDigests sends the block digests of the prior version to the sender, and copies the prior
+// version from the `--patch-base` directory into the file, so that only the changed ranges are written.
+func (t *TrzszTransfer) sendBlockDigests(file *os.File, basePath string, size int64) error {
+	base := file
+	if len(basePath) > 0 {
+		var err error
+		base, err = os.Open(basePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return t.sendString("BLOCKS", "[]")
+		} else if err != nil {
+			return err
+		}
+		defer base.Close()
+	}
+	digests, err := t.getBlockDigests(base)
+	if err != nil {
+		return err
+	}
+	if base != file {
+		if _, err := base.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, io.LimitReader(base, size)); err != nil {
+			return err
+		}
+	}
+	digestsStr, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	return t.sendString("BLOCKS", string(digestsStr))
+}
+
+func (t *TrzszTransfer) hashWholeFile(file *os.File) ([]byte, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hasher := t.newFileHasher()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+func (t *TrzszTransfer) sendFilePatch(ctx context.Context, file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
+	digestsStr, err := t.recvString("BLOCKS", false)
+	if err != nil {
+		return nil, err
+	}
+	var baseDigests []string
+	if err := json.Unmarshal([]byte(digestsStr), &baseDigests); err != nil {
+		return nil, err
+	}
+	ranges, err := t.getChangedRanges(baseDigests, file, size)
+	if err != nil {
+		return nil, err
+	}
+	rangesStr, err := json.Marshal(ranges)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.sendString("PATCH", string(rangesStr)); err != nil {
+		return nil, err
+	}
+	if err := t.checkString(string(rangesStr)); err != nil {
+		return nil, err
+	}
+
+	total := int64(0)
+	for _, r := range ranges {
+		total += r.Length
+	}
+	showProgress := progress != nil && !reflect.ValueOf(progress).IsNil()
+	if showProgress {
+		progress.OnSize(total)
+		progress.OnStep(0)
+	}
+
+	step := int64(0)
+	buffer := make([]byte, minInt64(t.transferConfig.MaxBufSize, kPatchBlockSize*16))
+	for _, r := range ranges {
+		for offset := r.Offset; offset < r.Offset+r.Length; {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			length := minInt64(int64(len(buffer)), r.Offset+r.Length-offset)
+			n, err := file.ReadAt(buffer[:length], offset)
+			if err != nil && !(err == io.EOF && int64(n) == length) {
+				return nil, err
+			}
+			if err := t.sendData(buffer[:n]); err != nil {
+				return nil, err
+			}
+			if err := t.checkInteger(int64(n)); err != nil {
+				return nil, err
+			}
+			offset += int64(n)
+			step += int64(n)
+			if showProgress {
+				progress.OnStep(step)
+			}
+		}
+	}
+
+	return t.hashWholeFile(file)
+}
+
+func (t *TrzszTransfer) recvFilePatch(ctx context.Context, file *os.File, basePath string, size int64, progress ProgressCallback) ([]byte, error) {
+	if err := t.sendBlockDigests(file, basePath, size); err != nil {
+		return nil, err
+	}
+	rangesStr, err := t.recvString("PATCH", false)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []PatchRange
+	if err := json.Unmarshal([]byte(rangesStr), &ranges); err != nil {
+		return nil, err
+	}
+	total := int64(0)
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 || r.Offset+r.Length > size {
+			return nil, newTrzszError(fmt.Sprintf("Invalid patch range [%d, %d) of size %d", r.Offset, r.Offset+r.Length, size))
+		}
+		total += r.Length
+	}
+	if err := t.sendString("SUCC", rangesStr); err != nil {
+		return nil, err
+	}
+	showProgress := progress != nil && !reflect.ValueOf(progress).IsNil()
+	if showProgress {
+		progress.OnSize(total)
+		progress.OnStep(0)
+	}
+
+	step := int64(0)
+	for _, r := range ranges {
+		if _, err := file.Seek(r.Offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		for received := int64(0); received < r.Length; {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			data, err := t.recvData()
+			if err != nil {
+				return nil, err
+			}
+			length := int64(len(data))
+			if received+length > r.Length {
+				return nil, newTrzszError(fmt.Sprintf("Patch range overflow %d > %d", received+length, r.Length))
+			}
+			if err := t.writeFileData(file, data); err != nil {
+				return nil, err
+			}
+			if err := t.sendInteger("SUCC", length); err != nil {
+				return nil, err
+			}
+			received += length
+			step += length
+			if showProgress {
+				progress.OnStep(step)
+			}
+		}
+	}
+
+	if err := file.Truncate(size); err != nil {
+		return nil, err
+	}
+	return t.hashWholeFile(file)
+}
@@ -0,0 +1,104 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pauseState holds the transfer at the chunk boundaries while paused. The timeouts are suspended too,
+// the receiving in progress restarts its timeout if the transfer has been paused in the meantime.
+type pauseState struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	paused     bool
+	count      atomic.Int64
+	newTimeout func() <-chan time.Time
+}
+
+func newPauseState(newTimeout func() <-chan time.Time) *pauseState {
+	p := &pauseState{newTimeout: newTimeout}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+func (p *pauseState) pause() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.paused = true
+	p.count.Add(1)
+}
+
+func (p *pauseState) resume() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.paused = false
+	p.cond.Broadcast()
+}
+
+// wake wakes up the waiters to check if the transfer is stopped or cancelled.
+func (p *pauseState) wake() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.cond.Broadcast()
+}
+
+// wait blocks while paused, until resumed or the cancelled returns true.
+func (p *pauseState) wait(cancelled func() bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.paused && !cancelled() {
+		p.cond.Wait()
+	}
+}
+
+// pausedSince returns true if the transfer is paused now, or has been paused after the count is read.
+func (p *pauseState) pausedSince(count int64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.paused || p.count.Load() != count
+}
+
+// Pause holds the transfer at the next chunk boundary until `Resume`, e.g., on the network loss, without
+// tearing it down. The timeouts are suspended while paused, but the peer should be paused too, or it may
+// time out waiting for the next chunk. It's safe to be called from another goroutine.
+func (t *TrzszTransfer) Pause() {
+	t.pauses.pause()
+}
+
+// Resume continues the transfer paused by `Pause`, and the timeouts are restarted.
+func (t *TrzszTransfer) Resume() {
+	t.pauses.resume()
+}
+
+// waitIfPaused blocks at the chunk boundary while paused, until resumed, stopped or the ctx is done.
+func (t *TrzszTransfer) waitIfPaused(ctx context.Context) {
+	t.pauses.wait(func() bool {
+		return t.stopped.Load() || ctx.Err() != nil
+	})
+}
@@ -0,0 +1,124 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseResume(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("hello trzsz\n", 10000)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Timeout = 1
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+
+		// the timeouts are suspended while paused, longer than the timeout
+		client.Pause()
+		server.Pause()
+		go func() {
+			time.Sleep(1500 * time.Millisecond)
+			// no data is received while paused
+			data, err := os.ReadFile(filepath.Join(dest, "a.txt"))
+			assert.Nil(err)
+			assert.Equal(0, len(data))
+			client.Resume()
+			server.Resume()
+		}()
+		beginTime := time.Now()
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.GreaterOrEqual(time.Since(beginTime), 1500*time.Millisecond)
+		assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+	}
+}
+
+func TestPauseStop(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	// the paused transfer could be stopped
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, newDefaultArgsForTest(), 1)
+	client.Pause()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Stop()
+		server.Stop()
+	}()
+	beginTime := time.Now()
+	result := runTransferForTest(client, server, files, t.TempDir())
+	assert.EqualError(result.sendErr, "Stopped")
+	assert.NotNil(result.recvErr)
+	assert.Less(time.Since(beginTime), 3*time.Second)
+}
+
+func TestPausedSince(t *testing.T) {
+	assert := assert.New(t)
+	pauses := newPauseState(nil)
+	count := pauses.count.Load()
+	assert.False(pauses.pausedSince(count))
+	pauses.pause()
+	assert.True(pauses.pausedSince(count))
+	pauses.resume()
+	assert.True(pauses.pausedSince(count))
+	assert.False(pauses.pausedSince(pauses.count.Load()))
+
+	// waiting returns once resumed or cancelled
+	pauses.pause()
+	done := make(chan struct{})
+	go func() {
+		pauses.wait(func() bool { return false })
+		close(done)
+	}()
+	select {
+	case <-done:
+		assert.Fail("wait returns while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	pauses.resume()
+	<-done
+	pauses.pause()
+	pauses.wait(func() bool { return true })
+}
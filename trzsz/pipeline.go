@@ -26,8 +26,8 @@ package trzsz
 
 import (
 	"bytes"
+	"compress/zlib"
 	"context"
-	"crypto/md5"
 	"encoding/base64"
 	"fmt"
 	"github.com/klauspost/compress/zstd"
@@ -43,6 +43,9 @@ type PipelineContext struct {
 	context.Context
 	cancel context.CancelCauseFunc
 	succ   chan struct{}
+	// truncated is the name of the file truncated while it's being read, it's set before the data channels
+	// are closed, and the sender tells the peer after the data in flight, instead of the finish flag.
+	truncated string
 }
 
 type TrzszData struct {
@@ -125,7 +128,7 @@ func (b *Base64Writer) Write(p []byte) (int, error) {
 			return 0, b.ctx.Err()
 		}
 
-		b.bufSize = b.transfer.bufferSize.Load()
+		b.bufSize = b.transfer.nextBufferSize()
 		b.buffer = bytes.NewBuffer(make([]byte, 0, b.bufSize))
 		p = p[n:]
 		m += n
@@ -143,7 +146,7 @@ func (b *Base64Writer) Close() error {
 }
 
 func NewBase64Writer(transfer *TrzszTransfer, ctx *PipelineContext, sendDataChan chan<- TrzszData) *Base64Writer {
-	bufSize := transfer.bufferSize.Load()
+	bufSize := transfer.nextBufferSize()
 	buffer := bytes.NewBuffer(make([]byte, 0, bufSize))
 	return &Base64Writer{transfer, ctx, sendDataChan, buffer, bufSize}
 }
@@ -175,10 +178,10 @@ func (t *TrzszTransfer) pipelineCalculateMD5(ctx *PipelineContext, md5SourceChan
 	md5DigestChan := make(chan []byte, 1)
 	go func() {
 		defer close(md5DigestChan)
-		hasher := md5.New()
+		hasher := t.newFileHasher()
 		for buf := range md5SourceChan {
 			if _, err := hasher.Write(buf); err != nil {
-				ctx.cancel(newTrzszError(fmt.Sprintf("MD5 write error: %v", err)))
+				ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("MD5 write error: %v", err)))
 				return
 			}
 		}
@@ -199,7 +202,7 @@ func (t *TrzszTransfer) pipelineReadData(ctx *PipelineContext, file *os.File, si
 		length := int64(0)
 		for ctx.Err() == nil {
 			buffer := make([]byte, 4096)
-			n, err := file.Read(buffer)
+			n, err := readFileFunc(file, buffer)
 			if n > 0 {
 				select {
 				case fileDataChan <- buffer[:n]:
@@ -214,14 +217,15 @@ func (t *TrzszTransfer) pipelineReadData(ctx *PipelineContext, file *os.File, si
 				length += int64(n)
 			}
 			if err == io.EOF {
-				if length == size {
-					return
+				if length < size {
+					ctx.truncated = file.Name()
+				} else if length > size {
+					ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("File size %d but read %d", size, length)))
 				}
-				ctx.cancel(newTrzszError(fmt.Sprintf("File size %d but read %d", size, length)))
 				return
 			}
 			if err != nil {
-				ctx.cancel(newTrzszError(fmt.Sprintf("Read file error: %v", err)))
+				ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Read file error: %v", err)))
 				return
 			}
 		}
@@ -229,6 +233,59 @@ func (t *TrzszTransfer) pipelineReadData(ctx *PipelineContext, file *os.File, si
 	return fileDataChan, md5SourceChan
 }
 
+// pipelineCompress returns the compress algorithm of the data stream in the pipeline. It's zstd unless another
+// one is negotiated, as the protocol 2 peers without the negotiation always compress the stream by zstd.
+func (t *TrzszTransfer) pipelineCompress() string {
+	if t.transferConfig.Compress == "" {
+		return "zstd"
+	}
+	return t.transferConfig.Compress
+}
+
+type streamCompressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newStreamCompressor(w io.Writer, compress string) (streamCompressor, error) {
+	if compress == "zlib" {
+		return zlib.NewWriter(w), nil
+	}
+	return zstd.NewWriter(w)
+}
+
+func newStreamDecompressor(r io.Reader, compress string) (io.ReadCloser, error) {
+	if compress == "zlib" {
+		return zlib.NewReader(r)
+	}
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zstdReadCloser{zr}, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// samplePipelineData returns the header of the stream, which is stored as is if the first data of the file
+// is incompressible, the same as the chunks of `compressDataChunk`.
+func (t *TrzszTransfer) samplePipelineData(first []byte, compress string, store bool) byte {
+	if !store && len(first) > 0 && float64(len(compressBytes(first, compress))) > kStoreRatio*float64(len(first)) {
+		store = true
+	}
+	if store {
+		return kChunkStored
+	}
+	return kChunkCompressed
+}
+
 func (t *TrzszTransfer) pipelineEncodeData(ctx *PipelineContext, fileDataChan <-chan []byte) <-chan TrzszData {
 	sendDataChan := make(chan TrzszData, 1)
 	go func() {
@@ -236,36 +293,75 @@ func (t *TrzszTransfer) pipelineEncodeData(ctx *PipelineContext, fileDataChan <-
 
 		c := NewCompressedWriter(t, ctx, sendDataChan)
 		defer func() {
+			if ctx.truncated != "" {
+				return
+			}
 			err := c.Close()
 			if err != nil {
-				ctx.cancel(newTrzszError(fmt.Sprintf("Close compressed writer error: %v", err)))
+				ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Close compressed writer error: %v", err)))
 			}
 		}()
 
-		z, err := zstd.NewWriter(c)
-		if err != nil {
-			ctx.cancel(newTrzszError(fmt.Sprintf("New zstd writer error: %v", err)))
-			return
+		compress := t.pipelineCompress()
+		store := t.transferConfig.NoCompress || compress == "none"
+		var first []byte
+		if t.transferConfig.ChunkHeader {
+			select {
+			case first = <-fileDataChan:
+			case <-ctx.Done():
+				return
+			}
+			header := t.samplePipelineData(first, compress, store)
+			if err := writeAll(c, []byte{header}); err != nil {
+				ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Write to base64 error: %v", err)))
+				return
+			}
+			store = header == kChunkStored
 		}
-		defer func() {
-			err := z.Close()
+
+		var w io.Writer = c
+		var z streamCompressor
+		if !store {
+			var err error
+			z, err = newStreamCompressor(c, compress)
 			if err != nil {
-				ctx.cancel(newTrzszError(fmt.Sprintf("Close zstd writer error: %v", err)))
+				ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("New %s writer error: %v", compress, err)))
+				return
 			}
-		}()
+			defer func() {
+				if ctx.truncated != "" {
+					return
+				}
+				err := z.Close()
+				if err != nil {
+					ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Close %s writer error: %v", compress, err)))
+				}
+			}()
+			w = z
+		}
 
-		for data := range fileDataChan {
-			if err := writeAll(z, data); err != nil {
-				ctx.cancel(newTrzszError(fmt.Sprintf("Write to zstd error: %v", err)))
-				return
+		write := func(data []byte) bool {
+			if err := writeAll(w, data); err != nil {
+				if z == nil {
+					ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Write to base64 error: %v", err)))
+				} else {
+					ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Write to %s error: %v", compress, err)))
+				}
+				return false
 			}
-			if t.flushInTime {
+			if z != nil && t.flushInTime {
 				if err := z.Flush(); err != nil {
-					ctx.cancel(newTrzszError(fmt.Sprintf("Flush to zstd error: %v", err)))
-					return
+					ctx.cancel(wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Flush to %s error: %v", compress, err)))
+					return false
 				}
 			}
-			if ctx.Err() != nil {
+			return ctx.Err() == nil
+		}
+		if len(first) > 0 && !write(first) {
+			return
+		}
+		for data := range fileDataChan {
+			if !write(data) {
 				return
 			}
 		}
@@ -288,10 +384,10 @@ func (t *TrzszTransfer) pipelineEscapeData(ctx *PipelineContext, fileDataChan <-
 	}
 	go func() {
 		defer close(sendDataChan)
-		bufSize := int(t.bufferSize.Load())
+		bufSize := int(t.nextBufferSize())
 		buffer := new(bytes.Buffer)
 		for data := range fileDataChan {
-			buf := escapeData(data, t.transferConfig.EscapeCodes)
+			buf := escapeData(t.encodeDataBlock(data), t.transferConfig.EscapeCodes)
 			if buffer.Len() == 0 {
 				buffer = bytes.NewBuffer(buf)
 			} else {
@@ -304,13 +400,13 @@ func (t *TrzszTransfer) pipelineEscapeData(ctx *PipelineContext, fileDataChan <-
 					return
 				}
 				buffer = bytes.NewBuffer(b[bufSize:])
-				bufSize = int(t.bufferSize.Load())
+				bufSize = int(t.nextBufferSize())
 			}
 			if ctx.Err() != nil {
 				return
 			}
 		}
-		if ctx.Err() != nil {
+		if ctx.Err() != nil || ctx.truncated != "" {
 			return
 		}
 		if buffer.Len() > 0 {
@@ -323,29 +419,39 @@ func (t *TrzszTransfer) pipelineEscapeData(ctx *PipelineContext, fileDataChan <-
 	return sendDataChan
 }
 
-func (t *TrzszTransfer) pipelineRecvCurrentAck() (int64, int64, error) {
+// pipelineRecvCurrentAck returns the length, the step and the chunk count of the ack. The count is only
+// sent in the windowed-ack mode, and it's 1 if not sent.
+func (t *TrzszTransfer) pipelineRecvCurrentAck() (int64, int64, int, error) {
 	timeout := t.getNewTimeout()
 	resp, err := t.recvCheck("SUCC", false, timeout)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 
 	tokens := strings.Split(resp, "/")
-	if len(tokens) != 2 {
-		return 0, 0, newTrzszError(fmt.Sprintf("Response number is not 2 but %d", len(tokens)))
+	if len(tokens) != 2 && len(tokens) != 3 {
+		return 0, 0, 0, newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Response number is not 2 but %d", len(tokens)))
 	}
 
 	length, err := strconv.ParseInt(tokens[0], 10, 64)
 	if err != nil {
-		return 0, 0, newTrzszError(fmt.Sprintf("Parse int from %s error: %v", tokens[0], err))
+		return 0, 0, 0, newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Parse int from %s error: %v", tokens[0], err))
 	}
 
 	step, err := strconv.ParseInt(tokens[1], 10, 64)
 	if err != nil {
-		return 0, 0, newTrzszError(fmt.Sprintf("Parse int from %s error: %v", tokens[1], err))
+		return 0, 0, 0, newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Parse int from %s error: %v", tokens[1], err))
 	}
 
-	return length, step, nil
+	count := 1
+	if len(tokens) == 3 {
+		count, err = strconv.Atoi(tokens[2])
+		if err != nil || count < 1 {
+			return 0, 0, 0, newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Invalid chunk count: %s", tokens[2]))
+		}
+	}
+
+	return length, step, count, nil
 }
 
 func (t *TrzszTransfer) pipelineRecvFinalAck(ctx *PipelineContext, size int64, progressChan chan<- int64) {
@@ -358,7 +464,7 @@ func (t *TrzszTransfer) pipelineRecvFinalAck(ctx *PipelineContext, size int64, p
 		}
 
 		if step > size {
-			ctx.cancel(newTrzszError(fmt.Sprintf("RecvFinalAck expected step %d but was %d", size, step)))
+			ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("RecvFinalAck expected step %d but was %d", size, step)))
 			return
 		}
 
@@ -388,20 +494,30 @@ func (t *TrzszTransfer) pipelineSendData(ctx *PipelineContext, size int64, sendD
 		if showProgress {
 			defer close(progressChan)
 		}
+		var throttle *adaptiveThrottle
+		if t.transferConfig.Adaptive {
+			throttle = &adaptiveThrottle{}
+		}
+		limiter := t.newRateLimiter()
+		policy := t.getBufferPolicy()
 		for data := range sendDataChan {
+			t.waitIfPaused(ctx)
+			if ctx.Err() != nil {
+				return
+			}
 			beginTime := time.Now()
 			if err := t.writeAll(data.buffer); err != nil {
 				ctx.cancel(err)
 				return
 			}
 
-			length, step, err := t.pipelineRecvCurrentAck()
+			length, step, _, err := t.pipelineRecvCurrentAck()
 			if err != nil {
 				ctx.cancel(err)
 				return
 			}
 			if length != int64(data.length) {
-				ctx.cancel(newTrzszError(fmt.Sprintf("SendData length check [%d] <> [%d]", length, data.length)))
+				ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("SendData length check [%d] <> [%d]", length, data.length)))
 				return
 			}
 
@@ -414,14 +530,19 @@ func (t *TrzszTransfer) pipelineSendData(ctx *PipelineContext, size int64, sendD
 			}
 
 			chunkTime := time.Now().Sub(beginTime)
-			bufSize := t.bufferSize.Load()
-			if length == bufSize && chunkTime < 500*time.Millisecond && bufSize < t.transferConfig.MaxBufSize {
-				t.bufferSize.Store(minInt64(bufSize*2, t.transferConfig.MaxBufSize))
-			} else if chunkTime >= 2*time.Second && bufSize > 1024 {
-				t.bufferSize.Store(1024)
+			if len(t.transferConfig.ChunkSizes) == 0 {
+				t.bufferSize.Store(policy.nextSize(t.bufferSize.Load(), length, chunkTime))
+			}
+			t.updateMaxChunkTime(chunkTime)
+			if throttle != nil {
+				if sleepContext(ctx, throttle.onChunk(length, chunkTime)) != nil {
+					return
+				}
 			}
-			if chunkTime > t.maxChunkTime {
-				t.maxChunkTime = chunkTime
+			if limiter != nil {
+				if sleepContext(ctx, limiter.onChunk(int64(len(data.buffer)), chunkTime)) != nil {
+					return
+				}
 			}
 			if ctx.Err() != nil {
 				return
@@ -430,6 +551,10 @@ func (t *TrzszTransfer) pipelineSendData(ctx *PipelineContext, size int64, sendD
 		if ctx.Err() != nil {
 			return
 		}
+		if ctx.truncated != "" {
+			ctx.cancel(t.sendTruncated(ctx.truncated))
+			return
+		}
 		t.pipelineRecvFinalAck(ctx, size, progressChan)
 	}()
 	return progressChan
@@ -438,7 +563,7 @@ func (t *TrzszTransfer) pipelineSendData(ctx *PipelineContext, size int64, sendD
 func (t *TrzszTransfer) pipelineShowProgress(ctx *PipelineContext, progress ProgressCallback, progressChan <-chan int64) {
 	go func() {
 		for step := range progressChan {
-			progress.onStep(step)
+			progress.OnStep(step)
 			if ctx.Err() != nil {
 				return
 			}
@@ -446,12 +571,13 @@ func (t *TrzszTransfer) pipelineShowProgress(ctx *PipelineContext, progress Prog
 	}()
 }
 
-func (t *TrzszTransfer) sendFileDataV2(file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
-	c, cancel := context.WithCancelCause(context.Background())
-	ctx := &PipelineContext{c, cancel, make(chan struct{}, 1)}
+func (t *TrzszTransfer) sendFileDataV2(parent context.Context, file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
+	c, cancel := context.WithCancelCause(parent)
+	ctx := &PipelineContext{Context: c, cancel: cancel, succ: make(chan struct{}, 1)}
 	defer ctx.cancel(nil)
 	defer close(ctx.succ)
 
+	t.chunkIndex = 0
 	fileDataChan, md5SourceChan := t.pipelineReadData(ctx, file, size)
 
 	md5DigestChan := t.pipelineCalculateMD5(ctx, md5SourceChan)
@@ -464,7 +590,12 @@ func (t *TrzszTransfer) sendFileDataV2(file *os.File, size int64, progress Progr
 	}
 
 	showProgress := progress != nil && !reflect.ValueOf(progress).IsNil()
-	progressChan := t.pipelineSendData(ctx, size, sendDataChan, showProgress)
+	var progressChan <-chan int64
+	if t.getAckWindow() > 1 {
+		progressChan = t.pipelineSendWindowData(ctx, size, sendDataChan, showProgress)
+	} else {
+		progressChan = t.pipelineSendData(ctx, size, sendDataChan, showProgress)
+	}
 
 	if showProgress {
 		t.pipelineShowProgress(ctx, progress, progressChan)
@@ -484,6 +615,7 @@ func (t *TrzszTransfer) pipelineRecvBase64Data() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	t.lastChunkSize.Store(int64(len(line)))
 
 	idx := bytes.IndexByte(line, ':')
 	if idx < 1 {
@@ -510,7 +642,8 @@ func (t *TrzszTransfer) pipelineRecvBinaryData() ([]byte, error) {
 		return []byte{}, nil
 	}
 
-	return t.buffer.readBinary(int(size), timeout)
+	t.lastChunkSize.Store(size)
+	return t.buffer.readBinary(size, timeout)
 }
 
 func (t *TrzszTransfer) pipelineSendCurrentAck(length int) error {
@@ -528,7 +661,7 @@ func (t *TrzszTransfer) pipelineSendFinalAck(ctx *PipelineContext, size int64, a
 			}
 
 			if step > size {
-				ctx.cancel(newTrzszError(fmt.Sprintf("SendFinalAck expected step %d but was %d", size, step)))
+				ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("SendFinalAck expected step %d but was %d", size, step)))
 				return
 			}
 
@@ -552,6 +685,10 @@ func (t *TrzszTransfer) pipelineRecvData(ctx *PipelineContext, size int64, ackSt
 	go func() {
 		defer close(recvDataChan)
 		t.savedSteps.Store(0)
+		var ack *rangeAck
+		if t.getAckWindow() > 1 {
+			ack = t.newRangeAck()
+		}
 		for ctx.Err() == nil {
 			beginTime := time.Now()
 			var err error
@@ -566,15 +703,18 @@ func (t *TrzszTransfer) pipelineRecvData(ctx *PipelineContext, size int64, ackSt
 				return
 			}
 
-			if err := t.pipelineSendCurrentAck(len(data)); err != nil {
+			if ack != nil {
+				err = t.pipelineSendRangeAck(ack, len(data))
+			} else {
+				err = t.pipelineSendCurrentAck(len(data))
+			}
+			if err != nil {
 				ctx.cancel(err)
 				return
 			}
 
 			chunkTime := time.Now().Sub(beginTime)
-			if chunkTime > t.maxChunkTime {
-				t.maxChunkTime = chunkTime
-			}
+			t.updateMaxChunkTime(chunkTime)
 
 			if len(data) == 0 {
 				break
@@ -599,12 +739,31 @@ func (t *TrzszTransfer) pipelineDecodeData(ctx *PipelineContext, recvDataChan <-
 	go func() {
 		defer close(fileDataChan)
 		defer close(md5SourceChan)
-		z, err := zstd.NewReader(base64.NewDecoder(base64.StdEncoding, NewBase64Reader(ctx, recvDataChan)))
-		if err != nil {
-			ctx.cancel(newTrzszError(fmt.Sprintf("New zstd reader error: %v", err)))
-			return
+		var z io.Reader = base64.NewDecoder(base64.StdEncoding, NewBase64Reader(ctx, recvDataChan))
+		compress := t.pipelineCompress()
+		store := t.transferConfig.NoCompress || compress == "none"
+		if t.transferConfig.ChunkHeader {
+			header := make([]byte, 1)
+			if _, err := io.ReadFull(z, header); err != nil {
+				ctx.cancel(wrapTrzszError(ErrChecksum, err, fmt.Sprintf("Read data header error: %v", err)))
+				return
+			}
+			if header[0] == kChunkStored {
+				store = true
+			} else if header[0] != kChunkCompressed {
+				ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Unknown data chunk header: %d", header[0])))
+				return
+			}
+		}
+		if !store {
+			zr, err := newStreamDecompressor(z, compress)
+			if err != nil {
+				ctx.cancel(wrapTrzszError(ErrChecksum, err, fmt.Sprintf("New %s reader error: %v", compress, err)))
+				return
+			}
+			defer zr.Close()
+			z = zr
 		}
-		defer z.Close()
 		for ctx.Err() == nil {
 			buffer := make([]byte, 4096)
 			n, err := z.Read(buffer)
@@ -624,7 +783,7 @@ func (t *TrzszTransfer) pipelineDecodeData(ctx *PipelineContext, recvDataChan <-
 				break
 			}
 			if err != nil {
-				ctx.cancel(newTrzszError(fmt.Sprintf("Read from zstd error: %v", err)))
+				ctx.cancel(wrapTrzszError(ErrChecksum, err, fmt.Sprintf("Read from %s error: %v", compress, err)))
 				return
 			}
 		}
@@ -635,8 +794,7 @@ func (t *TrzszTransfer) pipelineDecodeData(ctx *PipelineContext, recvDataChan <-
 func (t *TrzszTransfer) pipelineUnescapeData(ctx *PipelineContext, recvDataChan <-chan []byte) (<-chan []byte, <-chan []byte) {
 	fileDataChan := make(chan []byte, 100)
 	md5SourceChan := make(chan []byte, 100)
-	deliver := func(data []byte) bool {
-		buffer := unescapeData(data, t.transferConfig.EscapeCodes)
+	send := func(buffer []byte) bool {
 		select {
 		case fileDataChan <- buffer:
 		case <-ctx.Done():
@@ -649,6 +807,27 @@ func (t *TrzszTransfer) pipelineUnescapeData(ctx *PipelineContext, recvDataChan
 		}
 		return true
 	}
+	var decoder *blockDecoder
+	if t.transferConfig.BinaryCompress {
+		decoder = &blockDecoder{compress: t.transferConfig.Compress}
+	}
+	deliver := func(data []byte) bool {
+		buffer := unescapeData(data, t.transferConfig.EscapeCodes)
+		if decoder == nil {
+			return send(buffer)
+		}
+		blocks, err := decoder.decode(buffer)
+		if err != nil {
+			ctx.cancel(wrapTrzszError(ErrChecksum, err, fmt.Sprintf("Decode data block error: %v", err)))
+			return false
+		}
+		for _, block := range blocks {
+			if !send(block) {
+				return false
+			}
+		}
+		return true
+	}
 	go func() {
 		defer close(fileDataChan)
 		defer close(md5SourceChan)
@@ -690,7 +869,14 @@ func (t *TrzszTransfer) pipelineUnescapeData(ctx *PipelineContext, recvDataChan
 			return
 		}
 		if remainingBuf.Len() > 0 {
-			deliver(remainingBuf.Bytes())
+			if !deliver(remainingBuf.Bytes()) {
+				return
+			}
+		}
+		if decoder != nil {
+			if err := decoder.finish(); err != nil {
+				ctx.cancel(err)
+			}
 		}
 	}()
 	return fileDataChan, md5SourceChan
@@ -708,8 +894,15 @@ func (t *TrzszTransfer) pipelineSaveData(ctx *PipelineContext, file *os.File, si
 		}
 		step := int64(0)
 		for data := range fileDataChan {
-			if _, err := file.Write(data); err != nil {
-				ctx.cancel(newTrzszError(fmt.Sprintf("Write file error: %v", err)))
+			t.waitIfPaused(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err := t.writeFileData(file, data); err != nil {
+				if _, ok := err.(*TrzszError); !ok {
+					err = wrapTrzszError(ErrUnknown, err, fmt.Sprintf("Write file error: %v", err))
+				}
+				ctx.cancel(err)
 				return
 			}
 			step += int64(len(data))
@@ -729,7 +922,7 @@ func (t *TrzszTransfer) pipelineSaveData(ctx *PipelineContext, file *os.File, si
 			return
 		}
 		if step != size {
-			ctx.cancel(newTrzszError(fmt.Sprintf("SaveFile expected step %d but was %d", size, step)))
+			ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("SaveFile expected step %d but was %d", size, step)))
 			return
 		}
 		ackStepChan <- struct{}{}
@@ -737,10 +930,10 @@ func (t *TrzszTransfer) pipelineSaveData(ctx *PipelineContext, file *os.File, si
 	return progressChan
 }
 
-func (t *TrzszTransfer) recvFileDataV2(file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
+func (t *TrzszTransfer) recvFileDataV2(parent context.Context, file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
 	defer file.Close()
-	c, cancel := context.WithCancelCause(context.Background())
-	ctx := &PipelineContext{c, cancel, make(chan struct{}, 1)}
+	c, cancel := context.WithCancelCause(parent)
+	ctx := &PipelineContext{Context: c, cancel: cancel, succ: make(chan struct{}, 1)}
 	defer ctx.cancel(nil)
 	defer close(ctx.succ)
 
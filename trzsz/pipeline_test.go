@@ -31,16 +31,19 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func NewPipelineContext() *PipelineContext {
 	c, cancel := context.WithCancelCause(context.Background())
-	return &PipelineContext{c, cancel, make(chan struct{}, 1)}
+	return &PipelineContext{Context: c, cancel: cancel, succ: make(chan struct{}, 1)}
 }
 
 func assertClosed(t *testing.T, ch any) {
@@ -276,11 +279,11 @@ func TestPipelineReadData(t *testing.T) {
 	f2, err := os.Open(file.Name())
 	assert.Nil(err)
 	defer f2.Close()
-	transfer.pipelineReadData(ctx, f2, 4096*2+300)
+	transfer.pipelineReadData(ctx, f2, 4096*2-100)
 	select {
 	case <-ctx.Done():
 		assert.ErrorIs(ctx.Err(), context.Canceled)
-		assert.EqualError(context.Cause(ctx), "File size 8492 but read 8292")
+		assert.EqualError(context.Cause(ctx), "File size 8092 but read 8292")
 	case <-time.After(time.Second):
 		assert.Fail("Context timeout")
 	}
@@ -292,6 +295,18 @@ func TestPipelineReadData(t *testing.T) {
 	fileDataChan, md5SourceChan = transfer.pipelineReadData(ctx, f2, 4096*2+100)
 	assertClosed(t, fileDataChan)
 	assertClosed(t, md5SourceChan)
+
+	// truncated, the sender tells the peer after the data in flight
+	ctx = NewPipelineContext()
+	f4, err := os.Open(file.Name())
+	assert.Nil(err)
+	defer f4.Close()
+	fileDataChan, md5SourceChan = transfer.pipelineReadData(ctx, f4, 4096*2+300)
+	for range fileDataChan {
+	}
+	assertClosed(t, md5SourceChan)
+	assert.Nil(ctx.Err())
+	assert.Equal(file.Name(), ctx.truncated)
 }
 
 func TestPipelineEncodeAndDecode(t *testing.T) {
@@ -456,3 +471,42 @@ func TestPipelineUnescapeData(t *testing.T) {
 	assertChannel(t, []byte("\xee\xee"), fileDataChan)
 	assertChannel(t, []byte("\xee\xee"), md5SourceChan)
 }
+
+func TestPipelineRefusedLogged(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "world")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	for _, tc := range []struct {
+		name  string
+		setup func(args *Args)
+	}{
+		{"--retries", func(args *Args) { args.ChunkRetries = 2 }},
+		{"--check-every", func(args *Args) { args.CheckEvery = BufferSize{1024} }},
+	} {
+		args := newDefaultArgsForTest()
+		tc.setup(args)
+		clientLogger := &recordLogger{}
+		client := NewTransfer(nil, nil, false, WithLogger(clientLogger))
+		server := NewTransfer(nil, nil, false)
+		client.writer = &loopbackWriter{peer: server}
+		server.writer = &loopbackWriter{peer: client}
+		handshakeForTest(t, client, server, args, 3)
+		result := runTransferForTest(client, server, files, t.TempDir())
+		assert.Nil(result.sendErr, tc.name)
+		assert.Nil(result.recvErr, tc.name)
+
+		// the data is sent one chunk at a time instead of the pipeline, and it's logged only once
+		var refused []string
+		for _, line := range clientLogger.lines {
+			if strings.Contains(line, "pipeline") {
+				refused = append(refused, line)
+			}
+		}
+		assert.Equal([]string{"WARN send the data one chunk at a time, as the pipeline of protocol 2 is not with " + tc.name},
+			refused)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// TransferFileMeta is an incoming file, directory or link to be inspected before receiving it.
+// The Name is the path relative to the destination as sent, with slashes, before any renaming.
+// The Size is -1 for the directories and links, and for a stream of unknown size.
+type TransferFileMeta struct {
+	Name  string
+	Size  int64
+	IsDir bool
+}
+
+// PreReceiveHook is called once an incoming entry is known, before anything of it is written,
+// with all the entries of the batch so far, the last one being the new entry, so that both the
+// names and the total size can be checked. Returning an error rejects the transfer, and the error
+// message is sent to the sender. The regular files are checked once the size is received.
+type PreReceiveHook func(files []TransferFileMeta) error
+
+// WithPreReceiveHook sets the hook of the receiver to reject the transfer by a policy, e.g., in a gateway.
+func WithPreReceiveHook(hook PreReceiveHook) TransferOption {
+	return func(t *TrzszTransfer) {
+		t.preReceiveHook = hook
+	}
+}
+
+// newFileMeta returns the meta of the received name, which is the json of the entry in directory mode.
+// It returns whether data follows, i.e., the size is checked later for the regular files.
+func (t *TrzszTransfer) newFileMeta(name string) (TransferFileMeta, bool, error) {
+	if !t.transferConfig.Directory {
+		return TransferFileMeta{Name: name, Size: -1}, true, nil
+	}
+	var f TrzszFile
+	if err := json.Unmarshal([]byte(name), &f); err != nil {
+		return TransferFileMeta{}, false, err
+	}
+	meta := TransferFileMeta{Name: strings.Join(f.RelPath, "/"), Size: -1, IsDir: f.IsDir}
+	return meta, f.hasData(), nil
+}
+
+// checkPreReceive calls the hook with the new entry appended to the entries of the batch.
+func (t *TrzszTransfer) checkPreReceive(meta TransferFileMeta) error {
+	if t.preReceiveHook == nil {
+		return nil
+	}
+	t.incomingFiles = append(t.incomingFiles, meta)
+	if err := t.preReceiveHook(t.incomingFiles); err != nil {
+		t.preRejected = true
+		return newTrzszError(fmt.Sprintf("Rejected %s: %v", meta.Name, err))
+	}
+	return nil
+}
+
+// checkPreReceiveName checks the directories and links by the received name, before they are created.
+// The regular files are kept to be checked with the size.
+func (t *TrzszTransfer) checkPreReceiveName(name string) error {
+	t.incomingFile = nil
+	if t.preReceiveHook == nil {
+		return nil
+	}
+	meta, hasData, err := t.newFileMeta(name)
+	if err != nil {
+		return err
+	}
+	if hasData {
+		t.incomingFile = &meta
+		return nil
+	}
+	return t.checkPreReceive(meta)
+}
+
+// checkPreReceiveSize checks the regular file kept by checkPreReceiveName with the received size.
+func (t *TrzszTransfer) checkPreReceiveSize(size int64) error {
+	if t.incomingFile == nil {
+		return nil
+	}
+	meta := *t.incomingFile
+	t.incomingFile = nil
+	meta.Size = size
+	return t.checkPreReceive(meta)
+}
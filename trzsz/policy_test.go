@@ -0,0 +1,141 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreReceiveHookNames(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "b.txt"), "trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	for _, tc := range []struct {
+		protocol int
+		parallel int
+		tar      bool
+	}{{2, 1, false}, {kProtocolVersion, 2, false}, {kProtocolVersion, 1, true}} {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Parallel = tc.parallel
+		args.Tar = tc.tar
+		var metas []TransferFileMeta
+		client, server := newLoopbackTransfers()
+		WithPreReceiveHook(func(files []TransferFileMeta) error {
+			metas = append([]TransferFileMeta(nil), files...)
+			return nil
+		})(server)
+		handshakeForTest(t, client, server, args, tc.protocol)
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assertFileContent(t, filepath.Join(dest, "dir", "sub", "b.txt"), "trzsz")
+
+		assert.ElementsMatch([]TransferFileMeta{
+			{Name: "dir", Size: -1, IsDir: true},
+			{Name: "dir/a.txt", Size: 5},
+			{Name: "dir/sub", Size: -1, IsDir: true},
+			{Name: "dir/sub/b.txt", Size: 5},
+		}, metas, "protocol %d parallel %d tar %v", tc.protocol, tc.parallel, tc.tar)
+	}
+}
+
+func TestPreReceiveHookReject(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "virus.exe"), "MZ")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+	rejectExe := func(files []TransferFileMeta) error {
+		if strings.HasSuffix(files[len(files)-1].Name, ".exe") {
+			return errors.New("executable not allowed")
+		}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		protocol int
+		parallel int
+		tar      bool
+	}{{2, 1, false}, {kProtocolVersion, 2, false}, {kProtocolVersion, 1, true}} {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Parallel = tc.parallel
+		args.Tar = tc.tar
+		client, server := newLoopbackTransfers()
+		WithPreReceiveHook(rejectExe)(server)
+		handshakeForTest(t, client, server, args, tc.protocol)
+		result := runTransferForTest(client, server, files, dest)
+		require.NotNil(t, result.recvErr)
+		assert.Equal("Rejected dir/virus.exe: executable not allowed", result.recvErr.Error())
+		require.NotNil(t, result.sendErr)
+		assert.Contains(result.sendErr.Error(), "Rejected dir/virus.exe: executable not allowed")
+		_, err := os.Stat(filepath.Join(dest, "dir", "virus.exe"))
+		assert.True(os.IsNotExist(err), "protocol %d parallel %d tar %v", tc.protocol, tc.parallel, tc.tar)
+	}
+}
+
+func TestPreReceiveHookTotalSize(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("a", 100))
+	writeTestFile(t, filepath.Join(src, "b.txt"), strings.Repeat("b", 100))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	// the entries of the batch so far are passed to check the total size
+	dest := t.TempDir()
+	client, server := newLoopbackTransfers()
+	WithPreReceiveHook(func(files []TransferFileMeta) error {
+		var total int64
+		for _, f := range files {
+			total += f.Size
+		}
+		if total > 150 {
+			return errors.New("total size exceeds 150 bytes")
+		}
+		return nil
+	})(server)
+	handshakeForTest(t, client, server, newDefaultArgsForTest(), 2)
+	result := runTransferForTest(client, server, files, dest)
+	require.NotNil(t, result.recvErr)
+	assert.Equal("Rejected b.txt: total size exceeds 150 bytes", result.recvErr.Error())
+	assertFileContent(t, filepath.Join(dest, "a.txt"), strings.Repeat("a", 100))
+	_, err = os.Stat(filepath.Join(dest, "b.txt"))
+	assert.True(os.IsNotExist(err))
+}
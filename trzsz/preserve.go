@@ -0,0 +1,185 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// fileAttrs are the attributes of a file or directory to be preserved, sent after the name.
+// The owner is absent if the sender is on Windows, and the extended attributes are only sent with `--xattrs`.
+type fileAttrs struct {
+	ModTime int64             `json:"mtime"`
+	Mode    uint32            `json:"mode"`
+	Owner   *fileOwner        `json:"owner,omitempty"`
+	Xattrs  map[string][]byte `json:"xattrs,omitempty"`
+}
+
+type fileOwner struct {
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+}
+
+const (
+	kUnixModeSetuid = 04000
+	kUnixModeSetgid = 02000
+	kUnixModeSticky = 01000
+)
+
+// toUnixMode converts the permissions and the setuid, setgid and sticky bits to the unix style,
+// so the peers which only know the permissions are not affected.
+func toUnixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= kUnixModeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= kUnixModeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= kUnixModeSticky
+	}
+	return m
+}
+
+func fromUnixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m).Perm()
+	if m&kUnixModeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&kUnixModeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&kUnixModeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+type dirAttrs struct {
+	path  string
+	attrs *fileAttrs
+}
+
+// newFileAttrs reads the extended attributes of the file on demand, the links are skipped,
+// so are the streams without a path.
+func (t *TrzszTransfer) newFileAttrs(f *TrzszFile) (*fileAttrs, error) {
+	attrs := &fileAttrs{ModTime: f.ModTime, Mode: f.Mode, Owner: f.Owner}
+	if t.transferConfig.Xattrs && !f.IsLink && f.AbsPath != "" {
+		xattrs, err := getFileXattrs(f.AbsPath)
+		if err != nil {
+			return nil, newTrzszError(fmt.Sprintf("Read xattrs [%s] error: %v", f.AbsPath, err))
+		}
+		attrs.Xattrs = xattrs
+	}
+	return attrs, nil
+}
+
+func (t *TrzszTransfer) sendFileAttrs(f *TrzszFile) error {
+	fa, err := t.newFileAttrs(f)
+	if err != nil {
+		return err
+	}
+	attrs, err := json.Marshal(fa)
+	if err != nil {
+		return err
+	}
+	if err := t.sendString("ATTR", string(attrs)); err != nil {
+		return err
+	}
+	return t.checkString(string(attrs))
+}
+
+func (t *TrzszTransfer) recvFileAttrs() (*fileAttrs, error) {
+	attrsStr, err := t.recvString("ATTR", false)
+	if err != nil {
+		return nil, err
+	}
+	var attrs fileAttrs
+	if err := json.Unmarshal([]byte(attrsStr), &attrs); err != nil {
+		return nil, err
+	}
+	if err := t.sendString("SUCC", attrsStr); err != nil {
+		return nil, err
+	}
+	return &attrs, nil
+}
+
+// applyFileAttrs should be called after the file is closed, or all the children of the directory are written.
+// The owner is ignored on Windows, and the permissions are mapped to the read-only attribute of the file,
+// which is set last, after the modification time. The owner is changed first, which clears the setuid bits.
+// The owner and the setuid and setgid bits are only applied if the receiver enables -p itself,
+// as the preserve mode may be negotiated by the peer. The extended attributes are set before the permissions,
+// which may make the file read-only, and they are skipped if the filesystem doesn't support them.
+func (t *TrzszTransfer) applyFileAttrs(path string, attrs *fileAttrs) error {
+	if attrs == nil {
+		return nil
+	}
+	if attrs.Owner != nil && t.preserveOwner {
+		if err := chownFile(path, attrs.Owner); err != nil {
+			return err
+		}
+	}
+	if len(attrs.Xattrs) > 0 {
+		if err := setFileXattrs(path, attrs.Xattrs); err != nil {
+			return err
+		}
+	}
+	if attrs.Mode != 0 && !IsWindows() {
+		mode := fromUnixMode(attrs.Mode)
+		if !t.preserveOwner {
+			mode &^= os.ModeSetuid | os.ModeSetgid
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if attrs.ModTime != 0 {
+		mtime := time.Unix(attrs.ModTime, 0)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	if attrs.Mode != 0 && IsWindows() {
+		if err := setReadOnly(path, attrs.Mode&0200 == 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDirAttrs applies the attributes of the directories in reverse order, so the children go first.
+func (t *TrzszTransfer) applyDirAttrs() error {
+	for i := len(t.dirAttrs) - 1; i >= 0; i-- {
+		if err := t.applyFileAttrs(t.dirAttrs[i].path, t.dirAttrs[i].attrs); err != nil {
+			return err
+		}
+	}
+	t.dirAttrs = nil
+	return nil
+}
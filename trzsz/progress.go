@@ -25,10 +25,14 @@ SOFTWARE.
 package trzsz
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
@@ -72,33 +76,37 @@ func getEllipsisString(str string, max int) (string, int) {
 	return b.String(), length + 3
 }
 
-func convertSizeToString(size float64) string {
-	unit := "B"
-	for {
-		if size < 1024 {
-			break
-		}
-		size = size / 1024
-		unit = "KB"
+// SizeUnit is the unit base of the sizes and speeds shown in the progress bar.
+type SizeUnit int
 
-		if size < 1024 {
-			break
-		}
-		size = size / 1024
-		unit = "MB"
+const (
+	// SizeUnitDefault is 1024-based with the KB/MB names.
+	SizeUnitDefault SizeUnit = iota
+	// SizeUnitBinary is 1024-based with the KiB/MiB names.
+	SizeUnitBinary
+	// SizeUnitDecimal is 1000-based with the KB/MB names.
+	SizeUnitDecimal
+)
 
-		if size < 1024 {
-			break
-		}
-		size = size / 1024
-		unit = "GB"
+func convertSizeToString(size float64) string {
+	return convertSizeToUnitString(size, SizeUnitDefault)
+}
 
-		if size < 1024 {
+func convertSizeToUnitString(size float64, sizeUnit SizeUnit) string {
+	base := 1024.0
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	if sizeUnit == SizeUnitBinary {
+		units = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	} else if sizeUnit == SizeUnitDecimal {
+		base = 1000.0
+	}
+	unit := units[0]
+	for _, u := range units[1:] {
+		if size < base {
 			break
 		}
-		size = size / 1024
-		unit = "TB"
-		break
+		size = size / base
+		unit = u
 	}
 
 	if size >= 100 {
@@ -137,7 +145,94 @@ func convertTimeToString(seconds float64) string {
 
 const kSpeedArraySize = 30
 
+// speedCounter computes the speed of the recent steps, shared by the text and the json progress.
+// The speed is the average of a sliding window of the steps, or the exponential moving average if alpha is set.
+type speedCounter struct {
+	speedCnt  int
+	speedIdx  int
+	timeArray [kSpeedArraySize]*time.Time
+	stepArray [kSpeedArraySize]int64
+	alpha     float64
+	avgSpeed  float64
+	lastTime  *time.Time
+	lastStep  int64
+}
+
+func (s *speedCounter) resetSpeed(startTime *time.Time) {
+	s.timeArray[0] = startTime
+	s.stepArray[0] = 0
+	s.speedCnt = 1
+	s.speedIdx = 1
+	s.avgSpeed = -1
+	s.lastTime = startTime
+	s.lastStep = 0
+}
+
+func (s *speedCounter) getSpeed(now *time.Time, step int64) float64 {
+	if s.alpha > 0 {
+		return s.getAverageSpeed(now, step)
+	}
+	var speed float64
+	if s.speedCnt <= kSpeedArraySize {
+		s.speedCnt++
+		speed = float64(step-s.stepArray[0]) / (float64(now.Sub(*s.timeArray[0])) / float64(time.Second))
+	} else {
+		speed = float64(step-s.stepArray[s.speedIdx]) / (float64(now.Sub(*s.timeArray[s.speedIdx])) / float64(time.Second))
+	}
+
+	s.timeArray[s.speedIdx] = now
+	s.stepArray[s.speedIdx] = step
+
+	s.speedIdx++
+	if s.speedIdx >= kSpeedArraySize {
+		s.speedIdx %= kSpeedArraySize
+	}
+
+	if math.IsNaN(speed) {
+		return -1
+	}
+	return speed
+}
+
+// getAverageSpeed weights the speed since the last step by alpha, so a burst changes the speed gradually.
+func (s *speedCounter) getAverageSpeed(now *time.Time, step int64) float64 {
+	elapsed := float64(now.Sub(*s.lastTime)) / float64(time.Second)
+	if elapsed <= 0 {
+		return s.avgSpeed
+	}
+	speed := float64(step-s.lastStep) / elapsed
+	s.lastTime = now
+	s.lastStep = step
+	if s.avgSpeed < 0 {
+		s.avgSpeed = speed
+	} else {
+		s.avgSpeed = s.alpha*speed + (1-s.alpha)*s.avgSpeed
+	}
+	return s.avgSpeed
+}
+
+// ProgressMode is what the text progress bar counts, the bytes of the current file, or the files of the batch.
+type ProgressMode int
+
+const (
+	// ProgressModeAuto counts the files if there are many tiny files, otherwise the bytes.
+	ProgressModeAuto ProgressMode = iota
+	// ProgressModeBytes counts the bytes of the current file.
+	ProgressModeBytes
+	// ProgressModeFiles counts the files done, and shows the total bytes and speed of the batch.
+	ProgressModeFiles
+)
+
+const (
+	kFilesProgressMinCount = 100
+	kFilesProgressMaxSize  = 64 * 1024
+)
+
+// kDefaultColumns is the width of the progress bar if the columns of the terminal are unknown.
+const kDefaultColumns = 80
+
 type TextProgressBar struct {
+	speedCounter
 	writer          io.Writer
 	columns         int
 	tmuxPaneColumns int
@@ -146,52 +241,192 @@ type TextProgressBar struct {
 	fileName        string
 	fileSize        int64
 	fileStep        int64
+	fileSkipped     bool
+	fileFailed      bool
+	fileUnchanged   bool
+	fileStarted     bool
 	startTime       *time.Time
 	lastUpdateTime  *time.Time
+	refreshInterval time.Duration
+	asciiBar        bool
+	barColor        string
+	sizeUnit        SizeUnit
 	firstWrite      bool
-	speedCnt        int
-	speedIdx        int
-	timeArray       [kSpeedArraySize]*time.Time
-	stepArray       [kSpeedArraySize]int64
+	resizeColumns   atomic.Int32
+	progressMode    ProgressMode
+	batchSpeed      speedCounter
+	batchStartTime  *time.Time
+	doneCount       int
+	doneBytes       int64
+}
+
+// ProgressTheme is the colors of the text progress bar, as the SGR parameters, e.g. "36" for cyan.
+type ProgressTheme struct {
+	Bar string
 }
 
 func NewTextProgressBar(writer io.Writer, columns int, tmuxPaneColumns int) *TextProgressBar {
 	if tmuxPaneColumns > 1 {
 		columns = tmuxPaneColumns - 1 //  -1 to avoid messing up the tmux pane
+	} else if columns <= 0 {
+		columns = kDefaultColumns // no tty to get the columns, e.g., a plain pipe
 	}
 	return &TextProgressBar{
 		writer:          writer,
 		columns:         columns,
 		tmuxPaneColumns: tmuxPaneColumns,
+		refreshInterval: 200 * time.Millisecond,
+		barColor:        "36",
 		firstWrite:      true}
 }
 
+// SetRefreshInterval sets the minimum interval between the redraws, 0 means redrawing on every step.
+// The speed and ETA are calculated by the elapsed time, no matter how often the progress bar is redrawn.
+func (p *TextProgressBar) SetRefreshInterval(interval time.Duration) {
+	p.refreshInterval = interval
+}
+
+// SetASCII draws the progress bar with `#` and `-`, for the terminals can't render the block characters.
+func (p *TextProgressBar) SetASCII(ascii bool) {
+	p.asciiBar = ascii
+}
+
+// SetNoColor omits all the color codes, for the output redirected to files.
+func (p *TextProgressBar) SetNoColor(noColor bool) {
+	if noColor {
+		p.barColor = ""
+	}
+}
+
+// SetTheme sets the colors of the progress bar, the empty color means no color.
+func (p *TextProgressBar) SetTheme(theme ProgressTheme) {
+	p.barColor = theme.Bar
+}
+
+// SetSizeUnit sets the unit base of the size and speed, the default is 1024-based with the KB/MB names.
+func (p *TextProgressBar) SetSizeUnit(sizeUnit SizeUnit) {
+	p.sizeUnit = sizeUnit
+}
+
+// SetProgressMode sets what the progress bar counts, the default is `ProgressModeAuto`.
+func (p *TextProgressBar) SetProgressMode(mode ProgressMode) {
+	p.progressMode = mode
+}
+
+// isFilesMode tells whether to count the files. In auto mode, it's decided by the average size of the files
+// done so far, so a batch of many tiny files switches to count the files after the first one.
+func (p *TextProgressBar) isFilesMode() bool {
+	switch p.progressMode {
+	case ProgressModeFiles:
+		return true
+	case ProgressModeBytes:
+		return false
+	}
+	return p.fileCount >= kFilesProgressMinCount && p.doneCount > 0 && p.doneBytes/int64(p.doneCount) < kFilesProgressMaxSize
+}
+
+// SetSpeedSmoothing calculates the speed and ETA by the exponential moving average with the alpha in (0, 1],
+// instead of the sliding window of the recent steps. A smaller alpha is smoother on bursty links, and the
+// alpha out of the range restores the sliding window, which is the default.
+func (p *TextProgressBar) SetSpeedSmoothing(alpha float64) {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0
+	}
+	p.alpha = alpha
+	p.batchSpeed.alpha = alpha
+}
+
+// setTerminalColumns is called on resizing the terminal, maybe in another goroutine, so the new columns
+// take effect on the next redraw, which clears the stale line first.
 func (p *TextProgressBar) setTerminalColumns(columns int) {
+	if columns > 0 {
+		p.resizeColumns.Store(int32(columns))
+	}
+}
+
+func (p *TextProgressBar) applyResize() bool {
+	columns := int(p.resizeColumns.Swap(0))
+	if columns <= 0 {
+		return false
+	}
 	p.columns = columns
 	// resizing tmux panes is not supported
 	if p.tmuxPaneColumns > 0 {
 		p.tmuxPaneColumns = 0
 	}
+	return true
+}
+
+// OnNum implements ProgressCallback.
+func (p *TextProgressBar) OnNum(num int64) {
+	p.onNum(num)
 }
 
 func (p *TextProgressBar) onNum(num int64) {
 	p.fileCount = int(num)
 }
 
+// OnName implements ProgressCallback.
+func (p *TextProgressBar) OnName(name string) {
+	p.onName(name)
+}
+
 func (p *TextProgressBar) onName(name string) {
 	p.fileName = name
 	p.fileIdx++
 	now := timeNowFunc()
 	p.startTime = &now
-	p.timeArray[0] = p.startTime
-	p.stepArray[0] = 0
-	p.speedCnt = 1
-	p.speedIdx = 1
+	p.resetSpeed(p.startTime)
+	if p.batchStartTime == nil {
+		p.batchStartTime = &now
+		p.batchSpeed.resetSpeed(p.batchStartTime)
+	}
 	p.fileStep = -1
+	p.fileSkipped = false
+	p.fileFailed = false
+	p.fileUnchanged = false
+}
+
+// OnSkip marks the current file as skipped, its data is received but discarded.
+func (p *TextProgressBar) OnSkip() {
+	p.fileSkipped = true
+}
+
+// OnUnchanged shows the file kept as is in checksum mode, instead of 100%.
+func (p *TextProgressBar) OnUnchanged() {
+	p.fileUnchanged = true
+	p.fileStep = 0
+	p.lastUpdateTime = nil
+	p.showProgress()
+}
+
+// OnError shows the failed file in keep-going mode, and the transfer goes on with the next file.
+// The file fails before its name is shown, or after its size if it fails to be written or finished.
+func (p *TextProgressBar) OnError(name string, err error) {
+	if !p.fileStarted {
+		p.OnName(name)
+	}
+	p.fileFailed = true
+	p.fileSize = 0
+	p.fileStep = 0
+	p.lastUpdateTime = nil
+	p.showProgress()
+	p.OnDone()
+}
+
+// OnSize implements ProgressCallback.
+func (p *TextProgressBar) OnSize(size int64) {
+	p.onSize(size)
 }
 
 func (p *TextProgressBar) onSize(size int64) {
 	p.fileSize = size
+	p.fileStarted = true
+}
+
+// OnStep implements ProgressCallback.
+func (p *TextProgressBar) OnStep(step int64) {
+	p.onStep(step)
 }
 
 func (p *TextProgressBar) onStep(step int64) {
@@ -202,7 +437,22 @@ func (p *TextProgressBar) onStep(step int64) {
 	p.showProgress()
 }
 
+// OnDone implements ProgressCallback.
+func (p *TextProgressBar) OnDone() {
+	p.onDone()
+}
+
 func (p *TextProgressBar) onDone() {
+	p.fileStarted = false
+	p.doneCount++
+	if p.fileStep > 0 {
+		p.doneBytes += p.fileStep
+	}
+	// the last redraw may be skipped by the refresh interval, show all the files are done
+	if p.doneCount == p.fileCount && p.isFilesMode() {
+		p.lastUpdateTime = nil
+		p.showProgress()
+	}
 	if !p.firstWrite {
 		if p.tmuxPaneColumns > 0 {
 			writeAll(p.writer, []byte(fmt.Sprintf("\x1b[%dD", p.columns)))
@@ -214,25 +464,19 @@ func (p *TextProgressBar) onDone() {
 }
 
 func (p *TextProgressBar) showProgress() {
+	resized := p.applyResize()
 	now := timeNowFunc()
-	if p.lastUpdateTime != nil && now.Sub(*p.lastUpdateTime) < 200*time.Millisecond {
+	if !resized && p.lastUpdateTime != nil && now.Sub(*p.lastUpdateTime) < p.refreshInterval {
 		return
 	}
 	p.lastUpdateTime = &now
 
-	percentage := "100%"
-	if p.fileSize != 0 {
-		percentage = fmt.Sprintf("%.0f%%", math.Round(float64(p.fileStep)*100.0/float64(p.fileSize)))
-	}
-	total := convertSizeToString(float64(p.fileStep))
-	speed := p.getSpeed(&now)
-	speedStr := "--- B/s"
-	etaStr := "--- ETA"
-	if speed > 0 {
-		speedStr = fmt.Sprintf("%s/s", convertSizeToString(speed))
-		etaStr = fmt.Sprintf("%s ETA", convertTimeToString(math.Round(float64(p.fileSize-p.fileStep)/speed)))
+	var progressText string
+	if p.isFilesMode() {
+		progressText = p.getFilesProgressText(&now)
+	} else {
+		progressText = p.getBytesProgressText(&now)
 	}
-	progressText := p.getProgressText(percentage, total, speedStr, etaStr)
 
 	if p.firstWrite {
 		p.firstWrite = false
@@ -240,34 +484,71 @@ func (p *TextProgressBar) showProgress() {
 		return
 	}
 
-	if p.tmuxPaneColumns > 0 {
+	if resized {
+		// the stale line may be wrapped or truncated by the terminal, clear it to the end of the screen
+		writeAll(p.writer, []byte(fmt.Sprintf("\r\x1b[0J%s", progressText)))
+	} else if p.tmuxPaneColumns > 0 {
 		writeAll(p.writer, []byte(fmt.Sprintf("\x1b[%dD%s", p.columns, progressText)))
 	} else {
 		writeAll(p.writer, []byte(fmt.Sprintf("\r%s", progressText)))
 	}
 }
 
-func (p *TextProgressBar) getSpeed(now *time.Time) float64 {
-	var speed float64
-	if p.speedCnt <= kSpeedArraySize {
-		p.speedCnt++
-		speed = float64(p.fileStep-p.stepArray[0]) / (float64(now.Sub(*p.timeArray[0])) / float64(time.Second))
-	} else {
-		speed = float64(p.fileStep-p.stepArray[p.speedIdx]) / (float64(now.Sub(*p.timeArray[p.speedIdx])) / float64(time.Second))
+func (p *TextProgressBar) getBytesProgressText(now *time.Time) string {
+	percentage := "100%"
+	if p.fileUnchanged {
+		percentage = "Unchanged"
+	} else if p.fileSize < 0 {
+		percentage = "---"
+	} else if p.fileSize != 0 {
+		percentage = fmt.Sprintf("%.0f%%", math.Round(float64(p.fileStep)*100.0/float64(p.fileSize)))
+	}
+	total := convertSizeToUnitString(float64(p.fileStep), p.sizeUnit)
+	speed := p.getSpeed(now, p.fileStep)
+	speedStr := "--- B/s"
+	etaStr := "--- ETA"
+	if speed > 0 {
+		speedStr = fmt.Sprintf("%s/s", convertSizeToUnitString(speed, p.sizeUnit))
+		if p.fileSize >= 0 {
+			etaStr = fmt.Sprintf("%s ETA", convertTimeToString(math.Round(float64(p.fileSize-p.fileStep)/speed)))
+		}
+	}
+	if p.fileSkipped {
+		etaStr = "Skipped"
 	}
+	if p.fileFailed {
+		etaStr = "Failed"
+	}
+	return p.getProgressText(percentage, total, speedStr, etaStr)
+}
 
-	p.timeArray[p.speedIdx] = now
-	p.stepArray[p.speedIdx] = p.fileStep
+// getFilesProgressText shows the files done of the batch, e.g., "(3421/10000) files [bar] 45 MB, 12 MB/s".
+// The bar is the percentage of the files done, and the size and speed are of the total bytes of the batch.
+// On a narrow terminal, the bar is omitted first, e.g., "(3421/10000) files, 45 MB, 12 MB/s".
+func (p *TextProgressBar) getFilesProgressText(now *time.Time) string {
+	const barMinLength = 24
 
-	p.speedIdx++
-	if p.speedIdx >= kSpeedArraySize {
-		p.speedIdx %= kSpeedArraySize
+	bytes := p.doneBytes
+	if p.fileStep > 0 && p.doneCount < p.fileIdx {
+		bytes += p.fileStep
+	}
+	left := fmt.Sprintf("(%d/%d) files", p.fileIdx, p.fileCount)
+	total := convertSizeToUnitString(float64(bytes), p.sizeUnit)
+	speedStr := "--- B/s"
+	if speed := p.batchSpeed.getSpeed(now, bytes); speed > 0 {
+		speedStr = fmt.Sprintf("%s/s", convertSizeToUnitString(speed, p.sizeUnit))
 	}
+	right := fmt.Sprintf(" %s, %s", total, speedStr)
 
-	if math.IsNaN(speed) {
-		return -1
+	if barLength := p.columns - len(left) - len(right) - 1; barLength >= barMinLength {
+		return left + " " + p.getProgressBar(barLength, int64(p.doneCount), int64(p.fileCount)) + right
 	}
-	return speed
+	for _, text := range []string{left + "," + right, fmt.Sprintf("%s, %s", left, total)} {
+		if len(text) <= p.columns {
+			return text
+		}
+	}
+	return left
 }
 
 func (p *TextProgressBar) getProgressText(percentage, total, speed, eta string) string {
@@ -338,17 +619,444 @@ func (p *TextProgressBar) getProgressText(percentage, total, speed, eta string)
 		left += " "
 	}
 
-	return strings.TrimSpace(left + p.getProgressBar(barLength) + right)
+	return strings.TrimSpace(left + p.getProgressBar(barLength, p.fileStep, p.fileSize) + right)
 }
 
-func (p *TextProgressBar) getProgressBar(length int) string {
+func (p *TextProgressBar) getProgressBar(length int, step, size int64) string {
 	if length < 12 {
 		return ""
 	}
 	total := length - 2
 	complete := total
-	if p.fileSize != 0 {
-		complete = int(math.Round((float64(total) * float64(p.fileStep)) / float64(p.fileSize)))
+	if size < 0 {
+		complete = 0 // the size of the stream is unknown
+	} else if size != 0 {
+		complete = int(math.Round((float64(total) * float64(step)) / float64(size)))
+	}
+	bar := strings.Repeat("\u2588", complete) + strings.Repeat("\u2591", total-complete)
+	if p.asciiBar {
+		bar = strings.Repeat("#", complete) + strings.Repeat("-", total-complete)
+	}
+	if p.barColor == "" {
+		return "[" + bar + "]"
+	}
+	return "[\u001b[" + p.barColor + "m" + bar + "\u001b[0m]"
+}
+
+// JSONProgress writes the progress as json lines, for the programs wrapping trzsz to parse.
+// The speed is in bytes per second, and the eta is in seconds. They are -1 if unknown.
+type JSONProgress struct {
+	speedCounter
+	writer         io.Writer
+	fileCount      int
+	fileIdx        int
+	fileName       string
+	fileSize       int64
+	fileStep       int64
+	fileSkipped    bool
+	fileUnchanged  bool
+	fileStarted    bool
+	lastUpdateTime *time.Time
+}
+
+type jsonProgressLine struct {
+	Event     string `json:"event"`
+	File      string `json:"file"`
+	Index     int    `json:"index"`
+	Total     int    `json:"total"`
+	Bytes     int64  `json:"bytes"`
+	Size      int64  `json:"size"`
+	Speed     int64  `json:"speed"`
+	Eta       int64  `json:"eta"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	Unchanged bool   `json:"unchanged,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Algo      string `json:"algo,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+func NewJSONProgress(writer io.Writer) *JSONProgress {
+	return &JSONProgress{writer: writer}
+}
+
+func (p *JSONProgress) OnNum(num int64) {
+	p.fileCount = int(num)
+}
+
+func (p *JSONProgress) OnName(name string) {
+	p.fileName = name
+	p.fileIdx++
+	now := timeNowFunc()
+	p.resetSpeed(&now)
+	p.fileSize = 0
+	p.fileStep = 0
+	p.fileSkipped = false
+	p.fileUnchanged = false
+	p.lastUpdateTime = nil
+	p.writeLine("name", -1)
+}
+
+func (p *JSONProgress) OnSize(size int64) {
+	p.fileSize = size
+	p.fileStarted = true
+}
+
+func (p *JSONProgress) OnStep(step int64) {
+	if step <= p.fileStep {
+		return
+	}
+	p.fileStep = step
+	now := timeNowFunc()
+	if p.lastUpdateTime != nil && now.Sub(*p.lastUpdateTime) < 200*time.Millisecond {
+		return
+	}
+	p.lastUpdateTime = &now
+	p.writeLine("step", p.getSpeed(&now, p.fileStep))
+}
+
+func (p *JSONProgress) OnDone() {
+	p.fileStarted = false
+	if !p.fileUnchanged {
+		p.fileStep = p.fileSize
+	}
+	p.writeLine("done", -1)
+}
+
+func (p *JSONProgress) OnSkip() {
+	p.fileSkipped = true
+}
+
+func (p *JSONProgress) OnUnchanged() {
+	p.fileUnchanged = true
+}
+
+// OnError writes the failed file, which fails before its name, or after its size if it fails to be written or finished.
+func (p *JSONProgress) OnError(name string, err error) {
+	if !p.fileStarted {
+		p.fileName = name
+		p.fileIdx++
+		p.fileSize = 0
+		p.fileStep = 0
+		p.fileSkipped = false
+	}
+	p.fileStarted = false
+	p.writeError(err)
+}
+
+func (p *JSONProgress) OnFileDone(localName string, size int64) {
+	line := p.newLine("file_done", -1)
+	line.Path = localName
+	line.Bytes = size
+	line.Size = size
+	p.writeJSON(line)
+}
+
+func (p *JSONProgress) OnFileHash(localName string, algo string, digest []byte) {
+	line := p.newLine("file_hash", -1)
+	line.Path = localName
+	line.Algo = algo
+	line.Digest = hex.EncodeToString(digest)
+	p.writeJSON(line)
+}
+
+func (p *JSONProgress) writeLine(event string, speed float64) {
+	p.writeJSON(p.newLine(event, speed))
+}
+
+func (p *JSONProgress) writeError(err error) {
+	line := p.newLine("error", -1)
+	line.Error = err.Error()
+	p.writeJSON(line)
+}
+
+func (p *JSONProgress) newLine(event string, speed float64) *jsonProgressLine {
+	line := &jsonProgressLine{
+		Event:     event,
+		File:      p.fileName,
+		Index:     p.fileIdx,
+		Total:     p.fileCount,
+		Bytes:     p.fileStep,
+		Size:      p.fileSize,
+		Speed:     -1,
+		Eta:       -1,
+		Skipped:   p.fileSkipped,
+		Unchanged: p.fileUnchanged,
+	}
+	if speed > 0 {
+		line.Speed = int64(math.Round(speed))
+		if p.fileSize >= 0 {
+			line.Eta = int64(math.Round(float64(p.fileSize-p.fileStep) / speed))
+		}
+	}
+	return line
+}
+
+func (p *JSONProgress) writeJSON(line *jsonProgressLine) {
+	buf, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	writeAll(p.writer, append(buf, '\n'))
+}
+
+type multiProgress struct {
+	callbacks []ProgressCallback
+}
+
+// MultiProgress fans out the progress to all the callbacks, the nil callbacks are ignored.
+func MultiProgress(callbacks ...ProgressCallback) ProgressCallback {
+	p := &multiProgress{}
+	for _, callback := range callbacks {
+		if callback != nil && !reflect.ValueOf(callback).IsNil() {
+			p.callbacks = append(p.callbacks, callback)
+		}
+	}
+	return p
+}
+
+func (p *multiProgress) OnNum(num int64) {
+	for _, callback := range p.callbacks {
+		callback.OnNum(num)
+	}
+}
+
+func (p *multiProgress) OnName(name string) {
+	for _, callback := range p.callbacks {
+		callback.OnName(name)
+	}
+}
+
+func (p *multiProgress) OnSize(size int64) {
+	for _, callback := range p.callbacks {
+		callback.OnSize(size)
+	}
+}
+
+func (p *multiProgress) OnStep(step int64) {
+	for _, callback := range p.callbacks {
+		callback.OnStep(step)
+	}
+}
+
+func (p *multiProgress) OnDone() {
+	for _, callback := range p.callbacks {
+		callback.OnDone()
+	}
+}
+
+// OnSkip forwards to the callbacks implementing the SkipCallback.
+func (p *multiProgress) OnSkip() {
+	for _, callback := range p.callbacks {
+		reportSkip(callback)
+	}
+}
+
+// OnUnchanged forwards to the callbacks implementing the UnchangedCallback.
+func (p *multiProgress) OnUnchanged() {
+	for _, callback := range p.callbacks {
+		reportUnchanged(callback)
+	}
+}
+
+// OnError forwards the error to the callbacks implementing the ErrorCallback.
+func (p *multiProgress) OnError(name string, err error) {
+	for _, callback := range p.callbacks {
+		reportFileError(callback, name, err)
+	}
+}
+
+// OnFileDone forwards the local path to the callbacks implementing the FileDoneCallback.
+func (p *multiProgress) OnFileDone(localName string, size int64) {
+	for _, callback := range p.callbacks {
+		reportFileDone(callback, localName, size)
+	}
+}
+
+// OnFileHash forwards the digest to the callbacks implementing the FileHashCallback.
+func (p *multiProgress) OnFileHash(localName string, algo string, digest []byte) {
+	for _, callback := range p.callbacks {
+		if hashCallback, ok := callback.(FileHashCallback); ok {
+			hashCallback.OnFileHash(localName, algo, digest)
+		}
+	}
+}
+
+// SummaryProgress writes only a summary line after all the file(s) are done, e.g.,
+// "Transferred 3 file(s), 12.5 MB in 00:02, 6.25 MB/s", for the scripts wanting a one-line result.
+type SummaryProgress struct {
+	writer      io.Writer
+	fileCount   int64
+	doneCount   int64
+	failedCount int64
+	fileSize    int64
+	fileStep    int64
+	unchanged   bool
+	doneBytes   int64
+	startTime   *time.Time
+}
+
+func NewSummaryProgress(writer io.Writer) *SummaryProgress {
+	return &SummaryProgress{writer: writer}
+}
+
+func (p *SummaryProgress) OnNum(num int64) {
+	p.fileCount = num
+	now := timeNowFunc()
+	p.startTime = &now
+	if num == 0 {
+		p.writeSummary()
+	}
+}
+
+func (p *SummaryProgress) OnName(name string) {
+	p.fileSize = 0
+	p.fileStep = 0
+	p.unchanged = false
+}
+
+func (p *SummaryProgress) OnSize(size int64) {
+	p.fileSize = size
+}
+
+func (p *SummaryProgress) OnStep(step int64) {
+	if step > p.fileStep {
+		p.fileStep = step
+	}
+}
+
+// OnDone writes the summary after the last file, the bytes of the unchanged files are not counted.
+func (p *SummaryProgress) OnDone() {
+	p.doneCount++
+	if !p.unchanged && p.fileSize > p.fileStep {
+		p.fileStep = p.fileSize
+	}
+	p.doneBytes += p.fileStep
+	if p.doneCount+p.failedCount == p.fileCount {
+		p.writeSummary()
+	}
+}
+
+func (p *SummaryProgress) OnUnchanged() {
+	p.unchanged = true
+}
+
+// OnError counts the failed file in keep-going mode, it's shown in the summary.
+func (p *SummaryProgress) OnError(name string, err error) {
+	p.failedCount++
+	if p.doneCount+p.failedCount == p.fileCount {
+		p.writeSummary()
+	}
+}
+
+func (p *SummaryProgress) writeSummary() {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Transferred %d file(s), %s", p.doneCount, convertSizeToString(float64(p.doneBytes))))
+	if p.startTime != nil {
+		seconds := timeNowFunc().Sub(*p.startTime).Seconds()
+		b.WriteString(" in " + convertTimeToString(seconds))
+		if seconds > 0 {
+			b.WriteString(", " + convertSizeToString(float64(p.doneBytes)/seconds) + "/s")
+		}
+	}
+	if p.failedCount > 0 {
+		b.WriteString(fmt.Sprintf(", %d failed", p.failedCount))
+	}
+	b.WriteString("\r\n")
+	writeAll(p.writer, []byte(b.String()))
+}
+
+// OnSpeed forwards the speed to the callbacks implementing the SpeedCallback.
+func (p *multiProgress) OnSpeed(bytesPerSec float64) {
+	for _, callback := range p.callbacks {
+		if speedCallback, ok := callback.(SpeedCallback); ok {
+			speedCallback.OnSpeed(bytesPerSec)
+		}
+	}
+}
+
+// speedProgress computes the speed of the current file on each step for the SpeedCallback.
+type speedProgress struct {
+	ProgressCallback
+	speedCounter
+	callback SpeedCallback
+}
+
+// getOptionalCallback returns the progress to check for the optional callbacks, e.g., FileDoneCallback,
+// as the wrapper of withSpeedCallback only implements the methods of the ProgressCallback.
+func getOptionalCallback(progress ProgressCallback) interface{} {
+	if p, ok := progress.(*speedProgress); ok {
+		return p.ProgressCallback
+	}
+	return progress
+}
+
+// reportSkip calls `OnSkip` if the progress implements the SkipCallback.
+func reportSkip(progress ProgressCallback) {
+	if progress == nil || reflect.ValueOf(progress).IsNil() {
+		return
+	}
+	if callback, ok := getOptionalCallback(progress).(SkipCallback); ok {
+		callback.OnSkip()
+	}
+}
+
+// reportUnchanged calls `OnUnchanged` if the progress implements the UnchangedCallback.
+func reportUnchanged(progress ProgressCallback) {
+	if progress == nil || reflect.ValueOf(progress).IsNil() {
+		return
+	}
+	if callback, ok := getOptionalCallback(progress).(UnchangedCallback); ok {
+		callback.OnUnchanged()
+	}
+}
+
+// reportFileError calls `OnError` if the progress implements the ErrorCallback.
+func reportFileError(progress ProgressCallback, name string, err error) {
+	if progress == nil || reflect.ValueOf(progress).IsNil() {
+		return
+	}
+	if callback, ok := getOptionalCallback(progress).(ErrorCallback); ok {
+		callback.OnError(name, err)
+	}
+}
+
+// reportFileDone calls `OnFileDone` if the progress implements the FileDoneCallback.
+func reportFileDone(progress ProgressCallback, localName string, size int64) {
+	if progress == nil || reflect.ValueOf(progress).IsNil() {
+		return
+	}
+	if callback, ok := getOptionalCallback(progress).(FileDoneCallback); ok {
+		callback.OnFileDone(localName, size)
+	}
+}
+
+// withSpeedCallback wraps the progress to call `OnSpeed` after each step, if it implements the SpeedCallback.
+func withSpeedCallback(progress ProgressCallback) ProgressCallback {
+	if progress == nil || reflect.ValueOf(progress).IsNil() {
+		return progress
+	}
+	callback, ok := progress.(SpeedCallback)
+	if !ok {
+		return progress
+	}
+	return &speedProgress{ProgressCallback: progress, callback: callback}
+}
+
+func (p *speedProgress) OnName(name string) {
+	now := timeNowFunc()
+	p.resetSpeed(&now)
+	p.ProgressCallback.OnName(name)
+}
+
+func (p *speedProgress) OnStep(step int64) {
+	p.ProgressCallback.OnStep(step)
+	now := timeNowFunc()
+	if p.speedCnt == 0 {
+		p.resetSpeed(&now)
+	}
+	// the speed is unknown before any time has elapsed since the file started
+	if speed := p.getSpeed(&now, step); speed >= 0 && !math.IsInf(speed, 0) {
+		p.callback.OnSpeed(speed)
 	}
-	return "[\u001b[36m" + strings.Repeat("\u2588", complete) + strings.Repeat("\u2591", total-complete) + "\u001b[0m]"
 }
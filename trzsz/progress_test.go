@@ -25,6 +25,8 @@ SOFTWARE.
 package trzsz
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
 	"regexp"
@@ -49,7 +51,7 @@ func mockTimeNow(times []int64) *int {
 	return &idx
 }
 
-var colorRegexp = regexp.MustCompile(`\x1b\[\d+[mD]`)
+var colorRegexp = regexp.MustCompile(`\x1b\[\d+[mDJ]`)
 
 func getProgressLength(text string) int {
 	text = strings.ReplaceAll(text, "\r", "")
@@ -83,7 +85,14 @@ func (w *ProgressWriter) assertBufferText(idx int, size int, expected []string)
 	}
 }
 
+// restoreTimeNow restores the real clock, which mockTimeNow leaves mocked after the test,
+// as the transfers in the later tests read the clock too.
+func restoreTimeNow() {
+	timeNowFunc = time.Now
+}
+
 func NewProgressWriter(t *testing.T) *ProgressWriter {
+	t.Cleanup(restoreTimeNow)
 	return &ProgressWriter{t, nil}
 }
 
@@ -103,6 +112,23 @@ func TestProgressWithEmptyFile(t *testing.T) {
 	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 100% | 0.00 B | --- B/s | --- ETA"})
 }
 
+func TestProgressUnknownColumns(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564135000})
+
+	// no tty to get the columns, the default width is used
+	progress := NewTextProgressBar(writer, 0, 0)
+	progress.OnNum(1)
+	progress.OnName("test.txt")
+	progress.OnSize(0)
+	progress.OnStep(0)
+
+	assert.Equal(2, *callTimeNowCount)
+	writer.assertBufferCount(1)
+	writer.assertBufferText(0, kDefaultColumns, []string{"test.txt [", "] 100% | 0.00 B | --- B/s | --- ETA"})
+}
+
 func TestProgressZeroStep(t *testing.T) {
 	assert := assert.New(t)
 	writer := NewProgressWriter(t)
@@ -135,6 +161,72 @@ func TestProgressLastStep(t *testing.T) {
 	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 100% | 100 B | 500 B/s | 00:00 ETA"})
 }
 
+func TestProgressCallbackInterface(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564135200})
+
+	// the library users drive the progress bar by the exported ProgressCallback
+	var progress ProgressCallback = NewTextProgressBar(writer, 100, 0)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(100)
+	progress.OnStep(100)
+	progress.OnDone()
+
+	assert.Equal(2, *callTimeNowCount)
+	writer.assertBufferCount(2)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 100% | 100 B | 500 B/s | 00:00 ETA"})
+}
+
+func TestProgressSkippedFile(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564135200})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSkip()
+	progress.OnSize(100)
+	progress.OnStep(100)
+
+	assert.Equal(2, *callTimeNowCount)
+	writer.assertBufferCount(1)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 100% | 100 B | 500 B/s | Skipped"})
+}
+
+func TestProgressUnchangedFile(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564135200})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(100)
+	progress.OnUnchanged()
+	progress.OnDone()
+
+	assert.Equal(2, *callTimeNowCount)
+	writer.assertBufferCount(2)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] Unchanged | 0.00 B | --- B/s | --- ETA"})
+}
+
+func TestProgressFailedFile(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564135200})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.OnNum(2)
+	progress.OnError("test.txt", errors.New("permission denied"))
+
+	assert.Equal(2, *callTimeNowCount)
+	writer.assertBufferCount(2)
+	writer.assertBufferText(0, 100, []string{"(1/2) test.txt [", "] 100% | 0.00 B | --- B/s | Failed"})
+}
+
 func TestProgressWithSpeedAndEta(t *testing.T) {
 	assert := assert.New(t)
 	writer := NewProgressWriter(t)
@@ -151,6 +243,22 @@ func TestProgressWithSpeedAndEta(t *testing.T) {
 	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 1% | 1.00 B | 10.0 B/s | 00:10 ETA"})
 }
 
+func TestProgressUnknownSize(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564135100})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(-1)
+	progress.OnStep(1)
+
+	assert.Equal(2, *callTimeNowCount)
+	writer.assertBufferCount(1)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] --- | 1.00 B | 10.0 B/s | --- ETA"})
+}
+
 func TestProgressNewestSpeed(t *testing.T) {
 	assert := assert.New(t)
 	writer := NewProgressWriter(t)
@@ -215,6 +323,61 @@ func TestProgressNewestSpeed(t *testing.T) {
 
 }
 
+func TestProgressSpeedSmoothing(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	now := int64(1646564135000)
+	mockTimeNow([]int64{now, now + 1000, now + 2000})
+
+	// the ETA is derived from the smoothed speed, (100 + 200) / 2 = 150 B/s
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.SetRefreshInterval(0)
+	progress.SetSpeedSmoothing(0.5)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(1500)
+	progress.OnStep(100)
+	progress.OnStep(300)
+	writer.assertBufferCount(2)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 7% | 100 B | 100 B/s | 00:14 ETA"})
+	writer.assertBufferText(1, 100, []string{"中文😀test.txt [", "] 20% | 300 B | 150 B/s | 00:08 ETA"})
+
+	// the alpha out of the range restores the sliding window
+	progress.SetSpeedSmoothing(1.5)
+	assert.Equal(0.0, progress.alpha)
+	progress.SetSpeedSmoothing(-1)
+	assert.Equal(0.0, progress.alpha)
+
+	// the chunks are sent in 10ms, but stalled for 2s every 40 chunks
+	getMaxEtaJump := func(alpha float64) float64 {
+		var counter speedCounter
+		counter.alpha = alpha
+		startTime := time.UnixMilli(0)
+		counter.resetSpeed(&startTime)
+		var step, millis int64
+		var lastEta, maxJump float64
+		for i := 1; i <= 200; i++ {
+			if i%40 == 0 {
+				millis += 2000
+			} else {
+				millis += 10
+			}
+			step += 100000
+			now := time.UnixMilli(millis)
+			eta := float64(100000000-step) / counter.getSpeed(&now, step)
+			if i > 40 {
+				maxJump = math.Max(maxJump, math.Abs(eta-lastEta))
+			}
+			lastEta = eta
+		}
+		return maxJump
+	}
+	windowJump := getMaxEtaJump(0)
+	averageJump := getMaxEtaJump(0.1)
+	assert.Greater(windowJump, 30.0)
+	assert.Less(averageJump, 2.0)
+}
+
 func TestProgressReduceOutput(t *testing.T) {
 	assert := assert.New(t)
 	writer := NewProgressWriter(t)
@@ -232,6 +395,126 @@ func TestProgressReduceOutput(t *testing.T) {
 	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 1% | 1.00 B | 1000 B/s | 00:00 ETA"})
 }
 
+func TestProgressRefreshInterval(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		interval time.Duration
+		count    int
+	}{{0, 5}, {100 * time.Millisecond, 4}, {200 * time.Millisecond, 3}, {500 * time.Millisecond, 2}} {
+		writer := NewProgressWriter(t)
+		callTimeNowCount := mockTimeNow([]int64{
+			1646564135000, 1646564135050, 1646564135100, 1646564135150, 1646564135250, 1646564135600})
+
+		progress := NewTextProgressBar(writer, 100, 0)
+		progress.SetRefreshInterval(c.interval)
+		progress.OnNum(1)
+		progress.OnName("中文😀test.txt")
+		progress.OnSize(100)
+		for _, step := range []int64{5, 10, 15, 25, 60} {
+			progress.OnStep(step)
+		}
+
+		assert.Equal(6, *callTimeNowCount)
+		writer.assertBufferCount(c.count)
+		// the speed is calculated by the elapsed time, not the redraw interval
+		writer.assertBufferText(c.count-1, 100, []string{"中文😀test.txt [", "] 60% | 60.0 B | 100 B/s | 00:00 ETA"})
+	}
+}
+
+func TestProgressASCIIBar(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564136000})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.SetASCII(true)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(100)
+	progress.OnStep(50)
+
+	assert.Equal(2, *callTimeNowCount)
+	writer.assertBufferCount(1)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 50% | 50.0 B | 50.0 B/s | 00:01 ETA"})
+	assert.NotContains(writer.buffer[0], "\u2588")
+	assert.NotContains(writer.buffer[0], "\u2591")
+
+	bar := colorRegexp.ReplaceAllString(writer.buffer[0], "")
+	bar = bar[strings.Index(bar, "[")+1 : strings.Index(bar, "]")]
+	assert.Equal(strings.Repeat("#", (len(bar)+1)/2)+strings.Repeat("-", len(bar)/2), bar)
+}
+
+func TestProgressNoColor(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564136000, 1646564137000})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.SetNoColor(true)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(100)
+	progress.OnStep(50)
+	progress.SetTheme(ProgressTheme{Bar: "32"})
+	progress.OnStep(100)
+
+	assert.Equal(3, *callTimeNowCount)
+	writer.assertBufferCount(2)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 50% | 50.0 B | 50.0 B/s | 00:01 ETA"})
+	assert.NotContains(writer.buffer[0], "\x1b[")
+	writer.assertBufferText(1, 100, []string{"中文😀test.txt [\x1b[32m", "\x1b[0m] 100% | 100 B | 50.0 B/s | 00:00 ETA"})
+}
+
+func TestConvertSizeToUnitString(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		size     float64
+		sizeUnit SizeUnit
+		expected string
+	}{
+		{999, SizeUnitDefault, "999 B"},
+		{1000, SizeUnitDefault, "1000 B"},
+		{1023, SizeUnitDefault, "1023 B"},
+		{1024, SizeUnitDefault, "1.00 KB"},
+		{1000, SizeUnitBinary, "1000 B"},
+		{1024, SizeUnitBinary, "1.00 KiB"},
+		{1024 * 1024, SizeUnitBinary, "1.00 MiB"},
+		{999, SizeUnitDecimal, "999 B"},
+		{1000, SizeUnitDecimal, "1.00 KB"},
+		{1024, SizeUnitDecimal, "1.02 KB"},
+		{1000 * 1000, SizeUnitDecimal, "1.00 MB"},
+		{1000 * 1000 * 1000 * 1000 * 1000, SizeUnitDecimal, "1000 TB"},
+	} {
+		assert.Equal(c.expected, convertSizeToUnitString(c.size, c.sizeUnit))
+	}
+}
+
+func TestProgressSizeUnit(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		sizeUnit SizeUnit
+		expected string
+	}{
+		{SizeUnitDefault, "] 50% | 1000 B | 1000 B/s | 00:01 ETA"},
+		{SizeUnitBinary, "] 50% | 1000 B | 1000 B/s | 00:01 ETA"},
+		{SizeUnitDecimal, "] 50% | 1.00 KB | 1.00 KB/s | 00:01 ETA"},
+	} {
+		writer := NewProgressWriter(t)
+		callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564136000})
+
+		progress := NewTextProgressBar(writer, 100, 0)
+		progress.SetSizeUnit(c.sizeUnit)
+		progress.OnNum(1)
+		progress.OnName("中文😀test.txt")
+		progress.OnSize(2000)
+		progress.OnStep(1000)
+
+		assert.Equal(2, *callTimeNowCount)
+		writer.assertBufferCount(1)
+		writer.assertBufferText(0, 100, []string{"中文😀test.txt [", c.expected})
+	}
+}
+
 func TestProgressFastSpeed(t *testing.T) {
 	assert := assert.New(t)
 	writer := NewProgressWriter(t)
@@ -420,6 +703,32 @@ func TestProgressInTmuxPane(t *testing.T) {
 	assert.NotContains(writer.buffer[4], "\x1b[79D")
 }
 
+func TestProgressTerminalResize(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564136000, 1646564136050, 1646564136100, 1646564137000})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.OnNum(1)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(1000)
+	progress.OnStep(100)
+	progress.setTerminalColumns(60)
+	progress.OnStep(200)
+	progress.setTerminalColumns(0)
+	progress.OnStep(300)
+	progress.setTerminalColumns(120)
+	progress.OnStep(400)
+
+	assert.Equal(5, *callTimeNowCount)
+	writer.assertBufferCount(3)
+	writer.assertBufferText(0, 100, []string{"中文😀test.txt [", "] 10% | 100 B | 100 B/s | 00:09 ETA"})
+	assert.NotContains(writer.buffer[0], "\x1b[0J")
+	// redrawn on resizing, even within the refresh interval
+	writer.assertBufferText(1, 60, []string{"\r\x1b[0J", "中文😀test.txt [", "] 20%"})
+	writer.assertBufferText(2, 120, []string{"\r\x1b[0J", "中文😀test.txt [", "] 40%"})
+}
+
 func TestProgressEllipsisString(t *testing.T) {
 	assert := assert.New(t)
 	assertEllipsisEqual := func(str string, max int, expectedStr string, expectedLen int) {
@@ -439,3 +748,332 @@ func TestProgressEllipsisString(t *testing.T) {
 	assertEllipsisEqual("😀a中", 7, "😀a...", 6)
 	assertEllipsisEqual("😀a中", 8, "😀a中...", 8)
 }
+
+func TestJSONProgress(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564136000, 1646564136100, 1646564137000})
+
+	progress := NewJSONProgress(writer)
+	progress.OnNum(2)
+	progress.OnName("中文😀test.txt")
+	progress.OnSize(100)
+	progress.OnStep(40)
+	progress.OnStep(50) // too frequent, ignored
+	progress.OnDone()
+	progress.OnName("skip.txt")
+	progress.OnSkip()
+	progress.OnSize(0)
+	progress.OnDone()
+
+	assert.Equal(4, *callTimeNowCount)
+	writer.assertBufferCount(5)
+	assert.Equal(`{"event":"name","file":"中文😀test.txt","index":1,"total":2,"bytes":0,"size":0,"speed":-1,"eta":-1}`+"\n", writer.buffer[0])
+	assert.Equal(`{"event":"step","file":"中文😀test.txt","index":1,"total":2,"bytes":40,"size":100,"speed":40,"eta":2}`+"\n", writer.buffer[1])
+	assert.Equal(`{"event":"done","file":"中文😀test.txt","index":1,"total":2,"bytes":100,"size":100,"speed":-1,"eta":-1}`+"\n", writer.buffer[2])
+	assert.Equal(`{"event":"name","file":"skip.txt","index":2,"total":2,"bytes":0,"size":0,"speed":-1,"eta":-1}`+"\n", writer.buffer[3])
+	assert.Equal(`{"event":"done","file":"skip.txt","index":2,"total":2,"bytes":0,"size":0,"speed":-1,"eta":-1,"skipped":true}`+"\n", writer.buffer[4])
+
+	// the same speed and eta as the text progress bar
+	writer = NewProgressWriter(t)
+	mockTimeNow([]int64{1646564135000, 1646564136000})
+	bar := NewTextProgressBar(writer, 100, 0)
+	bar.OnNum(2)
+	bar.OnName("中文😀test.txt")
+	bar.OnSize(100)
+	bar.OnStep(40)
+	writer.assertBufferText(0, 100, []string{"] 40% | 40.0 B | 40.0 B/s | 00:02 ETA"})
+
+	// the local path of the file done
+	writer = NewProgressWriter(t)
+	progress = NewJSONProgress(writer)
+	progress.OnNum(1)
+	progress.OnFileDone("/tmp/test.txt", 100)
+	writer.assertBufferCount(1)
+	assert.Equal(`{"event":"file_done","file":"","index":0,"total":1,"bytes":100,"size":100,"speed":-1,"eta":-1,"path":"/tmp/test.txt"}`+"\n", writer.buffer[0])
+
+	// the digest of the file verified
+	writer = NewProgressWriter(t)
+	progress = NewJSONProgress(writer)
+	progress.OnNum(1)
+	progress.OnFileHash("/tmp/test.txt", "sha256", []byte{0x01, 0xef})
+	writer.assertBufferCount(1)
+	assert.Equal(`{"event":"file_hash","file":"","index":0,"total":1,"bytes":0,"size":0,"speed":-1,"eta":-1,"path":"/tmp/test.txt","algo":"sha256","digest":"01ef"}`+"\n", writer.buffer[0])
+}
+
+// progressRecorder records all the progress calls.
+type progressRecorder struct {
+	calls []string
+}
+
+func (r *progressRecorder) OnNum(num int64) {
+	r.record("num", num)
+}
+
+func (r *progressRecorder) OnName(name string) {
+	r.record("name", name)
+}
+
+func (r *progressRecorder) OnSize(size int64) {
+	r.record("size", size)
+}
+
+func (r *progressRecorder) OnStep(step int64) {
+	r.record("step", step)
+}
+
+func (r *progressRecorder) OnDone() {
+	r.record("done")
+}
+
+func (r *progressRecorder) OnSkip() {
+	r.record("skip")
+}
+
+func (r *progressRecorder) OnUnchanged() {
+	r.record("unchanged")
+}
+
+func (r *progressRecorder) OnError(name string, err error) {
+	r.record("error", name, err)
+}
+
+func (r *progressRecorder) OnFileDone(localName string, size int64) {
+	r.record("file_done", localName, size)
+}
+
+func (r *progressRecorder) OnFileHash(localName string, algo string, digest []byte) {
+	r.record("file_hash", localName, algo, hex.EncodeToString(digest))
+}
+
+func (r *progressRecorder) record(args ...interface{}) {
+	r.calls = append(r.calls, strings.TrimSpace(fmt.Sprintln(args...)))
+}
+
+// speedRecorder records the speeds along with the text progress bar.
+type speedRecorder struct {
+	*TextProgressBar
+	speeds []float64
+}
+
+func (r *speedRecorder) OnSpeed(bytesPerSec float64) {
+	r.speeds = append(r.speeds, bytesPerSec)
+}
+
+func TestSpeedCallback(t *testing.T) {
+	assert := assert.New(t)
+	originalTimeNow := timeNowFunc
+	defer func() { timeNowFunc = originalTimeNow }()
+	now := time.UnixMilli(1646564135000)
+	timeNowFunc = func() time.Time { return now }
+
+	writer := NewProgressWriter(t)
+	recorder := &speedRecorder{TextProgressBar: NewTextProgressBar(writer, 100, 0)}
+	progress := withSpeedCallback(recorder)
+	progress.OnNum(1)
+	progress.OnName("a.txt")
+	progress.OnSize(10000)
+
+	// no speed before any time has elapsed
+	progress.OnStep(100)
+	assert.Empty(recorder.speeds)
+
+	// the same speed as the progress bar shows
+	for _, step := range []int64{1000, 3000, 6000} {
+		now = now.Add(time.Second)
+		progress.OnStep(step)
+		require.NotEmpty(t, recorder.speeds)
+		speed := recorder.speeds[len(recorder.speeds)-1]
+		assert.Contains(writer.buffer[len(writer.buffer)-1], " | "+convertSizeToString(speed)+"/s | ")
+	}
+	assert.Equal([]float64{1000, 1500, 2000}, recorder.speeds)
+
+	// the speed is reset for the next file
+	progress.OnDone()
+	progress.OnName("b.txt")
+	now = now.Add(time.Second)
+	progress.OnStep(500)
+	assert.Equal(float64(500), recorder.speeds[len(recorder.speeds)-1])
+
+	// it's optional, and nil-safe
+	bar := NewTextProgressBar(writer, 100, 0)
+	assert.True(withSpeedCallback(bar) == ProgressCallback(bar))
+	assert.Nil(withSpeedCallback(nil))
+	var nilRecorder *speedRecorder
+	assert.Equal(nilRecorder, withSpeedCallback(nilRecorder))
+
+	// the speed is fanned out to the callbacks implementing it
+	recorder2 := &speedRecorder{TextProgressBar: NewTextProgressBar(writer, 100, 0)}
+	multi := withSpeedCallback(MultiProgress(bar, recorder2))
+	multi.OnName("c.txt")
+	now = now.Add(time.Second)
+	multi.OnStep(300)
+	assert.Equal([]float64{300}, recorder2.speeds)
+}
+
+func TestSummaryProgress(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	mockTimeNow([]int64{1646564135000, 1646564137000})
+
+	progress := NewSummaryProgress(writer)
+	progress.OnNum(4)
+	progress.OnName("a.txt")
+	progress.OnSize(100)
+	progress.OnStep(40)
+	progress.OnDone()
+	progress.OnName("b.txt")
+	progress.OnSize(300)
+	progress.OnStep(300)
+	progress.OnDone()
+	progress.OnName("same.txt")
+	progress.OnSize(500)
+	progress.OnUnchanged()
+	progress.OnDone()
+	writer.assertBufferCount(0)
+	progress.OnError("c.txt", errors.New("permission denied"))
+
+	// only the summary line after the last file
+	writer.assertBufferCount(1)
+	assert.Equal("Transferred 3 file(s), 400 B in 00:02, 200 B/s, 1 failed\r\n", writer.buffer[0])
+
+	writer = NewProgressWriter(t)
+	mockTimeNow([]int64{1646564135000, 1646564135000})
+	NewSummaryProgress(writer).OnNum(0)
+	assert.Equal([]string{"Transferred 0 file(s), 0.00 B in 00:00\r\n"}, writer.buffer)
+}
+
+func TestMultiProgress(t *testing.T) {
+	assert := assert.New(t)
+	first := &progressRecorder{}
+	second := &progressRecorder{}
+	var nilRecorder *progressRecorder
+	progress := MultiProgress(first, nil, nilRecorder, second)
+
+	progress.OnNum(2)
+	progress.OnName("a.txt")
+	progress.OnSize(100)
+	progress.OnStep(50)
+	progress.OnStep(100)
+	progress.OnDone()
+	progress.(FileHashCallback).OnFileHash("/tmp/a.txt", "md5", []byte{0x12, 0xab})
+	progress.(FileDoneCallback).OnFileDone("/tmp/a.txt", 100)
+	progress.OnName("b.txt")
+	progress.(SkipCallback).OnSkip()
+	progress.(UnchangedCallback).OnUnchanged()
+	progress.OnDone()
+	progress.(ErrorCallback).OnError("c.txt", fmt.Errorf("failed"))
+
+	assert.Equal([]string{"num 2", "name a.txt", "size 100", "step 50", "step 100", "done", "file_hash /tmp/a.txt md5 12ab",
+		"file_done /tmp/a.txt 100",
+		"name b.txt", "skip", "unchanged", "done", "error c.txt failed"}, first.calls)
+	assert.Equal(first.calls, second.calls)
+}
+
+func TestProgressFilesMode(t *testing.T) {
+	assert := assert.New(t)
+	writer := NewProgressWriter(t)
+	callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564136000, 1646564137000, 1646564138000, 1646564139000})
+
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.SetProgressMode(ProgressModeFiles)
+	progress.OnNum(2)
+	progress.OnName("a.txt")
+	progress.OnSize(1000)
+	progress.OnStep(1000)
+	progress.OnDone()
+	progress.OnName("b.txt")
+	progress.OnSize(2000)
+	progress.OnStep(2000)
+	progress.OnDone()
+
+	// the last file done is always shown
+	assert.Equal(5, *callTimeNowCount)
+	writer.assertBufferCount(5)
+	writer.assertBufferText(0, 100, []string{"(1/2) files [", "] 1000 B, 1000 B/s"})
+	assert.NotContains(writer.buffer[0], "█") // none of the files is done yet
+	assert.Equal("\r", writer.buffer[1])
+	writer.assertBufferText(2, 100, []string{"(2/2) files [", "] 2.93 KB, 1000 B/s"})
+	writer.assertBufferText(3, 100, []string{"(2/2) files [", "] 2.93 KB, 750 B/s"})
+	assert.NotContains(writer.buffer[3], "░") // all the files are done
+	assert.Equal("\r", writer.buffer[4])
+}
+
+func TestProgressFilesModeAuto(t *testing.T) {
+	assert := assert.New(t)
+	for _, mode := range []ProgressMode{ProgressModeAuto, ProgressModeBytes} {
+		writer := NewProgressWriter(t)
+		callTimeNowCount := mockTimeNow([]int64{1646564135000, 1646564136000, 1646564137000, 1646564138000})
+
+		progress := NewTextProgressBar(writer, 100, 0)
+		progress.SetProgressMode(mode)
+		progress.OnNum(200)
+		progress.OnName("a.txt")
+		progress.OnSize(10)
+		progress.OnStep(10)
+		progress.OnDone()
+		progress.OnName("b.txt")
+		progress.OnSize(10)
+		progress.OnStep(10)
+
+		assert.Equal(4, *callTimeNowCount)
+		writer.assertBufferCount(3)
+		writer.assertBufferText(0, 100, []string{"(1/200) a.txt [", "] 100% | 10.0 B | 10.0 B/s | 00:00 ETA"})
+		if mode == ProgressModeAuto {
+			// switch to count the files after the first tiny file is done
+			writer.assertBufferText(2, 100, []string{"(2/200) files [", "] 20.0 B, 6.67 B/s"})
+		} else {
+			writer.assertBufferText(2, 100, []string{"(2/200) b.txt [", "] 100% | 10.0 B | 10.0 B/s | 00:00 ETA"})
+		}
+	}
+
+	// not many files
+	writer := NewProgressWriter(t)
+	mockTimeNow([]int64{1646564135000, 1646564136000, 1646564137000, 1646564138000})
+	progress := NewTextProgressBar(writer, 100, 0)
+	progress.OnNum(2)
+	progress.OnName("a.txt")
+	progress.OnSize(10)
+	progress.OnStep(10)
+	progress.OnDone()
+	progress.OnName("b.txt")
+	progress.OnSize(10)
+	progress.OnStep(10)
+	writer.assertBufferText(2, 100, []string{"(2/2) b.txt [", "] 100% | 10.0 B"})
+}
+
+func TestProgressFilesModeNarrow(t *testing.T) {
+	writer := NewProgressWriter(t)
+	mockTimeNow([]int64{1646564135000, 1646564136000})
+
+	progress := NewTextProgressBar(writer, 40, 0)
+	progress.SetProgressMode(ProgressModeFiles)
+	progress.OnNum(10)
+	progress.OnName("a.txt")
+	progress.OnSize(1000)
+	progress.OnStep(1000)
+	writer.assertBufferCount(1)
+	assert.Equal(t, "(1/10) files, 1000 B, 1000 B/s", writer.buffer[0])
+
+	writer = NewProgressWriter(t)
+	mockTimeNow([]int64{1646564135000, 1646564136000})
+	progress = NewTextProgressBar(writer, 20, 0)
+	progress.SetProgressMode(ProgressModeFiles)
+	progress.OnNum(10)
+	progress.OnName("a.txt")
+	progress.OnSize(1000)
+	progress.OnStep(1000)
+	writer.assertBufferCount(1)
+	assert.Equal(t, "(1/10) files, 1000 B", writer.buffer[0])
+
+	writer = NewProgressWriter(t)
+	mockTimeNow([]int64{1646564135000, 1646564136000})
+	progress = NewTextProgressBar(writer, 15, 0)
+	progress.SetProgressMode(ProgressModeFiles)
+	progress.OnNum(10)
+	progress.OnName("a.txt")
+	progress.OnSize(1000)
+	progress.OnStep(1000)
+	writer.assertBufferCount(1)
+	assert.Equal(t, "(1/10) files", writer.buffer[0])
+}
@@ -27,9 +27,11 @@ SOFTWARE.
 package trzsz
 
 import (
+	"errors"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 
@@ -135,6 +137,61 @@ func syscallAccessRok(path string) error {
 	return syscall.Access(path, unix.R_OK)
 }
 
+func getFileInode(info os.FileInfo) (fileInode, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+		return fileInode{uint64(stat.Dev), uint64(stat.Ino)}, true
+	}
+	return fileInode{}, false
+}
+
+func isReparsePoint(info os.FileInfo) bool {
+	return false
+}
+
+func getRealPath(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+func getFileOwner(info os.FileInfo) *fileOwner {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return &fileOwner{int(stat.Uid), int(stat.Gid)}
+	}
+	return nil
+}
+
+func isNoSpaceError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// chownFile changes the owner of the file if privileged, otherwise it's silently skipped.
+func chownFile(path string, owner *fileOwner) error {
+	if err := os.Chown(path, owner.Uid, owner.Gid); err != nil && !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+	return nil
+}
+
+// newHookCommand runs the hook command by the shell, so it's quoted as usual,
+// and the file(s) are appended as the arguments "$@", which are not interpreted by the shell.
+func newHookCommand(command string, files []string) (*exec.Cmd, error) {
+	return exec.Command("/bin/sh", append([]string{"-c", command + ` "$@"`, "sh"}, files...)...), nil
+}
+
+// setReadOnly does nothing, as the permissions are applied by chmod on Unix.
+func setReadOnly(path string, readOnly bool) error {
+	return nil
+}
+
+// openTerminalInput opens the controlling terminal, to read the responses when stdin is the data to be sent.
+func openTerminalInput() (*os.File, error) {
+	return os.Open("/dev/tty")
+}
+
+// openTerminalOutput opens the controlling terminal, to write the requests when stdout is the data received.
+func openTerminalOutput() (*os.File, error) {
+	return os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+}
+
 func enableVirtualTerminal() (uint32, uint32, error) {
 	return 0, 0, nil
 }
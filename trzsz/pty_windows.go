@@ -26,6 +26,7 @@ package trzsz
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/exec"
 	"strings"
@@ -211,14 +212,149 @@ func (t *TrzszPty) ExitCode() int {
 	return int(*t.exitCode)
 }
 
+// syscallAccess opens the path with the access, so the ACLs and the read-only attribute are checked by the system.
+func syscallAccess(path string, access uint32) error {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	handle, err := windows.CreateFile(name, access,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil,
+		windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	return windows.CloseHandle(handle)
+}
+
 func syscallAccessWok(path string) error {
-	return nil
+	return syscallAccess(path, windows.FILE_WRITE_DATA)
 }
 
 func syscallAccessRok(path string) error {
+	return syscallAccess(path, windows.FILE_READ_DATA)
+}
+
+// getFileInode is not supported on Windows, the hard links are sent as regular files.
+func getFileInode(info os.FileInfo) (fileInode, bool) {
+	return fileInode{}, false
+}
+
+// isReparsePoint returns true for the symlinks and junctions which are not reported as symlinks.
+// The junctions may be reported as directories, so the attribute is checked before the mode of them.
+func isReparsePoint(info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink != 0 || info.Mode().IsRegular() {
+		return false
+	}
+	if attrs, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return attrs.FileAttributes&windows.FILE_ATTRIBUTE_REPARSE_POINT != 0
+	}
+	return false
+}
+
+// getRealPath resolves the symlinks and junctions by the system, as `filepath.EvalSymlinks` may fail on junctions.
+func getRealPath(path string) (string, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	handle, err := windows.CreateFile(name, 0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil,
+		windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return "", err
+	}
+	defer windows.CloseHandle(handle)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	n, err := windows.GetFinalPathNameByHandle(handle, &buf[0], uint32(len(buf)), 0)
+	if err != nil {
+		return "", err
+	}
+	realPath := windows.UTF16ToString(buf[:n])
+	if strings.HasPrefix(realPath, `\\?\UNC\`) {
+		return `\\` + realPath[8:], nil
+	}
+	return strings.TrimPrefix(realPath, `\\?\`), nil
+}
+
+func isNoSpaceError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, windows.ERROR_DISK_FULL) ||
+		errors.Is(err, windows.ERROR_HANDLE_DISK_FULL)
+}
+
+func getFileOwner(info os.FileInfo) *fileOwner {
+	return nil
+}
+
+func chownFile(path string, owner *fileOwner) error {
 	return nil
 }
 
+// getFileXattrs returns nil, as the extended attributes are not supported on Windows.
+func getFileXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setFileXattrs(path string, xattrs map[string][]byte) error {
+	return nil
+}
+
+// newHookCommand splits the hook command by the quoting rules of the Windows command line,
+// and appends the file(s) as the arguments, without being interpreted by a shell.
+func newHookCommand(command string, files []string) (*exec.Cmd, error) {
+	argv, err := windows.DecomposeCommandLine(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(argv) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return exec.Command(argv[0], append(argv[1:], files...)...), nil
+}
+
+// setReadOnly sets or clears the read-only attribute of the file, which is the only permission on Windows.
+// The directories are skipped, as the read-only attribute doesn't protect their children on Windows.
+func setReadOnly(path string, readOnly bool) error {
+	pathp, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attrs, err := windows.GetFileAttributes(pathp)
+	if err != nil {
+		return err
+	}
+	if attrs&windows.FILE_ATTRIBUTE_DIRECTORY != 0 {
+		return nil
+	}
+	newAttrs := attrs &^ windows.FILE_ATTRIBUTE_READONLY
+	if readOnly {
+		newAttrs |= windows.FILE_ATTRIBUTE_READONLY
+	}
+	if newAttrs == attrs {
+		return nil
+	}
+	return windows.SetFileAttributes(pathp, newAttrs)
+}
+
+// lockFile blocks until the exclusive lock of the file is acquired, which is released when the file is closed.
+func lockFile(file *os.File) error {
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
+
+// openTerminalInput opens the console input, to read the responses when stdin is the data to be sent.
+func openTerminalInput() (*os.File, error) {
+	return os.OpenFile("CONIN$", os.O_RDWR, 0)
+}
+
+// openTerminalOutput opens the console output, to write the requests when stdout is the data received.
+func openTerminalOutput() (*os.File, error) {
+	return os.OpenFile("CONOUT$", os.O_RDWR, 0)
+}
+
 func setupConsoleOutput() {
 	os.Stdout.WriteString("\x1b[?1049h\x1b[H\x1b[2J")
 
@@ -0,0 +1,176 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+const kAnonymousIdentity = "anonymous"
+
+// getSenderIdentity returns the identity of the sender for the quota. It's derived on the server side and never
+// declared by the client: the authenticated user given by the library users, or the user running trz, as which
+// the sender has logged in by SSH.
+func getSenderIdentity(authenticated string) string {
+	if len(authenticated) > 0 {
+		return authenticated
+	}
+	if u, err := user.Current(); err == nil && len(u.Username) > 0 {
+		return u.Username
+	}
+	return kAnonymousIdentity
+}
+
+func getDefaultQuotaFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".trzsz_quota.json"
+	}
+	return filepath.Join(home, ".trzsz_quota.json")
+}
+
+// senderQuota limits the cumulative bytes received from a sender identity.
+// The usage of all the identities is persisted in a json state file across invocations.
+// The size of a file is reserved in the usage when it's checked, so the concurrent invocations can't exceed the quota
+// together. The reservation is consumed as the file is received, and the rest is released when the batch ends.
+type senderQuota struct {
+	path     string
+	identity string
+	limit    int64
+	usage    map[string]int64
+	reserved int64
+	exceeded bool
+}
+
+func loadQuotaUsage(path string) (map[string]int64, error) {
+	usage := make(map[string]int64)
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &usage); err != nil {
+		return nil, newTrzszError(fmt.Sprintf("Invalid quota file %s: %v", path, err))
+	}
+	return usage, nil
+}
+
+func loadSenderQuota(path, identity string, limit int64) (*senderQuota, error) {
+	if len(path) == 0 {
+		path = getDefaultQuotaFile()
+	}
+	if len(identity) == 0 {
+		identity = kAnonymousIdentity
+	}
+	usage, err := loadQuotaUsage(path)
+	if err != nil {
+		return nil, err
+	}
+	return &senderQuota{path: path, identity: identity, limit: limit, usage: usage}, nil
+}
+
+// update locks the state file, and applies the change to the usage reloaded from it, so that the usage added by
+// the other invocations is neither lost nor overlooked. The usage is saved only if the change succeeds.
+func (q *senderQuota) update(change func(usage map[string]int64) error) error {
+	lock, err := os.OpenFile(q.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	usage, err := loadQuotaUsage(q.path)
+	if err != nil {
+		return err
+	}
+	if err := change(usage); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := q.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		return err
+	}
+	q.usage = usage
+	return nil
+}
+
+// check reserves the size in the usage if it's within the quota.
+func (q *senderQuota) check(size int64) error {
+	return q.update(func(usage map[string]int64) error {
+		used := usage[q.identity]
+		if used+size > q.limit {
+			q.exceeded = true
+			return newTrzszError(fmt.Sprintf("Quota exceeded for %s: %s used, %s more would exceed the quota %s",
+				q.identity, convertSizeToString(float64(used)), convertSizeToString(float64(size)),
+				convertSizeToString(float64(q.limit))))
+		}
+		usage[q.identity] += size
+		q.reserved += size
+		return nil
+	})
+}
+
+// add consumes the reservation by the received size, which is only added to the usage beyond the reservation.
+func (q *senderQuota) add(size int64) error {
+	consumed := minInt64(size, q.reserved)
+	if size > consumed {
+		if err := q.update(func(usage map[string]int64) error {
+			usage[q.identity] += size - consumed
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	q.reserved -= consumed
+	return nil
+}
+
+// release returns the rest of the reservation, e.g., the files failed or skipped, and the resumed parts.
+func (q *senderQuota) release() error {
+	if q.reserved <= 0 {
+		return nil
+	}
+	return q.update(func(usage map[string]int64) error {
+		usage[q.identity] = maxInt64(usage[q.identity]-q.reserved, 0)
+		q.reserved = 0
+		return nil
+	})
+}
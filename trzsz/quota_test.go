@@ -0,0 +1,111 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSenderQuota(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	quotaFile := filepath.Join(t.TempDir(), "quota.json")
+	writeTestFile(t, filepath.Join(src, "a.bin"), strings.Repeat("a", 6*1024))
+	writeTestFile(t, filepath.Join(src, "b.bin"), strings.Repeat("b", 3*1024))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin"), filepath.Join(src, "b.bin")}, false)
+	require.Nil(t, err)
+
+	uploadAs := func(identity string) *transferResultForTest {
+		client, server := newLoopbackTransfers()
+		require.Nil(t, client.sendAction(true, false))
+		action, err := server.recvAction()
+		require.Nil(t, err)
+		server.quota, err = loadSenderQuota(quotaFile, getSenderIdentity(identity), 10*1024)
+		require.Nil(t, err)
+		require.Nil(t, server.sendConfig(&newDefaultArgsForTest().TransferOptions, action, nil, NoTmux, -1))
+		_, err = client.recvConfig()
+		require.Nil(t, err)
+		return runTransferForTest(client, server, files, dest)
+	}
+
+	result := uploadAs("alice")
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal([]string{"a.bin", "b.bin"}, result.localNames)
+
+	result = uploadAs("alice")
+	message := "Quota exceeded for alice: 9.00 KB used, 6.00 KB more would exceed the quota 10.0 KB"
+	assert.EqualError(result.recvErr, message)
+	assert.EqualError(result.sendErr, message)
+	_, err = os.Stat(filepath.Join(dest, "a.bin.0"))
+	assert.True(os.IsNotExist(err))
+
+	result = uploadAs("bob")
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal([]string{"a.bin.0", "b.bin.0"}, result.localNames)
+
+	quota, err := loadSenderQuota(quotaFile, "alice", 10*1024)
+	require.Nil(t, err)
+	assert.Equal(map[string]int64{"alice": 9 * 1024, "bob": 9 * 1024}, quota.usage)
+
+	// the identity is derived on the server side
+	u, err := user.Current()
+	require.Nil(t, err)
+	assert.Equal(u.Username, getSenderIdentity(""))
+	t.Setenv("TRZSZ_IDENTITY", "bob")
+	assert.Equal(u.Username, getSenderIdentity(""))
+}
+
+func TestSenderQuotaConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	quotaFile := filepath.Join(t.TempDir(), "quota.json")
+	first, err := loadSenderQuota(quotaFile, "alice", 10*1024)
+	require.Nil(t, err)
+	second, err := loadSenderQuota(quotaFile, "alice", 10*1024)
+	require.Nil(t, err)
+
+	// the checked size is reserved, so the concurrent invocations can't exceed the quota together
+	assert.Nil(first.check(6 * 1024))
+	assert.EqualError(second.check(6*1024),
+		"Quota exceeded for alice: 6.00 KB used, 6.00 KB more would exceed the quota 10.0 KB")
+	assert.Nil(second.check(3 * 1024))
+
+	// the received size consumes the reservation, and the rest is released
+	assert.Nil(first.add(2 * 1024))
+	assert.Nil(first.release())
+	assert.Nil(second.add(3 * 1024))
+	assert.Nil(second.release())
+	quota, err := loadSenderQuota(quotaFile, "alice", 10*1024)
+	require.Nil(t, err)
+	assert.Equal(map[string]int64{"alice": 5 * 1024}, quota.usage)
+}
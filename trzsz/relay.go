@@ -204,9 +204,9 @@ func (r *TrzszRelay) recvConfig() (*TransferConfig, error) {
 		return nil, err
 	}
 	config := &TransferConfig{
-		Timeout:    20,
+		Timeout:    kDefaultTimeout,
 		Newline:    "\n",
-		MaxBufSize: 10 * 1024 * 1024,
+		MaxBufSize: kDefaultBufSize,
 	}
 	if r.serverIsWindows {
 		config.Newline = "!\n"
@@ -246,6 +246,10 @@ func (r *TrzszRelay) handshake() {
 		return
 	}
 	r.clientIsWindows = action.Newline == "!\n"
+	// the relay reads the lines of the server by "\n", and the client accepts the lines without the custom newline
+	if !r.clientIsWindows {
+		action.Newline = "\n"
+	}
 
 	action.SupportBinary = false
 	if action.Protocol > 2 {
@@ -0,0 +1,100 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+)
+
+// primeFileHasher feeds the first `offset` bytes of the file to the hasher, so that the digest
+// still covers the whole file when only the tail is transferred, then seeks the file to the offset.
+func (t *TrzszTransfer) primeFileHasher(file *os.File, offset int64) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hasher := t.newFileHasher()
+	if _, ok := hasher.(nopHasher); !ok {
+		if _, err := io.CopyN(hasher, file, offset); err != nil {
+			return err
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	t.primedHasher = hasher
+	return nil
+}
+
+// recvFileOffset receives the size of the partial file from the receiver, and returns the offset to resume from.
+func (t *TrzszTransfer) recvFileOffset(file *os.File, size int64, progress ProgressCallback) (int64, error) {
+	offset, err := t.recvInteger("OFFSET", false, nil)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset > size {
+		return 0, newTrzszError(fmt.Sprintf("Invalid resume offset %d of size %d", offset, size))
+	}
+	if err := t.sendInteger("SUCC", offset); err != nil {
+		return 0, err
+	}
+	if err := t.primeFileHasher(file, offset); err != nil {
+		return 0, err
+	}
+	if offset > 0 && progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnSize(size - offset)
+	}
+	return offset, nil
+}
+
+// sendFileOffset sends the size of the existing file to resume from, or 0 if it's larger than the incoming file.
+func (t *TrzszTransfer) sendFileOffset(file *os.File, size int64, progress ProgressCallback) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset := stat.Size()
+	if offset > size {
+		offset = 0
+		if err := file.Truncate(0); err != nil {
+			return 0, err
+		}
+	}
+	if err := t.sendInteger("OFFSET", offset); err != nil {
+		return 0, err
+	}
+	if err := t.checkInteger(offset); err != nil {
+		return 0, err
+	}
+	if err := t.primeFileHasher(file, offset); err != nil {
+		return 0, err
+	}
+	if offset > 0 && progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnSize(size - offset)
+	}
+	return offset, nil
+}
@@ -0,0 +1,95 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumePartialFiles(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("0123456789", 2000)
+	writeTestFile(t, filepath.Join(src, "partial.txt"), content)
+	writeTestFile(t, filepath.Join(src, "larger.txt"), content[:5000])
+	files, err := checkPathsReadable([]string{filepath.Join(src, "partial.txt"), filepath.Join(src, "larger.txt")}, false)
+	require.Nil(t, err)
+
+	resumeFiles := func(protocol int, partial string) (*transferResultForTest, string, int) {
+		dest := t.TempDir()
+		writeTestFile(t, filepath.Join(dest, "partial.txt"), partial)
+		writeTestFile(t, filepath.Join(dest, "larger.txt"), content[:6000])
+		args := newDefaultArgsForTest()
+		args.Resume = true
+		args.Binary = true
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		dataSize := 0
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			var length int
+			if _, err := fmt.Sscanf(string(buf), "#DATA:%d\n", &length); err == nil {
+				dataSize += length
+			}
+			return buf
+		}
+		return runTransferForTest(client, server, files, dest), dest, dataSize
+	}
+
+	result, dest, dataSize := resumeFiles(3, content[:8000])
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal([]string{"partial.txt", "larger.txt"}, result.localNames)
+	assert.Equal(12000+5000, dataSize)
+	for _, name := range []string{"partial.txt", "larger.txt"} {
+		expected, err := os.ReadFile(filepath.Join(src, name))
+		require.Nil(t, err)
+		received, err := os.ReadFile(filepath.Join(dest, name))
+		assert.Nil(err)
+		assert.True(bytes.Equal(expected, received), name)
+	}
+
+	// the digest covers the whole file, so a corrupted partial file is detected
+	result, _, _ = resumeFiles(3, "x"+content[1:8000])
+	assert.EqualError(result.recvErr, "Check MD5 failed")
+	assert.EqualError(result.sendErr, "Check MD5 failed")
+
+	// the old peer falls back to transfer the whole file
+	result, dest, dataSize = resumeFiles(2, content[:8000])
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal([]string{"partial.txt.0", "larger.txt.0"}, result.localNames)
+	assert.Equal(20000+5000, dataSize)
+	received, err := os.ReadFile(filepath.Join(dest, "partial.txt.0"))
+	assert.Nil(err)
+	assert.Equal(content, string(received))
+}
@@ -0,0 +1,116 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+)
+
+// chunkResendError is returned by `recvCheck` if the sender resends the chunk before the data is received.
+type chunkResendError struct {
+	offset int64
+}
+
+func (e *chunkResendError) Error() string {
+	return fmt.Sprintf("Chunk resent at offset %d", e.offset)
+}
+
+// sendChunk sends the offset and the data of the chunk, and resends them if the ack is timeout.
+// The receiver acks the end offset of the chunk, so the late acks of the resent chunks can be ignored.
+func (t *TrzszTransfer) sendChunk(offset int64, data []byte) error {
+	end := offset + int64(len(data))
+	for retries := 0; ; retries++ {
+		if err := t.sendInteger("CHUNK", offset); err != nil {
+			return err
+		}
+		if err := t.sendData(data); err != nil {
+			return err
+		}
+		err := t.recvChunkAck(end)
+		if isTimeoutError(err) && retries < t.transferConfig.Retries {
+			t.logger.Warnf("resend the chunk at offset %d, retry %d of %d", offset, retries+1, t.transferConfig.Retries)
+			continue
+		}
+		return err
+	}
+}
+
+func (t *TrzszTransfer) recvChunkAck(end int64) error {
+	timeout := t.getNewTimeout()
+	for {
+		ack, err := t.recvInteger("SUCC", false, timeout)
+		if err != nil {
+			return err
+		}
+		if ack == end {
+			return nil
+		}
+		if ack > end {
+			return NewTrzszError(fmt.Sprintf("Integer check [%d] <> [%d]", ack, end), "", true)
+		}
+	}
+}
+
+// recvChunk receives the chunk at the offset, waits for the resent one if timeout,
+// and acks the duplicated chunks again, whose acks may be lost.
+func (t *TrzszTransfer) recvChunk(offset int64) ([]byte, error) {
+	retries := 0
+	chunkOffset := int64(-1)
+	for {
+		var data []byte
+		var err error
+		if chunkOffset < 0 {
+			chunkOffset, err = t.recvInteger("CHUNK", false, t.getNewTimeout())
+		}
+		if err == nil {
+			data, err = t.recvData()
+		}
+		if e, ok := err.(*chunkResendError); ok && retries < t.transferConfig.Retries {
+			retries++
+			chunkOffset = e.offset
+			continue
+		}
+		if isTimeoutError(err) && retries < t.transferConfig.Retries {
+			retries++
+			chunkOffset = -1
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if chunkOffset > offset {
+			return nil, newTrzszError(fmt.Sprintf("Unexpected chunk offset %d, expect %d", chunkOffset, offset))
+		}
+		if chunkOffset < offset {
+			t.logger.Debugf("ack the duplicated chunk at offset %d again", chunkOffset)
+			if err := t.sendInteger("SUCC", chunkOffset+int64(len(data))); err != nil {
+				return nil, err
+			}
+			chunkOffset = -1
+			continue
+		}
+		return data, nil
+	}
+}
@@ -0,0 +1,86 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkRetries(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("0123456789", 300)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	retryFiles := func(retries int, dropData, dropAck bool) (*transferResultForTest, string, int32) {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Timeout = 1
+		args.ChunkRetries = retries
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, 3)
+		var dataCount atomic.Int32
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if strings.HasPrefix(string(buf), "#DATA:") && dataCount.Add(1) == 1 && dropData {
+				return buf[:0]
+			}
+			return buf
+		}
+		var ackDropped atomic.Bool
+		server.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if string(buf) == "#SUCC:1024\n" && dropAck && ackDropped.CompareAndSwap(false, true) {
+				return buf[:0]
+			}
+			return buf
+		}
+		return runTransferForTest(client, server, files, dest), dest, dataCount.Load()
+	}
+
+	// the first data is lost, and resent after timeout
+	result, dest, dataCount := retryFiles(1, true, false)
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+	assert.Equal(int32(4), dataCount)
+
+	// the first ack is lost, the duplicated chunk is acked again but not written
+	result, dest, dataCount = retryFiles(1, false, true)
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+	assert.Equal(int32(4), dataCount)
+
+	// give up without retries
+	result, _, _ = retryFiles(0, true, false)
+	assert.EqualError(result.recvErr, "Receive data timeout")
+}
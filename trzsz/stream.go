@@ -0,0 +1,218 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// kStreamSize is sent as the `#SIZE` of a stream, e.g., from stdin. The data of it is sent until EOF,
+// then an empty chunk marks the end, as the size is unknown before that.
+const kStreamSize = -1
+
+// newStreamFile sends the data read from the reader as a file with the name, in the stream mode.
+func newStreamFile(name string, reader io.ReadCloser) *TrzszFile {
+	return &TrzszFile{RelPath: []string{name}, Reader: reader}
+}
+
+// sendFileStream sends the data of the stream until EOF, and verifies it like a regular file.
+func (t *TrzszTransfer) sendFileStream(ctx context.Context, idx int64, f *TrzszFile, beginTime time.Time,
+	progress ProgressCallback) error {
+	if err := t.sendInteger("SIZE", kStreamSize); err != nil {
+		return err
+	}
+	if err := t.checkInteger(kStreamSize); err != nil {
+		return err
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnSize(kStreamSize)
+	}
+
+	dataBeginTime := timeNowFunc()
+	t.resetDataCompress()
+	t.verifyFile = t.needVerify(idx, kStreamSize)
+	size, digest, err := t.sendStreamData(ctx, f.Reader, progress)
+	if err != nil {
+		return err
+	}
+
+	t.fileCount++
+	if t.verifyFile {
+		if err := t.sendFileMD5(digest, t.progressBeforeResult(progress)); err != nil {
+			return err
+		}
+		t.verifiedCount++
+	} else if p := t.progressBeforeResult(progress); p != nil && !reflect.ValueOf(p).IsNil() {
+		p.OnDone()
+	}
+	if t.transferConfig.KeepGoing {
+		if err := t.recvFileResult(strings.Join(f.RelPath, "/"), progress); err != nil {
+			return err
+		}
+	}
+	if t.verifyFile {
+		t.onFileHash(progress, strings.Join(f.RelPath, "/"), digest)
+	}
+	t.logger.Infof("sent stream %s, %d bytes", strings.Join(f.RelPath, "/"), size)
+	t.addFileResult(strings.Join(f.RelPath, "/"), size, beginTime, dataBeginTime)
+	return nil
+}
+
+func (t *TrzszTransfer) sendStreamData(ctx context.Context, reader io.Reader, progress ProgressCallback) (int64, []byte, error) {
+	step := int64(0)
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnStep(step)
+	}
+	policy := t.getBufferPolicy()
+	bufSize := policy.InitialSize
+	buffer := make([]byte, bufSize)
+	hasher := t.newFileHasher()
+	for {
+		t.waitIfPaused(ctx)
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		beginTime := time.Now()
+		n, err := reader.Read(buffer)
+		if err != nil && err != io.EOF {
+			return 0, nil, err
+		}
+		if n == 0 && err == nil {
+			continue
+		}
+		length := int64(n)
+		data := buffer[:n]
+		// the empty chunk at EOF marks the end of the stream
+		if err := t.sendData(data); err != nil {
+			return 0, nil, err
+		}
+		if err := t.checkInteger(length); err != nil {
+			return 0, nil, err
+		}
+		if length == 0 {
+			break
+		}
+		if _, err := hasher.Write(data); err != nil {
+			return 0, nil, err
+		}
+		step += length
+		if progress != nil && !reflect.ValueOf(progress).IsNil() {
+			progress.OnStep(step)
+		}
+		chunkTime := time.Now().Sub(beginTime)
+		if next := policy.nextSize(bufSize, length, chunkTime); next != bufSize {
+			bufSize = next
+			buffer = make([]byte, bufSize)
+		}
+		t.updateMaxChunkTime(chunkTime)
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnSize(step)
+	}
+	return step, hasher.Sum(nil), nil
+}
+
+func (t *TrzszTransfer) recvStreamSize(progress ProgressCallback) error {
+	if err := t.sendInteger("SUCC", kStreamSize); err != nil {
+		return err
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnSize(kStreamSize)
+	}
+	return nil
+}
+
+// recvFileStream receives the data of the stream until the empty chunk, and returns the size of it.
+// The max file size and the quota are checked as the data is received.
+func (t *TrzszTransfer) recvFileStream(ctx context.Context, file *os.File, progress ProgressCallback) (int64, []byte, error) {
+	defer file.Close()
+	step := int64(0)
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnStep(step)
+	}
+	hasher := t.newFileHasher()
+	for {
+		t.waitIfPaused(ctx)
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		beginTime := time.Now()
+		data, err := t.recvData()
+		if err != nil {
+			return 0, nil, err
+		}
+		length := int64(len(data))
+		if length > 0 {
+			if err := t.checkStreamSize(file, step+length, length); err != nil {
+				return 0, nil, err
+			}
+		}
+		if err := t.writeFileData(file, data); err != nil {
+			return 0, nil, err
+		}
+		if err := t.sendInteger("SUCC", length); err != nil {
+			return 0, nil, err
+		}
+		if length == 0 {
+			break
+		}
+		if _, err := hasher.Write(data); err != nil {
+			return 0, nil, err
+		}
+		step += length
+		if progress != nil && !reflect.ValueOf(progress).IsNil() {
+			progress.OnStep(step)
+		}
+		t.updateMaxChunkTime(time.Now().Sub(beginTime))
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnSize(step)
+	}
+	return step, hasher.Sum(nil), nil
+}
+
+// checkStreamSize removes the partial file if the stream grows beyond the max file size or the quota.
+// The max file size is checked for each entry of the tar stream instead, and the quota isn't used by the skipped file.
+func (t *TrzszTransfer) checkStreamSize(file *os.File, size, length int64) error {
+	if t.maxFile > 0 && size > t.maxFile && !t.useTar() {
+		t.maxFileExceeded = true
+		t.removePartialFile(file)
+		return newTrzszError(fmt.Sprintf("Stream size exceeds the max file size %s: %s",
+			convertSizeToString(float64(t.maxFile)), file.Name()))
+	}
+	if t.quota != nil && t.skippedPath == "" {
+		if err := t.quota.check(length); err != nil {
+			t.removePartialFile(file)
+			return err
+		}
+	}
+	return nil
+}
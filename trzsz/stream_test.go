@@ -0,0 +1,119 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStreamForTest(data []byte) []*TrzszFile {
+	return []*TrzszFile{newStreamFile("out.bin", io.NopCloser(bytes.NewReader(data)))}
+}
+
+func TestTransferStream(t *testing.T) {
+	assert := assert.New(t)
+	large := make([]byte, 100*1024)
+	rand.Read(large)
+	for _, data := range [][]byte{large, []byte("hello trzsz"), {}} {
+		for _, binary := range []bool{false, true} {
+			dest := t.TempDir()
+			args := newDefaultArgsForTest()
+			args.Binary = binary
+			args.Stream = true
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, 4)
+			recorder := &progressRecorder{}
+			var result transferResultForTest
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				result.remoteNames, result.sendErr = client.sendFiles(newStreamForTest(data), nil)
+			}()
+			result.localNames, result.recvErr = server.recvFiles(dest, recorder)
+			<-done
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+			assert.Equal([]string{"out.bin"}, result.localNames)
+			assertFileContent(t, filepath.Join(dest, "out.bin"), string(data))
+			assert.Equal(int64(len(data)), server.GetTransferResult().Bytes)
+
+			// the size is unknown until the end of the stream
+			assert.Contains(recorder.calls, "size -1")
+			assert.Contains(recorder.calls, fmt.Sprintf("size %d", len(data)))
+		}
+	}
+}
+
+func TestStreamNotNegotiated(t *testing.T) {
+	args := newDefaultArgsForTest()
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 4)
+	result := runTransferForTest(client, server, newStreamForTest([]byte("hello")), t.TempDir())
+	assert.EqualError(t, result.recvErr, "Invalid size -1")
+}
+
+func TestStreamMaxFile(t *testing.T) {
+	assert := assert.New(t)
+	dest := t.TempDir()
+	args := newDefaultArgsForTest()
+	args.Stream = true
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 4)
+	server.maxFile = 3000
+	result := runTransferForTest(client, server, newStreamForTest(make([]byte, 5000)), dest)
+	require.NotNil(t, result.recvErr)
+	assert.Equal("Stream size exceeds the max file size 2.93 KB: "+filepath.Join(dest, "out.bin"), result.recvErr.Error())
+	_, err := os.Stat(filepath.Join(dest, "out.bin"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestCheckStreamArgs(t *testing.T) {
+	assert := assert.New(t)
+	args := &TszArgs{Name: "out.bin"}
+	assert.Nil(checkStreamArgs(args))
+	assert.True(args.Stream)
+
+	assert.Nil(checkStreamArgs(&TszArgs{File: []string{"a.txt"}}))
+	assert.EqualError(checkStreamArgs(&TszArgs{}), "file(s) to be sent or --name is required")
+	assert.EqualError(checkStreamArgs(&TszArgs{Name: "out.bin", File: []string{"a.txt"}}),
+		"--name can't be used with file(s)")
+	assert.EqualError(checkStreamArgs(&TszArgs{Name: filepath.Join("dir", "out.bin")}),
+		"--name should be a file name without directories: "+filepath.Join("dir", "out.bin"))
+	args = &TszArgs{Name: "out.bin"}
+	args.Parallel = 4
+	assert.EqualError(checkStreamArgs(args), "--name can't be used with --parallel")
+	args = &TszArgs{Name: "out.bin"}
+	args.Tar = true
+	assert.EqualError(checkStreamArgs(args), "--name can't be used with --tar")
+}
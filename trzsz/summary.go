@@ -0,0 +1,89 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func compactSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		value /= 1024
+		if value < 1024 || unit == "T" {
+			return fmt.Sprintf("%.1f%s", value, unit)
+		}
+	}
+	return "" // unreachable
+}
+
+func compactDuration(duration time.Duration) string {
+	seconds := int64(duration.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
+
+// formatSummary renders the transfer result in a compact one line, e.g., "{direction} {files}f {size} {duration}".
+// The placeholders are {direction} (↑ sent or ↓ received), {files}, {bytes}, {size} and {duration}.
+func formatSummary(format string, result *TransferResult) string {
+	direction := "↓"
+	if result.Sent {
+		direction = "↑"
+	}
+	return strings.NewReplacer(
+		"{direction}", direction,
+		"{files}", strconv.Itoa(result.FileCount),
+		"{bytes}", strconv.FormatInt(result.Bytes, 10),
+		"{size}", compactSize(result.Bytes),
+		"{duration}", compactDuration(result.Duration),
+	).Replace(format)
+}
+
+// writeSummary writes the compact summary to the file if specified, otherwise to stderr.
+func writeSummary(path, format string, result *TransferResult, writer io.Writer) error {
+	if len(format) == 0 || result == nil {
+		return nil
+	}
+	if len(path) > 0 {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	_, err := fmt.Fprintln(writer, formatSummary(format, result))
+	return err
+}
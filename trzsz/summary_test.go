@@ -0,0 +1,76 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatSummary(t *testing.T) {
+	assert := assert.New(t)
+	result := &TransferResult{Sent: true, Duration: 42*time.Second + 300*time.Millisecond, FileCount: 340,
+		Bytes: 340 * 13 * 1024 * 1024}
+	assert.Equal("↑ 340f 4.3G 00:42", formatSummary("{direction} {files}f {size} {duration}", result))
+	assert.Equal("sent 340 files, 4634705920 bytes", formatSummary("sent {files} files, {bytes} bytes", result))
+
+	result = &TransferResult{Duration: 3723 * time.Second, FileCount: 2, Bytes: 100}
+	assert.Equal("↓ 2f 100B 1:02:03", formatSummary("{direction} {files}f {size} {duration}", result))
+	assert.Equal("{unknown} 0f", formatSummary("{unknown} {files}f", &TransferResult{}))
+
+	assert.Equal("1.0K", compactSize(1024))
+	assert.Equal("1.5M", compactSize(1536*1024))
+	assert.Equal("2048.0T", compactSize(2048*1024*1024*1024*1024))
+	assert.Equal("00:00", compactDuration(400*time.Millisecond))
+	assert.Equal("01:01", compactDuration(61*time.Second))
+}
+
+func TestWriteSummary(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "summary.txt")
+	result := &TransferResult{Duration: 5 * time.Second, FileCount: 1, Bytes: 2048}
+	assert.Nil(writeSummary(path, "{direction} {files}f {size} {duration}", result, io.Discard))
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal("↓ 1f 2.0K 00:05\n", string(content))
+
+	// nothing is written without the format
+	assert.Nil(os.Remove(path))
+	assert.Nil(writeSummary(path, "", result, io.Discard))
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	// written to the writer without the path
+	var buf bytes.Buffer
+	assert.Nil(writeSummary("", "{files}f", result, &buf))
+	assert.Equal("1f\n", buf.String())
+}
@@ -0,0 +1,105 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isSafeLink returns false if the target is an absolute path, or points to outside of the transferred directory.
+// A link not under any transferred directory is never safe.
+func isSafeLink(relPath []string, target string) bool {
+	if len(relPath) < 2 {
+		return false
+	}
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" || strings.HasPrefix(target, string(filepath.Separator)) {
+		return false
+	}
+	p := filepath.Join(filepath.Join(relPath[1:len(relPath)-1]...), target)
+	return p != ".." && !strings.HasPrefix(p, ".."+string(filepath.Separator))
+}
+
+// isUnsafeName returns true if the name could escape the directory it's joined to, e.g., `..`, `../x` and `/x`,
+// or `..\x` and `C:x` on Windows. The backslash is a plain character in the names on other systems.
+func isUnsafeName(name string) bool {
+	return name == ".." || strings.ContainsAny(name, "/"+string(filepath.Separator)) ||
+		filepath.IsAbs(name) || filepath.VolumeName(name) != ""
+}
+
+// checkEntryPath refuses the names which are not plain, and the existing symlinks among the parent directories
+// of the entry, unless unsafe links are allowed. Otherwise, the links which are safe one by one could escape
+// together, e.g., `dir/s -> .` and then `dir/s/x -> ..` which actually points to the parent of `dir`.
+func (t *TrzszTransfer) checkEntryPath(path string, names []string) error {
+	for _, name := range names {
+		if isUnsafeName(name) {
+			return newTrzszError(fmt.Sprintf("Unsafe path: %s", strings.Join(names, "/")))
+		}
+		if name == "" || name == "." {
+			return newTrzszError(fmt.Sprintf("Invalid name: %s", strings.Join(names, "/")))
+		}
+	}
+	if t.unsafeLinks {
+		return nil
+	}
+	p := path
+	for _, name := range names[:len(names)-1] {
+		p = filepath.Join(p, name)
+		stat, err := os.Lstat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 || isReparsePoint(stat) {
+			return newTrzszError(fmt.Sprintf("Unsafe path through the symlink: %s", p))
+		}
+	}
+	return nil
+}
+
+// createLink recreates the symlink instead of a regular file. An existing symlink is replaced,
+// while an existing file or directory is kept in skip or update mode, otherwise it's an error.
+func (t *TrzszTransfer) createLink(f *TrzszFile, fullPath string) error {
+	target := filepath.FromSlash(f.LinkTarget)
+	if !t.unsafeLinks && !isSafeLink(f.RelPath, target) {
+		return newTrzszError(fmt.Sprintf("Unsafe link: %s -> %s", strings.Join(f.RelPath, "/"), f.LinkTarget))
+	}
+	if stat, err := os.Lstat(fullPath); err == nil {
+		if t.skipExisting(stat) {
+			return nil
+		}
+		if stat.Mode()&os.ModeSymlink == 0 {
+			return newTrzszError(fmt.Sprintf("Not a symlink: %s", fullPath))
+		}
+		if err := os.Remove(fullPath); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, fullPath)
+}
@@ -0,0 +1,354 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// useTar returns true if the files are packed into a tar stream, which is sent as the only file in the stream mode.
+// The modes relying on the files one by one, or on the size of them, are not supported then.
+func (t *TrzszTransfer) useTar() bool {
+	c := &t.transferConfig
+	return c.Tar && !c.Patch && !c.Audit && !c.Resume && !c.Update && !c.Checksum && !c.Atomic && !c.Dedup && !c.KeepGoing &&
+		!c.Preserve && !c.Preview && c.Retries == 0 && c.CheckEvery == 0 && c.StartAt == 0
+}
+
+// checkTarArg rejects the options which can't be used with `--tar`, instead of sending the files one by one silently.
+func checkTarArg(opts *TransferOptions) error {
+	if !opts.Tar {
+		return nil
+	}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{
+		{opts.Preserve, "-p"},
+		{opts.Resume, "-r"},
+		{opts.Update, "--update"},
+		{opts.Checksum, "--checksum"},
+		{opts.Atomic, "--atomic"},
+		{opts.Dedup, "--dedup"},
+		{opts.Patch, "--patch"},
+		{opts.Audit || opts.AuditPull, "--audit"},
+		{opts.KeepGoing, "--keep-going"},
+		{opts.ChunkRetries > 0, "--retries"},
+		{opts.CheckEvery.Size > 0, "--check-every"},
+		{opts.StartAt > 0, "--start-at"},
+		{opts.Preview, "--preview"},
+	} {
+		if opt.set {
+			return fmt.Errorf("--tar can't be used with %s", opt.name)
+		}
+	}
+	return nil
+}
+
+// getTarStreamName returns the name of the tar stream shown in the progress, after the only top-level name if any.
+func getTarStreamName(files []*TrzszFile) string {
+	if len(files) == 0 {
+		return "files.tar"
+	}
+	for _, f := range files {
+		if f.RelPath[0] != files[0].RelPath[0] {
+			return "files.tar"
+		}
+	}
+	return files[0].RelPath[0] + ".tar"
+}
+
+// newTarStream packs the files into a tar stream on the fly. The stream fails with the error of reading the files,
+// and the packing is stopped once the stream is closed.
+func (t *TrzszTransfer) newTarStream(files []*TrzszFile) *TrzszFile {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTarEntries(writer, files))
+	}()
+	return newStreamFile(getTarStreamName(files), reader)
+}
+
+func writeTarEntries(writer io.Writer, files []*TrzszFile) error {
+	tw := tar.NewWriter(writer)
+	for _, f := range files {
+		if err := writeTarEntry(tw, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, f *TrzszFile) error {
+	header := &tar.Header{
+		Name:    strings.Join(f.RelPath, "/"),
+		Mode:    int64(f.Mode & 0777),
+		ModTime: time.Unix(f.ModTime, 0),
+	}
+	if f.IsDir {
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+		return tw.WriteHeader(header)
+	}
+	if f.IsLink && len(f.LinkTarget) > 0 {
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = f.LinkTarget
+		return tw.WriteHeader(header)
+	}
+	file, err := os.Open(f.AbsPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header.Typeflag = tar.TypeReg
+	header.Size = stat.Size()
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, file, header.Size); err != nil {
+		return fmt.Errorf("read %s error: %v", f.AbsPath, err)
+	}
+	return nil
+}
+
+// tarEntry is a file extracted from the tar stream, which is reported after the stream is verified.
+type tarEntry struct {
+	path string
+	size int64
+}
+
+// tarExtractor extracts the tar stream written to the pipe, as the data is received.
+type tarExtractor struct {
+	writer  *os.File
+	done    chan struct{}
+	err     error
+	names   []string
+	entries []*tarEntry
+	created []string
+}
+
+// newTarExtractor extracts the entries to the path in another goroutine. Once the extraction fails,
+// the pipe is closed, and the following data can't be written to it.
+func (t *TrzszTransfer) newTarExtractor(path string) (*tarExtractor, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	e := &tarExtractor{writer: writer, done: make(chan struct{})}
+	go func() {
+		err := t.extractTar(e, reader, path)
+		if err == nil {
+			// the padding after the end of the archive
+			_, err = io.Copy(io.Discard, reader)
+		}
+		e.err = err
+		close(e.done)
+		reader.Close()
+	}()
+	return e, nil
+}
+
+// wait waits for the extraction after the stream is received. The error of the extraction takes precedence
+// if it's done before the error of receiving, as the latter is caused by the closed pipe then.
+func (e *tarExtractor) wait(err error) error {
+	if err != nil {
+		select {
+		case <-e.done:
+			if e.err != nil {
+				return e.err
+			}
+		default:
+		}
+	}
+	e.writer.Close()
+	<-e.done
+	if err != nil {
+		return err
+	}
+	return e.err
+}
+
+// removeExtracted removes the extracted files and links after the stream fails, the same as the partial file
+// received one by one. The extracted directories are removed after their children, only if they're empty.
+func (e *tarExtractor) removeExtracted() {
+	for i := len(e.created) - 1; i >= 0; i-- {
+		_ = os.Remove(e.created[i])
+	}
+}
+
+// extractTar creates the entries the same as the entries received one by one, so the names are renamed or
+// overwritten by the same rules, and the names escaping the path or the unsafe links are refused.
+func (t *TrzszTransfer) extractTar(e *tarExtractor, reader io.Reader, path string) error {
+	tr := tar.NewReader(reader)
+	pathIDs := make(map[string]int)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newTrzszError(fmt.Sprintf("Read tar stream error: %v", err))
+		}
+		relPath := strings.Split(strings.TrimSuffix(header.Name, "/"), "/")
+		pathID, ok := pathIDs[relPath[0]]
+		if !ok {
+			pathID = len(pathIDs)
+			pathIDs[relPath[0]] = pathID
+		}
+		f := &TrzszFile{PathID: pathID, RelPath: relPath, ModTime: header.ModTime.Unix(), Mode: uint32(header.Mode)}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			f.IsDir = true
+		case tar.TypeSymlink:
+			f.IsLink = true
+			f.LinkTarget = header.Linkname
+		case tar.TypeReg:
+			if err := t.checkMaxFileSize(header.Size); err != nil {
+				return err
+			}
+		default:
+			return newTrzszError(fmt.Sprintf("Unsupported tar entry type %q: %s", header.Typeflag, header.Name))
+		}
+		meta := TransferFileMeta{Name: strings.Join(relPath, "/"), Size: -1, IsDir: f.IsDir}
+		if header.Typeflag == tar.TypeReg {
+			meta.Size = header.Size
+		}
+		if err := t.checkPreReceive(meta); err != nil {
+			return err
+		}
+
+		file, localName, _, fullPath, err := t.createEntry(path, f)
+		if err != nil && err != errSkipExisting {
+			return err
+		}
+		if localName != "" && !containsString(e.names, localName) {
+			e.names = append(e.names, localName)
+		}
+		if err == nil && f.IsLink {
+			// the full path is only returned for the regular files
+			fullPath = filepath.Join(path, localName)
+			if !t.flatten {
+				fullPath = filepath.Join(append([]string{fullPath}, f.RelPath[1:]...)...)
+			}
+		}
+		if err == nil && fullPath != "" {
+			e.created = append(e.created, fullPath)
+		}
+		if file == nil {
+			continue
+		}
+		t.logger.Infof("extract file %s", fullPath)
+		_, err = io.Copy(file, tr)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		e.entries = append(e.entries, &tarEntry{fullPath, header.Size})
+	}
+}
+
+// recvFilesTar receives the tar stream as the only file, and extracts the entries to the path as the data arrives.
+// The stream is verified as a whole, then the extracted files are reported.
+func (t *TrzszTransfer) recvFilesTar(ctx context.Context, path string, num int64, progress ProgressCallback) ([]string, error) {
+	if num != 1 {
+		return nil, newTrzszError(fmt.Sprintf("Expect only one tar stream, but got %d", num))
+	}
+	beginTime := timeNowFunc()
+	name, err := t.recvString("NAME", false)
+	if err != nil {
+		return nil, err
+	}
+	if t.transferConfig.Directory {
+		var f TrzszFile
+		if err := json.Unmarshal([]byte(name), &f); err != nil {
+			return nil, err
+		}
+		if len(f.RelPath) != 1 {
+			return nil, newTrzszError(fmt.Sprintf("Invalid name: %s", name))
+		}
+		name = f.RelPath[0]
+	}
+	if err := t.sendString("SUCC", name); err != nil {
+		return nil, err
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnName(name)
+	}
+
+	size, err := t.recvFileSize(progress)
+	if err != nil {
+		return nil, err
+	}
+	if size != kStreamSize {
+		return nil, newTrzszError(fmt.Sprintf("Invalid tar stream size %d", size))
+	}
+
+	dataBeginTime := timeNowFunc()
+	t.verifyFile = t.needVerify(0, size)
+	extractor, err := t.newTarExtractor(path)
+	if err != nil {
+		return nil, err
+	}
+	size, digest, err := t.recvFileStream(ctx, extractor.writer, progress)
+	if err := extractor.wait(err); err != nil {
+		extractor.removeExtracted()
+		return nil, err
+	}
+
+	t.fileCount++
+	if t.verifyFile {
+		if err := t.recvFileMD5(digest, progress); err != nil {
+			extractor.removeExtracted()
+			return nil, err
+		}
+		t.verifiedCount++
+	} else if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnDone()
+	}
+	t.logger.Infof("received tar stream %s, %d bytes", name, size)
+	for _, entry := range extractor.entries {
+		reportFileDone(progress, entry.path, entry.size)
+		t.addFileResult(localRelPath(path, entry.path), entry.size, beginTime, dataBeginTime)
+	}
+	if t.quota != nil {
+		if err := t.quota.add(size); err != nil {
+			return nil, err
+		}
+	}
+	return extractor.names, nil
+}
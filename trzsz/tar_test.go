@@ -0,0 +1,274 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferTar(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "hello trzsz")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "b.bin"), string([]byte{0, 1, 2, 0xee, 0x7e, 0x1b, 0x03}))
+	require.Nil(t, os.MkdirAll(filepath.Join(src, "dir", "empty"), 0755))
+	writeTestFile(t, filepath.Join(src, "c.txt"), "ccc")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir"), filepath.Join(src, "c.txt")}, true)
+	require.Nil(t, err)
+
+	transferTar := func(protocol int, binary bool, dest string) (*transferResultForTest, int32, *TrzszTransfer) {
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Binary = binary
+		args.Tar = true
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		var nameCount atomic.Int32
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if strings.HasPrefix(string(buf), "#NAME:") {
+				nameCount.Add(1)
+			}
+			return buf
+		}
+		return runTransferForTest(client, server, files, dest), nameCount.Load(), server
+	}
+	assertFiles := func(dest, dir string) {
+		for _, name := range []string{"a.txt", filepath.Join("sub", "b.bin")} {
+			expected, err := os.ReadFile(filepath.Join(src, "dir", name))
+			require.Nil(t, err)
+			assertFileContent(t, filepath.Join(dest, dir, name), string(expected))
+		}
+		assertEmptyDir(t, filepath.Join(dest, dir, "empty"))
+		assertFileContent(t, filepath.Join(dest, "c.txt"), "ccc")
+	}
+
+	for _, binary := range []bool{false, true} {
+		dest := t.TempDir()
+		result, nameCount, server := transferTar(kProtocolVersion, binary, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal(int32(1), nameCount)
+		assert.Equal([]string{"files.tar"}, result.remoteNames)
+		assert.Equal([]string{"dir", "c.txt"}, result.localNames)
+		assertFiles(dest, "dir")
+		assert.Equal(int64(1), server.verifiedCount)
+		assert.Equal(3, server.GetTransferResult().FileCount)
+
+		// the existing top-level names are renamed as the files received one by one
+		result, _, _ = transferTar(kProtocolVersion, binary, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{"dir.0", "c.txt.0"}, result.localNames)
+		assertFiles(dest, "dir.0")
+	}
+
+	// the extracted files are removed if the stream fails the hash check
+	for _, binary := range []bool{false, true} {
+		dest := t.TempDir()
+		writeTestFile(t, filepath.Join(dest, "keep.txt"), "keep")
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Binary = binary
+		args.Tar = true
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, kProtocolVersion)
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if strings.HasPrefix(string(buf), "#MD5:") {
+				return []byte("#MD5:" + encodeBytesWith(make([]byte, 16), client.transferConfig.Compress) + "\n")
+			}
+			return buf
+		}
+		result := runTransferForTest(client, server, files, dest)
+		require.NotNil(t, result.recvErr)
+		assert.Contains(result.recvErr.Error(), "Check MD5 failed")
+		entries, err := os.ReadDir(dest)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(entries))
+		assert.Equal("keep.txt", entries[0].Name())
+	}
+
+	// the peer of an older protocol receives the files one by one
+	dest := t.TempDir()
+	result, nameCount, _ := transferTar(3, false, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	assert.Equal(int32(len(files)), nameCount)
+	assertFiles(dest, "dir")
+}
+
+func TestTransferTarSymlinks(t *testing.T) {
+	if IsWindows() {
+		t.Skip("creating symlinks requires privileges on Windows")
+	}
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "aaa")
+	require.Nil(t, os.Symlink("a.txt", filepath.Join(src, "dir", "rel")))
+	files, err := checkPathsReadableWith([]string{filepath.Join(src, "dir")}, pathOptions{directory: true})
+	require.Nil(t, err)
+
+	dest := t.TempDir()
+	args := newDefaultArgsForTest()
+	args.Directory = true
+	args.Tar = true
+	result := transferFilesForTest(t, args, kProtocolVersion, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	target, err := os.Readlink(filepath.Join(dest, "dir", "rel"))
+	require.Nil(t, err)
+	assert.Equal("a.txt", target)
+
+	// the unsafe link is refused while extracting
+	require.Nil(t, os.Symlink("../../outside", filepath.Join(src, "dir", "up")))
+	files, err = checkPathsReadableWith([]string{filepath.Join(src, "dir")}, pathOptions{directory: true})
+	require.Nil(t, err)
+	result = transferFilesForTest(t, args, kProtocolVersion, files, t.TempDir())
+	require.NotNil(t, result.recvErr)
+	assert.Contains(result.recvErr.Error(), "Unsafe link: dir/up -> ../../outside")
+}
+
+// newTarForTest packs the entries, the data of the regular files is the name of them.
+func newTarForTest(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		require.Nil(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(header.Name))
+			require.Nil(t, err)
+		}
+	}
+	require.Nil(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	assert := assert.New(t)
+	extract := func(transfer *TrzszTransfer, dest string, headers ...*tar.Header) (*tarExtractor, error) {
+		extractor, err := transfer.newTarExtractor(dest)
+		require.Nil(t, err)
+		_, err = extractor.writer.Write(newTarForTest(t, headers...))
+		return extractor, extractor.wait(err)
+	}
+
+	dest := t.TempDir()
+	extractor, err := extract(NewTransfer(nil, nil, false), dest,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "b.txt", Typeflag: tar.TypeReg})
+	require.Nil(t, err)
+	assert.Equal([]string{"dir", "b.txt"}, extractor.names)
+	require.Equal(t, 2, len(extractor.entries))
+	assert.Equal(filepath.Join(dest, "dir", "a.txt"), extractor.entries[0].path)
+	assert.Equal(int64(9), extractor.entries[0].size)
+	assertFileContent(t, filepath.Join(dest, "dir", "a.txt"), "dir/a.txt")
+	assertFileContent(t, filepath.Join(dest, "b.txt"), "b.txt")
+
+	// the existing files are overwritten in place with -y
+	transfer := NewTransfer(nil, nil, false)
+	transfer.transferConfig.Overwrite = true
+	extractor, err = extract(transfer, dest, &tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg})
+	require.Nil(t, err)
+	assert.Equal([]string{"dir"}, extractor.names)
+	_, err = os.Stat(filepath.Join(dest, "dir.0"))
+	assert.True(os.IsNotExist(err))
+
+	for _, c := range []struct {
+		header *tar.Header
+		err    string
+	}{
+		{&tar.Header{Name: "../evil.txt", Typeflag: tar.TypeReg}, "Unsafe path: ../evil.txt"},
+		{&tar.Header{Name: "dir/../../evil.txt", Typeflag: tar.TypeReg}, "Unsafe path: dir/../../evil.txt"},
+		{&tar.Header{Name: "/evil.txt", Typeflag: tar.TypeReg}, "Invalid name: /evil.txt"},
+		{&tar.Header{Name: "dir/hard", Typeflag: tar.TypeLink, Linkname: "dir/a.txt"}, "Unsupported tar entry type '1': dir/hard"},
+		{&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../evil"}, "Unsafe link: link -> ../evil"},
+	} {
+		dest := t.TempDir()
+		_, err := extract(NewTransfer(nil, nil, false), dest, c.header)
+		require.NotNil(t, err, c.header.Name)
+		assert.Contains(err.Error(), c.err)
+		entries, err := os.ReadDir(dest)
+		require.Nil(t, err)
+		assert.Empty(entries, c.header.Name)
+	}
+
+	// the max file size is checked for each entry
+	transfer = NewTransfer(nil, nil, false)
+	transfer.maxFile = 5
+	_, err = extract(transfer, t.TempDir(), &tar.Header{Name: "b.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg})
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), "exceeds the max file size")
+
+	// the extracted entries are removed on failure, but not the existing ones
+	dest = t.TempDir()
+	writeTestFile(t, filepath.Join(dest, "keep.txt"), "keep")
+	extractor, err = extract(NewTransfer(nil, nil, false), dest,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "dir/sub/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "dir/sub/a.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "keep.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "dir/../../evil.txt", Typeflag: tar.TypeReg})
+	require.NotNil(t, err)
+	assert.Equal(4, len(extractor.created))
+	extractor.removeExtracted()
+	entries, err := os.ReadDir(dest)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	assert.Equal("keep.txt", entries[0].Name())
+	assertFileContent(t, filepath.Join(dest, "keep.txt"), "keep")
+}
+
+func TestCheckTarArg(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(checkTarArg(&TransferOptions{Preserve: true}))
+	assert.Nil(checkTarArg(&TransferOptions{Tar: true, Directory: true, Binary: true}))
+	assert.EqualError(checkTarArg(&TransferOptions{Tar: true, Preserve: true}), "--tar can't be used with -p")
+	assert.EqualError(checkTarArg(&TransferOptions{Tar: true, AuditPull: true}), "--tar can't be used with --audit")
+	assert.EqualError(checkTarArg(&TransferOptions{Tar: true, ChunkRetries: 3}), "--tar can't be used with --retries")
+	assert.EqualError(checkTarArg(&TransferOptions{Tar: true, CheckEvery: BufferSize{1024}}), "--tar can't be used with --check-every")
+	assert.EqualError(checkTrzTarArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Tar: true}}, PatchBase: "base"}),
+		"--tar can't be used with --patch-base")
+
+	// the library users get the error too, instead of sending the files one by one silently
+	client, server := newLoopbackTransfers()
+	require.Nil(t, client.sendAction(true, false))
+	action, err := server.RecvAction()
+	require.Nil(t, err)
+	assert.EqualError(server.SendConfig(TransferOptions{Tar: true, Update: true}, action), "--tar can't be used with --update")
+}
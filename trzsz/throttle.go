@@ -0,0 +1,173 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"context"
+	"time"
+)
+
+const kThrottleLatencyFactor = 4
+const kThrottleMinLatency = 200 * time.Millisecond
+
+// BufferPolicy is how the sender adapts the size of the chunks to the link. The size starts from InitialSize,
+// doubles after a full chunk is acked in less than GrowBelow, and drops back to MinSize after a chunk takes
+// ShrinkAbove or longer, within MinSize and MaxSize. The zero fields are the defaults, i.e., 1024 bytes
+// to the max buffer size of the transfer, growing under 500ms and shrinking over 2s. A high latency
+// high bandwidth link may grow faster with a larger InitialSize and GrowBelow.
+type BufferPolicy struct {
+	InitialSize int64
+	MinSize     int64
+	MaxSize     int64
+	GrowBelow   time.Duration
+	ShrinkAbove time.Duration
+}
+
+// WithBufferPolicy sets the buffer growth policy of sending, the MaxSize is capped by the max buffer size
+// in the config, and the policy is ignored if the chunk sizes are scheduled.
+func WithBufferPolicy(policy BufferPolicy) TransferOption {
+	return func(t *TrzszTransfer) {
+		t.bufferPolicy = policy
+	}
+}
+
+// getBufferPolicy returns the buffer policy with the defaults, after the config is negotiated.
+func (t *TrzszTransfer) getBufferPolicy() *BufferPolicy {
+	p := t.bufferPolicy
+	if p.MaxSize <= 0 || p.MaxSize > t.transferConfig.MaxBufSize {
+		p.MaxSize = t.transferConfig.MaxBufSize
+	}
+	if p.MinSize <= 0 {
+		p.MinSize = 1024
+	}
+	p.MinSize = minInt64(p.MinSize, p.MaxSize)
+	p.InitialSize = minInt64(maxInt64(p.InitialSize, p.MinSize), p.MaxSize)
+	if p.GrowBelow <= 0 {
+		p.GrowBelow = 500 * time.Millisecond
+	}
+	if p.ShrinkAbove <= 0 {
+		p.ShrinkAbove = 2 * time.Second
+	}
+	return &p
+}
+
+// nextSize returns the buffer size after a chunk of the length is sent and acked in the chunk time.
+func (p *BufferPolicy) nextSize(bufSize, length int64, chunkTime time.Duration) int64 {
+	if length == bufSize && chunkTime < p.GrowBelow && bufSize < p.MaxSize {
+		return minInt64(bufSize*2, p.MaxSize)
+	}
+	if chunkTime >= p.ShrinkAbove && bufSize > p.MinSize {
+		return p.MinSize
+	}
+	return bufSize
+}
+
+// adaptiveThrottle uses the time from writing a chunk to receiving its ack as a proxy for
+// how backed-up the channel is. It halves the send rate while the latency is climbing,
+// and doubles it back until unlimited once the channel clears.
+type adaptiveThrottle struct {
+	baseLatency time.Duration
+	maxSpeed    float64
+	rate        float64 // bytes per second, 0 means unlimited
+}
+
+// onChunk records the ack latency of a chunk and returns how long to pause before sending the next one.
+func (a *adaptiveThrottle) onChunk(length int64, latency time.Duration) time.Duration {
+	if length <= 0 || latency <= 0 {
+		return 0
+	}
+	speed := float64(length) / latency.Seconds()
+	if speed > a.maxSpeed {
+		a.maxSpeed = speed
+	}
+	if a.baseLatency == 0 || latency < a.baseLatency {
+		a.baseLatency = latency
+	}
+
+	if latency > maxDuration(a.baseLatency*kThrottleLatencyFactor, kThrottleMinLatency) {
+		if a.rate == 0 || speed < a.rate {
+			a.rate = speed
+		}
+		a.rate /= 2
+	} else if a.rate > 0 {
+		a.rate *= 2
+		if a.rate >= a.maxSpeed {
+			a.rate = 0
+		}
+	}
+
+	if a.rate <= 0 {
+		return 0
+	}
+	pause := time.Duration(float64(length)/a.rate*float64(time.Second)) - latency
+	if pause < 0 {
+		return 0
+	}
+	return pause
+}
+
+// rateLimiter is a token bucket which keeps the average send rate under the limit.
+// It holds at most one second of tokens, so an idle period won't result in a long burst.
+type rateLimiter struct {
+	limit  float64 // bytes per second
+	tokens float64
+}
+
+func (t *TrzszTransfer) newRateLimiter() *rateLimiter {
+	if t.transferConfig.Limit <= 0 {
+		return nil
+	}
+	return &rateLimiter{limit: float64(t.transferConfig.Limit)}
+}
+
+// onChunk spends the tokens of a chunk sent in chunkTime and returns how long to pause before sending the next one.
+func (r *rateLimiter) onChunk(length int64, chunkTime time.Duration) time.Duration {
+	r.tokens += chunkTime.Seconds() * r.limit
+	if r.tokens > r.limit {
+		r.tokens = r.limit
+	}
+	r.tokens -= float64(length)
+	if r.tokens >= 0 {
+		return 0
+	}
+	pause := time.Duration(-r.tokens / r.limit * float64(time.Second))
+	r.tokens = 0 // refilled during the pause
+	return pause
+}
+
+// sleepContext pauses for the duration, and wakes up early with the error once the ctx is done.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
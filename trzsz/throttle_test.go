@@ -0,0 +1,188 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveThrottle(t *testing.T) {
+	assert := assert.New(t)
+	throttle := &adaptiveThrottle{}
+	const length = 100 * 1024
+
+	effectiveRate := func(latency time.Duration) float64 {
+		pause := throttle.onChunk(length, latency)
+		return float64(length) / (latency + pause).Seconds()
+	}
+
+	// the channel is clear, no throttling
+	assert.Equal(float64(length)/0.01, effectiveRate(10*time.Millisecond))
+	assert.Equal(float64(length)/0.02, effectiveRate(20*time.Millisecond))
+	assert.Equal(float64(0), throttle.rate)
+
+	// rising ack latency reduces the effective send rate
+	rate1 := effectiveRate(300 * time.Millisecond)
+	assert.InDelta(float64(length)/0.6, rate1, 1)
+	rate2 := effectiveRate(500 * time.Millisecond)
+	assert.Less(rate2, rate1)
+	rate3 := effectiveRate(800 * time.Millisecond)
+	assert.Less(rate3, rate2)
+
+	// the channel clears, restore the send rate step by step
+	rate4 := effectiveRate(10 * time.Millisecond)
+	assert.Greater(rate4, rate3)
+	for i := 0; i < 20 && throttle.rate > 0; i++ {
+		throttle.onChunk(length, 10*time.Millisecond)
+	}
+	assert.Equal(float64(0), throttle.rate)
+	assert.Equal(time.Duration(0), throttle.onChunk(length, 10*time.Millisecond))
+}
+
+func TestBufferPolicy(t *testing.T) {
+	assert := assert.New(t)
+	trajectory := func(policy *BufferPolicy, chunkTimes []time.Duration) []int64 {
+		bufSize := policy.InitialSize
+		var sizes []int64
+		for _, chunkTime := range chunkTimes {
+			bufSize = policy.nextSize(bufSize, bufSize, chunkTime)
+			sizes = append(sizes, bufSize)
+		}
+		return sizes
+	}
+	ms := time.Millisecond
+	chunkTimes := []time.Duration{100 * ms, 100 * ms, 600 * ms, 300 * ms, 2500 * ms, 100 * ms, 1000 * ms}
+
+	transfer := NewTransfer(nil, nil, false)
+	transfer.transferConfig.MaxBufSize = 4096
+	policy := transfer.getBufferPolicy()
+	assert.Equal(&BufferPolicy{1024, 1024, 4096, 500 * ms, 2 * time.Second}, policy)
+	assert.Equal([]int64{2048, 4096, 4096, 4096, 1024, 2048, 2048}, trajectory(policy, chunkTimes))
+	// a partial chunk doesn't grow the buffer
+	assert.Equal(int64(1024), policy.nextSize(1024, 100, 10*ms))
+
+	transfer = NewTransfer(nil, nil, false, WithBufferPolicy(BufferPolicy{
+		InitialSize: 8192, MinSize: 2048, MaxSize: 1024 * 1024, GrowBelow: time.Second, ShrinkAbove: 3 * time.Second}))
+	transfer.transferConfig.MaxBufSize = 32768
+	policy = transfer.getBufferPolicy()
+	assert.Equal(&BufferPolicy{8192, 2048, 32768, time.Second, 3 * time.Second}, policy)
+	assert.Equal([]int64{16384, 32768, 32768, 32768, 32768, 32768, 32768}, trajectory(policy, chunkTimes))
+	assert.Equal([]int64{2048, 4096}, trajectory(policy, []time.Duration{3 * time.Second, 100 * ms}))
+	assert.Equal(int64(8192), transfer.bufferSize.Load())
+
+	// the initial size is within the min and max size
+	transfer = NewTransfer(nil, nil, false, WithBufferPolicy(BufferPolicy{InitialSize: 100, MinSize: 512}))
+	assert.Equal(int64(512), transfer.getBufferPolicy().InitialSize)
+	transfer.transferConfig.MaxBufSize = 256
+	assert.Equal(&BufferPolicy{256, 256, 256, 500 * ms, 2 * time.Second}, transfer.getBufferPolicy())
+}
+
+func TestTransferBufferPolicy(t *testing.T) {
+	src := t.TempDir()
+	content := strings.Repeat("buffer policy\n", 10000)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		dest := t.TempDir()
+		client := NewTransfer(nil, nil, false, WithBufferPolicy(BufferPolicy{InitialSize: 64 * 1024, MinSize: 4096}))
+		server := NewTransfer(nil, nil, false)
+		client.writer = &loopbackWriter{peer: server}
+		server.writer = &loopbackWriter{peer: client}
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+		assert.GreaterOrEqual(t, client.bufferSize.Load(), int64(64*1024))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	limiter := &rateLimiter{limit: 100 * 1024}
+
+	// pause until the tokens of the chunk are refilled
+	assert.Equal(500*time.Millisecond, limiter.onChunk(50*1024, 0))
+	assert.Equal(400*time.Millisecond, limiter.onChunk(50*1024, 100*time.Millisecond))
+
+	// no pause while the chunks are slower than the limit
+	assert.Equal(time.Duration(0), limiter.onChunk(50*1024, time.Second))
+
+	// an idle period won't result in a burst of more than one second
+	assert.Equal(time.Duration(0), limiter.onChunk(100*1024, time.Hour))
+	assert.Equal(time.Second, limiter.onChunk(100*1024, 0))
+}
+
+func TestSleepContext(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(sleepContext(context.Background(), 10*time.Millisecond))
+
+	// a cancelled ctx wakes up the pause at once
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	beginTime := time.Now()
+	assert.ErrorIs(sleepContext(ctx, time.Hour), context.Canceled)
+	assert.Less(time.Since(beginTime), 5*time.Second)
+	assert.ErrorIs(sleepContext(ctx, 0), context.Canceled)
+}
+
+func TestLimitSendRate(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	const fileSize = 300 * 1024
+	// random data won't be compressed, so that the bytes sent are predictable
+	data := make([]byte, fileSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeTestFile(t, filepath.Join(src, "a.txt"), string(data))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		args := newDefaultArgsForTest()
+		args.Limit = BufferSize{200 * 1024}
+		beginTime := time.Now()
+		result := transferFilesForTest(t, args, protocol, files, t.TempDir())
+		elapsed := time.Since(beginTime)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{"a.txt"}, result.localNames)
+		// 300K at 200K/s should take about 1.5 seconds, and up to 2 seconds with the base64 overhead
+		assert.Greater(elapsed.Seconds(), 1.3, "protocol %d", protocol)
+		assert.Less(elapsed.Seconds(), 2.5, "protocol %d", protocol)
+	}
+}
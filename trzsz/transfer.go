@@ -26,16 +26,23 @@ package trzsz
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
 	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -43,44 +50,227 @@ import (
 	"golang.org/x/term"
 )
 
+// kProtocolVersion is the latest protocol, 2 for the pipeline, 3 for resuming the partial files,
+// 4 for streaming the data of unknown size.
+const kProtocolVersion = 4
+
+// the default limits of the received paths, see `--max-depth` and `--max-name` of trz
+const (
+	kDefaultMaxDepth   = 64
+	kDefaultMaxNameLen = 255
+)
+
+// the defaults of the transfer options, see `NewTransferOptions`
+const (
+	kDefaultBufSize = 10 * 1024 * 1024
+	kDefaultTimeout = 20
+)
+
 type TransferAction struct {
-	Lang             string `json:"lang"`
-	Version          string `json:"version"`
-	Confirm          bool   `json:"confirm"`
-	Newline          string `json:"newline"`
-	Protocol         int    `json:"protocol"`
-	SupportBinary    bool   `json:"binary"`
-	SupportDirectory bool   `json:"support_dir"`
+	Lang             string   `json:"lang"`
+	Version          string   `json:"version"`
+	Confirm          bool     `json:"confirm"`
+	Newline          string   `json:"newline"`
+	Protocol         int      `json:"protocol"`
+	SupportBinary    bool     `json:"binary"`
+	SupportDirectory bool     `json:"support_dir"`
+	SupportSample    bool     `json:"support_sample"`
+	SupportPatch     bool     `json:"support_patch"`
+	SupportAudit     bool     `json:"support_audit"`
+	SupportHashes    []string `json:"support_hashes"`
+	SupportCompress  []string `json:"support_compress"`
+	SupportStored    bool     `json:"support_stored"`
+	SupportPreserve  bool     `json:"support_preserve"`
+	SupportUpdate    bool     `json:"support_update"`
+	SupportChecksum  bool     `json:"support_checksum"`
+	SupportLink      bool     `json:"support_link"`
+	SupportKeepGoing bool     `json:"support_keep_going"`
+	SupportRetries   bool     `json:"support_retries"`
+	SupportParallel  bool     `json:"support_parallel"`
+	SupportCheck     bool     `json:"support_check"`
+	SupportDedup     bool     `json:"support_dedup"`
+	SupportHardLink  bool     `json:"support_hard_link"`
+	SupportTar       bool     `json:"support_tar"`
+	SupportBlocks    bool     `json:"support_blocks"`
+	SupportEscape    bool     `json:"support_escape"`
+	SupportXattrs    bool     `json:"support_xattrs"`
+	SupportEmpty     bool     `json:"support_empty"`
+	SupportAckWindow bool     `json:"support_ack_window"`
+	SupportErrCode   bool     `json:"support_error_code"`
+	SupportVerdict   bool     `json:"support_verdict"`
+	SupportAtomic    bool     `json:"support_atomic"`
 }
 
 type TransferConfig struct {
-	Quiet           bool        `json:"quiet"`
-	Binary          bool        `json:"binary"`
-	Directory       bool        `json:"directory"`
-	Overwrite       bool        `json:"overwrite"`
-	Timeout         int         `json:"timeout"`
-	Newline         string      `json:"newline"`
-	Protocol        int         `json:"protocol"`
-	MaxBufSize      int64       `json:"bufsize"`
-	EscapeCodes     EscapeArray `json:"escape_chars"`
-	TmuxPaneColumns int         `json:"tmux_pane_width"`
-	TmuxOutputJunk  bool        `json:"tmux_output_junk"`
+	Quiet            bool        `json:"quiet"`
+	Verbosity        int         `json:"verbosity"`
+	Binary           bool        `json:"binary"`
+	Directory        bool        `json:"directory"`
+	Overwrite        bool        `json:"overwrite"`
+	OverwriteMode    string      `json:"overwrite_mode"`
+	RenameScheme     string      `json:"rename_scheme"`
+	Timeout          int         `json:"timeout"`
+	HandshakeTimeout int         `json:"handshake_timeout"`
+	Newline          string      `json:"newline"`
+	Protocol         int         `json:"protocol"`
+	MaxBufSize       int64       `json:"bufsize"`
+	EscapeCodes      EscapeArray `json:"escape_chars"`
+	TmuxPaneColumns  int         `json:"tmux_pane_width"`
+	TmuxOutputJunk   bool        `json:"tmux_output_junk"`
+	Adaptive         bool        `json:"adaptive"`
+	Limit            int64       `json:"limit"`
+	MinSpeed         int64       `json:"min_speed"`
+	StartAt          int         `json:"start_at"`
+	Preview          bool        `json:"preview"`
+	PreviewTimeout   int         `json:"preview_timeout"`
+	Sample           bool        `json:"sample"`
+	SamplePercent    int         `json:"sample_percent"`
+	SampleAbove      int64       `json:"sample_above"`
+	SampleSeed       int64       `json:"sample_seed"`
+	Stats            bool        `json:"stats"`
+	Patch            bool        `json:"patch"`
+	Normalize        string      `json:"normalize"`
+	Audit            bool        `json:"audit"`
+	AuditPull        bool        `json:"audit_pull"`
+	ChunkSizes       []int64     `json:"chunk_sizes"`
+	Hash             string      `json:"hash"`
+	Compress         string      `json:"compress"`
+	ChunkHeader      bool        `json:"chunk_header"`
+	NoCompress       bool        `json:"no_compress"`
+	Resume           bool        `json:"resume"`
+	WriteTimeout     int         `json:"write_timeout"`
+	Preserve         bool        `json:"preserve"`
+	Update           bool        `json:"update"`
+	Checksum         bool        `json:"checksum"`
+	Atomic           bool        `json:"atomic"`
+	CheckEvery       int64       `json:"check_every"`
+	Dedup            bool        `json:"dedup"`
+	Links            bool        `json:"links"`
+	HardLinks        bool        `json:"hard_links"`
+	Exclude          []string    `json:"exclude"`
+	Include          []string    `json:"include"`
+	SkipSpecial      bool        `json:"skip_special"`
+	KeepGoing        bool        `json:"keep_going"`
+	Retries          int         `json:"retries"`
+	Parallel         int         `json:"parallel"`
+	AckWindow        int         `json:"ack_window"`
+	Stream           bool        `json:"stream"`
+	Tar              bool        `json:"tar"`
+	BinaryCompress   bool        `json:"binary_compress"`
+	VerifyEscape     bool        `json:"verify_escape"`
+	Xattrs           bool        `json:"xattrs"`
+	SkipEmptyData    bool        `json:"skip_empty_data"`
+	ErrorCode        bool        `json:"error_code"`
+	Verdict          bool        `json:"verdict"`
+}
+
+// TransferResult is the result of the last sent or received files.
+// Names are the top-level local names of the received files, or the remote names of the sent files.
+// FileCount, Bytes and Speed are the totals of the files, the bytes are counted before compression.
+// SkippedCount is the number of the files kept untouched, e.g., the existing or unchanged ones, excluded from FileCount.
+// Verified is the number of the received files verified on disk again after the transfer, if enabled,
+// and Corrupted are the relative paths of the files which fail it.
+type TransferResult struct {
+	Sent         bool
+	Duration     time.Duration
+	Names        []string
+	Files        []*FileResult
+	FileCount    int
+	SkippedCount int
+	Bytes        int64
+	Speed        float64
+	Verified     int
+	Corrupted    []string
+}
+
+// FileResult is the result of a transferred file, the name is relative to the destination.
+// Size excludes the resumed part of the file, and is 0 if the file is skipped in audit mode.
+// Skipped is true if the existing or unchanged file is kept untouched, it's counted in SkippedCount.
+// NegotiationTime is spent on the NAME and SIZE round-trips, DataTime on the data and checksum.
+type FileResult struct {
+	Name            string
+	Size            int64
+	Skipped         bool
+	NegotiationTime time.Duration
+	DataTime        time.Duration
 }
 
 type TrzszTransfer struct {
 	buffer          *TrzszBuffer
 	writer          PtyIO
-	stopped         bool
+	stopped         atomic.Bool
+	pauses          *pauseState
 	lastInputTime   atomic.Int64
-	cleanTimeout    time.Duration
-	maxChunkTime    time.Duration
+	cleanTimeout    atomic.Int64
+	maxChunkTime    atomic.Int64
 	stdinState      *term.State
+	terminalOnce    sync.Once
 	fileNameMap     map[int]string
 	remoteIsWindows bool
 	flushInTime     bool
 	bufferSize      atomic.Int64
+	bufferPolicy    BufferPolicy
+	lastChunkSize   atomic.Int64
 	savedSteps      atomic.Int64
 	transferConfig  TransferConfig
+	confirmOutput   io.Writer
+	exitOutput      io.Writer
+	logger          Logger
+	confirmInput    chan []byte
+	confirming      atomic.Bool
+	verifyFile      bool
+	fileCount       int64
+	verifiedCount   int64
+	auditReport     *AuditReport
+	auditMissing    bool
+	auditPath       string
+	checksumMissing bool
+	skippedPath     string
+	outputName      string
+	outputFile      *os.File
+	unsafeLinks     bool
+	preserveOwner   bool
+	dirMode         os.FileMode
+	patchBase       string
+	traceLog        bool
+	traceFunc       TraceFunc
+	beginTime       time.Time
+	action          *TransferAction
+	maxTotal        int64
+	receivedTotal   int64
+	maxFile         int64
+	maxFileExceeded bool
+	preReceiveHook  PreReceiveHook
+	incomingFiles   []TransferFileMeta
+	incomingFile    *TransferFileMeta
+	preRejected     bool
+	maxDepth        int
+	flatten         bool
+	newline         string
+	maxNameLen      int
+	receivedPaths   map[int64]string
+	atomicPath      string
+	atomicTmpPath   string
+	storeData       bool
+	sampleCompress  bool
+	sourceModTime   int64
+	sourceModTimeNs int64
+	batchCount      int64
+	failedCount     int64
+	writeErr        error
+	parallelRefused bool
+	pipelineRefused bool
+	transferResult  *TransferResult
+	chunkIndex      int
+	quota           *senderQuota
+	primedHasher    hash.Hash
+	writeBlocked    atomic.Bool
+	asyncWriter     *asyncWriter
+	asyncWriterOnce sync.Once
+	writeMutex      sync.Mutex
+	dirAttrs        []*dirAttrs
+	verifyDisk      bool
+	diskDigests     []*diskDigest
 }
 
 func maxDuration(a, b time.Duration) time.Duration {
@@ -90,6 +280,20 @@ func maxDuration(a, b time.Duration) time.Duration {
 	return b
 }
 
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func minInt64(a, b int64) int64 {
 	if a < b {
 		return a
@@ -97,43 +301,108 @@ func minInt64(a, b int64) int64 {
 	return b
 }
 
-func NewTransfer(writer PtyIO, stdinState *term.State, flushInTime bool) *TrzszTransfer {
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func NewTransfer(writer PtyIO, stdinState *term.State, flushInTime bool, opts ...TransferOption) *TrzszTransfer {
 	t := &TrzszTransfer{
-		buffer:       NewTrzszBuffer(),
-		writer:       writer,
-		cleanTimeout: 100 * time.Millisecond,
-		stdinState:   stdinState,
-		fileNameMap:  make(map[int]string),
-		flushInTime:  flushInTime,
+		buffer:      NewTrzszBuffer(),
+		writer:      writer,
+		stdinState:  stdinState,
+		logger:      nopLogger{},
+		fileNameMap: make(map[int]string),
+		flushInTime: flushInTime,
+		verifyFile:  true,
+		maxDepth:    kDefaultMaxDepth,
+		maxNameLen:  kDefaultMaxNameLen,
+		newline:     "\n",
 		transferConfig: TransferConfig{
-			Timeout:    20,
-			Newline:    "\n",
-			MaxBufSize: 10 * 1024 * 1024,
+			Timeout:      kDefaultTimeout,
+			Newline:      "\n",
+			MaxBufSize:   kDefaultBufSize,
+			WriteTimeout: kDefaultTimeout,
 		},
 	}
-	t.bufferSize.Store(1024)
+	t.cleanTimeout.Store(int64(100 * time.Millisecond))
+	t.pauses = newPauseState(t.getNewTimeout)
+	t.buffer.pauses = t.pauses
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.bufferSize.Store(t.getBufferPolicy().InitialSize)
 	return t
 }
 
+// TraceFunc is called with the raw data of the protocol, the direction is `TraceSend` for the data written
+// to the peer, or `TraceRecv` for the data received from the peer. It's called by the goroutines writing
+// and receiving concurrently, and the data shouldn't be modified, copy it if retained.
+type TraceFunc func(direction string, data []byte)
+
+const (
+	TraceSend = "send"
+	TraceRecv = "recv"
+)
+
+// WithTraceFunc sets the callback to capture the wire protocol, without the global trace log file.
+func WithTraceFunc(fn TraceFunc) TransferOption {
+	return func(t *TrzszTransfer) {
+		t.traceFunc = fn
+	}
+}
+
 func (t *TrzszTransfer) addReceivedData(buf []byte) {
-	if !t.stopped {
+	if t.traceFunc != nil {
+		t.traceFunc(TraceRecv, buf)
+	}
+	if !t.stopped.Load() {
 		t.buffer.addBuffer(buf)
 	}
 	t.lastInputTime.Store(time.Now().UnixMilli())
 }
 
+// Stop cancels the transfer from another goroutine, and it's safe to be called multiple times.
+// After `Stop`, the next protocol operation returns a "Stopped" `TrzszError`.
+func (t *TrzszTransfer) Stop() {
+	t.stopTransferringFiles()
+}
+
 func (t *TrzszTransfer) stopTransferringFiles() {
-	t.cleanTimeout = maxDuration(t.maxChunkTime*2, 500*time.Millisecond)
-	t.stopped = true
+	t.cleanTimeout.Store(int64(maxDuration(time.Duration(t.maxChunkTime.Load())*2, 500*time.Millisecond)))
+	t.stopped.Store(true)
 	t.buffer.stopBuffer()
+	t.pauses.wake()
+}
+
+// updateMaxChunkTime keeps the slowest chunk time, as it's written by the send and receive loops,
+// and read by `stopTransferringFiles` in another goroutine.
+func (t *TrzszTransfer) updateMaxChunkTime(chunkTime time.Duration) {
+	for {
+		maxChunkTime := t.maxChunkTime.Load()
+		if int64(chunkTime) <= maxChunkTime || t.maxChunkTime.CompareAndSwap(maxChunkTime, int64(chunkTime)) {
+			return
+		}
+	}
 }
 
 func (t *TrzszTransfer) cleanInput(timeoutDuration time.Duration) {
-	t.stopped = true
+	t.cleanInputUntil(timeoutDuration, time.Time{})
+}
+
+// cleanInputUntil drains the input until there is no input for the timeout, or until the deadline if it's not zero,
+// e.g., the peer keeps sending after the signal.
+func (t *TrzszTransfer) cleanInputUntil(timeoutDuration time.Duration, deadline time.Time) {
+	t.stopped.Store(true)
 	t.buffer.drainBuffer()
 	t.lastInputTime.Store(time.Now().UnixMilli())
 	for {
 		sleepDuration := timeoutDuration - time.Now().Sub(time.UnixMilli(t.lastInputTime.Load()))
+		if !deadline.IsZero() {
+			sleepDuration = minDuration(sleepDuration, time.Until(deadline))
+		}
 		if sleepDuration <= 0 {
 			return
 		}
@@ -141,11 +410,42 @@ func (t *TrzszTransfer) cleanInput(timeoutDuration time.Duration) {
 	}
 }
 
+// writeAll writes to the peer, it's serialized with the exit output, which may be written by the signal goroutine.
 func (t *TrzszTransfer) writeAll(buf []byte) error {
-	if gTrzszArgs.TraceLog {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	if t.traceLog {
 		writeTraceLog(buf, "tosvr")
 	}
-	return writeAll(t.writer, buf)
+	if t.traceFunc != nil {
+		t.traceFunc(TraceSend, buf)
+	}
+	if t.transferConfig.WriteTimeout <= 0 {
+		return writeAll(t.writer, buf)
+	}
+	return t.writeAllTimeout(buf, time.Duration(t.transferConfig.WriteTimeout)*time.Second)
+}
+
+// writeAllTimeout gives up if the writer is blocked longer than the timeout, e.g., the terminal is wedged.
+// The write deadline is used if the writer supports it, otherwise the data is written by the `asyncWriter`.
+// The following writes fail immediately after the timeout instead of hanging again.
+func (t *TrzszTransfer) writeAllTimeout(buf []byte, timeout time.Duration) error {
+	if t.writeBlocked.Load() {
+		return newTrzszErrorCode(ErrTimeout, "Write timeout, the terminal is unresponsive")
+	}
+	var err error
+	if w, ok := t.writer.(deadlineWriter); ok && w.SetWriteDeadline(time.Now().Add(timeout)) == nil {
+		err = writeAll(w, buf)
+		_ = w.SetWriteDeadline(time.Time{})
+	} else {
+		t.asyncWriterOnce.Do(func() { t.asyncWriter = newAsyncWriter(t.writer) })
+		err = t.asyncWriter.writeAll(buf, timeout)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.writeBlocked.Store(true)
+		return newTrzszErrorCode(ErrTimeout, fmt.Sprintf("Write timeout after %v, the terminal is unresponsive", timeout))
+	}
+	return err
 }
 
 func (t *TrzszTransfer) sendLine(typ string, buf string) error {
@@ -153,8 +453,8 @@ func (t *TrzszTransfer) sendLine(typ string, buf string) error {
 }
 
 func (t *TrzszTransfer) recvLine(expectType string, mayHasJunk bool, timeout <-chan time.Time) ([]byte, error) {
-	if t.stopped {
-		return nil, newTrzszError("Stopped")
+	if t.stopped.Load() {
+		return nil, newTrzszErrorCode(ErrCancelled, "Stopped")
 	}
 
 	if IsWindows() || t.remoteIsWindows {
@@ -173,6 +473,8 @@ func (t *TrzszTransfer) recvLine(expectType string, mayHasJunk bool, timeout <-c
 	if err != nil {
 		return nil, err
 	}
+	// the bytes before the line feed of the newline advertised by `sendAction`
+	line = bytes.TrimSuffix(line, []byte(strings.TrimSuffix(t.newline, "\n")))
 
 	if t.transferConfig.TmuxOutputJunk || mayHasJunk {
 		idx := bytes.LastIndex(line, []byte("#"+expectType+":"))
@@ -187,6 +489,9 @@ func (t *TrzszTransfer) recvLine(expectType string, mayHasJunk bool, timeout <-c
 func (t *TrzszTransfer) recvCheck(expectType string, mayHasJunk bool, timeout <-chan time.Time) (string, error) {
 	line, err := t.recvLine(expectType, mayHasJunk, timeout)
 	if err != nil {
+		if isTimeoutError(err) {
+			t.logger.Warnf("receive %s timeout", expectType)
+		}
 		return "", err
 	}
 
@@ -197,6 +502,16 @@ func (t *TrzszTransfer) recvCheck(expectType string, mayHasJunk bool, timeout <-
 
 	typ := string(line[1:idx])
 	buf := string(line[idx+1:])
+	if typ == "SKIP" && t.transferConfig.KeepGoing {
+		return "", newFileSkipError(buf)
+	}
+	if typ == "CHUNK" && expectType == "DATA" && t.transferConfig.Retries > 0 {
+		offset, err := strconv.ParseInt(buf, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return "", &chunkResendError{offset}
+	}
 	if typ != expectType {
 		return "", NewTrzszError(buf, typ, true)
 	}
@@ -232,7 +547,11 @@ func (t *TrzszTransfer) sendString(typ string, str string) error {
 }
 
 func (t *TrzszTransfer) recvString(typ string, mayHasJunk bool) (string, error) {
-	buf, err := t.recvCheck(typ, mayHasJunk, nil)
+	return t.recvStringTimeout(typ, mayHasJunk, nil)
+}
+
+func (t *TrzszTransfer) recvStringTimeout(typ string, mayHasJunk bool, timeout <-chan time.Time) (string, error) {
+	buf, err := t.recvCheck(typ, mayHasJunk, timeout)
 	if err != nil {
 		return "", err
 	}
@@ -254,8 +573,9 @@ func (t *TrzszTransfer) checkString(expect string) error {
 	return nil
 }
 
+// sendBinary compresses the buffer with the negotiated algorithm, while the strings are always compressed with zlib.
 func (t *TrzszTransfer) sendBinary(typ string, buf []byte) error {
-	return t.sendLine(typ, encodeBytes(buf))
+	return t.sendLine(typ, encodeBytesWith(buf, t.transferConfig.Compress))
 }
 
 func (t *TrzszTransfer) recvBinary(typ string, mayHasJunk bool, timeout <-chan time.Time) ([]byte, error) {
@@ -263,7 +583,7 @@ func (t *TrzszTransfer) recvBinary(typ string, mayHasJunk bool, timeout <-chan t
 	if err != nil {
 		return nil, err
 	}
-	return decodeString(buf)
+	return decodeStringWith(buf, t.transferConfig.Compress)
 }
 
 func (t *TrzszTransfer) checkBinary(expect []byte) error {
@@ -277,26 +597,142 @@ func (t *TrzszTransfer) checkBinary(expect []byte) error {
 	return nil
 }
 
+// kStoreRatio is the compression ratio of the first chunk above which the rest chunks of the file are stored as is.
+const kStoreRatio = 0.95
+
 func (t *TrzszTransfer) sendData(data []byte) error {
+	if !t.transferConfig.Binary && t.transferConfig.ChunkHeader {
+		return t.sendLine("DATA", t.encodeDataChunk(data))
+	}
 	if !t.transferConfig.Binary {
 		return t.sendBinary("DATA", data)
 	}
-	buf := escapeData(data, t.transferConfig.EscapeCodes)
+	buf := escapeData(t.encodeDataBlock(data), t.transferConfig.EscapeCodes)
 	if err := t.writeAll([]byte(fmt.Sprintf("#DATA:%d\n", len(buf)))); err != nil {
 		return err
 	}
 	return t.writeAll(buf)
 }
 
+// resetDataCompress should be called before sending each file, the first chunk of which is sampled.
+func (t *TrzszTransfer) resetDataCompress() {
+	t.storeData = t.transferConfig.NoCompress
+	t.sampleCompress = !t.storeData
+}
+
+func (t *TrzszTransfer) encodeDataChunk(data []byte) string {
+	return encodeChunk(t.compressDataChunk(data))
+}
+
+// compressDataChunk returns the header and the payload of the chunk, which is stored as is if the first chunk
+// of the file is incompressible.
+func (t *TrzszTransfer) compressDataChunk(data []byte) (byte, []byte) {
+	if t.storeData {
+		return kChunkStored, data
+	}
+	compressed := compressBytes(data, t.transferConfig.Compress)
+	if t.sampleCompress && len(data) > 0 {
+		t.sampleCompress = false
+		if float64(len(compressed)) > kStoreRatio*float64(len(data)) {
+			t.storeData = true
+			return kChunkStored, data
+		}
+	}
+	return kChunkCompressed, compressed
+}
+
+// encodeDataBlock compresses the data as a block before escaping in binary mode if `BinaryCompress` is negotiated.
+// The empty data, e.g., the end of a stream, is sent as is.
+func (t *TrzszTransfer) encodeDataBlock(data []byte) []byte {
+	if !t.transferConfig.BinaryCompress || len(data) == 0 {
+		return data
+	}
+	return encodeBlock(t.compressDataChunk(data))
+}
+
+// decodeDataBlock decompresses the only block of the data after unescaping in binary mode.
+func (t *TrzszTransfer) decodeDataBlock(data []byte) ([]byte, error) {
+	if !t.transferConfig.BinaryCompress || len(data) == 0 {
+		return data, nil
+	}
+	decoder := &blockDecoder{compress: t.transferConfig.Compress}
+	blocks, err := decoder.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.finish(); err != nil {
+		return nil, err
+	}
+	if len(blocks) != 1 {
+		return nil, newTrzszError(fmt.Sprintf("Expect one data block, but got %d", len(blocks)))
+	}
+	return blocks[0], nil
+}
+
+// getNewTimeout returns the timer for a chunk. With `MinSpeed`, the timeout is extended to the time of
+// moving the next chunk at the min speed if it's longer, so it means stalled rather than slow:
+//
+//	timeout = max(Timeout, chunkSize / MinSpeed)
+//
+// The sender knows the size of the chunk in flight. The receiver doesn't, but the sender's flow control
+// only doubles the size after a fast chunk, so it's up to double of the last received one, capped by
+// `MaxBufSize`, or the largest size of `ChunkSizes` if scheduled. The timeout is restarted if the transfer
+// has been paused while waiting, see `Pause`.
 func (t *TrzszTransfer) getNewTimeout() <-chan time.Time {
-	if t.transferConfig.Timeout > 0 {
-		return time.NewTimer(time.Duration(t.transferConfig.Timeout) * time.Second).C
+	if t.transferConfig.Timeout <= 0 {
+		return nil
+	}
+	timeout := time.Duration(t.transferConfig.Timeout) * time.Second
+	if t.transferConfig.MinSpeed > 0 {
+		chunkTime := float64(t.getChunkSizeHint()) / float64(t.transferConfig.MinSpeed)
+		timeout = maxDuration(timeout, time.Duration(chunkTime*float64(time.Second)))
+	}
+	return time.NewTimer(timeout).C
+}
+
+// getChunkSizeHint returns the max size of the next chunk to be sent or received.
+func (t *TrzszTransfer) getChunkSizeHint() int64 {
+	size := t.bufferSize.Load()
+	if last := t.lastChunkSize.Load(); last > 0 {
+		size = maxInt64(size, minInt64(last*2, t.transferConfig.MaxBufSize))
+	}
+	for _, s := range t.transferConfig.ChunkSizes {
+		size = maxInt64(size, s)
+	}
+	return size
+}
+
+// getHandshakeTimeout is for the action and config, which may take longer than the data on a slow session.
+// It's the same as the data timeout if not set, and N < 0 means never timeout.
+func (t *TrzszTransfer) getHandshakeTimeout() <-chan time.Time {
+	timeout := t.transferConfig.HandshakeTimeout
+	if timeout == 0 {
+		timeout = t.transferConfig.Timeout
+	}
+	if timeout > 0 {
+		return time.NewTimer(time.Duration(timeout) * time.Second).C
 	}
 	return nil
 }
 
 func (t *TrzszTransfer) recvData() ([]byte, error) {
+	data, err := t.doRecvData()
+	if err != nil {
+		return nil, err
+	}
+	t.lastChunkSize.Store(int64(len(data)))
+	return data, nil
+}
+
+func (t *TrzszTransfer) doRecvData() ([]byte, error) {
 	timeout := t.getNewTimeout()
+	if !t.transferConfig.Binary && t.transferConfig.ChunkHeader {
+		buf, err := t.recvCheck("DATA", false, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return decodeChunk(buf, t.transferConfig.Compress)
+	}
 	if !t.transferConfig.Binary {
 		return t.recvBinary("DATA", false, timeout)
 	}
@@ -304,22 +740,72 @@ func (t *TrzszTransfer) recvData() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	data, err := t.buffer.readBinary(int(size), timeout)
+	data, err := t.buffer.readBinary(size, timeout)
 	if err != nil {
 		return nil, err
 	}
-	return unescapeData(data, t.transferConfig.EscapeCodes), nil
+	return t.decodeDataBlock(unescapeData(data, t.transferConfig.EscapeCodes))
+}
+
+// WithNewline sets the newline which the peer should end the lines with, e.g., "%\n" for the exotic terminals
+// or middleboxes which mangle the lines. It should end with "\n", and the bytes before that should be printable,
+// but neither the letters nor the symbols of the protocol. It's ignored on Windows, which always uses "!\n".
+func WithNewline(newline string) TransferOption {
+	return func(t *TrzszTransfer) {
+		t.newline = newline
+	}
+}
+
+func isValidNewline(newline string) bool {
+	if len(newline) == 0 || len(newline) > 8 || newline[len(newline)-1] != '\n' {
+		return false
+	}
+	for i := 0; i < len(newline)-1; i++ {
+		c := newline[i]
+		if c < 0x20 || c >= 0x7f || isTrzszLetter(c) {
+			return false
+		}
+	}
+	return true
 }
 
 func (t *TrzszTransfer) sendAction(confirm, remoteIsWindows bool) error {
+	if !isValidNewline(t.newline) {
+		return newTrzszError(fmt.Sprintf("Invalid newline: %q", t.newline))
+	}
 	action := &TransferAction{
 		Lang:             "go",
 		Version:          kTrzszVersion,
 		Confirm:          confirm,
-		Newline:          "\n",
-		Protocol:         2,
+		Newline:          t.newline,
+		Protocol:         kProtocolVersion,
 		SupportBinary:    true,
 		SupportDirectory: true,
+		SupportSample:    true,
+		SupportPatch:     true,
+		SupportAudit:     true,
+		SupportHashes:    kSupportedHashes,
+		SupportCompress:  kSupportedCompressions,
+		SupportStored:    true,
+		SupportPreserve:  true,
+		SupportUpdate:    true,
+		SupportChecksum:  true,
+		SupportLink:      true,
+		SupportKeepGoing: true,
+		SupportRetries:   true,
+		SupportParallel:  true,
+		SupportCheck:     true,
+		SupportDedup:     true,
+		SupportHardLink:  true,
+		SupportTar:       true,
+		SupportBlocks:    true,
+		SupportEscape:    true,
+		SupportXattrs:    true,
+		SupportEmpty:     true,
+		SupportAckWindow: true,
+		SupportErrCode:   true,
+		SupportVerdict:   true,
+		SupportAtomic:    true,
 	}
 	if IsWindows() || remoteIsWindows {
 		action.Newline = "!\n"
@@ -333,14 +819,45 @@ func (t *TrzszTransfer) sendAction(confirm, remoteIsWindows bool) error {
 		t.remoteIsWindows = true
 		t.transferConfig.Newline = "!\n"
 	}
+	t.logger.Debugf("send action: confirm %v, protocol %d", action.Confirm, action.Protocol)
+	t.action = action
 	return t.sendString("ACT", string(actStr))
 }
 
 func (t *TrzszTransfer) recvAction() (*TransferAction, error) {
-	actStr, err := t.recvString("ACT", false)
+	return t.recvActionTimeout(t.getHandshakeTimeout())
+}
+
+// recvActionRetry re-emits the handshake by `emit` if the client's action is not received in time,
+// up to `retries` times with the timeout doubled each time. Errors other than timeout are fatal.
+// The deadlines are of the clock `timeNowFunc`, so the retries can be tested without waiting.
+func (t *TrzszTransfer) recvActionRetry(retries int, timeout time.Duration, emit func()) (*TransferAction, error) {
+	if retries <= 0 || timeout <= 0 || emit == nil {
+		return t.recvAction()
+	}
+	deadline := timeNowFunc()
+	for i := 0; ; i++ {
+		deadline = deadline.Add(timeout)
+		action, err := t.recvActionTimeout(time.NewTimer(deadline.Sub(timeNowFunc())).C)
+		if err == nil || i >= retries || !isTimeoutError(err) {
+			return action, err
+		}
+		t.logger.Warnf("re-emit the handshake, retry %d of %d", i+1, retries)
+		emit()
+		timeout *= 2
+	}
+}
+
+func (t *TrzszTransfer) recvActionTimeout(timeout <-chan time.Time) (*TransferAction, error) {
+	buf, err := t.recvCheck("ACT", false, timeout)
 	if err != nil {
 		return nil, err
 	}
+	actBuf, err := decodeString(buf)
+	if err != nil {
+		return nil, err
+	}
+	actStr := string(actBuf)
 	action := &TransferAction{
 		Newline:       "\n",
 		SupportBinary: true,
@@ -348,35 +865,207 @@ func (t *TrzszTransfer) recvAction() (*TransferAction, error) {
 	if err := json.Unmarshal([]byte(actStr), action); err != nil {
 		return nil, err
 	}
+	t.logger.Debugf("received action: lang %s, version %s, confirm %v, protocol %d",
+		action.Lang, action.Version, action.Confirm, action.Protocol)
 	t.transferConfig.Newline = action.Newline
+	t.action = action
 	return action, nil
 }
 
-func (t *TrzszTransfer) sendConfig(args *Args, action *TransferAction, escapeChars [][]unicode, tmuxMode TmuxMode, tmuxPaneWidth int) error {
+// RecvAction receives the action of the client in the handshake, it's the first step of the server
+// after the magic key is written, e.g., by an SSH server receiving or sending files as a library.
+func (t *TrzszTransfer) RecvAction() (*TransferAction, error) {
+	return t.recvAction()
+}
+
+// SendConfig negotiates the options with the client by the received action, it's the next step of the server.
+// The zero values of the options mean the same as on the command line, see `NewTransferOptions` for the defaults.
+func (t *TrzszTransfer) SendConfig(opts TransferOptions, action *TransferAction) error {
+	opts.setDefaults()
+	if err := checkTarArg(&opts); err != nil {
+		return err
+	}
+	if err := checkAtomicArg(&opts); err != nil {
+		return err
+	}
+	if opts.Binary && !action.SupportBinary {
+		opts.Binary = false
+	}
+	return t.sendConfig(&opts, action, getEscapeChars(false), NoTmux, -1)
+}
+
+func (t *TrzszTransfer) sendConfig(opts *TransferOptions, action *TransferAction, escapeChars [][]unicode, tmuxMode TmuxMode, tmuxPaneWidth int) error {
 	cfgMap := map[string]interface{}{
 		"lang": "go",
 	}
-	if args.Quiet {
+	if opts.Quiet || opts.Verbosity.Level >= kVerbositySilent {
 		cfgMap["quiet"] = true
+	} else if opts.Verbosity.Level == kVerbositySummary {
+		// the older clients show the progress bar as before
+		cfgMap["verbosity"] = kVerbositySummary
 	}
-	if args.Binary {
+	if opts.Binary {
 		cfgMap["binary"] = true
 		cfgMap["escape_chars"] = escapeChars
 	}
-	if args.Directory {
+	if opts.Directory {
 		cfgMap["directory"] = true
 	}
-	cfgMap["bufsize"] = args.Bufsize.Size
-	cfgMap["timeout"] = args.Timeout
-	if args.Overwrite {
+	cfgMap["bufsize"] = opts.Bufsize.Size
+	cfgMap["timeout"] = opts.Timeout
+	if timeout := opts.getHandshakeTimeout(); timeout != 0 {
+		cfgMap["handshake_timeout"] = timeout
+	}
+	if opts.Overwrite || opts.OnConflict.Mode == "force" {
 		cfgMap["overwrite"] = true
 	}
+	if len(opts.OnConflict.Mode) > 0 {
+		cfgMap["overwrite_mode"] = opts.OnConflict.Mode
+	}
+	// the receiver tells whether it wants the data, e.g., the existing files are skipped before the data,
+	// and the modification time is carried in the name in update mode, if the client knows it
+	if action.SupportVerdict {
+		cfgMap["verdict"] = true
+	}
+	if len(opts.RenameScheme.Scheme) > 0 && opts.RenameScheme.Scheme != "dot" {
+		cfgMap["rename_scheme"] = opts.RenameScheme.Scheme
+	}
+	if opts.Adaptive {
+		cfgMap["adaptive"] = true
+	}
+	if opts.Limit.Size > 0 {
+		cfgMap["limit"] = opts.Limit.Size
+	}
+	if opts.MinSpeed.Size > 0 {
+		cfgMap["min_speed"] = opts.MinSpeed.Size
+	}
+	if opts.StartAt > 0 {
+		cfgMap["start_at"] = opts.StartAt
+	}
+	if opts.Preview {
+		cfgMap["preview"] = true
+		cfgMap["preview_timeout"] = opts.PreviewTimeout
+	}
+	if opts.NoCheck && action.SupportSample {
+		// none of the files is selected to verify, the same as `--verify-sample 0` without `--verify-above`
+		cfgMap["sample"] = true
+		cfgMap["sample_percent"] = 0
+	} else if opts.VerifySample.Skip > 0 && action.SupportSample {
+		cfgMap["sample"] = true
+		cfgMap["sample_percent"] = 100 - opts.VerifySample.Skip
+		cfgMap["sample_above"] = opts.VerifyAbove.Size
+		cfgMap["sample_seed"] = rand.Int63()
+	}
+	if opts.Stats {
+		cfgMap["stats"] = true
+	}
+	if len(opts.Normalize.Form) > 0 {
+		cfgMap["normalize"] = opts.Normalize.Form
+	}
+	if opts.Patch && action.SupportPatch {
+		cfgMap["patch"] = true
+	}
+	if opts.Audit || opts.AuditPull {
+		cfgMap["audit"] = true
+	}
+	if opts.AuditPull {
+		cfgMap["audit_pull"] = true
+	}
+	if len(opts.Hash.Name) > 0 && opts.Hash.Name != "md5" && containsString(action.SupportHashes, opts.Hash.Name) {
+		cfgMap["hash"] = opts.Hash.Name
+	}
+	// zlib is the default of the chunks, but it's sent if chosen, as the pipeline of protocol 2 defaults to zstd
+	if len(opts.Compress.Name) > 0 && containsString(action.SupportCompress, opts.Compress.Name) {
+		cfgMap["compress"] = opts.Compress.Name
+	}
+	if action.SupportStored {
+		cfgMap["chunk_header"] = true
+		if opts.NoCompress {
+			cfgMap["no_compress"] = true
+		}
+	}
+	cfgMap["write_timeout"] = opts.WriteTimeout
+	if len(opts.ChunkSizes.Sizes) > 0 {
+		cfgMap["chunk_sizes"] = clampChunkSizes(opts.ChunkSizes.Sizes, opts.Bufsize.Size)
+	}
+	if opts.Resume && action.Protocol >= 3 && !opts.Patch {
+		cfgMap["resume"] = true
+	}
+	if opts.Preserve && action.SupportPreserve {
+		cfgMap["preserve"] = true
+		if opts.Xattrs && action.SupportXattrs {
+			cfgMap["xattrs"] = true
+		}
+	}
+	if opts.Update && action.SupportUpdate {
+		cfgMap["update"] = true
+	}
+	if opts.Atomic && action.SupportAtomic {
+		cfgMap["atomic"] = true
+	}
+	if opts.Dedup && action.SupportDedup {
+		cfgMap["dedup"] = true
+	}
+	if opts.Checksum && action.SupportChecksum && !opts.Patch && !opts.Audit && !opts.AuditPull {
+		cfgMap["checksum"] = true
+	}
+	if opts.Parallel > 1 && action.SupportParallel && action.Protocol >= 3 {
+		cfgMap["parallel"] = opts.Parallel
+	}
+	if opts.VerifyEscape && opts.Binary && action.SupportBinary && action.SupportEscape {
+		cfgMap["verify_escape"] = true
+	}
+	// the data phase of the empty files is skipped by both sides, if the client knows it
+	if action.SupportEmpty {
+		cfgMap["skip_empty_data"] = true
+	}
+	// the window is of the V2 pipeline, the V1 data path ignores it and acks the chunks one by one
+	if opts.AckWindow > 1 && action.SupportAckWindow && action.Protocol >= 2 {
+		cfgMap["ack_window"] = opts.AckWindow
+	}
+	if opts.ChunkRetries > 0 && action.SupportRetries {
+		cfgMap["retries"] = opts.ChunkRetries
+	}
+	if opts.CheckEvery.Size > 0 && action.SupportCheck && action.Protocol >= 3 && opts.ChunkRetries == 0 {
+		cfgMap["check_every"] = opts.CheckEvery.Size
+	}
+	if opts.Stream && action.Protocol >= 4 {
+		cfgMap["stream"] = true
+	}
+	if opts.Tar && action.SupportTar && action.Protocol >= 4 {
+		cfgMap["tar"] = true
+	}
+	if opts.Binary && opts.BinaryCompress && !opts.NoCompress && action.SupportBlocks {
+		cfgMap["binary_compress"] = true
+	}
+	if opts.KeepGoing && action.SupportKeepGoing {
+		cfgMap["keep_going"] = true
+	}
+	// the fail messages carry the code of the error, if both sides know it
+	if action.SupportErrCode {
+		cfgMap["error_code"] = true
+	}
+	if opts.Directory && len(opts.Exclude) > 0 {
+		cfgMap["exclude"] = opts.Exclude
+	}
+	if opts.Directory && len(opts.Include) > 0 {
+		cfgMap["include"] = opts.Include
+	}
+	if opts.SkipSpecial {
+		cfgMap["skip_special"] = true
+	}
+	if opts.Directory && !opts.FollowSymlinks && action.SupportLink {
+		cfgMap["links"] = true
+	}
+	if opts.Directory && action.SupportHardLink {
+		cfgMap["hard_links"] = true
+	}
 	if tmuxMode == TmuxNormalMode {
 		cfgMap["tmux_output_junk"] = true
 		cfgMap["tmux_pane_width"] = tmuxPaneWidth
 	}
 	if action.Protocol > 0 {
-		cfgMap["protocol"] = action.Protocol
+		cfgMap["protocol"] = minInt(action.Protocol, kProtocolVersion)
 	}
 	cfgStr, err := json.Marshal(cfgMap)
 	if err != nil {
@@ -385,17 +1074,30 @@ func (t *TrzszTransfer) sendConfig(args *Args, action *TransferAction, escapeCha
 	if err := json.Unmarshal([]byte(cfgStr), &t.transferConfig); err != nil {
 		return err
 	}
+	t.logger.Debugf("send config: %s", cfgStr)
 	return t.sendString("CFG", string(cfgStr))
 }
 
 func (t *TrzszTransfer) recvConfig() (*TransferConfig, error) {
-	cfgStr, err := t.recvString("CFG", true)
+	cfgStr, err := t.recvStringTimeout("CFG", true, t.getHandshakeTimeout())
 	if err != nil {
 		return nil, err
 	}
 	if err := json.Unmarshal([]byte(cfgStr), &t.transferConfig); err != nil {
 		return nil, err
 	}
+	t.logger.Debugf("received config: %s", cfgStr)
+	if t.transferConfig.MaxBufSize > 1024*1024*1024 {
+		return nil, newTrzszError(fmt.Sprintf("invalid bufsize %d, greater than 1G", t.transferConfig.MaxBufSize))
+	}
+	if _, err := hashNew(t.transferConfig.Hash); err != nil {
+		return nil, newTrzszError(err.Error())
+	}
+	t.transferConfig.ChunkSizes = clampChunkSizes(t.transferConfig.ChunkSizes, t.transferConfig.MaxBufSize)
+	if len(t.transferConfig.Compress) > 0 && !containsString(kSupportedCompressions, t.transferConfig.Compress) {
+		return nil, newTrzszError(fmt.Sprintf("unsupported compress %s, should be one of %s",
+			t.transferConfig.Compress, strings.Join(kSupportedCompressions, ", ")))
+	}
 	return &t.transferConfig, nil
 }
 
@@ -407,23 +1109,119 @@ func (t *TrzszTransfer) recvExit() (string, error) {
 	return t.recvString("EXIT", false)
 }
 
+// stopOnDone wakes up the blocking reads once the ctx is done, the returned function should be called when finished.
+// It's called at the start of each transfer, so the stop by the previous ctx doesn't affect the next transfer.
+func (t *TrzszTransfer) stopOnDone(ctx context.Context) func() {
+	// the ctx of the previous transfer may be done after it finished, the reused transfer can still read
+	if !t.stopped.Load() {
+		t.buffer.resetStop()
+	}
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	finished := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			t.buffer.stopBuffer()
+			t.pauses.wake()
+		case <-finished:
+		}
+	}()
+	// wait for the goroutine, so it won't stop the next transfer after it has cleared the stop
+	return func() {
+		close(finished)
+		<-exited
+	}
+}
+
+// cancelTransfer tells the peer that the transfer is cancelled by the ctx.
+// The returned error wraps the cause, and won't be sent to the peer again by `clientError` or `serverError`.
+func (t *TrzszTransfer) cancelTransfer(ctx context.Context) error {
+	t.cleanInput(time.Duration(t.cleanTimeout.Load()))
+	_ = t.sendString("fail", "Cancelled")
+	err := NewTrzszError(encodeString(fmt.Sprintf("Cancelled: %v", context.Cause(ctx))), "fail", false)
+	err.cause = context.Cause(ctx)
+	err.code = ErrCancelled
+	return err
+}
+
+// sendCancel tells the peer that the transfer is cancelled before any file is sent.
+// The returned error won't be sent to the peer again by `clientError` or `serverError`.
+func (t *TrzszTransfer) sendCancel() error {
+	if err := t.sendString("fail", "Cancelled"); err != nil {
+		return err
+	}
+	return NewTrzszError(encodeString("Cancelled"), "fail", false)
+}
+
+// readFileFunc reads the data of the local file to be sent, it's replaced in tests.
+var readFileFunc = func(file *os.File, buffer []byte) (int, error) {
+	return file.Read(buffer)
+}
+
+// sendTruncated tells the peer that the file is truncated while it's being read, so that the peer
+// won't wait for the missing data. The returned error won't be sent to the peer again.
+func (t *TrzszTransfer) sendTruncated(name string) error {
+	msg := fmt.Sprintf("File truncated during read: %s", name)
+	if err := t.sendString("fail", msg); err != nil {
+		return err
+	}
+	return NewTrzszError(encodeString(msg), "fail", false)
+}
+
+// termRestoreFunc restores the terminal state of stdin, it's replaced in tests.
+var termRestoreFunc = term.Restore
+
+func (t *TrzszTransfer) getExitOutput() io.Writer {
+	if t.exitOutput == nil {
+		return os.Stdout
+	}
+	return t.exitOutput
+}
+
+// cleanupTerminal restores the terminal state, and restores the cursor to clear the output of the transfer.
+// It's done only once, by the exit of the transfer or at once on the signal, whichever comes first.
+func (t *TrzszTransfer) cleanupTerminal() {
+	t.terminalOnce.Do(func() {
+		if t.stdinState != nil {
+			_ = termRestoreFunc(int(os.Stdin.Fd()), t.stdinState)
+		}
+		t.writeMutex.Lock()
+		defer t.writeMutex.Unlock()
+		if IsWindows() {
+			writeAll(t.getExitOutput(), []byte("\x1b[H\x1b[2J\x1b[?1049l"))
+		} else {
+			writeAll(t.getExitOutput(), []byte("\x1b8\x1b[0J"))
+		}
+	})
+}
+
 func (t *TrzszTransfer) serverExit(msg string) {
+	output := t.getExitOutput()
 	t.cleanInput(500 * time.Millisecond)
-	if t.stdinState != nil {
-		term.Restore(int(os.Stdin.Fd()), t.stdinState)
-	}
+	t.cleanupTerminal()
 	if IsWindows() {
 		msg = strings.ReplaceAll(msg, "\n", "\r\n")
-		os.Stdout.WriteString("\x1b[H\x1b[2J\x1b[?1049l")
-	} else {
-		os.Stdout.WriteString("\x1b8\x1b[0J")
 	}
-	os.Stdout.WriteString(msg)
-	os.Stdout.WriteString("\r\n")
+	writeAll(output, []byte(msg))
+	writeAll(output, []byte("\r\n"))
+}
+
+// sendFail sends the error to the peer, with the code of it appended if the peer knows it.
+func (t *TrzszTransfer) sendFail(typ string, err error) error {
+	var e *TrzszError
+	if t.transferConfig.ErrorCode && errors.As(err, &e) && e.code != ErrUnknown {
+		return t.sendLine(typ, fmt.Sprintf("%s:%d", encodeString(err.Error()), e.code))
+	}
+	return t.sendString(typ, err.Error())
 }
 
 func (t *TrzszTransfer) clientError(err error) {
-	t.cleanInput(t.cleanTimeout)
+	t.logger.Warnf("transfer error: %v", err)
+	t.cleanInput(time.Duration(t.cleanTimeout.Load()))
 
 	trace := true
 	if e, ok := err.(*TrzszError); ok {
@@ -437,11 +1235,12 @@ func (t *TrzszTransfer) clientError(err error) {
 	if trace {
 		typ = "FAIL"
 	}
-	_ = t.sendString(typ, err.Error())
+	_ = t.sendFail(typ, err)
 }
 
 func (t *TrzszTransfer) serverError(err error) {
-	t.cleanInput(t.cleanTimeout)
+	t.logger.Warnf("transfer error: %v", err)
+	t.cleanInput(time.Duration(t.cleanTimeout.Load()))
 
 	trace := true
 	if e, ok := err.(*TrzszError); ok {
@@ -456,12 +1255,65 @@ func (t *TrzszTransfer) serverError(err error) {
 	if trace {
 		typ = "FAIL"
 	}
-	_ = t.sendString(typ, err.Error())
+	_ = t.sendFail(typ, err)
 
 	t.serverExit(err.Error())
 }
 
+// needVerify tells whether to verify the checksum of the file at the index of the batch.
+// Both sides make the same choice by the seed negotiated in the config.
+func (t *TrzszTransfer) needVerify(idx, size int64) bool {
+	if !t.transferConfig.Sample {
+		return true
+	}
+	if t.transferConfig.SampleAbove > 0 && size > t.transferConfig.SampleAbove {
+		return true
+	}
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.LittleEndian, t.transferConfig.SampleSeed)
+	_ = binary.Write(h, binary.LittleEndian, idx)
+	return h.Sum64()%100 < uint64(t.transferConfig.SamplePercent)
+}
+
+func (t *TrzszTransfer) newFileHasher() hash.Hash {
+	if t.primedHasher != nil {
+		hasher := t.primedHasher
+		t.primedHasher = nil
+		return hasher
+	}
+	if !t.verifyFile {
+		return nopHasher{}
+	}
+	hasher, err := hashNew(t.transferConfig.Hash)
+	if err != nil { // the hash has been checked in recvConfig
+		return md5.New()
+	}
+	return hasher
+}
+
+func (t *TrzszTransfer) getHashName() string {
+	if len(t.transferConfig.Hash) == 0 {
+		return "MD5"
+	}
+	return strings.ToUpper(t.transferConfig.Hash)
+}
+
+func (t *TrzszTransfer) getStatsMessage() string {
+	return fmt.Sprintf("Verified checksum of %d/%d file(s)", t.verifiedCount, t.fileCount)
+}
+
+func (t *TrzszTransfer) getTotalsMessage() string {
+	result := t.transferResult
+	msg := fmt.Sprintf("Total %d file(s)", result.FileCount)
+	if result.SkippedCount > 0 {
+		msg += fmt.Sprintf(", %d skipped", result.SkippedCount)
+	}
+	return msg + fmt.Sprintf(", %s in %s, %s/s", convertSizeToString(float64(result.Bytes)),
+		result.Duration.Round(time.Millisecond), convertSizeToString(result.Speed))
+}
+
 func (t *TrzszTransfer) sendFileNum(num int64, progress ProgressCallback) error {
+	t.beginTime = timeNowFunc()
 	if err := t.sendInteger("NUM", num); err != nil {
 		return err
 	}
@@ -469,46 +1321,144 @@ func (t *TrzszTransfer) sendFileNum(num int64, progress ProgressCallback) error
 		return err
 	}
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onNum(num)
+		progress.OnNum(num)
 	}
 	return nil
 }
 
-func (t *TrzszTransfer) sendFileName(f *TrzszFile, progress ProgressCallback) (*os.File, string, error) {
-	var fileName string
-	if t.transferConfig.Directory {
-		jsonName, err := json.Marshal(f)
-		if err != nil {
-			return nil, "", err
-		}
-		fileName = string(jsonName)
-	} else {
-		fileName = f.RelPath[0]
-	}
-	if err := t.sendString("NAME", fileName); err != nil {
-		return nil, "", err
+// confirmPreview shows the file count and total size on the terminal and waits for the user's answer.
+// It's always accepted without a terminal ( e.g., on the server side ), and is auto accepted after
+// `PreviewTimeout` seconds if it is positive.
+func (t *TrzszTransfer) confirmPreview(action string, num, total int64) bool {
+	if t.confirmOutput == nil || t.confirmInput == nil {
+		return true
 	}
-	remoteName, err := t.recvString("SUCC", false)
-	if err != nil {
-		return nil, "", err
+	prompt := fmt.Sprintf("%s %d file(s), %s, accept? [y/N] ", action, num, convertSizeToString(float64(total)))
+	_ = writeAll(t.confirmOutput, []byte(prompt))
+	defer writeAll(t.confirmOutput, []byte("\r\x1b[0K"))
+
+	var timeout <-chan time.Time
+	if t.transferConfig.PreviewTimeout > 0 {
+		timeout = time.NewTimer(time.Duration(t.transferConfig.PreviewTimeout) * time.Second).C
 	}
-	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onName(f.RelPath[len(f.RelPath)-1])
+	t.confirming.Store(true)
+	defer t.confirming.Store(false)
+	for {
+		select {
+		case buf := <-t.confirmInput:
+			switch buf[0] {
+			case 'y', 'Y':
+				return true
+			case 'n', 'N', '\r', '\n', '\x03':
+				return false
+			}
+		case <-timeout:
+			return true
+		}
 	}
-	if f.IsDir {
-		return nil, remoteName, nil
+}
+
+// addConfirmInput passes the user's input to `confirmPreview`, returns false if it's not waiting for an answer.
+func (t *TrzszTransfer) addConfirmInput(buf []byte) bool {
+	if len(buf) == 0 || !t.confirming.Load() {
+		return false
 	}
-	file, err := os.Open(f.AbsPath)
-	if err != nil {
-		return nil, "", err
+	select {
+	case t.confirmInput <- buf:
+	default:
 	}
-	return file, remoteName, nil
+	return true
 }
 
-func (t *TrzszTransfer) sendFileSize(file *os.File, progress ProgressCallback) (int64, error) {
-	stat, err := file.Stat()
-	if err != nil {
-		return 0, err
+func (t *TrzszTransfer) sendFileTotal(files []*TrzszFile) error {
+	total := int64(0)
+	for _, f := range files {
+		if !f.hasData() {
+			continue
+		}
+		stat, err := os.Stat(f.AbsPath)
+		if err != nil {
+			return err
+		}
+		total += stat.Size()
+	}
+	if err := t.sendInteger("TOTAL", total); err != nil {
+		return err
+	}
+	if err := t.checkInteger(total); err != nil {
+		return err
+	}
+	if !t.confirmPreview("Send", int64(len(files)), total) {
+		return t.sendCancel()
+	}
+	return nil
+}
+
+// sendFileName opens the file before sending the name, and tells the receiver to skip it in keep-going mode if failed.
+// sendFileName returns the reader of the file data, which is the `Reader` of the stream, or the opened file.
+func (t *TrzszTransfer) sendFileName(f *TrzszFile, progress ProgressCallback) (io.ReadCloser, string, error) {
+	var file io.ReadCloser = f.Reader
+	if file == nil && f.hasData() {
+		var err error
+		file, err = os.Open(f.AbsPath)
+		if err != nil {
+			if t.transferConfig.KeepGoing {
+				return nil, "", t.sendFileSkip(strings.Join(f.RelPath, "/"), err)
+			}
+			return nil, "", err
+		}
+	}
+	remoteName, err := t.sendFileHead(f, progress)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		if skipErr, ok := err.(*fileSkipError); ok {
+			skipErr.name = strings.Join(f.RelPath, "/")
+		}
+		return nil, "", err
+	}
+	return file, remoteName, nil
+}
+
+func (t *TrzszTransfer) sendFileHead(f *TrzszFile, progress ProgressCallback) (string, error) {
+	var fileName string
+	if t.transferConfig.Directory || t.hasModTimeInName() {
+		jsonName, err := json.Marshal(f)
+		if err != nil {
+			return "", err
+		}
+		fileName = string(jsonName)
+	} else {
+		fileName = f.RelPath[0]
+		if t.transferConfig.Update {
+			if err := t.sendFileModTime(f); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := t.sendString("NAME", fileName); err != nil {
+		return "", err
+	}
+	remoteName, err := t.recvString("SUCC", false)
+	if err != nil {
+		return "", err
+	}
+	if t.transferConfig.Preserve {
+		if err := t.sendFileAttrs(f); err != nil {
+			return "", err
+		}
+	}
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnName(f.RelPath[len(f.RelPath)-1])
+	}
+	return remoteName, nil
+}
+
+func (t *TrzszTransfer) sendFileSize(file *os.File, progress ProgressCallback) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
 	}
 	size := stat.Size()
 	if err := t.sendInteger("SIZE", size); err != nil {
@@ -518,50 +1468,151 @@ func (t *TrzszTransfer) sendFileSize(file *os.File, progress ProgressCallback) (
 		return 0, err
 	}
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onSize(size)
+		progress.OnSize(size)
 	}
 	return size, nil
 }
 
-func (t *TrzszTransfer) sendFileData(file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
+// useDataV2 returns whether to send or receive the data in the pipeline, which doesn't support the retries
+// and the checkpoints. The data is sent one chunk at a time with them instead, which is logged once.
+func (t *TrzszTransfer) useDataV2() bool {
+	if t.transferConfig.Protocol < 2 {
+		return false
+	}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{
+		{t.transferConfig.Retries > 0, "--retries"},
+		{t.transferConfig.CheckEvery > 0, "--check-every"},
+	} {
+		if opt.set {
+			if !t.pipelineRefused {
+				t.pipelineRefused = true
+				t.logger.Warnf("send the data one chunk at a time, as the pipeline of protocol 2 is not with %s", opt.name)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// skipEmptyData tells whether to skip the data phase of the file, as nothing is left to be transferred.
+// Both sides know the size and the offset already, so they skip it together without a round trip.
+func (t *TrzszTransfer) skipEmptyData(size int64) bool {
+	return size == 0 && t.transferConfig.SkipEmptyData
+}
+
+// emptyDataDigest returns the digest without any data, which is of the empty input,
+// or of the data resumed if the file has been transferred completely.
+func (t *TrzszTransfer) emptyDataDigest(progress ProgressCallback) []byte {
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnStep(0)
+	}
+	return t.newFileHasher().Sum(nil)
+}
+
+// clampChunkSizes limits the sizes of the chunk schedule by the max buffer size, the same as the adaptive one.
+func clampChunkSizes(sizes []int64, maxBufSize int64) []int64 {
+	if maxBufSize <= 0 {
+		return sizes
+	}
+	clamped := make([]int64, 0, len(sizes))
+	for _, size := range sizes {
+		clamped = append(clamped, minInt64(size, maxBufSize))
+	}
+	return clamped
+}
+
+// nextBufferSize returns the next size of the chunk schedule if set, otherwise the adaptive buffer size.
+func (t *TrzszTransfer) nextBufferSize() int64 {
+	sizes := t.transferConfig.ChunkSizes
+	if len(sizes) == 0 {
+		return t.bufferSize.Load()
+	}
+	size := sizes[t.chunkIndex%len(sizes)]
+	t.chunkIndex++
+	return size
+}
+
+func (t *TrzszTransfer) sendFileData(ctx context.Context, file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
 	step := int64(0)
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onStep(step)
+		progress.OnStep(step)
+	}
+	t.chunkIndex = 0
+	policy := t.getBufferPolicy()
+	bufSize := policy.InitialSize
+	if len(t.transferConfig.ChunkSizes) > 0 {
+		bufSize = t.nextBufferSize()
 	}
-	bufSize := int64(1024)
 	buffer := make([]byte, bufSize)
-	hasher := md5.New()
+	hasher := t.newFileHasher()
+	var throttle *adaptiveThrottle
+	if t.transferConfig.Adaptive {
+		throttle = &adaptiveThrottle{}
+	}
+	limiter := t.newRateLimiter()
 	for step < size {
+		t.waitIfPaused(ctx)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		beginTime := time.Now()
-		n, err := file.Read(buffer)
+		n, err := readFileFunc(file, buffer)
+		if err == io.EOF {
+			return nil, t.sendTruncated(file.Name())
+		}
 		if err != nil {
 			return nil, err
 		}
 		length := int64(n)
 		data := buffer[:n]
-		if err := t.sendData(data); err != nil {
-			return nil, err
+		t.bufferSize.Store(bufSize)
+		if t.transferConfig.Retries > 0 {
+			if err := t.sendChunk(step, data); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := t.sendData(data); err != nil {
+				return nil, err
+			}
+			if err := t.checkInteger(length); err != nil {
+				return nil, err
+			}
 		}
 		if _, err := hasher.Write(data); err != nil {
 			return nil, err
 		}
-		if err := t.checkInteger(length); err != nil {
-			return nil, err
+		if t.passCheckpoint(step, step+length) {
+			if err := t.sendCheckpoint(hasher); err != nil {
+				return nil, err
+			}
 		}
 		step += length
 		if progress != nil && !reflect.ValueOf(progress).IsNil() {
-			progress.onStep(step)
+			progress.OnStep(step)
 		}
 		chunkTime := time.Now().Sub(beginTime)
-		if length == bufSize && chunkTime < 500*time.Millisecond && bufSize < t.transferConfig.MaxBufSize {
-			bufSize = minInt64(bufSize*2, t.transferConfig.MaxBufSize)
-			buffer = make([]byte, bufSize)
-		} else if chunkTime >= 2*time.Second && bufSize > 1024 {
-			bufSize = 1024
+		if len(t.transferConfig.ChunkSizes) > 0 {
+			if next := t.nextBufferSize(); next != bufSize {
+				bufSize = next
+				buffer = make([]byte, bufSize)
+			}
+		} else if next := policy.nextSize(bufSize, length, chunkTime); next != bufSize {
+			bufSize = next
 			buffer = make([]byte, bufSize)
 		}
-		if chunkTime > t.maxChunkTime {
-			t.maxChunkTime = chunkTime
+		t.updateMaxChunkTime(chunkTime)
+		if throttle != nil {
+			if err := sleepContext(ctx, throttle.onChunk(length, chunkTime)); err != nil {
+				return nil, err
+			}
+		}
+		if limiter != nil {
+			if err := sleepContext(ctx, limiter.onChunk(length, chunkTime)); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return hasher.Sum(nil), nil
@@ -575,91 +1626,437 @@ func (t *TrzszTransfer) sendFileMD5(digest []byte, progress ProgressCallback) er
 		return err
 	}
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onDone()
+		progress.OnDone()
 	}
 	return nil
 }
 
+// onFileHash reports the digest of the file verified, with the same name as `OnFileDone`.
+func (t *TrzszTransfer) onFileHash(progress ProgressCallback, localName string, digest []byte) {
+	if progress == nil || reflect.ValueOf(progress).IsNil() {
+		return
+	}
+	if callback, ok := getOptionalCallback(progress).(FileHashCallback); ok {
+		callback.OnFileHash(localName, strings.ToLower(t.getHashName()), digest)
+	}
+}
+
 func (t *TrzszTransfer) sendFiles(files []*TrzszFile, progress ProgressCallback) ([]string, error) {
+	return t.SendFilesContext(context.Background(), files, progress)
+}
+
+// SendFilesContext sends the files, and stops promptly once the ctx is done. The peer is told that the
+// transfer is cancelled, and the returned error wraps the cause, which won't be sent to the peer again.
+func (t *TrzszTransfer) SendFilesContext(ctx context.Context, files []*TrzszFile, progress ProgressCallback) ([]string, error) {
+	stop := t.stopOnDone(ctx)
+	remoteNames, err := t.doSendFiles(ctx, files, withSpeedCallback(progress))
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return nil, t.cancelTransfer(ctx)
+	}
+	return remoteNames, err
+}
+
+// doSendFiles sends the files from index `StartAt` of the batch. The receiver is not aware of the
+// skipped files, the `NUM` is the count of the remaining files, and they are received as a new batch.
+func (t *TrzszTransfer) doSendFiles(ctx context.Context, files []*TrzszFile, progress ProgressCallback) ([]string, error) {
+	if t.transferConfig.StartAt > 0 {
+		if t.transferConfig.StartAt >= len(files) {
+			return nil, newTrzszError(fmt.Sprintf("Start index %d out of range, only %d file(s)", t.transferConfig.StartAt, len(files)))
+		}
+		files = files[t.transferConfig.StartAt:]
+	}
+	if t.useTar() {
+		files = []*TrzszFile{t.newTarStream(files)}
+	}
+	files = t.resolveHardLinks(files, t.transferConfig.StartAt)
+
+	if t.stopped.Load() {
+		return nil, t.sendCancel()
+	}
+
+	if t.transferConfig.VerifyEscape {
+		if err := t.sendEscapeCanary(); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := t.sendFileNum(int64(len(files)), progress); err != nil {
 		return nil, err
 	}
 
+	if t.transferConfig.Preview {
+		if err := t.sendFileTotal(files); err != nil {
+			return nil, err
+		}
+	}
+
+	t.transferResult = &TransferResult{Sent: true}
+	t.batchCount = int64(len(files))
+	t.failedCount = 0
+	if t.useParallel() {
+		remoteNames, err := t.sendFilesParallel(ctx, files, progress)
+		if err != nil {
+			return nil, err
+		}
+		t.finishTransferResult(remoteNames)
+		return remoteNames, nil
+	}
+	var dedup *dedupFiles
+	if t.transferConfig.Dedup {
+		dedup = findDuplicateFiles(files)
+	}
 	var remoteNames []string
-	for _, f := range files {
-		file, remoteName, err := t.sendFileName(f, progress)
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		beginTime := timeNowFunc()
+		t.logger.Infof("send file %s", strings.Join(f.RelPath, "/"))
+		reader, remoteName, err := t.sendFileName(f, progress)
+		if skipErr, ok := err.(*fileSkipError); ok {
+			t.onFileError(skipErr, progress)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		if !containsString(remoteNames, remoteName) {
+		if remoteName != "" && !containsString(remoteNames, remoteName) {
 			remoteNames = append(remoteNames, remoteName)
 		}
 
-		if file == nil {
+		if reader == nil {
 			continue
 		}
 
-		defer file.Close()
+		defer reader.Close()
+
+		if f.Reader != nil {
+			if skipped, err := t.recvFileSkipped(f, beginTime, progress); err != nil || skipped {
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := t.sendFileStream(ctx, int64(i), f, beginTime, progress); err != nil {
+				if skipErr, ok := err.(*fileSkipError); ok {
+					t.onFileError(skipErr, progress)
+					continue
+				}
+				return nil, err
+			}
+			continue
+		}
+		file := reader.(*os.File)
+
+		var dedupDigest string
+		if dedup != nil {
+			var same *sameFile
+			same, dedupDigest, err = dedup.getSameFile(i, file)
+			if err != nil {
+				return nil, err
+			}
+			send, err := t.sendFileSame(same)
+			if err != nil {
+				return nil, err
+			}
+			if !send {
+				t.addFileResult(strings.Join(f.RelPath, "/"), 0, beginTime, timeNowFunc())
+				if progress != nil && !reflect.ValueOf(progress).IsNil() {
+					progress.OnDone()
+				}
+				continue
+			}
+		}
+
+		if skipped, err := t.recvFileSkipped(f, beginTime, progress); err != nil || skipped {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 
 		size, err := t.sendFileSize(file, progress)
 		if err != nil {
 			return nil, err
 		}
 
+		if t.transferConfig.Checksum {
+			changed, err := t.recvFileChecksum(file)
+			if err != nil {
+				return nil, err
+			}
+			if !changed {
+				t.addSkippedResult(strings.Join(f.RelPath, "/"), beginTime, timeNowFunc())
+				if progress != nil && !reflect.ValueOf(progress).IsNil() {
+					reportUnchanged(progress)
+					progress.OnDone()
+				}
+				continue
+			}
+		}
+
+		if t.transferConfig.Audit {
+			pull, err := t.sendFileAudit(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pull {
+				t.addFileResult(strings.Join(f.RelPath, "/"), 0, beginTime, timeNowFunc())
+				if progress != nil && !reflect.ValueOf(progress).IsNil() {
+					progress.OnDone()
+				}
+				continue
+			}
+		}
+
+		dataBeginTime := timeNowFunc()
+		t.resetDataCompress()
+		t.verifyFile = t.needVerify(int64(i), size)
+		var sentHasher *dedupHasher
+		if dedup != nil {
+			sentHasher = t.primeDedupHasher(dedup, i, dedupDigest)
+		}
+		var offset int64
+		if t.transferConfig.Resume {
+			offset, err = t.recvFileOffset(file, size, progress)
+			if err != nil {
+				return nil, err
+			}
+		}
 		var digest []byte
-		if t.transferConfig.Protocol == 2 {
-			digest, err = t.sendFileDataV2(file, size, progress)
+		if t.transferConfig.Patch {
+			digest, err = t.sendFilePatch(ctx, file, size, progress)
+		} else if t.skipEmptyData(size - offset) {
+			digest = t.emptyDataDigest(progress)
+		} else if t.useDataV2() {
+			digest, err = t.sendFileDataV2(ctx, file, size-offset, progress)
 		} else {
-			digest, err = t.sendFileData(file, size, progress)
+			digest, err = t.sendFileData(ctx, file, size-offset, progress)
 		}
 		if err != nil {
 			return nil, err
 		}
 
-		if err := t.sendFileMD5(digest, progress); err != nil {
-			return nil, err
+		t.fileCount++
+		if t.verifyFile {
+			if err := t.sendFileMD5(digest, t.progressBeforeResult(progress)); err != nil {
+				return nil, err
+			}
+			t.verifiedCount++
+		} else {
+			digest = nil
+			if p := t.progressBeforeResult(progress); p != nil && !reflect.ValueOf(p).IsNil() {
+				p.OnDone()
+			}
+		}
+		if t.transferConfig.KeepGoing {
+			if err := t.recvFileResult(strings.Join(f.RelPath, "/"), progress); err != nil {
+				if skipErr, ok := err.(*fileSkipError); ok {
+					t.onFileError(skipErr, progress)
+					continue
+				}
+				return nil, err
+			}
+		}
+		t.finishSendFile(&finishedFile{localPath: f.AbsPath, resultName: strings.Join(f.RelPath, "/"), size: size,
+			dataSize: size - offset, digest: digest, beginTime: beginTime, dataBeginTime: dataBeginTime}, progress)
+		if dedup != nil {
+			dedup.addSentFile(i, dedupDigest, sentHasher)
 		}
 	}
 
+	t.finishTransferResult(remoteNames)
 	return remoteNames, nil
 }
 
+// Config returns a copy of the negotiated config, which is only valid after the config is sent or received.
+func (t *TrzszTransfer) Config() TransferConfig {
+	return t.transferConfig
+}
+
+// Action returns a copy of the action sent by the client or received by the server in the handshake,
+// or nil before the handshake.
+func (t *TrzszTransfer) Action() *TransferAction {
+	if t.action == nil {
+		return nil
+	}
+	action := *t.action
+	return &action
+}
+
+// GetTransferResult returns the result of the last sent or received files.
+func (t *TrzszTransfer) GetTransferResult() *TransferResult {
+	return t.transferResult
+}
+
+// finishTransferResult sums up the files, the elapsed time is since the file count is negotiated.
+func (t *TrzszTransfer) finishTransferResult(names []string) {
+	result := t.transferResult
+	result.Duration = timeNowFunc().Sub(t.beginTime)
+	result.Names = names
+	for _, file := range result.Files {
+		if file.Skipped {
+			result.SkippedCount++
+		} else {
+			result.FileCount++
+		}
+		result.Bytes += file.Size
+	}
+	if result.Duration > 0 {
+		result.Speed = float64(result.Bytes) / result.Duration.Seconds()
+	}
+}
+
+func (t *TrzszTransfer) addFileResult(name string, size int64, beginTime, dataBeginTime time.Time) {
+	t.transferResult.Files = append(t.transferResult.Files, &FileResult{
+		Name:            name,
+		Size:            size,
+		NegotiationTime: dataBeginTime.Sub(beginTime),
+		DataTime:        timeNowFunc().Sub(dataBeginTime),
+	})
+}
+
+// addSkippedResult records the file kept untouched, which is counted apart from the transferred files.
+func (t *TrzszTransfer) addSkippedResult(name string, beginTime, dataBeginTime time.Time) {
+	t.addFileResult(name, 0, beginTime, dataBeginTime)
+	t.transferResult.Files[len(t.transferResult.Files)-1].Skipped = true
+}
+
+// finishedFile is a file sent or received with its data, to be reported and recorded in the result.
+type finishedFile struct {
+	localPath     string     // the local path reported by `OnFileDone`
+	resultName    string     // the relative name in the TransferResult
+	size          int64      // the size of the file
+	dataSize      int64      // the size of the data transferred, less than the size if resumed
+	digest        []byte     // the digest agreed by the peer, nil if the file is not verified
+	attrs         *fileAttrs // the attributes to be applied to the received file
+	beginTime     time.Time
+	dataBeginTime time.Time
+}
+
+// finishSendFile reports the file sent and records the result, it's shared by the parallel mode.
+func (t *TrzszTransfer) finishSendFile(f *finishedFile, progress ProgressCallback) {
+	t.logger.Infof("sent file %s, %d bytes", f.resultName, f.dataSize)
+	if f.digest != nil {
+		t.onFileHash(progress, f.localPath, f.digest)
+	}
+	reportFileDone(progress, f.localPath, f.size)
+	t.addFileResult(f.resultName, f.dataSize, f.beginTime, f.dataBeginTime)
+}
+
+// finishRecvFile reports the file received and records the result, then applies the attributes
+// and counts the quota, it's shared by the parallel mode.
+func (t *TrzszTransfer) finishRecvFile(f *finishedFile, progress ProgressCallback) error {
+	t.logger.Infof("received file %s, %d bytes", f.localPath, f.dataSize)
+	if f.digest != nil {
+		t.onFileHash(progress, f.localPath, f.digest)
+		t.addDiskDigest(f.localPath, f.digest)
+	}
+	reportFileDone(progress, f.localPath, f.size)
+	t.addFileResult(f.resultName, f.dataSize, f.beginTime, f.dataBeginTime)
+	if err := t.applyFileAttrs(f.localPath, f.attrs); err != nil {
+		return err
+	}
+	if t.quota != nil {
+		if err := t.quota.add(f.dataSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitRecvFile renames the atomic file, or applies the attributes to the received file, and returns its local path.
+// In keep-going mode, the file which fails to be written or finished is removed, and it's skipped by the error.
+func (t *TrzszTransfer) commitRecvFile(file *os.File, localName string, attrs *fileAttrs) (string, error) {
+	localPath := file.Name()
+	if t.isOutputFile(file) {
+		localPath = localName
+	}
+	err := t.writeErr
+	if err == nil && len(t.atomicTmpPath) > 0 {
+		localPath, err = t.commitAtomicFile(attrs)
+	} else if err == nil {
+		err = t.applyFileAttrs(localPath, attrs)
+	}
+	if err != nil && t.transferConfig.KeepGoing {
+		t.removeAtomicFile()
+		t.removePartialFile(file)
+	}
+	return localPath, err
+}
+
+func localRelPath(path, name string) string {
+	if relPath, err := filepath.Rel(path, name); err == nil {
+		return filepath.ToSlash(relPath)
+	}
+	return name
+}
+
 func (t *TrzszTransfer) recvFileNum(progress ProgressCallback) (int64, error) {
 	num, err := t.recvInteger("NUM", false, nil)
 	if err != nil {
 		return 0, err
 	}
+	t.beginTime = timeNowFunc()
 	if err := t.sendInteger("SUCC", num); err != nil {
 		return 0, err
 	}
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onNum(num)
+		progress.OnNum(num)
 	}
 	return num, nil
 }
 
+func (t *TrzszTransfer) recvFileTotal(num int64) error {
+	total, err := t.recvInteger("TOTAL", false, nil)
+	if err != nil {
+		return err
+	}
+	if !t.confirmPreview("Receive", num, total) {
+		return t.sendCancel()
+	}
+	return t.sendInteger("SUCC", total)
+}
+
 func doCreateFile(path string) (*os.File, error) {
-	file, err := os.Create(path)
+	return doOpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+func doOpenFile(path string, flag int) (*os.File, error) {
+	file, err := os.OpenFile(path, flag, 0666)
 	if err != nil {
 		if e, ok := err.(*fs.PathError); ok {
 			if errno, ok := e.Unwrap().(syscall.Errno); ok {
 				if (!IsWindows() && errno == 13) || (IsWindows() && errno == 5) {
-					return nil, newTrzszError(fmt.Sprintf("No permission to write: %s", path))
+					return nil, newTrzszErrorCode(ErrPermission, fmt.Sprintf("No permission to write: %s", path))
 				} else if (!IsWindows() && errno == 21) || (IsWindows() && errno == 0x2000002a) {
 					return nil, newTrzszError(fmt.Sprintf("Is a directory: %s", path))
 				}
 			}
 		}
+		if isNoSpaceError(err) {
+			return nil, newTrzszErrorCode(ErrNoSpace, fmt.Sprintf("No space left on device: %s", path))
+		}
 		return nil, newTrzszError(fmt.Sprintf("%v", err))
 	}
 	return file, nil
 }
 
-func doCreateDirectory(path string) error {
+// getDirMode returns the mode of the directories to be created, including the intermediate ones.
+// It's a local setting of the receiver. The mode of the received directories is applied later in preserve mode.
+func (t *TrzszTransfer) getDirMode() os.FileMode {
+	if t.dirMode != 0 {
+		return t.dirMode
+	}
+	return 0755
+}
+
+func doCreateDirectory(path string, mode os.FileMode) error {
 	stat, err := os.Stat(path)
 	if errors.Is(err, os.ErrNotExist) {
-		return os.MkdirAll(path, 0755)
+		return os.MkdirAll(path, mode)
 	} else if err != nil {
 		return err
 	}
@@ -669,56 +2066,204 @@ func doCreateDirectory(path string) error {
 	return nil
 }
 
+// errSkipExisting is returned by createLocalFile if the existing file should be skipped.
+var errSkipExisting = errors.New("skip existing file")
+
+// keepLocalName returns true if the existing files should be written, audited or skipped in place.
+func (t *TrzszTransfer) keepLocalName() bool {
+	return t.transferConfig.Overwrite || t.transferConfig.Patch || t.transferConfig.Audit || t.transferConfig.Resume ||
+		t.transferConfig.OverwriteMode == "force" || t.transferConfig.OverwriteMode == "skip" || t.transferConfig.Update ||
+		t.transferConfig.Checksum
+}
+
+// skipExisting returns true if the existing file should be kept untouched, the patch, audit, resume and checksum modes take precedence.
+// In update mode, only the existing file newer than or as new as the source one is kept.
+func (t *TrzszTransfer) skipExisting(stat os.FileInfo) bool {
+	if t.transferConfig.Patch || t.transferConfig.Audit || t.transferConfig.Resume || t.transferConfig.Checksum {
+		return false
+	}
+	if t.transferConfig.OverwriteMode == "skip" && !t.transferConfig.Overwrite {
+		return true
+	}
+	if !t.transferConfig.Update {
+		return false
+	}
+	if t.sourceModTimeNs > 0 {
+		return stat.ModTime().UnixNano() >= t.sourceModTimeNs
+	}
+	return stat.ModTime().Unix() >= t.sourceModTime
+}
+
+// createLocalFile keeps the existing content in patch mode, the changed ranges will be written in place.
+// In audit mode, the existing content is compared with the incoming file before it's truncated.
+// In resume mode, the existing content is kept as the received part, and only the tail will be received.
+// In checksum mode, the existing content is kept until it's known to be changed.
+// In skip mode, errSkipExisting is returned if the file exists, and its data should be discarded.
+// createLocalFile refuses to replace an existing directory, e.g., an empty directory of the same name.
+func (t *TrzszTransfer) createLocalFile(path string) (*os.File, error) {
+	if stat, err := os.Stat(path); err == nil && stat.IsDir() {
+		return nil, newTrzszError(fmt.Sprintf("Is a directory: %s", path))
+	} else if err == nil && stat.Mode().IsRegular() && t.skipExisting(stat) {
+		return nil, errSkipExisting
+	}
+	if t.transferConfig.Audit {
+		return t.openAuditFile(path)
+	}
+	if t.transferConfig.Checksum {
+		_, err := os.Stat(path)
+		t.checksumMissing = errors.Is(err, os.ErrNotExist)
+	}
+	if t.transferConfig.Patch || t.transferConfig.Resume || t.transferConfig.Checksum {
+		return doOpenFile(path, os.O_RDWR|os.O_CREATE)
+	}
+	if t.transferConfig.Atomic {
+		dir, name := filepath.Split(path)
+		tmpPath := filepath.Join(dir, "."+name+".tmp")
+		file, err := doCreateFile(tmpPath)
+		if err != nil {
+			return nil, err
+		}
+		t.atomicPath, t.atomicTmpPath = path, tmpPath
+		return file, nil
+	}
+	return doCreateFile(path)
+}
+
+// getOutputName returns the output name to save the only file as, or the transmitted name if not set.
+func (t *TrzszTransfer) getOutputName(fileName string) string {
+	if len(t.outputName) > 0 {
+		return t.outputName
+	}
+	return fileName
+}
+
+// checkOutputName ensures that exactly one file is received if the output name or the output file is set.
+func (t *TrzszTransfer) checkOutputName(num int64) error {
+	option := "--output"
+	if t.outputFile != nil {
+		option = "--stdout"
+	} else if len(t.outputName) == 0 {
+		return nil
+	}
+	if t.transferConfig.Directory {
+		return newTrzszError(fmt.Sprintf("%s doesn't support receiving directories", option))
+	}
+	if num != 1 {
+		return newTrzszError(fmt.Sprintf("%s expects exactly one file, but got %d", option, num))
+	}
+	return nil
+}
+
+// isOutputFile returns true for the output file, e.g., stdout, which receives the data instead of a local file.
+// It's neither removed on errors nor applied with the attributes.
+func (t *TrzszTransfer) isOutputFile(file *os.File) bool {
+	return t.outputFile != nil && file == t.outputFile
+}
+
+// checkPathLimits refuses the path deeper than the max depth, or with a name longer than the max bytes,
+// before any directory is created for it.
+func (t *TrzszTransfer) checkPathLimits(relPath []string) error {
+	if t.maxDepth > 0 && len(relPath) > t.maxDepth {
+		return newTrzszError(fmt.Sprintf("Path depth %d exceeds the max depth %d: %s",
+			len(relPath), t.maxDepth, strings.Join(relPath[:t.maxDepth], "/")+"/..."))
+	}
+	for _, name := range relPath {
+		if t.maxNameLen > 0 && len(name) > t.maxNameLen {
+			return newTrzszError(fmt.Sprintf("Name length %d exceeds the max length %d: %s",
+				len(name), t.maxNameLen, strings.Join(relPath, "/")))
+		}
+	}
+	return nil
+}
+
+// createFile refuses the name which could escape the path, as it's from the sender.
 func (t *TrzszTransfer) createFile(path, fileName string) (*os.File, string, error) {
+	fileName = toLocalName(fileName, t.transferConfig.Normalize)
+	if isUnsafeName(fileName) {
+		return nil, "", newTrzszError(fmt.Sprintf("Unsafe path: %s", fileName))
+	}
+	if err := t.checkPathLimits([]string{fileName}); err != nil {
+		return nil, "", err
+	}
 	var localName string
-	if t.transferConfig.Overwrite {
+	if t.keepLocalName() {
 		localName = fileName
 	} else {
 		var err error
-		localName, err = getNewName(path, fileName)
+		localName, err = getNewName(path, fileName, t.transferConfig.RenameScheme)
 		if err != nil {
 			return nil, "", err
 		}
 	}
-	file, err := doCreateFile(filepath.Join(path, localName))
+	file, err := t.createLocalFile(filepath.Join(path, localName))
+	if err == errSkipExisting {
+		return nil, localName, err
+	}
 	if err != nil {
 		return nil, "", err
 	}
 	return file, localName, nil
 }
 
-func (t *TrzszTransfer) createDirOrFile(path, name string) (*os.File, string, string, error) {
+func (t *TrzszTransfer) createDirOrFile(path, name string) (*os.File, string, string, string, error) {
 	var f TrzszFile
 	if err := json.Unmarshal([]byte(name), &f); err != nil {
-		return nil, "", "", err
+		return nil, "", "", "", err
 	}
 	if len(f.RelPath) < 1 {
-		return nil, "", "", newTrzszError(fmt.Sprintf("Invalid name: %s", name))
+		return nil, "", "", "", newTrzszError(fmt.Sprintf("Invalid name: %s", name))
+	}
+	return t.createEntry(path, &f)
+}
+
+// createEntry creates the directory, the link or the file of the entry under the path, the same as the entries
+// received one by one and the entries extracted from the tar stream. The top-level name is renamed by the path id.
+func (t *TrzszTransfer) createEntry(path string, f *TrzszFile) (*os.File, string, string, string, error) {
+	for i, p := range f.RelPath {
+		f.RelPath[i] = toLocalName(p, t.transferConfig.Normalize)
+		if isUnsafeName(f.RelPath[i]) {
+			return nil, "", "", "", newTrzszError(fmt.Sprintf("Unsafe path: %s", strings.Join(f.RelPath, "/")))
+		}
+		if f.RelPath[i] == "" || f.RelPath[i] == "." {
+			return nil, "", "", "", newTrzszError(fmt.Sprintf("Invalid name: %s", strings.Join(f.RelPath, "/")))
+		}
+	}
+	if err := t.checkPathLimits(f.RelPath); err != nil {
+		return nil, "", "", "", err
 	}
 
+	t.sourceModTime, t.sourceModTimeNs = f.ModTime, f.ModTimeNano
+	if t.flatten {
+		return t.createFlatEntry(path, f)
+	}
 	fileName := f.RelPath[len(f.RelPath)-1]
 
 	var localName string
-	if t.transferConfig.Overwrite {
+	if t.keepLocalName() {
 		localName = f.RelPath[0]
 	} else {
 		if v, ok := t.fileNameMap[f.PathID]; ok {
 			localName = v
 		} else {
 			var err error
-			localName, err = getNewName(path, f.RelPath[0])
+			localName, err = getNewName(path, f.RelPath[0], t.transferConfig.RenameScheme)
 			if err != nil {
-				return nil, "", "", err
+				return nil, "", "", "", err
 			}
 			t.fileNameMap[f.PathID] = localName
 		}
 	}
 
+	names := append([]string{localName}, f.RelPath[1:]...)
+	if err := t.checkEntryPath(path, names); err != nil {
+		return nil, "", "", "", err
+	}
+
 	var fullPath string
 	if len(f.RelPath) > 1 {
 		p := filepath.Join(append([]string{path, localName}, f.RelPath[1:len(f.RelPath)-1]...)...)
-		if err := doCreateDirectory(p); err != nil {
-			return nil, "", "", err
+		if err := t.createDirectory(p); err != nil {
+			return nil, "", "", "", err
 		}
 		fullPath = filepath.Join(p, fileName)
 	} else {
@@ -726,44 +2271,142 @@ func (t *TrzszTransfer) createDirOrFile(path, name string) (*os.File, string, st
 	}
 
 	if f.IsDir {
-		if err := doCreateDirectory(fullPath); err != nil {
-			return nil, "", "", err
+		if err := t.createDirectory(fullPath); err != nil {
+			return nil, "", "", "", err
 		}
-		return nil, localName, fileName, nil
+		return nil, localName, fileName, fullPath, nil
 	}
 
-	file, err := doCreateFile(fullPath)
+	file, filePath, err := t.createEntryFile(f, fullPath)
+	if err == errSkipExisting {
+		return nil, localName, fileName, filePath, err
+	}
+	if err != nil {
+		return nil, "", "", "", err
+	}
+	return file, localName, fileName, filePath, nil
+}
+
+// createFlatEntry creates the file or the link of the entry directly under the path by its own name with `--flatten`,
+// which is renamed as usual if the name exists, e.g., a/x.txt and b/x.txt become x.txt and x.txt.0.
+// The directories are skipped, so the local name is empty for them.
+func (t *TrzszTransfer) createFlatEntry(path string, f *TrzszFile) (*os.File, string, string, string, error) {
+	fileName := f.RelPath[len(f.RelPath)-1]
+	if f.IsDir {
+		return nil, "", fileName, "", nil
+	}
+	localName := fileName
+	if !t.keepLocalName() {
+		var err error
+		localName, err = getNewName(path, fileName, t.transferConfig.RenameScheme)
+		if err != nil {
+			return nil, "", "", "", err
+		}
+	}
+	if err := t.checkEntryPath(path, []string{localName}); err != nil {
+		return nil, "", "", "", err
+	}
+	file, filePath, err := t.createEntryFile(f, filepath.Join(path, localName))
+	if err == errSkipExisting {
+		return nil, localName, fileName, filePath, err
+	}
 	if err != nil {
-		return nil, "", "", err
+		return nil, "", "", "", err
 	}
-	return file, localName, fileName, nil
+	return file, localName, fileName, filePath, nil
 }
 
-func (t *TrzszTransfer) recvFileName(path string, progress ProgressCallback) (*os.File, string, error) {
+// createEntryFile creates the link or the file of the entry, the full path is only returned for the file,
+// which gets the attributes after it's written.
+func (t *TrzszTransfer) createEntryFile(f *TrzszFile, fullPath string) (*os.File, string, error) {
+	if (f.IsLink || f.HardLink != nil) && t.transferConfig.Audit {
+		return nil, "", nil // the links are not audited
+	}
+	if f.HardLink != nil {
+		return nil, "", t.createHardLink(f, fullPath)
+	}
+	if f.IsLink {
+		return nil, "", t.createLink(f, fullPath)
+	}
+	file, err := t.createLocalFile(fullPath)
+	return file, fullPath, err
+}
+
+// recvFileName returns the attributes to be applied after the file is written in preserve mode.
+// The attributes of the directories are applied after all the files are received.
+// An existing file to be skipped is replaced by the null device, and its path is kept in `skippedPath`.
+// The output file, e.g., stdout, receives the data of the only file instead of a local file.
+func (t *TrzszTransfer) recvFileName(path string, progress ProgressCallback) (*os.File, string, *fileAttrs, error) {
+	t.skippedPath = ""
+	t.maxFileExceeded = false
+	t.writeErr = nil
+	if t.transferConfig.Update && !t.transferConfig.Directory && !t.transferConfig.Verdict {
+		modTime, err := t.recvFileModTime()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		t.sourceModTime, t.sourceModTimeNs = modTime, 0
+	}
+
 	fileName, err := t.recvString("NAME", false)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
+	}
+	if t.hasModTimeInName() {
+		if fileName, err = t.parseModTimeName(fileName); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if err := t.checkPreReceiveName(fileName); err != nil {
+		return nil, "", nil, err
 	}
 
 	var file *os.File
-	var localName string
+	var localName, fullPath string
+	name := fileName
 	if t.transferConfig.Directory {
-		file, localName, fileName, err = t.createDirOrFile(path, fileName)
+		file, localName, fileName, fullPath, err = t.createDirOrFile(path, fileName)
+	} else if t.outputFile != nil {
+		file, localName, fullPath = t.outputFile, fileName, t.outputFile.Name()
 	} else {
-		file, localName, err = t.createFile(path, fileName)
+		file, localName, err = t.createFile(path, t.getOutputName(fileName))
+		fullPath = filepath.Join(path, localName)
+	}
+	if err == errSkipExisting {
+		t.skippedPath = fullPath
+		file, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 	}
 	if err != nil {
-		return nil, "", err
+		if t.transferConfig.KeepGoing {
+			return nil, "", nil, t.sendFileSkip(t.getSkipName(name), err)
+		}
+		return nil, "", nil, err
 	}
+	t.logger.Infof("receive file %s", fullPath)
 
 	if err := t.sendString("SUCC", localName); err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
+
+	var attrs *fileAttrs
+	if t.transferConfig.Preserve {
+		attrs, err = t.recvFileAttrs()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if file == nil && fullPath != "" && !t.transferConfig.Audit {
+			t.dirAttrs = append(t.dirAttrs, &dirAttrs{fullPath, attrs})
+		}
+	}
+
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onName(fileName)
+		progress.OnName(fileName)
+		if t.skippedPath != "" {
+			reportSkip(progress)
+		}
 	}
 
-	return file, localName, nil
+	return file, localName, attrs, nil
 }
 
 func (t *TrzszTransfer) recvFileSize(progress ProgressCallback) (int64, error) {
@@ -771,46 +2414,155 @@ func (t *TrzszTransfer) recvFileSize(progress ProgressCallback) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	if size == kStreamSize && (t.transferConfig.Stream || t.useTar()) {
+		if err := t.checkPreReceiveSize(size); err != nil {
+			return 0, err
+		}
+		return size, t.recvStreamSize(progress)
+	}
+	if size < 0 {
+		return 0, newTrzszError(fmt.Sprintf("Invalid size %d", size))
+	}
+	if t.skippedPath == "" {
+		if err := t.checkPreReceiveSize(size); err != nil {
+			return 0, err
+		}
+	}
+	if t.quota != nil && t.skippedPath == "" {
+		if err := t.quota.check(size); err != nil {
+			return 0, err
+		}
+	}
+	// the skipped file is checked too, or its data would be received to be discarded
+	if err := t.checkMaxFileSize(size); err != nil {
+		return 0, err
+	}
 	if err := t.sendInteger("SUCC", size); err != nil {
 		return 0, err
 	}
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onSize(size)
+		progress.OnSize(size)
 	}
 	return size, nil
 }
 
-func (t *TrzszTransfer) recvFileData(file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
+// checkMaxFileSize rejects the file larger than the max file size before any data is sent,
+// the sender gets the error instead of the SUCC reply. Each file is checked on its own.
+func (t *TrzszTransfer) checkMaxFileSize(size int64) error {
+	t.maxFileExceeded = t.maxFile > 0 && size > t.maxFile
+	if t.maxFileExceeded {
+		return newTrzszError(fmt.Sprintf("File size %s exceeds the max file size %s",
+			convertSizeToString(float64(size)), convertSizeToString(float64(t.maxFile))))
+	}
+	return nil
+}
+
+// writeFileFunc writes the received data to the local file, it's replaced in tests.
+var writeFileFunc = func(file *os.File, data []byte) (int, error) {
+	return file.Write(data)
+}
+
+// releaseQuota returns the quota reserved but not received in the batch.
+func (t *TrzszTransfer) releaseQuota() {
+	if t.quota == nil {
+		return
+	}
+	if err := t.quota.release(); err != nil {
+		t.logger.Warnf("release quota error: %v", err)
+	}
+}
+
+// isDiscardedFile returns true for the null device, which receives the data of the skipped files.
+func isDiscardedFile(file *os.File) bool {
+	return file.Name() == os.DevNull
+}
+
+// writeFileData removes the partial file if the device is full or the max total size would be exceeded,
+// except the received part is kept in resume mode. The discarded data of the skipped files is not counted.
+// In keep-going mode, the data after a write error is discarded, and the file is skipped after all its data.
+func (t *TrzszTransfer) writeFileData(file *os.File, data []byte) error {
+	if t.writeErr != nil {
+		return nil
+	}
+	if isDiscardedFile(file) {
+		_, err := file.Write(data)
+		return err
+	}
+	if t.maxTotal > 0 && t.receivedTotal+int64(len(data)) > t.maxTotal {
+		t.removePartialFile(file)
+		return newTrzszError(fmt.Sprintf("Exceeded the max total size %s: %s",
+			convertSizeToString(float64(t.maxTotal)), file.Name()))
+	}
+	if _, err := writeFileFunc(file, data); err != nil {
+		if !isNoSpaceError(err) {
+			if t.transferConfig.KeepGoing {
+				t.writeErr = err
+				return nil
+			}
+			return err
+		}
+		t.removePartialFile(file)
+		return newTrzszErrorCode(ErrNoSpace, fmt.Sprintf("No space left on device: %s", file.Name()))
+	}
+	t.receivedTotal += int64(len(data))
+	return nil
+}
+
+func (t *TrzszTransfer) removePartialFile(file *os.File) {
+	file.Close()
+	if !t.transferConfig.Resume && !isDiscardedFile(file) && !t.isOutputFile(file) && !t.useTar() && !t.isAuditFile(file) {
+		_ = os.Remove(file.Name())
+	}
+}
+
+func (t *TrzszTransfer) recvFileData(ctx context.Context, file *os.File, size int64, progress ProgressCallback) ([]byte, error) {
 	defer file.Close()
 	step := int64(0)
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onStep(step)
+		progress.OnStep(step)
 	}
-	hasher := md5.New()
+	hasher := t.newFileHasher()
 	for step < size {
+		t.waitIfPaused(ctx)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		beginTime := time.Now()
-		data, err := t.recvData()
+		var data []byte
+		var err error
+		if t.transferConfig.Retries > 0 {
+			data, err = t.recvChunk(step)
+		} else {
+			data, err = t.recvData()
+		}
 		if err != nil {
 			return nil, err
 		}
-		if _, err := file.Write(data); err != nil {
+		if err := t.writeFileData(file, data); err != nil {
 			return nil, err
 		}
 		length := int64(len(data))
 		step += length
 		if progress != nil && !reflect.ValueOf(progress).IsNil() {
-			progress.onStep(step)
+			progress.OnStep(step)
+		}
+		ack := length
+		if t.transferConfig.Retries > 0 {
+			ack = step
 		}
-		if err := t.sendInteger("SUCC", length); err != nil {
+		if err := t.sendInteger("SUCC", ack); err != nil {
 			return nil, err
 		}
 		if _, err := hasher.Write(data); err != nil {
 			return nil, err
 		}
-		chunkTime := time.Now().Sub(beginTime)
-		if chunkTime > t.maxChunkTime {
-			t.maxChunkTime = chunkTime
+		if t.passCheckpoint(step-length, step) {
+			if err := t.recvCheckpoint(hasher, step); err != nil {
+				return nil, err
+			}
 		}
+		chunkTime := time.Now().Sub(beginTime)
+		t.updateMaxChunkTime(chunkTime)
 	}
 	return hasher.Sum(nil), nil
 }
@@ -820,32 +2572,113 @@ func (t *TrzszTransfer) recvFileMD5(digest []byte, progress ProgressCallback) er
 	if err != nil {
 		return err
 	}
+	if len(digest) != len(expectDigest) {
+		return newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Check %s failed: digest length %d <> %d", t.getHashName(), len(digest), len(expectDigest)))
+	}
 	if bytes.Compare(digest, expectDigest) != 0 {
-		return newTrzszError("Check MD5 failed")
+		return newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Check %s failed", t.getHashName()))
 	}
 	if err := t.sendBinary("SUCC", digest); err != nil {
 		return err
 	}
 	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		progress.onDone()
+		progress.OnDone()
 	}
 	return nil
 }
 
 func (t *TrzszTransfer) recvFiles(path string, progress ProgressCallback) ([]string, error) {
+	return t.RecvFilesContext(context.Background(), path, progress)
+}
+
+// RecvFilesContext receives the files to the path, and stops promptly once the ctx is done. The peer is told that
+// the transfer is cancelled, and the returned error wraps the cause, which won't be sent to the peer again.
+// With the files verified on disk, the `ErrChecksum` error is returned if any is corrupted, along with the names.
+func (t *TrzszTransfer) RecvFilesContext(ctx context.Context, path string, progress ProgressCallback) ([]string, error) {
+	stop := t.stopOnDone(ctx)
+	localNames, err := t.doRecvFiles(ctx, path, withSpeedCallback(progress))
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return nil, t.cancelTransfer(ctx)
+	}
+	if err == nil && t.verifyDisk {
+		err = t.verifyDiskFiles(path)
+	}
+	return localNames, err
+}
+
+func (t *TrzszTransfer) doRecvFiles(ctx context.Context, path string, progress ProgressCallback) ([]string, error) {
+	defer t.removeAtomicFile()
+	defer t.releaseQuota()
+	if t.transferConfig.VerifyEscape {
+		if err := t.recvEscapeCanary(); err != nil {
+			return nil, err
+		}
+	}
 	num, err := t.recvFileNum(progress)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := t.checkOutputName(num); err != nil {
+		return nil, err
+	}
+	t.receivedTotal = 0
+	t.receivedPaths = make(map[int64]string)
+	t.incomingFiles = nil
+	t.incomingFile = nil
+	t.preRejected = false
+
+	if t.transferConfig.Preview {
+		if err := t.recvFileTotal(num); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.transferConfig.Audit {
+		t.auditReport = &AuditReport{}
+	}
+
+	t.transferResult = &TransferResult{}
+	t.batchCount = num
+	t.failedCount = 0
+	t.dirAttrs = nil
+	t.diskDigests = nil
+	if t.useTar() {
+		localNames, err := t.recvFilesTar(ctx, path, num, progress)
+		if err != nil {
+			return nil, err
+		}
+		t.finishTransferResult(localNames)
+		return localNames, nil
+	}
+	if t.useParallel() {
+		localNames, err := t.recvFilesParallel(ctx, path, num, progress)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.applyDirAttrs(); err != nil {
+			return nil, err
+		}
+		t.finishTransferResult(localNames)
+		return localNames, nil
+	}
 	var localNames []string
 	for i := int64(0); i < num; i++ {
-		file, localName, err := t.recvFileName(path, progress)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		beginTime := timeNowFunc()
+		file, localName, attrs, err := t.recvFileName(path, progress)
+		if skipErr, ok := err.(*fileSkipError); ok {
+			t.onFileError(skipErr, progress)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		if !containsString(localNames, localName) {
+		if localName != "" && !containsString(localNames, localName) {
 			localNames = append(localNames, localName)
 		}
 
@@ -855,22 +2688,157 @@ func (t *TrzszTransfer) recvFiles(path string, progress ProgressCallback) ([]str
 
 		defer file.Close()
 
+		if t.transferConfig.Dedup {
+			linked, err := t.recvFileSame(file)
+			if err != nil {
+				return nil, err
+			}
+			if linked {
+				localPath, err := t.finishSameFile(file, attrs, progress)
+				if err != nil {
+					return nil, err
+				}
+				t.receivedPaths[i] = localPath
+				t.addFileResult(localRelPath(path, localPath), 0, beginTime, timeNowFunc())
+				continue
+			}
+		}
+
+		if t.hasFileVerdict() {
+			if err := t.sendFileVerdict(t.skippedPath != ""); err != nil {
+				return nil, err
+			}
+			if t.skippedPath != "" {
+				t.receivedPaths[i] = t.skippedPath
+				t.addSkippedResult(localRelPath(path, t.skippedPath), beginTime, timeNowFunc())
+				if progress != nil && !reflect.ValueOf(progress).IsNil() {
+					progress.OnDone()
+				}
+				continue
+			}
+		}
+
 		size, err := t.recvFileSize(progress)
 		if err != nil {
+			if (t.quota != nil && t.quota.exceeded) || t.maxFileExceeded || t.preRejected {
+				t.removePartialFile(file)
+			}
 			return nil, err
 		}
 
+		if t.transferConfig.Checksum {
+			changed, err := t.sendFileChecksum(file, size)
+			if err != nil {
+				return nil, err
+			}
+			if !changed {
+				t.receivedPaths[i] = file.Name()
+				t.addSkippedResult(localRelPath(path, file.Name()), beginTime, timeNowFunc())
+				if progress != nil && !reflect.ValueOf(progress).IsNil() {
+					reportUnchanged(progress)
+					progress.OnDone()
+				}
+				continue
+			}
+		}
+
+		if t.transferConfig.Audit {
+			pulled, err := t.recvFileAudit(path, file, size)
+			if err != nil {
+				return nil, err
+			}
+			if pulled == nil {
+				t.addFileResult(localRelPath(path, t.auditPath), 0, beginTime, timeNowFunc())
+				if progress != nil && !reflect.ValueOf(progress).IsNil() {
+					progress.OnDone()
+				}
+				continue
+			}
+			file = pulled
+			defer file.Close()
+		}
+
+		dataBeginTime := timeNowFunc()
+		t.verifyFile = t.needVerify(i, size)
+		var offset int64
+		if t.transferConfig.Resume {
+			offset, err = t.sendFileOffset(file, size, progress)
+			if err != nil {
+				return nil, err
+			}
+		}
 		var digest []byte
-		if t.transferConfig.Protocol == 2 {
-			digest, err = t.recvFileDataV2(file, size, progress)
+		if size == kStreamSize {
+			size, digest, err = t.recvFileStream(ctx, file, progress)
+		} else if t.transferConfig.Patch {
+			digest, err = t.recvFilePatch(ctx, file, t.getPatchBasePath(path, file), size, progress)
+		} else if t.skipEmptyData(size - offset) {
+			file.Close()
+			digest = t.emptyDataDigest(progress)
+		} else if t.useDataV2() {
+			digest, err = t.recvFileDataV2(ctx, file, size-offset, progress)
 		} else {
-			digest, err = t.recvFileData(file, size, progress)
+			digest, err = t.recvFileData(ctx, file, size-offset, progress)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		t.fileCount++
+		if t.verifyFile {
+			if err := t.recvFileMD5(digest, t.progressBeforeResult(progress)); err != nil {
+				return nil, err
+			}
+			t.verifiedCount++
+		} else {
+			digest = nil
+			if p := t.progressBeforeResult(progress); p != nil && !reflect.ValueOf(p).IsNil() {
+				p.OnDone()
+			}
+		}
+		var localPath string
+		renamed := len(t.atomicTmpPath) > 0
+		skipName := file.Name()
+		if renamed {
+			skipName = t.atomicPath
+		}
+		if t.skippedPath == "" {
+			localPath, err = t.commitRecvFile(file, localName, attrs)
+		}
+		if t.transferConfig.KeepGoing {
+			err = t.sendFileResult(localRelPath(path, skipName), err, progress)
+		}
+		if skipErr, ok := err.(*fileSkipError); ok {
+			t.onFileError(skipErr, progress)
+			continue
 		}
 		if err != nil {
 			return nil, err
 		}
+		if t.skippedPath != "" {
+			t.receivedPaths[i] = t.skippedPath // the existing file is the target of the later hard links
+			t.addSkippedResult(localRelPath(path, t.skippedPath), beginTime, dataBeginTime)
+			continue
+		}
+		if renamed && !t.transferConfig.Directory && filepath.Base(localPath) != localName {
+			localNames[len(localNames)-1] = filepath.Base(localPath)
+		}
+		t.receivedPaths[i] = localPath
+		// the attributes are applied by commitRecvFile
+		if err := t.finishRecvFile(&finishedFile{localPath: localPath, resultName: localRelPath(path, localPath), size: size,
+			dataSize: size - offset, digest: digest, beginTime: beginTime, dataBeginTime: dataBeginTime},
+			progress); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.applyDirAttrs(); err != nil {
+		return nil, err
+	}
+	t.finishTransferResult(localNames)
 
-		if err := t.recvFileMD5(digest, progress); err != nil {
+	if t.transferConfig.Audit {
+		if err := t.auditExtraFiles(path, localNames); err != nil {
 			return nil, err
 		}
 	}
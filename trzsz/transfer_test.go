@@ -0,0 +1,2865 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type loopbackWriter struct {
+	peer *TrzszTransfer
+	hook func(buf []byte) []byte
+}
+
+func (w *loopbackWriter) Read(b []byte) (int, error) {
+	return 0, nil
+}
+
+func (w *loopbackWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	if w.hook != nil {
+		buf = w.hook(buf)
+	}
+	w.peer.addReceivedData(buf)
+	return len(p), nil
+}
+
+func (w *loopbackWriter) Close() error {
+	return nil
+}
+
+// newLoopbackTransfers creates a client and a server connected to each other.
+func newLoopbackTransfers() (*TrzszTransfer, *TrzszTransfer) {
+	client := NewTransfer(nil, nil, false)
+	server := NewTransfer(nil, nil, false)
+	client.writer = &loopbackWriter{peer: server}
+	server.writer = &loopbackWriter{peer: client}
+	return client, server
+}
+
+// pipeIO writes to an io.Pipe, and the peer reads the other end of it.
+type pipeIO struct {
+	*io.PipeWriter
+}
+
+func (p pipeIO) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// newPipeTransfers creates a client and a server connected by a pair of io.Pipe. Unlike the loopback,
+// the data is read by wrapTransferInput in arbitrary chunks, the same as from a real terminal.
+func newPipeTransfers(t *testing.T) (*TrzszTransfer, *TrzszTransfer) {
+	t.Helper()
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	client := NewTransfer(pipeIO{clientWriter}, nil, false)
+	server := NewTransfer(pipeIO{serverWriter}, nil, false)
+	go wrapTransferInput(client, clientReader)
+	go wrapTransferInput(server, serverReader)
+	t.Cleanup(func() {
+		clientWriter.Close()
+		serverWriter.Close()
+	})
+	return client, server
+}
+
+// handshakeForTest negotiates the action and config between the client and the server.
+func handshakeForTest(t *testing.T, client, server *TrzszTransfer, args *Args, protocol int) {
+	t.Helper()
+	require.Nil(t, client.sendAction(true, false))
+	action, err := server.recvAction()
+	require.Nil(t, err)
+	action.Protocol = protocol
+	require.Nil(t, server.sendConfig(&args.TransferOptions, action, appendEscapeBytes(getEscapeChars(args.Escape), args.EscapeBytes.Bytes), NoTmux, -1))
+	_, err = client.recvConfig()
+	require.Nil(t, err)
+}
+
+type transferResultForTest struct {
+	remoteNames []string
+	localNames  []string
+	sendErr     error
+	recvErr     error
+}
+
+// runTransferForTest sends the files from the sender to the receiver's destination directory.
+func runTransferForTest(sender, receiver *TrzszTransfer, files []*TrzszFile, dest string) *transferResultForTest {
+	return runTransferWithProgressForTest(sender, receiver, files, dest, nil, nil)
+}
+
+// runTransferWithProgressForTest is runTransferForTest reporting the progress of both sides.
+func runTransferWithProgressForTest(sender, receiver *TrzszTransfer, files []*TrzszFile, dest string,
+	sendProgress, recvProgress ProgressCallback) *transferResultForTest {
+	result := &transferResultForTest{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.remoteNames, result.sendErr = sender.sendFiles(files, sendProgress)
+		if result.sendErr != nil {
+			sender.clientError(result.sendErr)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		result.localNames, result.recvErr = receiver.recvFiles(dest, recvProgress)
+		if result.recvErr != nil {
+			receiver.clientError(result.recvErr)
+		}
+	}()
+	wg.Wait()
+	return result
+}
+
+// transferFilesForTest uploads the files from the client to the server's destination directory.
+func transferFilesForTest(t *testing.T, args *Args, protocol int, files []*TrzszFile, dest string) *transferResultForTest {
+	t.Helper()
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, protocol)
+	return runTransferForTest(client, server, files, dest)
+}
+
+func newDefaultArgsForTest() *Args {
+	return &Args{TransferOptions: TransferOptions{Bufsize: BufferSize{10 * 1024 * 1024}, Timeout: 5}}
+}
+
+func TestTransferFiles(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	writeTestFile(t, filepath.Join(src, "b.bin"), string([]byte{0, 1, 2, 0xee, 0x7e, 0x1b, 0x03}))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.bin")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		for _, binary := range []bool{false, true} {
+			dest := t.TempDir()
+			args := newDefaultArgsForTest()
+			args.Binary = binary
+			result := transferFilesForTest(t, args, protocol, files, dest)
+			assert.Nil(result.sendErr)
+			assert.Nil(result.recvErr)
+			assert.Equal([]string{"a.txt", "b.bin"}, result.localNames)
+			assert.Equal([]string{"a.txt", "b.bin"}, result.remoteNames)
+			for _, name := range []string{"a.txt", "b.bin"} {
+				expected, _ := os.ReadFile(filepath.Join(src, name))
+				actual, err := os.ReadFile(filepath.Join(dest, name))
+				assert.Nil(err)
+				assert.Equal(expected, actual, fmt.Sprintf("protocol %d binary %v", protocol, binary))
+			}
+		}
+	}
+}
+
+func TestPipeTransfers(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	data := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeTestFile(t, filepath.Join(src, "a.bin"), string(data))
+	writeTestFile(t, filepath.Join(src, "dir", "b.txt"), "hello trzsz")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "c.txt"), "")
+
+	for _, protocol := range []int{2, kProtocolVersion} {
+		for _, binary := range []bool{false, true} {
+			for _, directory := range []bool{false, true} {
+				paths := []string{filepath.Join(src, "a.bin")}
+				if directory {
+					paths = append(paths, filepath.Join(src, "dir"))
+				}
+				files, err := checkPathsReadable(paths, directory)
+				require.Nil(t, err)
+				dest := t.TempDir()
+				args := newDefaultArgsForTest()
+				args.Binary = binary
+				args.Directory = directory
+				args.Bufsize.Size = 64 * 1024
+				client, server := newPipeTransfers(t)
+				handshakeForTest(t, client, server, args, protocol)
+				result := runTransferForTest(client, server, files, dest)
+				msg := fmt.Sprintf("protocol %d binary %v directory %v", protocol, binary, directory)
+				require.Nil(t, result.sendErr, msg)
+				require.Nil(t, result.recvErr, msg)
+				assertFileContent(t, filepath.Join(dest, "a.bin"), string(data))
+				if directory {
+					assert.Equal([]string{"a.bin", "dir"}, result.localNames, msg)
+					assertFileContent(t, filepath.Join(dest, "dir", "b.txt"), "hello trzsz")
+					assertFileContent(t, filepath.Join(dest, "dir", "sub", "c.txt"), "")
+				} else {
+					assert.Equal([]string{"a.bin"}, result.localNames, msg)
+				}
+			}
+		}
+	}
+}
+
+func TestTransferStartAt(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	var paths []string
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(src, fmt.Sprintf("%d.txt", i))
+		writeTestFile(t, path, fmt.Sprintf("file %d", i))
+		paths = append(paths, path)
+	}
+	files, err := checkPathsReadable(paths, false)
+	require.Nil(t, err)
+
+	// resume from index 3
+	dest := t.TempDir()
+	args := newDefaultArgsForTest()
+	args.StartAt = 3
+	result := transferFilesForTest(t, args, 2, files, dest)
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal([]string{"3.txt", "4.txt"}, result.localNames)
+	entries, err := os.ReadDir(dest)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	for i := 3; i < 5; i++ {
+		content, err := os.ReadFile(filepath.Join(dest, fmt.Sprintf("%d.txt", i)))
+		assert.Nil(err)
+		assert.Equal(fmt.Sprintf("file %d", i), string(content))
+	}
+
+	// out of range
+	args.StartAt = 5
+	result = transferFilesForTest(t, args, 2, files, t.TempDir())
+	assert.EqualError(result.sendErr, "Start index 5 out of range, only 5 file(s)")
+	assert.NotNil(result.recvErr)
+}
+
+// captureStdout returns what is written to os.Stdout while running the function.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	outChan := make(chan string, 1)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		outChan <- string(buf)
+	}()
+	fn()
+	w.Close()
+	return <-outChan
+}
+
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDeclinedTransfer(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	// the client declines to upload
+	client, server := newLoopbackTransfers()
+	require.Nil(t, client.sendAction(false, false))
+	dest := t.TempDir()
+	output := captureStdout(t, func() {
+		assert.Nil(recvFiles(server, &TrzArgs{Args: *newDefaultArgsForTest(), Path: dest}, &receiveEnv{tmuxMode: NoTmux, tmuxPaneWidth: -1, errOutput: io.Discard}, nil))
+	})
+	assert.Contains(output, "Cancelled")
+	assertEmptyDir(t, dest)
+
+	// the client declines to download
+	client, server = newLoopbackTransfers()
+	require.Nil(t, client.sendAction(false, false))
+	output = captureStdout(t, func() {
+		assert.Nil(sendFiles(server, files, &TszArgs{Args: *newDefaultArgsForTest()}, NoTmux, -1, nil))
+	})
+	assert.Contains(output, "Cancelled")
+	assert.Empty(client.buffer.bufCh)
+}
+
+func TestClientCancelBeforeNum(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, newDefaultArgsForTest(), 2)
+	client.stopTransferringFiles()
+	remoteNames, err := client.sendFiles(files, nil)
+	assert.Nil(remoteNames)
+	assert.EqualError(err, "Cancelled")
+	e, ok := err.(*TrzszError)
+	require.True(t, ok)
+	assert.True(e.isRemoteFail()) // won't be sent to the server again
+	assert.Equal(ErrCancelled, e.Code())
+
+	dest := t.TempDir()
+	localNames, err := server.recvFiles(dest, nil)
+	assert.Nil(localNames)
+	assert.EqualError(err, "Cancelled")
+	assertEmptyDir(t, dest)
+}
+
+func TestStopTransfer(t *testing.T) {
+	assert := assert.New(t)
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, newDefaultArgsForTest(), 2)
+
+	dest := t.TempDir()
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.recvFiles(dest, nil)
+		done <- err
+	}()
+
+	// safe to be stopped from multiple goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Stop()
+		}()
+	}
+	wg.Wait()
+	assert.EqualError(<-done, "Stopped")
+
+	// the next protocol operation fails
+	_, err := server.recvString("NUM", false)
+	assert.EqualError(err, "Stopped")
+	assertEmptyDir(t, dest)
+}
+
+// pipeTransferWriter feeds the peer through a pipe, and calls the hook on each write.
+type pipeTransferWriter struct {
+	*io.PipeWriter
+	hook func()
+}
+
+func (w *pipeTransferWriter) Read(b []byte) (int, error) {
+	return 0, nil
+}
+
+func (w *pipeTransferWriter) Write(p []byte) (int, error) {
+	w.hook()
+	return w.PipeWriter.Write(p)
+}
+
+func TestStopWhileReceiving(t *testing.T) {
+	src := t.TempDir()
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	writeTestFile(t, filepath.Join(src, "a.bin"), string(data))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin")}, false)
+	require.Nil(t, err)
+
+	args := newDefaultArgsForTest()
+	args.Bufsize = BufferSize{1024}
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 2)
+
+	// the input goroutine, the stopping goroutines and the transfer loops run concurrently
+	reader, writer := io.Pipe()
+	var writes atomic.Int32
+	client.writer = &pipeTransferWriter{writer, func() {
+		if writes.Add(1) == 20 {
+			go server.Stop()
+			go server.Stop()
+		}
+	}}
+	go wrapTransferInput(server, reader)
+	result := runTransferForTest(client, server, files, t.TempDir())
+	writer.Close()
+	assert.EqualError(t, result.recvErr, "Stopped")
+	assert.NotNil(t, result.sendErr)
+}
+
+func TestPreviewConfirm(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "hello world")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	downloadWithAnswer := func(answer string, timeout int) (*transferResultForTest, string, string) {
+		t.Helper()
+		client, server := newLoopbackTransfers()
+		output := new(bytes.Buffer)
+		client.confirmOutput = output
+		client.confirmInput = make(chan []byte, 1)
+		args := newDefaultArgsForTest()
+		args.Preview = true
+		args.PreviewTimeout = timeout
+		handshakeForTest(t, client, server, args, 2)
+		if len(answer) > 0 {
+			go func() {
+				for !client.addConfirmInput([]byte(answer)) {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+		}
+		dest := t.TempDir()
+		return runTransferForTest(server, client, files, dest), dest, output.String()
+	}
+
+	// accept
+	result, dest, output := downloadWithAnswer("y", 0)
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal([]string{"a.txt", "b.txt"}, result.localNames)
+	assert.Contains(output, "Receive 2 file(s), 22.0 B, accept? [y/N] ")
+	content, err := os.ReadFile(filepath.Join(dest, "b.txt"))
+	assert.Nil(err)
+	assert.Equal("hello world", string(content))
+
+	// decline
+	result, dest, output = downloadWithAnswer("n", 0)
+	assert.EqualError(result.sendErr, "Cancelled")
+	assert.EqualError(result.recvErr, "Cancelled")
+	assert.Contains(output, "Receive 2 file(s), 22.0 B, accept? [y/N] ")
+	assertEmptyDir(t, dest)
+
+	// auto accept after timeout
+	beginTime := time.Now()
+	result, dest, _ = downloadWithAnswer("", 1)
+	assert.GreaterOrEqual(time.Since(beginTime), time.Second)
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal([]string{"a.txt", "b.txt"}, result.localNames)
+
+	// the client declines to upload
+	client, server := newLoopbackTransfers()
+	client.confirmOutput = new(bytes.Buffer)
+	client.confirmInput = make(chan []byte, 1)
+	args := newDefaultArgsForTest()
+	args.Preview = true
+	handshakeForTest(t, client, server, args, 2)
+	go func() {
+		for !client.addConfirmInput([]byte("\r")) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	dest = t.TempDir()
+	result = runTransferForTest(client, server, files, dest)
+	assert.EqualError(result.sendErr, "Cancelled")
+	assert.EqualError(result.recvErr, "Cancelled")
+	assertEmptyDir(t, dest)
+}
+
+func TestVerifySample(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	var paths []string
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(src, fmt.Sprintf("%d.txt", i))
+		writeTestFile(t, path, fmt.Sprintf("file content %d", i))
+		paths = append(paths, path)
+	}
+	writeTestFile(t, filepath.Join(src, "large.bin"), strings.Repeat("x", 2048))
+	paths = append(paths, filepath.Join(src, "large.bin"))
+	files, err := checkPathsReadable(paths, false)
+	require.Nil(t, err)
+
+	newSampleTransfers := func(corrupt string) (*TrzszTransfer, *TrzszTransfer, *int) {
+		client, server := newLoopbackTransfers()
+		args := newDefaultArgsForTest()
+		args.Binary = true
+		args.VerifySample = SampleRate{Skip: 70}
+		args.VerifyAbove = BufferSize{1024}
+		args.Stats = true
+		handshakeForTest(t, client, server, args, 1)
+		md5Count := 0
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if bytes.HasPrefix(buf, []byte("#MD5:")) {
+				md5Count++
+			}
+			if len(corrupt) > 0 && bytes.Equal(buf, []byte(corrupt)) {
+				buf[0] ^= 0xff
+			}
+			return buf
+		}
+		return client, server, &md5Count
+	}
+
+	// only the selected files exchange MD5
+	client, server, md5Count := newSampleTransfers("")
+	var selected []int
+	for i := range files {
+		size := int64(len(fmt.Sprintf("file content %d", i)))
+		if i == len(files)-1 {
+			size = 2048
+		}
+		assert.Equal(client.needVerify(int64(i), size), server.needVerify(int64(i), size))
+		if server.needVerify(int64(i), size) {
+			selected = append(selected, i)
+		}
+	}
+	assert.Contains(selected, len(files)-1)
+	assert.Less(len(selected), len(files))
+	result := runTransferForTest(client, server, files, t.TempDir())
+	assert.Nil(result.sendErr)
+	assert.Nil(result.recvErr)
+	assert.Equal(len(selected), *md5Count)
+	assert.Equal(fmt.Sprintf("Verified checksum of %d/%d file(s)", len(selected), len(files)), server.getStatsMessage())
+	assert.Equal(server.getStatsMessage(), client.getStatsMessage())
+
+	// the selected files are still checked
+	client, server, _ = newSampleTransfers(strings.Repeat("x", 1024))
+	result = runTransferForTest(client, server, files, t.TempDir())
+	assert.EqualError(result.recvErr, "Check MD5 failed")
+	assert.EqualError(result.sendErr, "Check MD5 failed")
+	var e *TrzszError
+	require.True(t, errors.As(result.recvErr, &e))
+	assert.Equal(ErrChecksum, e.Code())
+	// the code is sent to the peer with the fail message
+	require.True(t, errors.As(result.sendErr, &e))
+	assert.Equal(ErrChecksum, e.Code())
+
+	// the zero value args verify all the files, e.g., used as a library
+	client, server = newLoopbackTransfers()
+	handshakeForTest(t, client, server, &Args{}, 1)
+	assert.False(client.transferConfig.Sample)
+	for i := range files {
+		assert.True(client.needVerify(int64(i), 1))
+		assert.True(server.needVerify(int64(i), 1))
+	}
+
+	var rate SampleRate
+	assert.Nil(rate.UnmarshalText([]byte("30")))
+	assert.Equal(SampleRate{Skip: 70}, rate)
+	assert.Nil(rate.UnmarshalText([]byte("0%")))
+	assert.Equal(SampleRate{Skip: 100}, rate)
+	assert.EqualError(rate.UnmarshalText([]byte("101")), "invalid percent 101, should be 0 to 100")
+}
+
+func TestPatchRanges(t *testing.T) {
+	assert := assert.New(t)
+	base, src, dest := t.TempDir(), t.TempDir(), t.TempDir()
+	prior := bytes.Repeat([]byte("0123456789abcdef"), 5*kPatchBlockSize/16)
+	writeTestFile(t, filepath.Join(base, "data.bin"), string(prior))
+	writeTestFile(t, filepath.Join(dest, "data.bin"), string(prior))
+	writeTestFile(t, filepath.Join(base, "short.bin"), string(prior))
+	writeTestFile(t, filepath.Join(dest, "short.bin"), string(prior))
+
+	current := bytes.Clone(prior)
+	current[10] = 'x'
+	current[3*kPatchBlockSize+100] = 'y'
+	current[4*kPatchBlockSize] = 'z'
+	current = append(current, []byte("appended tail")...)
+	writeTestFile(t, filepath.Join(src, "data.bin"), string(current))
+	short := bytes.Clone(prior[:2*kPatchBlockSize+10])
+	writeTestFile(t, filepath.Join(src, "short.bin"), string(short))
+	writeTestFile(t, filepath.Join(src, "new.txt"), "a new file")
+
+	getChangedRanges := func(basePath, path string, size int64) ([]PatchRange, error) {
+		transfer := &TrzszTransfer{}
+		baseDigests := []string{}
+		if base, err := os.Open(basePath); err == nil {
+			defer base.Close()
+			baseDigests, err = transfer.getBlockDigests(base)
+			require.Nil(t, err)
+		}
+		file, err := os.Open(path)
+		require.Nil(t, err)
+		defer file.Close()
+		return transfer.getChangedRanges(baseDigests, file, size)
+	}
+	ranges, err := getChangedRanges(filepath.Join(base, "data.bin"), filepath.Join(src, "data.bin"), int64(len(current)))
+	assert.Nil(err)
+	assert.Equal([]PatchRange{{0, kPatchBlockSize}, {3 * kPatchBlockSize, 2*kPatchBlockSize + 13}}, ranges)
+	ranges, err = getChangedRanges(filepath.Join(base, "short.bin"), filepath.Join(src, "short.bin"), int64(len(short)))
+	assert.Nil(err)
+	assert.Equal([]PatchRange{{2 * kPatchBlockSize, 10}}, ranges)
+	ranges, err = getChangedRanges(filepath.Join(base, "new.txt"), filepath.Join(src, "new.txt"), 10)
+	assert.Nil(err)
+	assert.Equal([]PatchRange{{0, 10}}, ranges)
+
+	files, err := checkPathsReadable([]string{filepath.Join(src, "data.bin"), filepath.Join(src, "short.bin"), filepath.Join(src, "new.txt")}, false)
+	require.Nil(t, err)
+	args := newDefaultArgsForTest()
+	args.Patch = true
+	patchFiles := func(dest, patchBase string) {
+		t.Helper()
+		dataSize := 0
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, 2)
+		server.patchBase = patchBase
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if bytes.HasPrefix(buf, []byte("#DATA:")) {
+				data, err := decodeChunk(strings.TrimSpace(string(buf[6:])), "")
+				require.Nil(t, err)
+				dataSize += len(data)
+			}
+			return buf
+		}
+		result := runTransferForTest(client, server, files, dest)
+		assert.Nil(result.sendErr)
+		assert.Nil(result.recvErr)
+		assert.Equal([]string{"data.bin", "short.bin", "new.txt"}, result.localNames)
+		assert.Equal(3*kPatchBlockSize+13+10+10, dataSize)
+
+		content, err := os.ReadFile(filepath.Join(dest, "data.bin"))
+		assert.Nil(err)
+		assert.Equal(current, content)
+		content, err = os.ReadFile(filepath.Join(dest, "short.bin"))
+		assert.Nil(err)
+		assert.Equal(short, content)
+		content, err = os.ReadFile(filepath.Join(dest, "new.txt"))
+		assert.Nil(err)
+		assert.Equal("a new file", string(content))
+	}
+	// the existing files of the receiver are the prior versions
+	patchFiles(dest, "")
+	// the prior versions in the local patch base of the receiver
+	patchFiles(t.TempDir(), base)
+
+	// the patched data is limited by the max total size too
+	writeTestFile(t, filepath.Join(dest, "data.bin"), string(prior))
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 2)
+	server.maxTotal = kPatchBlockSize
+	result := runTransferForTest(client, server, files[:1], dest)
+	assert.EqualError(result.recvErr, "Exceeded the max total size 64.0 KB: "+filepath.Join(dest, "data.bin"))
+}
+
+func TestHandshakeRetry(t *testing.T) {
+	assert := assert.New(t)
+	originalTimeNow := timeNowFunc
+	defer func() { timeNowFunc = originalTimeNow }()
+	mockClock := func(millis ...int64) {
+		idx := 0
+		timeNowFunc = func() time.Time {
+			now := time.UnixMilli(millis[minInt(idx, len(millis)-1)])
+			idx++
+			return now
+		}
+	}
+
+	// the first attempt times out and the second succeeds
+	client, server := newLoopbackTransfers()
+	emitCount := 0
+	mockClock(0, 100, 100)
+	action, err := server.recvActionRetry(3, 100*time.Millisecond, func() {
+		emitCount++
+		require.Nil(t, client.sendAction(true, false))
+	})
+	assert.Nil(err)
+	assert.True(action.Confirm)
+	assert.Equal(1, emitCount)
+
+	// give up after retries with the timeout doubled each time, the deadlines are at 100, 300 and 700
+	client, server = newLoopbackTransfers()
+	emitCount = 0
+	mockClock(0, 100, 300, 700)
+	beginTime := time.Now()
+	action, err = server.recvActionRetry(2, 100*time.Millisecond, func() { emitCount++ })
+	assert.Nil(action)
+	assert.EqualError(err, "Receive data timeout")
+	assert.Equal(2, emitCount)
+	assert.Less(time.Since(beginTime), 100*time.Millisecond)
+
+	// the second attempt waits until its deadline at 300, as the timeout is doubled
+	_, server = newLoopbackTransfers()
+	mockClock(0, 100, 250)
+	beginTime = time.Now()
+	_, err = server.recvActionRetry(1, 100*time.Millisecond, func() {})
+	assert.EqualError(err, "Receive data timeout")
+	assert.GreaterOrEqual(time.Since(beginTime), 50*time.Millisecond)
+
+	// fatal errors are not retried
+	client, server = newLoopbackTransfers()
+	emitCount = 0
+	require.Nil(t, client.sendString("fail", "Not supported"))
+	action, err = server.recvActionRetry(2, 100*time.Millisecond, func() { emitCount++ })
+	assert.Nil(action)
+	assert.EqualError(err, "Not supported")
+	assert.Equal(0, emitCount)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// the handshake timeout is apart from the data timeout
+	client, _ := newLoopbackTransfers()
+	client.transferConfig.Timeout = 0
+	client.transferConfig.HandshakeTimeout = 1
+	beginTime := time.Now()
+	_, err := client.recvConfig()
+	assert.EqualError(err, "Receive data timeout")
+	assert.GreaterOrEqual(time.Since(beginTime), time.Second)
+
+	_, server := newLoopbackTransfers()
+	server.transferConfig.HandshakeTimeout = 1
+	_, err = server.recvAction()
+	assert.EqualError(err, "Receive data timeout")
+
+	// the same as the data timeout if not set
+	client, _ = newLoopbackTransfers()
+	client.transferConfig.Timeout = 1
+	beginTime = time.Now()
+	_, err = client.recvConfig()
+	assert.EqualError(err, "Receive data timeout")
+	assert.GreaterOrEqual(time.Since(beginTime), time.Second)
+
+	// N < 0 means never timeout
+	client, server = newLoopbackTransfers()
+	server.transferConfig.Timeout = 1
+	server.transferConfig.HandshakeTimeout = -1
+	actionChan := make(chan *TransferAction, 1)
+	go func() {
+		action, err := server.recvAction()
+		assert.Nil(err)
+		actionChan <- action
+	}()
+	select {
+	case <-actionChan:
+		assert.Fail("the action should not be received")
+	case <-time.After(1200 * time.Millisecond):
+	}
+	require.Nil(t, client.sendAction(true, false))
+	assert.True((<-actionChan).Confirm)
+
+	// the connect timeout is sent in the config, and the data timeout is kept
+	args := newDefaultArgsForTest()
+	args.ConnectTimeout = 60
+	require.Nil(t, server.sendConfig(&args.TransferOptions, server.action, getEscapeChars(args.Escape), NoTmux, -1))
+	config, err := client.recvConfig()
+	require.Nil(t, err)
+	assert.Equal(60, config.HandshakeTimeout)
+	assert.Equal(5, config.Timeout)
+	assert.Equal(60*time.Second, args.getRetryTimeout())
+	args.ConnectTimeout = -1
+	assert.Equal(5*time.Second, args.getRetryTimeout())
+	args.ConnectTimeout = 0
+	assert.Equal(-time.Second, args.getRetryTimeout()) // no retry as never timeout
+
+	// the connect timeout 0 means never timeout, and it's not sent if not set
+	args.ConnectTimeout = 0
+	require.Nil(t, server.sendConfig(&args.TransferOptions, server.action, getEscapeChars(args.Escape), NoTmux, -1))
+	config, err = client.recvConfig()
+	require.Nil(t, err)
+	assert.Equal(-1, config.HandshakeTimeout)
+	args.ConnectTimeout = -1
+	client.transferConfig = TransferConfig{}
+	require.Nil(t, server.sendConfig(&args.TransferOptions, server.action, getEscapeChars(args.Escape), NoTmux, -1))
+	config, err = client.recvConfig()
+	require.Nil(t, err)
+	assert.Equal(0, config.HandshakeTimeout)
+	assert.Equal(-1, NewTransferOptions().ConnectTimeout)
+	assert.Equal(-1, NewTrzArgs(".").ConnectTimeout)
+}
+
+func TestMinSpeedTimeout(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+	writeTestFile(t, filepath.Join(src, "a.bin"), string(content))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		for _, minSpeed := range []int64{8 * 1024, 0} {
+			args := newDefaultArgsForTest()
+			args.Timeout = 1
+			args.ChunkSizes = ChunkSizes{[]int64{64 * 1024}}
+			args.MinSpeed = BufferSize{minSpeed}
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, protocol)
+			// the slow writer takes about 1.8 seconds to move the chunk, longer than the timeout
+			client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+				time.Sleep(time.Duration(len(buf)) * time.Second / (48 * 1024))
+				return buf
+			}
+
+			dest := t.TempDir()
+			result := runTransferForTest(client, server, files, dest)
+			if minSpeed > 0 {
+				assert.Nil(result.sendErr)
+				assert.Nil(result.recvErr)
+				assertFileContent(t, filepath.Join(dest, "a.bin"), string(content))
+			} else {
+				assert.EqualError(result.recvErr, "Receive data timeout")
+			}
+		}
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	assert := assert.New(t)
+	const nfc = "caf\u00e9"
+	const nfd = "cafe\u0301"
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "nfd", nfd+".txt"), "nfd content")
+	writeTestFile(t, filepath.Join(src, "nfc", nfc+".txt"), "nfc content")
+	writeTestFile(t, filepath.Join(src, nfd, nfd+".txt"), "nfd in dir")
+
+	transfer := func(form string, directory bool, paths ...string) (*transferResultForTest, string) {
+		t.Helper()
+		files, err := checkPathsReadable(paths, directory)
+		require.Nil(t, err)
+		args := newDefaultArgsForTest()
+		args.Directory = directory
+		require.Nil(t, args.Normalize.UnmarshalText([]byte(form)))
+		dest := t.TempDir()
+		result := transferFilesForTest(t, args, 2, files, dest)
+		assert.Nil(result.sendErr)
+		assert.Nil(result.recvErr)
+		return result, dest
+	}
+
+	// NFD to NFC
+	result, dest := transfer("NFC", false, filepath.Join(src, "nfd", nfd+".txt"))
+	assert.Equal([]string{nfc + ".txt"}, result.localNames)
+	content, err := os.ReadFile(filepath.Join(dest, nfc+".txt"))
+	assert.Nil(err)
+	assert.Equal("nfd content", string(content))
+
+	// NFC to NFD
+	result, dest = transfer("nfd", false, filepath.Join(src, "nfc", nfc+".txt"))
+	assert.Equal([]string{nfd + ".txt"}, result.localNames)
+	content, err = os.ReadFile(filepath.Join(dest, nfd+".txt"))
+	assert.Nil(err)
+	assert.Equal("nfc content", string(content))
+
+	// directory names are normalized too
+	result, dest = transfer("nfc", true, filepath.Join(src, nfd))
+	assert.Equal([]string{nfc}, result.localNames)
+	content, err = os.ReadFile(filepath.Join(dest, nfc, nfc+".txt"))
+	assert.Nil(err)
+	assert.Equal("nfd in dir", string(content))
+
+	// collision after normalization
+	result, _ = transfer("nfc", false, filepath.Join(src, "nfc", nfc+".txt"), filepath.Join(src, "nfd", nfd+".txt"))
+	assert.Equal([]string{nfc + ".txt", nfc + ".txt.0"}, result.localNames)
+
+	var form UnicodeForm
+	assert.EqualError(form.UnmarshalText([]byte("nfkc")), "invalid form nfkc, should be nfc or nfd")
+}
+
+func TestTransferUnicodeNames(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "中文😀test.txt"), "中文😀content")
+	writeTestFile(t, filepath.Join(src, "目录😀", "한국어 ファイル.txt"), "in dir")
+
+	for _, protocol := range []int{2, kProtocolVersion} {
+		for _, tar := range []bool{false, true} {
+			files, err := checkPathsReadable([]string{filepath.Join(src, "中文😀test.txt"), filepath.Join(src, "目录😀")}, true)
+			require.Nil(t, err)
+			dest := t.TempDir()
+			args := newDefaultArgsForTest()
+			args.Directory = true
+			args.Tar = tar
+			result := transferFilesForTest(t, args, protocol, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+			if !tar {
+				assert.Equal([]string{"中文😀test.txt", "目录😀"}, result.localNames)
+			}
+			assertFileContent(t, filepath.Join(dest, "中文😀test.txt"), "中文😀content")
+			assertFileContent(t, filepath.Join(dest, "目录😀", "한국어 ファイル.txt"), "in dir")
+			entries, err := os.ReadDir(dest)
+			require.Nil(t, err)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			assert.ElementsMatch([]string{"中文😀test.txt", "目录😀"}, names)
+		}
+	}
+}
+
+func TestAuditReport(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "site", "same.txt"), "same content")
+	writeTestFile(t, filepath.Join(src, "site", "changed.txt"), "new content")
+	writeTestFile(t, filepath.Join(src, "site", "resized.txt"), "longer content")
+	writeTestFile(t, filepath.Join(src, "site", "sub", "new.txt"), "new file")
+	writeTestFile(t, filepath.Join(src, "site", "fresh", "new.txt"), "new dir")
+	writeTestFile(t, filepath.Join(dest, "site", "same.txt"), "same content")
+	writeTestFile(t, filepath.Join(dest, "site", "changed.txt"), "old content")
+	writeTestFile(t, filepath.Join(dest, "site", "resized.txt"), "short")
+	writeTestFile(t, filepath.Join(dest, "site", "sub", "stale.txt"), "stale file")
+	writeTestFile(t, filepath.Join(dest, "other.txt"), "not in the transfer")
+
+	files, err := checkPathsReadable([]string{filepath.Join(src, "site")}, true)
+	require.Nil(t, err)
+	expected := &AuditReport{
+		Matched:   []string{"site/same.txt"},
+		Differing: []string{"site/changed.txt", "site/resized.txt"},
+		Missing:   []string{"site/fresh/new.txt", "site/sub/new.txt"},
+		Extra:     []string{"site/sub/stale.txt"},
+	}
+
+	for _, pull := range []bool{false, true} {
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Audit = true
+		args.AuditPull = pull
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, 2)
+		result := runTransferForTest(client, server, files, dest)
+		assert.Nil(result.sendErr)
+		assert.Nil(result.recvErr)
+		assert.Equal([]string{"site"}, result.localNames)
+		report := server.GetAuditReport()
+		require.NotNil(t, report)
+		sort.Strings(report.Matched)
+		sort.Strings(report.Differing)
+		sort.Strings(report.Missing)
+		assert.Equal(expected, report)
+		assert.Equal("Audit: 1 matched, 2 differing, 2 missing, 1 extra", report.String())
+		assert.Nil(client.GetAuditReport())
+
+		content, err := os.ReadFile(filepath.Join(dest, "site", "changed.txt"))
+		assert.Nil(err)
+		_, statErr := os.Stat(filepath.Join(dest, "site", "sub", "new.txt"))
+		_, dirErr := os.Stat(filepath.Join(dest, "site", "fresh"))
+		if pull {
+			assert.Equal("new content", string(content))
+			assert.Nil(statErr)
+			assertFileContent(t, filepath.Join(dest, "site", "fresh", "new.txt"), "new dir")
+		} else {
+			// nothing is created or changed without pulling
+			assert.Equal("old content", string(content))
+			assert.True(errors.Is(statErr, os.ErrNotExist))
+			assert.True(errors.Is(dirErr, os.ErrNotExist))
+		}
+		content, err = os.ReadFile(filepath.Join(dest, "other.txt"))
+		assert.Nil(err)
+		assert.Equal("not in the transfer", string(content))
+	}
+}
+
+func TestTransferTiming(t *testing.T) {
+	assert := assert.New(t)
+	var ticks atomic.Int64
+	originalTimeNow := timeNowFunc
+	timeNowFunc = func() time.Time {
+		return time.UnixMilli(ticks.Add(1))
+	}
+	defer func() { timeNowFunc = originalTimeNow }()
+
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "b.txt"), strings.Repeat("b", 3000))
+	writeTestFile(t, filepath.Join(src, "c.txt"), "")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir"), filepath.Join(src, "c.txt")}, true)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Overwrite = true
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+
+		for _, transfer := range []*TrzszTransfer{client, server} {
+			transferResult := transfer.GetTransferResult()
+			require.NotNil(t, transferResult)
+			var names []string
+			for _, file := range transferResult.Files {
+				names = append(names, file.Name)
+				assert.Greater(file.NegotiationTime, time.Duration(0))
+				assert.GreaterOrEqual(file.DataTime, time.Duration(0))
+			}
+			assert.Equal([]string{"dir/sub/b.txt", "dir/a.txt", "c.txt"}, names)
+		}
+	}
+}
+
+func TestChunkSchedule(t *testing.T) {
+	assert := assert.New(t)
+	var sizes ChunkSizes
+	assert.Nil(sizes.UnmarshalText([]byte("1K, 4K")))
+	assert.Equal([]int64{1024, 4096}, sizes.Sizes)
+	assert.NotNil(sizes.UnmarshalText([]byte("1K,100")))
+	assert.NotNil(sizes.UnmarshalText([]byte("1K,,4K")))
+
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("a", 12*1024))
+	writeTestFile(t, filepath.Join(src, "b.txt"), strings.Repeat("b", 3*1024))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		args := newDefaultArgsForTest()
+		args.Overwrite = true
+		args.Binary = protocol == 2
+		args.ChunkSizes = sizes
+		var chunkSizes []int
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if !bytes.HasPrefix(buf, []byte("#DATA:")) {
+				return buf
+			}
+			if protocol == 1 {
+				data, err := decodeChunk(strings.TrimSpace(string(buf[6:])), "")
+				require.Nil(t, err)
+				chunkSizes = append(chunkSizes, len(data))
+			} else {
+				var length int
+				_, err := fmt.Sscanf(string(buf), "#DATA:%d\n", &length)
+				require.Nil(t, err)
+				if length > 0 { // skip the finish flag
+					chunkSizes = append(chunkSizes, length)
+				}
+			}
+			return buf
+		}
+		result := runTransferForTest(client, server, files, dest)
+		assert.Nil(result.sendErr)
+		assert.Nil(result.recvErr)
+		assert.Equal([]int{1024, 4096, 1024, 4096, 1024, 1024, 1024, 2048}, chunkSizes, "protocol %d", protocol)
+	}
+
+	// the sizes of the schedule are limited by the max buffer size, the same as the adaptive one
+	args := newDefaultArgsForTest()
+	args.Bufsize = BufferSize{2048}
+	args.ChunkSizes = sizes
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 2)
+	assert.Equal([]int64{1024, 2048}, client.transferConfig.ChunkSizes)
+	assert.Equal([]int64{1024, 2048}, server.transferConfig.ChunkSizes)
+}
+
+func TestConfigurableHash(t *testing.T) {
+	assert := assert.New(t)
+	for _, name := range kSupportedHashes {
+		hasher, err := hashNew(name)
+		assert.Nil(err)
+		assert.NotNil(hasher)
+	}
+	_, err := hashNew("crc32")
+	assert.EqualError(err, "unsupported hash crc32, should be one of md5, sha1, sha256, sha512")
+	var hashName HashName
+	assert.Nil(hashName.UnmarshalText([]byte("SHA256")))
+	assert.Equal("sha256", hashName.Name)
+	assert.NotNil(hashName.UnmarshalText([]byte("crc32")))
+
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("hash me ", 1000))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	transferWithHash := func(name string, protocol int, digestLen *int) (*TrzszTransfer, *TrzszTransfer) {
+		args := newDefaultArgsForTest()
+		args.Overwrite = true
+		args.Hash = HashName{name}
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if bytes.HasPrefix(buf, []byte("#MD5:")) {
+				digest, err := decodeString(strings.TrimSpace(string(buf[5:])))
+				require.Nil(t, err)
+				*digestLen = len(digest)
+			}
+			return buf
+		}
+		return client, server
+	}
+
+	for _, protocol := range []int{1, 2} {
+		for name, length := range map[string]int{"md5": 16, "sha1": 20, "sha256": 32, "sha512": 64} {
+			digestLen := 0
+			client, server := transferWithHash(name, protocol, &digestLen)
+			result := runTransferForTest(client, server, files, dest)
+			assert.Nil(result.sendErr)
+			assert.Nil(result.recvErr)
+			assert.Equal(length, digestLen, "%s protocol %d", name, protocol)
+		}
+	}
+
+	// falls back to md5 if the client doesn't support the hash
+	client, server := newLoopbackTransfers()
+	require.Nil(t, server.sendConfig(&TransferOptions{Hash: HashName{"sha256"}}, &TransferAction{Protocol: 2}, nil, NoTmux, -1))
+	config, err := client.recvConfig()
+	require.Nil(t, err)
+	assert.Equal("", config.Hash)
+
+	// the receiver reports the different digest length
+	digestLen := 0
+	client, server = transferWithHash("sha256", 2, &digestLen)
+	server.transferConfig.Hash = ""
+	result := runTransferForTest(client, server, files, dest)
+	assert.EqualError(result.recvErr, "Check MD5 failed: digest length 16 <> 32")
+	assert.EqualError(result.sendErr, "Check MD5 failed: digest length 16 <> 32")
+}
+
+func TestSendConfigOptions(t *testing.T) {
+	assert := assert.New(t)
+	opts := NewTransferOptions()
+	assert.Equal(int64(10*1024*1024), opts.Bufsize.Size)
+	assert.Equal(20, opts.Timeout)
+	assert.Equal(20, opts.WriteTimeout)
+
+	// the options are set directly, without parsing the command line args
+	opts.Binary = true
+	opts.Quiet = true
+	opts.Overwrite = true
+	opts.Bufsize = BufferSize{1024 * 1024}
+	opts.Timeout = 60
+	client, server := newLoopbackTransfers()
+	require.Nil(t, client.sendAction(true, false))
+	action, err := server.RecvAction()
+	require.Nil(t, err)
+	require.Nil(t, server.SendConfig(opts, action))
+	config, err := client.recvConfig()
+	require.Nil(t, err)
+	assert.True(config.Binary)
+	assert.True(config.Quiet)
+	assert.True(config.Overwrite)
+	assert.Equal(int64(1024*1024), config.MaxBufSize)
+	assert.Equal(60, config.Timeout)
+	assert.Equal(20, config.WriteTimeout)
+
+	// the zero values mean the same as on the command line, and the binary mode needs the client's support
+	client, server = newLoopbackTransfers()
+	require.Nil(t, client.sendAction(true, false))
+	action, err = server.RecvAction()
+	require.Nil(t, err)
+	action.SupportBinary = false
+	require.Nil(t, server.SendConfig(TransferOptions{Binary: true}, action))
+	config, err = client.recvConfig()
+	require.Nil(t, err)
+	assert.False(config.Binary)
+	assert.Equal(int64(kDefaultBufSize), config.MaxBufSize)
+	assert.Equal(0, config.Timeout)
+}
+
+func TestSendConfigVerbosity(t *testing.T) {
+	assert := assert.New(t)
+	var verbosity Verbosity
+	assert.EqualError(verbosity.UnmarshalText([]byte("3")), "invalid verbosity 3, should be 0, 1 or 2")
+	assert.EqualError(verbosity.UnmarshalText([]byte("x")), "invalid verbosity x, should be 0, 1 or 2")
+
+	// -q is the alias of the silent level, which is sent as quiet for the older clients
+	for _, c := range []struct {
+		quiet     bool
+		text      string
+		sentQuiet bool
+		verbosity int
+	}{
+		{false, "0", false, 0},
+		{false, "1", false, kVerbositySummary},
+		{false, "2", true, 0},
+		{true, "0", true, 0},
+		{true, "1", true, 0},
+	} {
+		opts := NewTransferOptions()
+		opts.Quiet = c.quiet
+		require.Nil(t, opts.Verbosity.UnmarshalText([]byte(c.text)))
+		client, server := newLoopbackTransfers()
+		require.Nil(t, client.sendAction(true, false))
+		action, err := server.recvAction()
+		require.Nil(t, err)
+		require.Nil(t, server.sendConfig(&opts, action, getEscapeChars(false), NoTmux, -1))
+		config, err := client.recvConfig()
+		require.Nil(t, err)
+		assert.Equal(c.sentQuiet, config.Quiet, c.text)
+		assert.Equal(c.verbosity, config.Verbosity, c.text)
+	}
+}
+
+// protocolTracer captures the wire protocol of a transfer by the direction.
+type protocolTracer struct {
+	mutex  sync.Mutex
+	traces map[string]*bytes.Buffer
+}
+
+func (p *protocolTracer) trace(direction string, data []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.traces[direction] == nil {
+		p.traces[direction] = new(bytes.Buffer)
+	}
+	p.traces[direction].Write(data)
+}
+
+func (p *protocolTracer) String(direction string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.traces[direction] == nil {
+		return ""
+	}
+	return p.traces[direction].String()
+}
+
+func TestNoCheck(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	writeTestFile(t, filepath.Join(src, "large.bin"), strings.Repeat("x", 4096))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "large.bin")}, false)
+	require.Nil(t, err)
+
+	for _, noCheck := range []bool{false, true} {
+		for _, protocol := range []int{2, kProtocolVersion} {
+			dest := t.TempDir()
+			clientTracer := &protocolTracer{traces: make(map[string]*bytes.Buffer)}
+			serverTracer := &protocolTracer{traces: make(map[string]*bytes.Buffer)}
+			client := NewTransfer(nil, nil, false, WithTraceFunc(clientTracer.trace))
+			server := NewTransfer(nil, nil, false, WithTraceFunc(serverTracer.trace))
+			client.writer = &loopbackWriter{peer: server}
+			server.writer = &loopbackWriter{peer: client}
+			args := newDefaultArgsForTest()
+			args.NoCheck = noCheck
+			// overrides the sampling, even for the large files
+			args.VerifySample = SampleRate{Skip: 50}
+			args.VerifyAbove = BufferSize{1024}
+			handshakeForTest(t, client, server, args, protocol)
+			result := runTransferForTest(client, server, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+			assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+			assertFileContent(t, filepath.Join(dest, "large.bin"), strings.Repeat("x", 4096))
+
+			// the sizes are still checked
+			assert.Contains(clientTracer.String(TraceSend), "#SIZE:4096")
+			assert.Equal(!noCheck, strings.Contains(clientTracer.String(TraceSend), "#MD5:"))
+			assert.Equal(!noCheck, strings.Contains(serverTracer.String(TraceRecv), "#MD5:"))
+		}
+	}
+}
+
+func TestTransferEmptyFile(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "empty.txt"), "")
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "empty.txt"), filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, skipEmpty := range []bool{false, true} {
+		for _, protocol := range []int{2, kProtocolVersion} {
+			dest := t.TempDir()
+			clientTracer := &protocolTracer{traces: make(map[string]*bytes.Buffer)}
+			client := NewTransfer(nil, nil, false, WithTraceFunc(clientTracer.trace))
+			server := NewTransfer(nil, nil, false)
+			client.writer = &loopbackWriter{peer: server}
+			server.writer = &loopbackWriter{peer: client}
+			handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+			assert.True(client.transferConfig.SkipEmptyData)
+			assert.True(server.transferConfig.SkipEmptyData)
+			// an older client doesn't know it, and sends the empty chunk as before
+			client.transferConfig.SkipEmptyData = skipEmpty
+			server.transferConfig.SkipEmptyData = skipEmpty
+			result := runTransferForTest(client, server, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+			assertFileContent(t, filepath.Join(dest, "empty.txt"), "")
+			assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+
+			// the size and the md5 of the empty file are still checked
+			sent := clientTracer.String(TraceSend)
+			require.Contains(t, sent, "#SIZE:0\n")
+			emptyFile := sent[strings.Index(sent, "#SIZE:0\n"):]
+			emptyFile = emptyFile[:strings.Index(emptyFile, "#NAME:")]
+			assert.Contains(emptyFile, "#MD5:")
+			assert.Equal(!skipEmpty, strings.Contains(emptyFile, "#DATA:"))
+			assert.Contains(sent, "#SIZE:11\n#DATA:")
+		}
+	}
+}
+
+func TestTraceFunc(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "trace the protocol")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	clientTracer := &protocolTracer{traces: make(map[string]*bytes.Buffer)}
+	serverTracer := &protocolTracer{traces: make(map[string]*bytes.Buffer)}
+	client := NewTransfer(nil, nil, false, WithTraceFunc(clientTracer.trace))
+	server := NewTransfer(nil, nil, false, WithTraceFunc(serverTracer.trace))
+	client.writer = &loopbackWriter{peer: server}
+	server.writer = &loopbackWriter{peer: client}
+	handshakeForTest(t, client, server, newDefaultArgsForTest(), kProtocolVersion)
+	result := runTransferForTest(client, server, files, t.TempDir())
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+
+	// what one side sends is exactly what the other side receives
+	assert.True(strings.HasPrefix(clientTracer.String(TraceSend), "#ACT:"))
+	assert.True(strings.HasPrefix(serverTracer.String(TraceSend), "#CFG:"))
+	assert.Contains(clientTracer.String(TraceSend), "#NAME:")
+	assert.Contains(serverTracer.String(TraceSend), "#SUCC:")
+	assert.Equal(clientTracer.String(TraceSend), serverTracer.String(TraceRecv))
+	assert.Equal(serverTracer.String(TraceSend), clientTracer.String(TraceRecv))
+}
+
+func TestBinaryCompress(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("hello trzsz, compress me in binary mode\n", 5000))
+	random := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	writeTestFile(t, filepath.Join(src, "b.bin"), string(random))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.bin")}, false)
+	require.Nil(t, err)
+
+	transferBinary := func(protocol, parallel int, compress string, binaryCompress bool) int64 {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Binary = true
+		args.BinaryCompress = binaryCompress
+		args.Compress = CompressName{compress}
+		args.Parallel = parallel
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		assert.Equal(binaryCompress, client.transferConfig.BinaryCompress)
+		var written atomic.Int64
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			written.Add(int64(len(buf)))
+			return buf
+		}
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		for _, name := range []string{"a.txt", "b.bin"} {
+			expected, err := os.ReadFile(filepath.Join(src, name))
+			require.Nil(t, err)
+			assertFileContent(t, filepath.Join(dest, name), string(expected))
+		}
+		return written.Load()
+	}
+
+	for _, c := range []struct {
+		protocol int
+		parallel int
+	}{{1, 0}, {2, 0}, {kProtocolVersion, 2}} {
+		for _, compress := range []string{"zlib", "zstd"} {
+			plain := transferBinary(c.protocol, c.parallel, compress, false)
+			compressed := transferBinary(c.protocol, c.parallel, compress, true)
+			// the text file is compressed, while the random file is stored as is
+			assert.Less(compressed, plain-150*1024, "protocol %d parallel %d %s", c.protocol, c.parallel, compress)
+			assert.Greater(compressed, int64(len(random)), "protocol %d parallel %d %s", c.protocol, c.parallel, compress)
+		}
+	}
+
+	// not negotiated if the client doesn't support it, or without compression
+	client, _ := newLoopbackTransfers()
+	args := &Args{TransferOptions: TransferOptions{Binary: true, BinaryCompress: true}}
+	require.Nil(t, client.sendConfig(&args.TransferOptions, &TransferAction{Protocol: 2}, nil, NoTmux, -1))
+	assert.False(client.transferConfig.BinaryCompress)
+	args.NoCompress = true
+	require.Nil(t, client.sendConfig(&args.TransferOptions, &TransferAction{Protocol: 2, SupportBlocks: true}, nil, NoTmux, -1))
+	assert.False(client.transferConfig.BinaryCompress)
+}
+
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Read(b []byte) (int, error) {
+	return 0, nil
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func (w *blockingWriter) Close() error {
+	return nil
+}
+
+func TestWriteTimeout(t *testing.T) {
+	assert := assert.New(t)
+	writer := &blockingWriter{make(chan struct{})}
+	defer close(writer.unblock)
+	transfer := NewTransfer(writer, nil, false)
+	transfer.transferConfig.WriteTimeout = 1
+
+	beginTime := time.Now()
+	err := transfer.sendString("NUM", "1")
+	assert.EqualError(err, "Write timeout after 1s, the terminal is unresponsive")
+	assert.GreaterOrEqual(time.Since(beginTime), time.Second)
+
+	// fails immediately without blocking again, so the error could be reported
+	beginTime = time.Now()
+	err = transfer.sendString("fail", "Write timeout")
+	assert.EqualError(err, "Write timeout, the terminal is unresponsive")
+	assert.Less(time.Since(beginTime), 100*time.Millisecond)
+
+	// the writes share one goroutine, instead of leaking one per write
+	writer = &blockingWriter{make(chan struct{})}
+	close(writer.unblock)
+	transfer = NewTransfer(writer, nil, false)
+	assert.Nil(transfer.sendString("NUM", "1"))
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		assert.Nil(transfer.sendString("NUM", "1"))
+	}
+	assert.LessOrEqual(runtime.NumGoroutine(), goroutines)
+
+	// the write deadline is used if supported
+	reader, pipe, err := os.Pipe()
+	require.Nil(t, err)
+	defer reader.Close()
+	defer pipe.Close()
+	transfer = NewTransfer(pipe, nil, false)
+	transfer.transferConfig.WriteTimeout = 1
+	err = transfer.writeAll(make([]byte, 1024*1024))
+	assert.EqualError(err, "Write timeout after 1s, the terminal is unresponsive")
+	var trzszErr *TrzszError
+	require.True(t, errors.As(err, &trzszErr))
+	assert.Equal(ErrTimeout, trzszErr.Code())
+
+	// never timeout if it's disabled
+	client, server := newLoopbackTransfers()
+	client.transferConfig.WriteTimeout = 0
+	assert.Nil(client.sendString("NUM", "1"))
+	buf, err := server.recvString("NUM", false)
+	assert.Nil(err)
+	assert.Equal("1", buf)
+}
+
+func TestPreserveModTime(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	fileTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	dirTime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.Local)
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "bbb")
+	for _, p := range []string{"dir/sub/a.txt", "b.txt"} {
+		require.Nil(t, os.Chtimes(filepath.Join(src, p), fileTime, fileTime))
+	}
+	for _, p := range []string{"dir/sub", "dir"} {
+		require.Nil(t, os.Chtimes(filepath.Join(src, p), dirTime, dirTime))
+	}
+
+	for _, preserve := range []bool{true, false} {
+		dest := t.TempDir()
+		files, err := checkPathsReadable([]string{filepath.Join(src, "dir"), filepath.Join(src, "b.txt")}, true)
+		require.Nil(t, err)
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Preserve = preserve
+		result := transferFilesForTest(t, args, 2, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+
+		for p, expected := range map[string]time.Time{
+			"dir/sub/a.txt": fileTime, "b.txt": fileTime, "dir/sub": dirTime, "dir": dirTime} {
+			stat, err := os.Stat(filepath.Join(dest, p))
+			require.Nil(t, err)
+			if preserve {
+				assert.True(expected.Equal(stat.ModTime()), "%s: %v", p, stat.ModTime())
+			} else {
+				assert.True(stat.ModTime().After(dirTime), "%s: %v", p, stat.ModTime())
+			}
+		}
+	}
+}
+
+func TestPreservePermissions(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		name         string
+		windows      bool // only the read-only attribute is preserved on Windows
+		files        []string
+		modes        map[string]os.FileMode
+		intermediate string      // not sent, created by the receiver for the files inside
+		dirMode      os.FileMode // the local --dir-mode of the receiver
+		preserved    map[string]os.FileMode
+		dropped      map[string]os.FileMode
+	}{
+		{
+			name:      "permissions",
+			files:     []string{"dir/private.sh", "dir/shared.txt"},
+			modes:     map[string]os.FileMode{"dir/private.sh": 0700, "dir/shared.txt": 0644, "dir": 0750},
+			preserved: map[string]os.FileMode{"dir/private.sh": 0700, "dir/shared.txt": 0644, "dir": 0750},
+			dropped:   map[string]os.FileMode{"dir/private.sh": 0600, "dir/shared.txt": 0600, "dir": 0700},
+		},
+		{
+			name:      "read-only",
+			windows:   true,
+			files:     []string{"readonly.txt", "writable.txt"},
+			modes:     map[string]os.FileMode{"readonly.txt": 0444, "writable.txt": 0644},
+			preserved: map[string]os.FileMode{"readonly.txt": 0444, "writable.txt": 0644},
+			dropped:   map[string]os.FileMode{"readonly.txt": 0600, "writable.txt": 0600},
+		},
+		{
+			name:         "dir mode",
+			files:        []string{"dir/sub/a.txt"},
+			modes:        map[string]os.FileMode{"dir": 0750},
+			intermediate: "dir/sub",
+			dirMode:      0700,
+			preserved:    map[string]os.FileMode{"dir": 0750, "dir/sub": 0700},
+			dropped:      map[string]os.FileMode{"dir": 0700, "dir/sub": 0700},
+		},
+	} {
+		if IsWindows() && !c.windows {
+			continue
+		}
+		src := t.TempDir()
+		var paths []string
+		for _, p := range c.files {
+			writeTestFile(t, filepath.Join(src, p), p)
+			top := filepath.Join(src, strings.Split(p, "/")[0])
+			if len(paths) == 0 || paths[len(paths)-1] != top {
+				paths = append(paths, top)
+			}
+		}
+		for p, mode := range c.modes {
+			require.Nil(t, os.Chmod(filepath.Join(src, p), mode))
+			defer os.Chmod(filepath.Join(src, p), 0755)
+		}
+		files, err := checkPathsReadable(paths, true)
+		require.Nil(t, err)
+		var entries []*TrzszFile
+		for _, f := range files {
+			if strings.Join(f.RelPath, "/") != c.intermediate {
+				entries = append(entries, f)
+			}
+		}
+
+		for _, preserve := range []bool{true, false} {
+			dest := t.TempDir()
+			args := newDefaultArgsForTest()
+			args.Directory = true
+			args.Preserve = preserve
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, 2)
+			// the mode is a local setting of the receiver, which is not sent in the config
+			server.dirMode = c.dirMode
+			result := runTransferForTest(client, server, entries, dest)
+			require.Nil(t, result.sendErr, c.name)
+			require.Nil(t, result.recvErr, c.name)
+			for _, p := range c.files {
+				assertFileContent(t, filepath.Join(dest, p), p)
+			}
+
+			expected := c.dropped
+			if preserve {
+				expected = c.preserved
+			}
+			for p, mode := range expected {
+				stat, err := os.Stat(filepath.Join(dest, p))
+				require.Nil(t, err)
+				defer os.Chmod(filepath.Join(dest, p), 0755)
+				// the group and other bits of the new entries depend on the umask
+				mask := os.FileMode(0700)
+				if preserve || stat.IsDir() && c.dirMode != 0 {
+					mask = 0777
+				}
+				if IsWindows() {
+					mask = 0200
+				}
+				assert.Equal(mode&mask, stat.Mode().Perm()&mask, "%s %s preserve %v", c.name, p, preserve)
+			}
+		}
+	}
+}
+
+func TestDirMode(t *testing.T) {
+	assert := assert.New(t)
+	var mode DirMode
+	assert.Nil(mode.UnmarshalText([]byte("0700")))
+	assert.Equal(os.FileMode(0700), mode.Mode)
+	assert.EqualError(mode.UnmarshalText([]byte("0644")), "invalid mode 0644, should be writable and searchable by the owner")
+	assert.EqualError(mode.UnmarshalText([]byte("01777")), "invalid mode 01777, should be writable and searchable by the owner")
+	assert.EqualError(mode.UnmarshalText([]byte("rwx")), "invalid mode rwx, should be octal, e.g., 0700")
+}
+
+func TestTransferContextCancel(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("cancel trzsz\n", 100000))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		client, server := newLoopbackTransfers()
+		args := newDefaultArgsForTest()
+		args.Bufsize = BufferSize{1024}
+		handshakeForTest(t, client, server, args, protocol)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var chunks atomic.Int32
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if bytes.HasPrefix(buf, []byte("#DATA:")) && chunks.Add(1) == 1 {
+				cancel()
+			}
+			return buf
+		}
+
+		var sendErr error
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, sendErr = client.sendFiles(files, nil)
+		}()
+
+		beginTime := time.Now()
+		localNames, err := server.RecvFilesContext(ctx, t.TempDir(), nil)
+		wg.Wait()
+		assert.Less(time.Since(beginTime), 3*time.Second)
+		assert.Nil(localNames)
+		assert.True(errors.Is(err, context.Canceled))
+		e, ok := err.(*TrzszError)
+		require.True(t, ok)
+		assert.True(e.isRemoteFail()) // won't be sent to the client again
+		assert.Equal(ErrCancelled, e.Code())
+		assert.EqualError(sendErr, "Cancelled")
+		require.True(t, errors.As(sendErr, &e))
+		assert.Equal(ErrCancelled, e.Code())
+	}
+}
+
+func TestTransferReuseAfterContextDone(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			dest := t.TempDir()
+			var recvErr error
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, recvErr = server.RecvFilesContext(ctx, dest, nil)
+			}()
+			_, sendErr := client.SendFilesContext(ctx, files, nil)
+			wg.Wait()
+			assert.Nil(sendErr)
+			assert.Nil(recvErr)
+			assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+			// the ctx is done after the transfer, as if the stop races with the finish
+			cancel()
+			client.buffer.stopBuffer()
+			server.buffer.stopBuffer()
+		}
+	}
+}
+
+func TestOnConflictSkip(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "new a")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "new b")
+	writeTestFile(t, filepath.Join(src, "dir", "c.txt"), "new c")
+	writeTestFile(t, filepath.Join(src, "dir", "d.txt"), "new d")
+	paths := []string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"), filepath.Join(src, "dir")}
+
+	for _, c := range []struct {
+		protocol  int
+		directory bool
+		verdict   bool
+	}{
+		{1, false, true},
+		{1, true, true},
+		{2, false, true},
+		{2, true, true},
+		// the client not knowing the verdict receives the data of the skipped files, and discards it
+		{2, false, false},
+		{2, true, false},
+	} {
+		files, err := checkPathsReadable(paths[:len(paths)-1], false)
+		if c.directory {
+			files, err = checkPathsReadable(paths, true)
+		}
+		require.Nil(t, err)
+
+		dest := t.TempDir()
+		writeTestFile(t, filepath.Join(dest, "a.txt"), "old a")
+		writeTestFile(t, filepath.Join(dest, "dir", "c.txt"), "old c")
+
+		args := newDefaultArgsForTest()
+		args.Directory = c.directory
+		args.OnConflict = ConflictMode{"skip"}
+		client, server := newLoopbackTransfers()
+		require.Nil(t, client.sendAction(true, false))
+		action, err := server.recvAction()
+		require.Nil(t, err)
+		action.Protocol = c.protocol
+		action.SupportVerdict = c.verdict
+		require.Nil(t, server.sendConfig(&args.TransferOptions, action, getEscapeChars(false), NoTmux, -1))
+		_, err = client.recvConfig()
+		require.Nil(t, err)
+		var sizeCount atomic.Int32
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if bytes.HasPrefix(buf, []byte("#SIZE:")) {
+				sizeCount.Add(1)
+			}
+			return buf
+		}
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+
+		assertFileContent(t, filepath.Join(dest, "a.txt"), "old a")
+		assertFileContent(t, filepath.Join(dest, "b.txt"), "new b")
+		if c.directory {
+			assert.Equal([]string{"a.txt", "b.txt", "dir"}, result.localNames)
+			assertFileContent(t, filepath.Join(dest, "dir", "c.txt"), "old c")
+			assertFileContent(t, filepath.Join(dest, "dir", "d.txt"), "new d")
+		} else {
+			assert.Equal([]string{"a.txt", "b.txt"}, result.localNames)
+		}
+
+		// the skipped files are negotiated before the size, so none of the data is sent
+		expectedCount := 2
+		if c.directory {
+			expectedCount = 4
+		}
+		if c.verdict {
+			expectedCount /= 2
+		}
+		assert.Equal(int32(expectedCount), sizeCount.Load(), c)
+	}
+}
+
+func TestUpdateNewerOnly(t *testing.T) {
+	assert := assert.New(t)
+	srcTime := time.Date(2022, 1, 2, 3, 4, 5, 500000000, time.Local)
+	newerTime := srcTime.Add(time.Hour)
+	olderTime := srcTime.Add(-time.Hour)
+	sameSecondTime := srcTime.Truncate(time.Second)
+	src := t.TempDir()
+	for _, p := range []string{"a.txt", "b.txt", "c.txt", "g.txt", "dir/d.txt", "dir/e.txt", "dir/f.txt"} {
+		writeTestFile(t, filepath.Join(src, p), "new "+p)
+		require.Nil(t, os.Chtimes(filepath.Join(src, p), srcTime, srcTime))
+	}
+
+	for _, c := range []struct {
+		protocol  int
+		directory bool
+		verdict   bool
+	}{
+		{1, false, true}, {1, true, true}, {2, false, true}, {2, true, true}, {2, false, false}, {2, true, false},
+	} {
+		paths := []string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"), filepath.Join(src, "c.txt"),
+			filepath.Join(src, "g.txt")}
+		if c.directory {
+			paths = append(paths, filepath.Join(src, "dir"))
+		}
+		files, err := checkPathsReadable(paths, c.directory)
+		require.Nil(t, err)
+
+		dest := t.TempDir()
+		for p, mtime := range map[string]time.Time{"a.txt": newerTime, "b.txt": olderTime, "g.txt": sameSecondTime,
+			"dir/d.txt": srcTime, "dir/e.txt": olderTime} {
+			writeTestFile(t, filepath.Join(dest, p), "old "+p)
+			require.Nil(t, os.Chtimes(filepath.Join(dest, p), mtime, mtime))
+		}
+
+		args := newDefaultArgsForTest()
+		args.Directory = c.directory
+		args.Update = true
+		client, server := newLoopbackTransfers()
+		require.Nil(t, client.sendAction(true, false))
+		action, err := server.recvAction()
+		require.Nil(t, err)
+		action.Protocol = c.protocol
+		action.SupportVerdict = c.verdict
+		require.Nil(t, server.sendConfig(&args.TransferOptions, action, getEscapeChars(false), NoTmux, -1))
+		_, err = client.recvConfig()
+		require.Nil(t, err)
+		var mtimeCount atomic.Int32
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if bytes.HasPrefix(buf, []byte("#MTIME:")) {
+				mtimeCount.Add(1)
+			}
+			return buf
+		}
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+
+		// the newer or equal local files are kept, the older or missing ones are received
+		assertFileContent(t, filepath.Join(dest, "a.txt"), "old a.txt")
+		assertFileContent(t, filepath.Join(dest, "b.txt"), "new b.txt")
+		assertFileContent(t, filepath.Join(dest, "c.txt"), "new c.txt")
+		expectedSizes := map[string]int64{"a.txt": 0, "b.txt": 9, "c.txt": 9, "g.txt": 9}
+		// the older local file within the same second is only known by the nanoseconds
+		if c.verdict || c.directory {
+			assertFileContent(t, filepath.Join(dest, "g.txt"), "new g.txt")
+		} else {
+			assertFileContent(t, filepath.Join(dest, "g.txt"), "old g.txt")
+			expectedSizes["g.txt"] = 0
+		}
+		if c.directory {
+			assertFileContent(t, filepath.Join(dest, "dir", "d.txt"), "old dir/d.txt")
+			assertFileContent(t, filepath.Join(dest, "dir", "e.txt"), "new dir/e.txt")
+			assertFileContent(t, filepath.Join(dest, "dir", "f.txt"), "new dir/f.txt")
+			expectedSizes["dir/d.txt"] = 0
+			expectedSizes["dir/e.txt"] = 13
+			expectedSizes["dir/f.txt"] = 13
+		}
+
+		// the skipped files are not streamed by the sender
+		sentSizes := make(map[string]int64)
+		for _, f := range client.GetTransferResult().Files {
+			sentSizes[f.Name] = f.Size
+		}
+		assert.Equal(expectedSizes, sentSizes, c)
+
+		// the skipped files are counted apart from the received ones
+		skippedCount := 0
+		for _, size := range expectedSizes {
+			if size == 0 {
+				skippedCount++
+			}
+		}
+		for _, transfer := range []*TrzszTransfer{client, server} {
+			assert.Equal(skippedCount, transfer.GetTransferResult().SkippedCount, c)
+			assert.Equal(len(expectedSizes)-skippedCount, transfer.GetTransferResult().FileCount, c)
+		}
+
+		// the modification time is carried in the name, unless the peer doesn't support the verdict
+		expectedCount := 0
+		if !c.verdict && !c.directory {
+			expectedCount = 4
+		}
+		assert.Equal(int32(expectedCount), mtimeCount.Load(), c)
+	}
+}
+
+func TestTransferSymlinks(t *testing.T) {
+	if IsWindows() {
+		t.Skip("creating symlinks requires privileges on Windows")
+	}
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "b.txt"), "bbb")
+	require.Nil(t, os.Symlink("a.txt", filepath.Join(src, "dir", "rel")))
+	require.Nil(t, os.Symlink("../a.txt", filepath.Join(src, "dir", "sub", "up")))
+	require.Nil(t, os.Symlink("sub", filepath.Join(src, "dir", "subdir")))
+
+	// transfer the symlinks as links
+	files, err := checkPathsReadableWith([]string{filepath.Join(src, "dir")}, pathOptions{directory: true})
+	require.Nil(t, err)
+	args := newDefaultArgsForTest()
+	args.Directory = true
+	dest := t.TempDir()
+	result := transferFilesForTest(t, args, 2, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	for link, target := range map[string]string{"dir/rel": "a.txt", "dir/sub/up": "../a.txt", "dir/subdir": "sub"} {
+		actual, err := os.Readlink(filepath.Join(dest, link))
+		require.Nil(t, err)
+		assert.Equal(target, actual)
+	}
+	assertFileContent(t, filepath.Join(dest, "dir", "subdir", "b.txt"), "bbb")
+
+	// follow the symlinks to transfer the targets, a directory linked twice is a duplicate
+	require.Nil(t, os.Remove(filepath.Join(src, "dir", "subdir")))
+	files, err = checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+	args.FollowSymlinks = true
+	dest = t.TempDir()
+	result = transferFilesForTest(t, args, 2, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	for _, p := range []string{"dir/rel", "dir/sub/up"} {
+		stat, err := os.Lstat(filepath.Join(dest, p))
+		require.Nil(t, err)
+		assert.True(stat.Mode().IsRegular(), p)
+	}
+	assertFileContent(t, filepath.Join(dest, "dir", "sub", "up"), "aaa")
+
+	// reject the absolute or escaping links unless explicitly allowed
+	for _, target := range []string{filepath.Join(src, "dir", "a.txt"), "../outside", "sub/../../outside"} {
+		require.Nil(t, os.Remove(filepath.Join(src, "dir", "rel")))
+		require.Nil(t, os.Symlink(target, filepath.Join(src, "dir", "rel")))
+		files, err = checkPathsReadableWith([]string{filepath.Join(src, "dir")}, pathOptions{directory: true})
+		require.Nil(t, err)
+		for _, unsafe := range []bool{false, true} {
+			args := newDefaultArgsForTest()
+			args.Directory = true
+			dest := t.TempDir()
+			client, server := newLoopbackTransfers()
+			server.unsafeLinks = unsafe
+			handshakeForTest(t, client, server, args, 2)
+			result := runTransferForTest(client, server, files, dest)
+			if unsafe {
+				require.Nil(t, result.recvErr)
+				actual, err := os.Readlink(filepath.Join(dest, "dir", "rel"))
+				require.Nil(t, err)
+				assert.Equal(target, actual)
+			} else {
+				assert.EqualError(result.recvErr, fmt.Sprintf("Unsafe link: dir/rel -> %s", target))
+			}
+		}
+	}
+}
+
+func TestChainedLinksEscape(t *testing.T) {
+	assert := assert.New(t)
+	// each link is safe by itself, while `dir/s/x` is actually `dir/x -> ..` through `dir/s -> .`,
+	// and then `dir/s/x/z` is actually `z -> ..` in the destination, so `y` is created outside of it.
+	files := []*TrzszFile{
+		{RelPath: []string{"dir"}, IsDir: true, Mode: 0755},
+		{RelPath: []string{"dir", "s"}, IsLink: true, LinkTarget: "."},
+		{RelPath: []string{"dir", "s", "x"}, IsLink: true, LinkTarget: ".."},
+		{RelPath: []string{"dir", "s", "x", "z"}, IsLink: true, LinkTarget: ".."},
+		{RelPath: []string{"dir", "s", "x", "z", "y"}, IsDir: true, Mode: 0755},
+	}
+	for _, unsafe := range []bool{false, true} {
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		dest := filepath.Join(t.TempDir(), "dest")
+		require.Nil(t, os.Mkdir(dest, 0755))
+		client, server := newLoopbackTransfers()
+		server.unsafeLinks = unsafe
+		handshakeForTest(t, client, server, args, 2)
+		result := runTransferForTest(client, server, files, dest)
+		if unsafe {
+			require.Nil(t, result.recvErr)
+			assert.DirExists(filepath.Join(dest, "..", "y"))
+		} else {
+			assert.EqualError(result.recvErr, fmt.Sprintf("Unsafe path through the symlink: %s",
+				filepath.Join(dest, "dir", "s")))
+			_, err := os.Lstat(filepath.Join(dest, "dir", "x"))
+			assert.True(errors.Is(err, os.ErrNotExist))
+			_, err = os.Lstat(filepath.Join(dest, "..", "y"))
+			assert.True(errors.Is(err, os.ErrNotExist))
+		}
+	}
+
+	// the names of the entries should be plain
+	for _, name := range []string{".", ""} {
+		files := []*TrzszFile{
+			{RelPath: []string{"dir"}, IsDir: true, Mode: 0755},
+			{RelPath: []string{"dir", name, "a"}, IsDir: true, Mode: 0755},
+		}
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		result := transferFilesForTest(t, args, 2, files, t.TempDir())
+		assert.EqualError(result.recvErr, fmt.Sprintf("Invalid name: dir/%s/a", name))
+	}
+}
+
+func TestReceiveUnsafePath(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	absPath := filepath.Join(src, "abs.txt")
+
+	relPaths := [][]string{
+		{"..", "..", "etc", "passwd"},
+		{"../../etc/passwd"},
+		{"dir", "../../etc/passwd"},
+		{"dir", "..", "a.txt"},
+		{absPath},
+	}
+	if IsWindows() {
+		relPaths = append(relPaths, []string{`..\..\etc\passwd`}, []string{"dir", `..\a.txt`}, []string{"C:a.txt"})
+	}
+	for _, relPath := range relPaths {
+		for _, directory := range []bool{false, true} {
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "a", "b")
+			require.Nil(t, os.MkdirAll(dest, 0755))
+			if !directory && len(relPath) > 1 {
+				// only the first name is sent without -d
+				continue
+			}
+			files := []*TrzszFile{{AbsPath: filepath.Join(src, "a.txt"), RelPath: relPath}}
+			args := newDefaultArgsForTest()
+			args.Directory = directory
+			result := transferFilesForTest(t, args, 2, files, dest)
+			assert.EqualError(result.recvErr, "Unsafe path: "+strings.Join(relPath, "/"))
+			assert.NotNil(result.sendErr)
+			_, err := os.Stat(absPath)
+			assert.True(errors.Is(err, os.ErrNotExist))
+			entries, err := os.ReadDir(parent)
+			require.Nil(t, err)
+			require.Equal(t, 1, len(entries))
+			assert.Equal("a", entries[0].Name())
+		}
+	}
+
+	// the backslash is a plain character on other systems
+	if !IsWindows() {
+		dest := t.TempDir()
+		files := []*TrzszFile{{AbsPath: filepath.Join(src, "a.txt"), RelPath: []string{`..\a.txt`}}}
+		result := transferFilesForTest(t, newDefaultArgsForTest(), 2, files, dest)
+		require.Nil(t, result.recvErr)
+		assertFileContent(t, filepath.Join(dest, `..\a.txt`), "hello trzsz")
+	}
+}
+
+func TestReceivePathLimits(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	args := newDefaultArgsForTest()
+	args.Directory = true
+
+	// a pathologically deep path is refused before creating any directory
+	deepPath := make([]string, 10000)
+	for i := range deepPath {
+		deepPath[i] = "d"
+	}
+	dest := t.TempDir()
+	files := []*TrzszFile{{AbsPath: filepath.Join(src, "a.txt"), RelPath: deepPath}}
+	result := transferFilesForTest(t, args, 2, files, dest)
+	require.NotNil(t, result.recvErr)
+	assert.True(strings.HasPrefix(result.recvErr.Error(), "Path depth 10000 exceeds the max depth 64: d/d/"))
+	assert.NotNil(result.sendErr)
+	assertEmptyDir(t, dest)
+
+	// the name is limited in bytes
+	longName := strings.Repeat("\u6587", 86)
+	dest = t.TempDir()
+	files = []*TrzszFile{{AbsPath: filepath.Join(src, "a.txt"), RelPath: []string{"dir", longName, "a.txt"}}}
+	result = transferFilesForTest(t, args, 2, files, dest)
+	assert.EqualError(result.recvErr, fmt.Sprintf("Name length 258 exceeds the max length 255: dir/%s/a.txt", longName))
+	assertEmptyDir(t, dest)
+
+	files = []*TrzszFile{{AbsPath: filepath.Join(src, "a.txt"), RelPath: []string{strings.Repeat("a", 256)}}}
+	result = transferFilesForTest(t, newDefaultArgsForTest(), 2, files, dest)
+	assert.EqualError(result.recvErr, "Name length 256 exceeds the max length 255: "+strings.Repeat("a", 256))
+	assertEmptyDir(t, dest)
+
+	// the limits could be changed by the receiver
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 2)
+	server.maxDepth = 3
+	files = []*TrzszFile{{AbsPath: filepath.Join(src, "a.txt"), RelPath: []string{"a", "b", "c"}}}
+	result = runTransferForTest(client, server, files, dest)
+	require.Nil(t, result.recvErr)
+	assertFileContent(t, filepath.Join(dest, "a", "b", "c"), "hello trzsz")
+	files = []*TrzszFile{{AbsPath: filepath.Join(src, "a.txt"), RelPath: []string{"a", "b", "c", "d"}}}
+	client, server = newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 2)
+	server.maxDepth = 3
+	result = runTransferForTest(client, server, files, dest)
+	assert.EqualError(result.recvErr, "Path depth 4 exceeds the max depth 3: a/b/c/...")
+}
+
+func TestTransferFlatten(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "a.txt"), "sub aaa")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "b.txt"), "sub bbb")
+	require.Nil(t, os.MkdirAll(filepath.Join(src, "dir", "empty"), 0755))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	for _, mode := range []string{"sequential", "parallel", "tar"} {
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Parallel = map[string]int{"parallel": 2}[mode]
+		args.Tar = mode == "tar"
+		dest := t.TempDir()
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, kProtocolVersion)
+		server.flatten = true
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr, mode)
+		require.Nil(t, result.recvErr, mode)
+		assert.Equal([]string{"b.txt", "a.txt", "a.txt.0"}, result.localNames, mode)
+		assertFileContent(t, filepath.Join(dest, "a.txt"), "sub aaa")
+		assertFileContent(t, filepath.Join(dest, "a.txt.0"), "aaa")
+		assertFileContent(t, filepath.Join(dest, "b.txt"), "sub bbb")
+		entries, err := os.ReadDir(dest)
+		require.Nil(t, err)
+		assert.Len(entries, 3, mode)
+	}
+}
+
+func TestTransferEscapeBytes(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat(string([]byte{0, 0x11, 0x13, 0xee, 0x7e, 'a'}), 1000)
+	writeTestFile(t, filepath.Join(src, "a.bin"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin")}, false)
+	require.Nil(t, err)
+
+	// the middlebox mangles XON on the way to the server
+	corruptXON := func(buf []byte) []byte {
+		return bytes.ReplaceAll(buf, []byte{0x11}, []byte{0x00})
+	}
+	for _, c := range []struct {
+		verify      bool
+		escapeBytes string
+		corrupt     bool
+		ok          bool
+	}{
+		{false, "", false, true},
+		{false, "", true, false},
+		{false, "11,0x13", true, true},
+		{true, "", false, true},
+		{true, "", true, false},
+		{true, "11", true, true},
+	} {
+		for _, protocol := range []int{1, 2, kProtocolVersion} {
+			msg := fmt.Sprintf("protocol %d verify %v escape %q corrupt %v", protocol, c.verify, c.escapeBytes, c.corrupt)
+			args := newDefaultArgsForTest()
+			args.Binary = true
+			args.VerifyEscape = c.verify
+			if c.escapeBytes != "" {
+				require.Nil(t, args.EscapeBytes.UnmarshalText([]byte(c.escapeBytes)))
+			}
+			dest := t.TempDir()
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, protocol)
+			assert.Equal(c.verify, server.transferConfig.VerifyEscape, msg)
+			if c.corrupt {
+				client.writer.(*loopbackWriter).hook = corruptXON
+			}
+			result := runTransferForTest(client, server, files, dest)
+			if c.ok {
+				require.Nil(t, result.sendErr, msg)
+				require.Nil(t, result.recvErr, msg)
+				assertFileContent(t, filepath.Join(dest, "a.bin"), content)
+				continue
+			}
+			assert.NotNil(result.recvErr, msg)
+			if c.verify {
+				// fail fast with the bytes mangled before any file data
+				require.NotNil(t, result.sendErr, msg)
+				assert.Equal("Escape verification failed, the bytes mangled: 11, try --escape-bytes or transfer without -b",
+					result.sendErr.Error())
+				assertEmptyDir(t, dest)
+			}
+		}
+	}
+
+	// the bytes escaped already are skipped
+	escapeChars := appendEscapeBytes(getEscapeChars(true), []byte{0x1b, 0x11, 0x11, 0x7f})
+	assert.Equal([]unicode{"\x11", "\u00eea"}, escapeChars[len(escapeChars)-2])
+	assert.Equal([]unicode{"\x7f", "\u00eeb"}, escapeChars[len(escapeChars)-1])
+	assert.Equal(9, len(escapeChars))
+
+	var escapeBytes EscapeBytes
+	assert.Nil(escapeBytes.UnmarshalText([]byte("1B, 9d,00")))
+	assert.Equal([]byte{0x1b, 0x9d, 0x00}, escapeBytes.Bytes)
+	assert.EqualError(escapeBytes.UnmarshalText([]byte("41")), "invalid escape byte 41, should be a control character in hex, e.g., 1b")
+	assert.NotNil(escapeBytes.UnmarshalText([]byte("a0")))
+	assert.NotNil(escapeBytes.UnmarshalText([]byte("100")))
+	assert.NotNil(escapeBytes.UnmarshalText([]byte("11,")))
+
+	// only verified in binary mode, and if the client supports it
+	opts := NewTransferOptions()
+	opts.VerifyEscape = true
+	for _, c := range []struct {
+		binary bool
+		action TransferAction
+		expect bool
+	}{
+		{true, TransferAction{Protocol: 2, SupportBinary: true, SupportEscape: true}, true},
+		{false, TransferAction{Protocol: 2, SupportBinary: true, SupportEscape: true}, false},
+		{true, TransferAction{Protocol: 2, SupportBinary: true}, false},
+	} {
+		opts.Binary = c.binary
+		client, server := newLoopbackTransfers()
+		require.Nil(t, server.sendConfig(&opts, &c.action, nil, NoTmux, -1))
+		config, err := client.recvConfig()
+		require.Nil(t, err)
+		assert.Equal(c.expect, config.VerifyEscape)
+	}
+}
+
+func TestTransferNewline(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	// the lines of the server end with the newline advertised by the client
+	for _, protocol := range []int{1, 2} {
+		dest := t.TempDir()
+		client, server := newLoopbackTransfers()
+		client.newline = "%\n"
+		var lines int
+		server.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			if bytes.HasSuffix(buf, []byte("\n")) {
+				assert.True(bytes.HasSuffix(buf, []byte("%\n")), string(buf))
+				lines++
+			}
+			return buf
+		}
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		assert.Equal("%\n", server.transferConfig.Newline)
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+		assert.Greater(lines, 0)
+	}
+
+	for _, newline := range []string{"\n", "!\n", "%\n", "~%\n"} {
+		assert.True(isValidNewline(newline), newline)
+	}
+	for _, newline := range []string{"", "%", "\r\n", "a\n", "#\n", "\n\n", "\x1b\n", "%%%%%%%%\n"} {
+		assert.False(isValidNewline(newline), newline)
+	}
+	client := NewTransfer(nil, nil, false, WithNewline("\r\n"))
+	assert.EqualError(client.sendAction(true, false), `Invalid newline: "\r\n"`)
+}
+
+func TestTransferWithCompress(t *testing.T) {
+	src := t.TempDir()
+	content := strings.Repeat("hello trzsz\n", 10000)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		for _, compress := range append([]string{""}, kSupportedCompressions...) {
+			args := newDefaultArgsForTest()
+			args.Compress = CompressName{compress}
+			dest := t.TempDir()
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, protocol)
+			assert.Equal(t, compress, client.transferConfig.Compress)
+			var stream []byte
+			client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+				if bytes.HasPrefix(buf, []byte("#DATA:")) {
+					stream = append(stream, bytes.TrimSpace(buf[6:])...)
+				}
+				return buf
+			}
+			result := runTransferForTest(client, server, files, dest)
+			require.Nil(t, result.sendErr, compress)
+			require.Nil(t, result.recvErr, compress)
+			assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+
+			// the stream of the pipeline is compressed by the chosen one, or zstd by default
+			if protocol == 2 {
+				data, err := base64.StdEncoding.DecodeString(string(stream))
+				require.Nil(t, err)
+				require.NotEmpty(t, data)
+				if compress == "none" {
+					assert.Equal(t, kChunkStored, data[0])
+				} else {
+					assert.Equal(t, kChunkCompressed, data[0])
+				}
+				data = data[1:]
+				if compress != "none" {
+					codec := compress
+					if codec == "" {
+						codec = "zstd"
+					}
+					r, err := newStreamDecompressor(bytes.NewReader(data), codec)
+					require.Nil(t, err, compress)
+					data, err = io.ReadAll(r)
+					require.Nil(t, err, compress)
+				}
+				assert.Equal(t, content, string(data), compress)
+			}
+		}
+	}
+}
+
+func TestNoCompress(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	text := strings.Repeat("hello trzsz\n", 10000)
+	random := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	writeTestFile(t, filepath.Join(src, "text.txt"), text)
+	writeTestFile(t, filepath.Join(src, "random.bin"), string(random))
+
+	for _, protocol := range []int{1, 2} {
+		for _, noCompress := range []bool{false, true} {
+			for name, content := range map[string]string{"text.txt": text, "random.bin": string(random)} {
+				files, err := checkPathsReadable([]string{filepath.Join(src, name)}, false)
+				require.Nil(t, err)
+				args := newDefaultArgsForTest()
+				args.NoCompress = noCompress
+				dest := t.TempDir()
+				client, server := newLoopbackTransfers()
+				handshakeForTest(t, client, server, args, protocol)
+
+				var headers, stream []byte
+				client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+					if protocol == 1 && bytes.HasPrefix(buf, []byte("#DATA:")) {
+						b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf[6:])))
+						require.Nil(t, err)
+						headers = append(headers, b[0])
+					} else if bytes.HasPrefix(buf, []byte("#DATA:")) {
+						stream = append(stream, bytes.TrimSpace(buf[6:])...)
+					}
+					return buf
+				}
+				result := runTransferForTest(client, server, files, dest)
+				require.Nil(t, result.sendErr)
+				require.Nil(t, result.recvErr)
+				assertFileContent(t, filepath.Join(dest, name), content)
+
+				// the incompressible file is stored as is after sampling the first chunk, or the stream of the pipeline
+				expected := kChunkCompressed
+				if noCompress || name == "random.bin" {
+					expected = kChunkStored
+				}
+				if protocol == 1 {
+					require.NotEmpty(t, headers)
+					assert.Equal(bytes.Repeat([]byte{expected}, len(headers)), headers, "%s %v", name, noCompress)
+				} else {
+					data, err := base64.StdEncoding.DecodeString(string(stream))
+					require.Nil(t, err)
+					require.NotEmpty(t, data)
+					assert.Equal(expected, data[0], "%s %v", name, noCompress)
+					if expected == kChunkStored {
+						assert.Equal(content, string(data[1:]))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	assert := assert.New(t)
+	for _, protocol := range []int{1, 2} {
+		src := t.TempDir()
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			writeTestFile(t, filepath.Join(src, name), "new "+name)
+		}
+		files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"),
+			filepath.Join(src, "c.txt")}, false)
+		require.Nil(t, err)
+		require.Nil(t, os.Remove(filepath.Join(src, "b.txt"))) // failed to open by the sender
+		dest := t.TempDir()
+		require.Nil(t, os.Mkdir(filepath.Join(dest, "c.txt"), 0755)) // failed to create by the receiver
+
+		args := newDefaultArgsForTest()
+		args.Overwrite = true
+		result := transferFilesForTest(t, args, protocol, files, dest)
+		assert.NotNil(result.sendErr)
+		assert.NotNil(result.recvErr)
+
+		args.KeepGoing = true
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		var sendOutput, recvOutput bytes.Buffer
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := client.sendFiles(files, NewJSONProgress(&sendOutput))
+			assert.Nil(err)
+		}()
+		go func() {
+			defer wg.Done()
+			localNames, err := server.recvFiles(dest, NewJSONProgress(&recvOutput))
+			assert.Nil(err)
+			assert.Equal([]string{"a.txt"}, localNames)
+		}()
+		wg.Wait()
+
+		assertFileContent(t, filepath.Join(dest, "a.txt"), "new a.txt")
+		assert.NoFileExists(filepath.Join(dest, "b.txt"))
+		assert.Equal("Transferred 1 file(s), 2 failed", client.getFailedMessage())
+		assert.Equal("Transferred 1 file(s), 2 failed", server.getFailedMessage())
+
+		for _, output := range []string{sendOutput.String(), recvOutput.String()} {
+			var failures []*jsonProgressLine
+			for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+				var progress jsonProgressLine
+				require.Nil(t, json.Unmarshal([]byte(line), &progress))
+				if progress.Event == "error" {
+					failures = append(failures, &progress)
+				}
+			}
+			require.Equal(t, 2, len(failures))
+			assert.Equal("b.txt", failures[0].File)
+			assert.Equal(2, failures[0].Index)
+			assert.Contains(failures[0].Error, "b.txt")
+			assert.Equal("c.txt", failures[1].File)
+			assert.Equal(3, failures[1].Index)
+			assert.Contains(failures[1].Error, "c.txt")
+		}
+	}
+}
+
+func TestKeepGoingAfterData(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, filepath.Join(src, name), strings.Repeat(name, 100))
+	}
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"),
+		filepath.Join(src, "c.txt")}, false)
+	require.Nil(t, err)
+
+	originalWriteFile := writeFileFunc
+	defer func() { writeFileFunc = originalWriteFile }()
+
+	for _, c := range []struct {
+		name    string
+		atomic  bool
+		fail    func(file *os.File, dest string) error
+		unix    bool
+		remains bool
+	}{
+		{name: "write", fail: func(file *os.File, dest string) error {
+			return errors.New("io error")
+		}},
+		{name: "attrs", unix: true, fail: func(file *os.File, dest string) error {
+			return os.Remove(file.Name()) // the attributes can't be applied to the removed file
+		}},
+		{name: "rename", atomic: true, remains: true, fail: func(file *os.File, dest string) error {
+			return os.MkdirAll(filepath.Join(dest, "b.txt", "dir"), 0755) // the file can't replace the directory
+		}},
+	} {
+		if c.unix && IsWindows() {
+			continue
+		}
+		for _, protocol := range []int{1, 2} {
+			dest := t.TempDir()
+			writeFileFunc = func(file *os.File, data []byte) (int, error) {
+				if strings.HasSuffix(file.Name(), "b.txt") || strings.HasSuffix(file.Name(), "b.txt.tmp") {
+					if err := c.fail(file, dest); err != nil {
+						return 0, err
+					}
+				}
+				return file.Write(data)
+			}
+			args := newDefaultArgsForTest()
+			args.Bufsize = BufferSize{64}
+			args.Overwrite = true
+			args.Preserve = true
+			args.Atomic = c.atomic
+			args.KeepGoing = true
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, protocol)
+			var sendOutput, recvOutput bytes.Buffer
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_, err := client.sendFiles(files, NewJSONProgress(&sendOutput))
+				assert.Nil(err, c.name)
+			}()
+			go func() {
+				defer wg.Done()
+				_, err := server.recvFiles(dest, NewJSONProgress(&recvOutput))
+				assert.Nil(err, c.name)
+			}()
+			wg.Wait()
+
+			// the failed file is removed, and the later files are received
+			assertFileContent(t, filepath.Join(dest, "a.txt"), strings.Repeat("a.txt", 100))
+			assertFileContent(t, filepath.Join(dest, "c.txt"), strings.Repeat("c.txt", 100))
+			if !c.remains {
+				assert.NoFileExists(filepath.Join(dest, "b.txt"), c.name)
+			}
+			assert.NoFileExists(filepath.Join(dest, ".b.txt.tmp"), c.name)
+			assert.Equal("Transferred 2 file(s), 1 failed", client.getFailedMessage(), c.name)
+			assert.Equal("Transferred 2 file(s), 1 failed", server.getFailedMessage(), c.name)
+
+			// the failed file is reported once, instead of being done too
+			for _, output := range []string{sendOutput.String(), recvOutput.String()} {
+				events := make(map[string]int)
+				for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+					var progress jsonProgressLine
+					require.Nil(t, json.Unmarshal([]byte(line), &progress))
+					events[progress.Event]++
+					if progress.Event == "error" {
+						assert.Equal("b.txt", progress.File, c.name)
+						assert.Equal(2, progress.Index, c.name)
+					}
+				}
+				assert.Equal(1, events["error"], c.name)
+				assert.Equal(2, events["done"], c.name)
+			}
+		}
+	}
+}
+
+// fileProgressRecorder records the files done, the digests and the speeds reported, and ignores the other progress.
+type fileProgressRecorder struct {
+	*JSONProgress
+	files  []string
+	hashes []string
+	speeds []float64
+}
+
+func newFileProgressRecorder() *fileProgressRecorder {
+	return &fileProgressRecorder{JSONProgress: NewJSONProgress(io.Discard)}
+}
+
+func (r *fileProgressRecorder) OnFileDone(localName string, size int64) {
+	r.files = append(r.files, fmt.Sprintf("%s:%d", localName, size))
+}
+
+func (r *fileProgressRecorder) OnFileHash(localName string, algo string, digest []byte) {
+	r.hashes = append(r.hashes, fmt.Sprintf("%s:%s:%x", localName, algo, digest))
+}
+
+// OnSpeed makes the recorder wrapped by the speed progress, which should still report the files and the digests.
+func (r *fileProgressRecorder) OnSpeed(bytesPerSec float64) {
+	r.speeds = append(r.speeds, bytesPerSec)
+}
+
+func TestProgressFileCallbacks(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "dir", "b.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	md5a := fmt.Sprintf("%x", md5.Sum([]byte("hello")))
+	md5b := fmt.Sprintf("%x", md5.Sum([]byte("hello trzsz")))
+	for _, c := range []struct {
+		protocol     int
+		parallel     int
+		verifySample SampleRate
+	}{
+		{1, 0, SampleRate{}},
+		{2, 0, SampleRate{}},
+		{kProtocolVersion, 2, SampleRate{}},
+		{1, 0, SampleRate{Skip: 100}},
+		{2, 0, SampleRate{Skip: 100}},
+		{kProtocolVersion, 2, SampleRate{Skip: 100}},
+	} {
+		msg := fmt.Sprintf("protocol %d parallel %d sample %v", c.protocol, c.parallel, c.verifySample)
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Parallel = c.parallel
+		args.VerifySample = c.verifySample
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, c.protocol)
+		sendRecorder, recvRecorder := newFileProgressRecorder(), newFileProgressRecorder()
+		result := runTransferWithProgressForTest(client, server, files, dest, sendRecorder, recvRecorder)
+		require.Nil(t, result.sendErr, msg)
+		require.Nil(t, result.recvErr, msg)
+
+		// the directories are not reported, and the files not verified are reported too
+		assert.Equal([]string{filepath.Join(src, "a.txt") + ":5", filepath.Join(src, "dir", "b.txt") + ":11"},
+			sendRecorder.files, msg)
+		assert.Equal([]string{filepath.Join(dest, "a.txt") + ":5", filepath.Join(dest, "dir", "b.txt") + ":11"},
+			recvRecorder.files, msg)
+
+		// no digest is reported for the files not verified
+		if c.verifySample.Skip > 0 {
+			assert.Empty(sendRecorder.hashes, msg)
+			assert.Empty(recvRecorder.hashes, msg)
+			continue
+		}
+		assert.Equal([]string{filepath.Join(src, "a.txt") + ":md5:" + md5a, filepath.Join(src, "dir", "b.txt") + ":md5:" + md5b},
+			sendRecorder.hashes, msg)
+		assert.Equal([]string{filepath.Join(dest, "a.txt") + ":md5:" + md5a, filepath.Join(dest, "dir", "b.txt") + ":md5:" + md5b},
+			recvRecorder.hashes, msg)
+	}
+}
+
+func TestProgressSpeed(t *testing.T) {
+	assert := assert.New(t)
+	originalTimeNow := timeNowFunc
+	defer func() { timeNowFunc = originalTimeNow }()
+	var clock atomic.Int64
+	timeNowFunc = func() time.Time { return time.UnixMilli(clock.Add(10)) }
+
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("hello trzsz", 1000))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+	args := newDefaultArgsForTest()
+	args.Bufsize = BufferSize{1024}
+	client, server := newLoopbackTransfers()
+	// the steps are reported in order without the pipeline of protocol 2
+	handshakeForTest(t, client, server, args, 1)
+	sendRecorder, recvRecorder := newFileProgressRecorder(), newFileProgressRecorder()
+	result := runTransferWithProgressForTest(client, server, files, t.TempDir(), sendRecorder, recvRecorder)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+
+	// both sides are notified of the speed by the steps, which is 0 before any data is transferred
+	for _, recorder := range []*fileProgressRecorder{sendRecorder, recvRecorder} {
+		require.NotEmpty(t, recorder.speeds)
+		assert.Equal(float64(0), recorder.speeds[0])
+		assert.True(recorder.speeds[len(recorder.speeds)-1] > 0)
+	}
+}
+
+func TestTransferEmptyDirectories(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	for _, dir := range []string{"empty", "tree/empty1", "tree/sub/empty2", "tree/sub/deep/empty3", "other"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(src, dir), 0755))
+	}
+	writeTestFile(t, filepath.Join(src, "tree", "sub", "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "other", "empty"), "not a directory")
+	paths := []string{filepath.Join(src, "empty"), filepath.Join(src, "tree"), filepath.Join(src, "other", "empty")}
+	files, err := checkPathsReadable(paths, true)
+	require.Nil(t, err)
+
+	assertEmptyDirs := func(dest string) {
+		for _, dir := range []string{"empty", "tree/empty1", "tree/sub/empty2", "tree/sub/deep/empty3"} {
+			entries, err := os.ReadDir(filepath.Join(dest, dir))
+			assert.Nil(err, dir)
+			assert.Empty(entries, dir)
+		}
+		assertFileContent(t, filepath.Join(dest, "tree", "sub", "a.txt"), "hello")
+	}
+
+	for _, protocol := range []int{1, 2} {
+		// the empty directory and the file of the same name get different local names
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		result := transferFilesForTest(t, args, protocol, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{"empty", "tree", "empty.0"}, result.localNames)
+		assert.Equal([]string{"empty", "tree", "empty.0"}, result.remoteNames)
+		assertEmptyDirs(dest)
+		assertFileContent(t, filepath.Join(dest, "empty.0"), "not a directory")
+
+		// the empty directory is kept if transferred again with overwrite
+		args.Overwrite = true
+		result = transferFilesForTest(t, args, protocol, files[:len(files)-1], dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{"empty", "tree"}, result.localNames)
+		assertEmptyDirs(dest)
+
+		// the empty directory won't be replaced by the file of the same name
+		result = transferFilesForTest(t, args, protocol, files[len(files)-1:], dest)
+		assert.EqualError(result.recvErr, "Is a directory: "+filepath.Join(dest, "empty"))
+		assertEmptyDirs(dest)
+	}
+}
+
+func TestRecvWriteFailed(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.bin"), strings.Repeat("trzsz", 100))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin")}, false)
+	require.Nil(t, err)
+
+	originalWriteFile := writeFileFunc
+	defer func() { writeFileFunc = originalWriteFile }()
+	for _, c := range []struct {
+		atomic bool
+		err    error
+	}{
+		{false, syscall.ENOSPC},
+		{true, syscall.ENOSPC},
+		{true, errors.New("io error")},
+	} {
+		name := "a.bin"
+		if c.atomic {
+			name = ".a.bin.tmp"
+		}
+		written := 0
+		writeFileFunc = func(file *os.File, data []byte) (int, error) {
+			// the final path is never seen while writing atomically
+			assert.Equal(name, filepath.Base(file.Name()))
+			if c.atomic {
+				_, err := os.Stat(filepath.Join(filepath.Dir(file.Name()), "a.bin"))
+				assert.True(errors.Is(err, os.ErrNotExist))
+			}
+			if written+len(data) > 100 {
+				return 0, &os.PathError{Op: "write", Path: file.Name(), Err: c.err}
+			}
+			written += len(data)
+			return file.Write(data)
+		}
+
+		for _, protocol := range []int{1, 2} {
+			written = 0
+			dest := t.TempDir()
+			args := newDefaultArgsForTest()
+			args.Bufsize = BufferSize{64}
+			args.Atomic = c.atomic
+			result := transferFilesForTest(t, args, protocol, files, dest)
+			require.NotNil(t, result.recvErr)
+			require.NotNil(t, result.sendErr)
+			if c.err == syscall.ENOSPC {
+				assert.Equal("No space left on device: "+filepath.Join(dest, name), result.recvErr.Error())
+				var e *TrzszError
+				require.True(t, errors.As(result.recvErr, &e))
+				assert.Equal(ErrNoSpace, e.Code())
+				// the sender is told about the error
+				assert.Contains(result.sendErr.Error(), "No space left on device")
+			}
+			// the partial file is removed
+			assertEmptyDir(t, dest)
+		}
+	}
+}
+
+func TestFileTruncatedDuringRead(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.bin"), strings.Repeat("trzsz", 100))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.bin")}, false)
+	require.Nil(t, err)
+
+	// the file shrinks to 200 bytes after the size is sent
+	originalReadFile := readFileFunc
+	defer func() { readFileFunc = originalReadFile }()
+	read := 0
+	readFileFunc = func(file *os.File, buffer []byte) (int, error) {
+		if read >= 200 {
+			return 0, io.EOF
+		}
+		n, err := file.Read(buffer[:minInt(len(buffer), 200-read)])
+		read += n
+		return n, err
+	}
+
+	for _, tc := range []struct {
+		protocol  int
+		parallel  int
+		binary    bool
+		ackWindow int
+	}{{1, 0, false, 0}, {2, 0, false, 0}, {2, 0, true, 0}, {2, 0, false, 4}, {3, 2, false, 0}} {
+		read = 0
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Bufsize = BufferSize{64}
+		args.Parallel = tc.parallel
+		args.Binary = tc.binary
+		args.AckWindow = tc.ackWindow
+		result := transferFilesForTest(t, args, tc.protocol, files, dest)
+		require.NotNil(t, result.sendErr)
+		assert.Equal("File truncated during read: "+filepath.Join(src, "a.bin"), result.sendErr.Error())
+		// the receiver is told about the error instead of waiting for the missing data
+		require.NotNil(t, result.recvErr)
+		assert.Equal("File truncated during read: "+filepath.Join(src, "a.bin"), result.recvErr.Error())
+	}
+}
+
+func TestTransferTotals(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), strings.Repeat("a", 10000))
+	writeTestFile(t, filepath.Join(src, "b.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	originalTimeNow := timeNowFunc
+	timeNowFunc = time.Now
+	defer func() { timeNowFunc = originalTimeNow }()
+
+	for _, protocol := range []int{1, 2} {
+		for _, binary := range []bool{false, true} {
+			args := newDefaultArgsForTest()
+			args.Binary = binary
+			client, server := newLoopbackTransfers()
+			handshakeForTest(t, client, server, args, protocol)
+			result := runTransferForTest(client, server, files, t.TempDir())
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+
+			// the bytes are the file content, no matter how they are compressed or escaped
+			for _, transfer := range []*TrzszTransfer{client, server} {
+				totals := transfer.GetTransferResult()
+				assert.Equal(2, totals.FileCount)
+				assert.Equal(int64(10011), totals.Bytes)
+				assert.True(totals.Duration > 0)
+				assert.InDelta(float64(totals.Bytes)/totals.Duration.Seconds(), totals.Speed, 1)
+			}
+		}
+	}
+
+	transfer := NewTransfer(nil, nil, false)
+	transfer.transferResult = &TransferResult{FileCount: 3, Bytes: 3 * 1024 * 1024, Duration: 1500 * time.Millisecond,
+		Speed: 2 * 1024 * 1024}
+	assert.Equal("Total 3 file(s), 3.00 MB in 1.5s, 2.00 MB/s", transfer.getTotalsMessage())
+	transfer.transferResult.SkippedCount = 2
+	assert.Equal("Total 3 file(s), 2 skipped, 3.00 MB in 1.5s, 2.00 MB/s", transfer.getTotalsMessage())
+}
+
+func TestNegotiatedConfigAndAction(t *testing.T) {
+	assert := assert.New(t)
+	client, server := newLoopbackTransfers()
+	assert.Nil(client.Action())
+	assert.Nil(server.Action())
+
+	args := newDefaultArgsForTest()
+	args.Binary = true
+	args.Compress = CompressName{"zstd"}
+	handshakeForTest(t, client, server, args, 2)
+
+	for _, transfer := range []*TrzszTransfer{client, server} {
+		config := transfer.Config()
+		assert.True(config.Binary)
+		assert.Equal("zstd", config.Compress)
+		assert.Equal(2, config.Protocol)
+
+		action := transfer.Action()
+		require.NotNil(t, action)
+		assert.Equal("go", action.Lang)
+		assert.Equal(kTrzszVersion, action.Version)
+		assert.True(action.Confirm)
+	}
+
+	// the copies can't change the transfer
+	config := client.Config()
+	config.Binary = false
+	assert.True(client.Config().Binary)
+	client.Action().Confirm = false
+	assert.True(client.Action().Confirm)
+}
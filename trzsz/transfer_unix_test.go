@@ -0,0 +1,97 @@
+//go:build !windows
+
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreserveOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "setuid.sh"), "#!/bin/sh")
+	writeTestFile(t, filepath.Join(src, "dir", "b.txt"), "hello")
+	for _, p := range []string{"dir", "dir/setuid.sh", "dir/b.txt"} {
+		require.Nil(t, os.Chown(filepath.Join(src, p), 1234, 5678))
+	}
+	require.Nil(t, os.Chmod(filepath.Join(src, "dir", "setuid.sh"), 0755|os.ModeSetuid|os.ModeSetgid))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	for _, tc := range []struct {
+		preserve      bool
+		preserveOwner bool
+	}{{true, true}, {true, false}, {false, false}} {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Preserve = tc.preserve
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, 2)
+		// the preserve mode negotiated by the peer won't change the owner of the receiver
+		server.preserveOwner = tc.preserveOwner
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+
+		for _, p := range []string{"dir", "dir/setuid.sh", "dir/b.txt"} {
+			info, err := os.Stat(filepath.Join(dest, p))
+			require.Nil(t, err)
+			stat := info.Sys().(*syscall.Stat_t)
+			if tc.preserveOwner {
+				assert.Equal(uint32(1234), stat.Uid, p)
+				assert.Equal(uint32(5678), stat.Gid, p)
+			} else {
+				assert.Equal(uint32(0), stat.Uid, p)
+			}
+		}
+		// the setuid bits survive the chown
+		info, err := os.Stat(filepath.Join(dest, "dir", "setuid.sh"))
+		require.Nil(t, err)
+		assert.Equal(tc.preserveOwner, info.Mode()&os.ModeSetuid != 0)
+		assert.Equal(tc.preserveOwner, info.Mode()&os.ModeSetgid != 0)
+		assert.Equal(tc.preserve, info.Mode().Perm() == 0755)
+	}
+}
+
+func TestChownWithoutPrivilege(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root has the privilege to change the owner")
+	}
+	path := filepath.Join(t.TempDir(), "a.txt")
+	writeTestFile(t, path, "hello")
+	assert.Nil(t, chownFile(path, &fileOwner{0, 0}))
+}
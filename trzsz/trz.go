@@ -26,11 +26,11 @@ package trzsz
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/alexflint/go-arg"
 	"golang.org/x/term"
@@ -38,7 +38,21 @@ import (
 
 type TrzArgs struct {
 	Args
-	Path string `arg:"positional" default:"." help:"path to save file(s). (default: current directory)"`
+	Quota       QuotaSize `arg:"--quota" placeholder:"N" help:"max cumulative size received from each sender, which is\nidentified as the user running trz"`
+	QuotaFile   string    `arg:"--quota-file" placeholder:"PATH" help:"state file of the quota usage. (default: ~/.trzsz_quota.json)"`
+	MaxTotal    QuotaSize `arg:"--max-total" placeholder:"N" help:"abort if the total size of the received file(s) exceeds N, e.g., 500M"`
+	MaxFile     QuotaSize `arg:"--max-file" placeholder:"N" help:"reject the file larger than N before receiving it, e.g., 100M"`
+	MaxDepth    int       `arg:"--max-depth" placeholder:"N" default:"64" help:"reject the received path deeper than N levels.\nN < 0 means no limit. (default: 64)"`
+	MaxName     int       `arg:"--max-name" placeholder:"N" default:"255" help:"reject the received file or directory name longer than N\nbytes. N < 0 means no limit. (default: 255)"`
+	DirMode     DirMode   `arg:"--dir-mode" placeholder:"MODE" help:"create the missing directories with MODE, e.g., 0700, and the\numask still applies. the directories transferred with -p keep\ntheir own mode. (default: 0755)"`
+	PatchBase   string    `arg:"--patch-base" placeholder:"DIR" help:"compare with the prior versions of the same relative paths in\nDIR instead of the existing files, implies --patch"`
+	Flatten     bool      `arg:"--flatten" help:"save the file(s) of the directories directly under the path by\ntheir own names, without the subdirectories. the same names\nare renamed as usual"`
+	UnsafeLinks bool      `arg:"--unsafe-links" help:"allow the received symlinks pointing to absolute paths or outside\nof the transferred directories, and writing through them"`
+	Output      string    `arg:"--output" placeholder:"NAME" help:"save the only received file as NAME under the path,\ninstead of the sender's name. not with -d or --tar"`
+	Verify      bool      `arg:"--verify" help:"read the received file(s) back from disk after the transfer and\ncheck the hash again, to catch the corruption after receiving.\nit doubles the disk I/O. not with --stdout, and the file(s)\nin --tar are not verified"`
+	Manifest    string    `arg:"--manifest" placeholder:"PATH" help:"write a json array of the path, size and hash of the received\nfile(s) to PATH after the transfer, e.g., out.json"`
+	Stdout      bool      `arg:"--stdout" help:"write the only received file to stdout instead of saving it,\ne.g., trz --stdout | tar x, the terminal is written for the\nrequests then. not with -d, --output, -p, -r, --update,\n--checksum, --patch, --audit, --atomic, --dedup, --parallel,\n--tar or --verify"`
+	Path        string    `arg:"positional" default:"." help:"path to save file(s). (default: current directory)"`
 }
 
 func (TrzArgs) Description() string {
@@ -49,8 +63,10 @@ func (TrzArgs) Version() string {
 	return fmt.Sprintf("trz (trzsz) go %s", kTrzszVersion)
 }
 
-func recvFiles(transfer *TrzszTransfer, args *TrzArgs, tmuxMode TmuxMode, tmuxPaneWidth int) error {
-	action, err := transfer.recvAction()
+func recvFiles(transfer *TrzszTransfer, args *TrzArgs, env *receiveEnv, emitMagic func()) error {
+	transfer.transferConfig.Timeout = args.Timeout
+	transfer.transferConfig.HandshakeTimeout = args.getHandshakeTimeout()
+	action, err := transfer.recvActionRetry(args.HandshakeRetries, args.getRetryTimeout(), emitMagic)
 	if err != nil {
 		return err
 	}
@@ -70,101 +86,420 @@ func recvFiles(transfer *TrzszTransfer, args *TrzArgs, tmuxMode TmuxMode, tmuxPa
 		return newTrzszError("The client doesn't support transfer directory")
 	}
 
-	escapeChars := getEscapeChars(args.Escape)
-	if err := transfer.sendConfig(&args.Args, action, escapeChars, tmuxMode, tmuxPaneWidth); err != nil {
+	// check if the client doesn't support audit
+	if (args.Audit || args.AuditPull) && !action.SupportAudit {
+		return newTrzszError("The client doesn't support audit")
+	}
+
+	transfer.outputName = args.Output
+	if args.Stdout {
+		transfer.outputFile = env.stdout
+	}
+	transfer.unsafeLinks = args.UnsafeLinks
+	transfer.preserveOwner = args.Preserve
+	transfer.dirMode = args.DirMode.Mode
+	transfer.patchBase = args.PatchBase
+	if len(args.PatchBase) > 0 {
+		args.Patch = true
+	}
+	transfer.maxTotal = args.MaxTotal.Size
+	transfer.maxFile = args.MaxFile.Size
+	transfer.maxDepth = getPathLimit(args.MaxDepth, kDefaultMaxDepth)
+	transfer.flatten = args.Flatten
+	transfer.maxNameLen = getPathLimit(args.MaxName, kDefaultMaxNameLen)
+	transfer.verifyDisk = args.Verify
+
+	if args.Quota.Size > 0 {
+		quota, err := loadSenderQuota(args.QuotaFile, getSenderIdentity(env.identity), args.Quota.Size)
+		if err != nil {
+			return err
+		}
+		transfer.quota = quota
+	}
+
+	escapeChars := appendEscapeBytes(getEscapeChars(args.Escape), args.EscapeBytes.Bytes)
+	if err := transfer.sendConfig(&args.TransferOptions, action, escapeChars, env.tmuxMode, env.tmuxPaneWidth); err != nil {
 		return err
 	}
 
-	localNames, err := transfer.recvFiles(args.Path, nil)
+	var manifest *manifestRecorder
+	if len(args.Manifest) > 0 {
+		manifest = newManifestRecorder(args.Path)
+	}
+	// the manifest is written after the files are verified on disk, and not if any is corrupted
+	localNames, err := transfer.recvFiles(args.Path, manifest)
 	if err != nil {
 		return err
 	}
+	if manifest != nil {
+		if err := manifest.write(args.Manifest); err != nil {
+			return newTrzszError(fmt.Sprintf("Write manifest error: %v", err))
+		}
+	}
 
 	if _, err := transfer.recvExit(); err != nil {
 		return err
 	}
 
-	transfer.serverExit(fmt.Sprintf("Received %s to %s", strings.Join(localNames, ", "), args.Path))
+	target := args.Path
+	if args.Stdout {
+		target = "stdout"
+	}
+	msg := fmt.Sprintf("Received %s to %s", strings.Join(localNames, ", "), target)
+	if args.Stats {
+		msg += "\n" + transfer.getStatsMessage()
+	}
+	msg += "\n" + transfer.getTotalsMessage()
+	if transfer.transferConfig.KeepGoing {
+		msg += "\n" + transfer.getFailedMessage()
+	}
+	if args.Verify {
+		msg += "\n" + transfer.getVerifyMessage()
+	}
+	if report := transfer.GetAuditReport(); report != nil {
+		msg += "\n" + report.String()
+	}
+	transfer.serverExit(msg)
+	if err := writeSummary(args.SummaryFile, args.SummaryFormat, transfer.GetTransferResult(), env.errOutput); err != nil {
+		fmt.Fprintln(env.errOutput, err)
+	}
+	return nil
+}
+
+// ReceiveConfig is the config of receiving files as a library, e.g., in an SSH server.
+// The Reader is the input from the client, and the Writer is the output to the client.
+// The ErrWriter gets the summary without a summary file, and the local errors, which are discarded if it's nil.
+// The files are saved to `Args.Path`. The zero values of the args mean the same as on the command line, e.g.,
+// the timeout 0 means never timeout, see `NewTrzArgs` for the args with the defaults of trz.
+// The Identity is the authenticated client for `Args.Quota`, e.g., the SSH user, or the current user if empty.
+// The Stdout gets the data of the only file instead of saving it under the path, as `Args.Stdout` does.
+// The PreReceiveHook inspects the incoming files, and rejects the transfer by returning an error.
+type ReceiveConfig struct {
+	Reader         io.Reader
+	Writer         io.Writer
+	ErrWriter      io.Writer
+	Identity       string
+	Stdout         io.Writer
+	Args           TrzArgs
+	PreReceiveHook PreReceiveHook
+}
+
+// NewTrzArgs returns the args with the same defaults as trz, to save the files to the path.
+func NewTrzArgs(path string) TrzArgs {
+	args := TrzArgs{Path: path}
+	args.TransferOptions = NewTransferOptions()
+	args.setDefaults()
+	return args
+}
+
+// setDefaults sets the zero values of the transfer options and the limits, see `TransferOptions.setDefaults`.
+func (a *TrzArgs) setDefaults() {
+	a.TransferOptions.setDefaults()
+	a.MaxDepth = getPathLimit(a.MaxDepth, kDefaultMaxDepth)
+	a.MaxName = getPathLimit(a.MaxName, kDefaultMaxNameLen)
+	if len(a.Path) == 0 {
+		a.Path = "."
+	}
+}
+
+// getPathLimit returns the limit of the received paths, the same on the command line and for the library users,
+// 0 means the default, and N < 0 means no limit.
+func getPathLimit(limit, defaultLimit int) int {
+	if limit == 0 {
+		return defaultLimit
+	}
+	return limit
+}
+
+// receiveEnv is the terminal state of the trz command, which the library users don't have.
+type receiveEnv struct {
+	output        io.Writer
+	stdinState    *term.State
+	tmuxMode      TmuxMode
+	tmuxPaneWidth int
+	uniqueSuffix  string
+	handleSignal  bool
+	errOutput     io.Writer
+	identity      string
+	stdout        *os.File
+	preRecvHook   PreReceiveHook
+}
+
+// writerIO adapts the writer of the library users to the PtyIO of the transfer, which is write only.
+type writerIO struct {
+	io.Writer
+}
+
+func (w writerIO) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (w writerIO) Close() error {
+	return nil
+}
+
+// ReceiveFiles receives files from the client to the path, and returns the result of the transfer.
+// The result is nil if the client cancels the transfer. The messages are written to the writer too.
+func ReceiveFiles(cfg ReceiveConfig) (*TransferResult, error) {
+	args := cfg.Args
+	args.setDefaults()
+	var err error
+	args.Path, err = filepath.Abs(args.Path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Stdout != nil {
+		args.Stdout = true
+	}
+	if err := checkOutputArg(&args); err != nil {
+		return nil, err
+	}
+	if err := checkStdoutArg(&args); err != nil {
+		return nil, err
+	}
+	if err := checkTrzTarArg(&args); err != nil {
+		return nil, err
+	}
+	if err := checkTrzAtomicArg(&args); err != nil {
+		return nil, err
+	}
+	if args.Stdout && cfg.Stdout == nil {
+		return nil, fmt.Errorf("the Stdout writer is required for --stdout")
+	}
+	if err := checkPathWritable(args.Path); err != nil {
+		return nil, err
+	}
+	errOutput := cfg.ErrWriter
+	if errOutput == nil {
+		errOutput = io.Discard
+	}
+	env := &receiveEnv{output: cfg.Writer, tmuxMode: NoTmux, tmuxPaneWidth: -1, uniqueSuffix: "00", errOutput: errOutput,
+		identity: cfg.Identity, preRecvHook: cfg.PreReceiveHook}
+	if !args.Stdout {
+		return receiveFiles(writerIO{cfg.Writer}, cfg.Reader, &args, env)
+	}
+	stdout, wait, err := pipeStdout(cfg.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	env.stdout = stdout
+	result, err := receiveFiles(writerIO{cfg.Writer}, cfg.Reader, &args, env)
+	if e := wait(); e != nil && err == nil {
+		return nil, e
+	}
+	return result, err
+}
+
+// ReceiveFilesWithOptions receives files from the client to the path with the options, instead of the args of trz.
+// The other args are the defaults of trz, see `NewTrzArgs`, and `cfg.Args` is ignored.
+func ReceiveFilesWithOptions(cfg ReceiveConfig, path string, opts TransferOptions) (*TransferResult, error) {
+	cfg.Args = NewTrzArgs(path)
+	cfg.Args.TransferOptions = opts
+	return ReceiveFiles(cfg)
+}
+
+// pipeStdout adapts the writer to a file, which is closed by the transfer after the data is written.
+// The returned function waits until all the data is copied to the writer.
+func pipeStdout(writer io.Writer) (*os.File, func() error, error) {
+	reader, stdout, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(writer, reader)
+		// closing the reader fails the pending writes if the writer returns an error
+		reader.Close()
+		done <- err
+	}()
+	return stdout, func() error {
+		stdout.Close()
+		return <-done
+	}, nil
+}
+
+func receiveFiles(writer PtyIO, reader io.Reader, args *TrzArgs, env *receiveEnv) (result *TransferResult, err error) {
+	mode := "R"
+	if args.Directory {
+		mode = "D"
+	}
+	// the re-emitted handshake keeps the same unique id, so the client knows it's the same transfer
+	uniqueID := strconv.FormatInt(timeNowFunc().UnixMilli()%10e10, 10) + env.uniqueSuffix
+	emitMagic := func() {
+		writeAll(env.output, []byte(fmt.Sprintf("\x1b7\x07::TRZSZ:TRANSFER:%s:%s:%s\r\n", mode, kTrzszVersion, uniqueID)))
+		if f, ok := env.output.(*os.File); ok {
+			f.Sync()
+		}
+	}
+	emitMagic()
+
+	transfer := NewTransfer(writer, env.stdinState, false, WithPreReceiveHook(env.preRecvHook))
+	transfer.exitOutput = env.output
+	defer func() {
+		if e := recover(); e != nil {
+			err = NewTrzszError(fmt.Sprintf("%v", e), "panic", true)
+			transfer.serverError(err)
+		}
+	}()
+
+	go wrapTransferInput(transfer, reader)
+	if env.handleSignal {
+		handleServerSignal(transfer)
+	}
+
+	if err := recvFiles(transfer, args, env, emitMagic); err != nil {
+		transfer.serverError(err)
+		return nil, err
+	}
+	return transfer.GetTransferResult(), nil
+}
+
+// checkOutputArg ensures the output is a plain file name, which is saved under the path.
+func checkOutputArg(args *TrzArgs) error {
+	if len(args.Output) == 0 {
+		return nil
+	}
+	if args.Directory {
+		return fmt.Errorf("--output can't be used with -d")
+	}
+	if args.Tar {
+		return fmt.Errorf("--output can't be used with --tar")
+	}
+	if args.Output != filepath.Base(args.Output) || args.Output == "." || args.Output == ".." {
+		return fmt.Errorf("--output should be a file name without directories: %s", args.Output)
+	}
+	return nil
+}
+
+// checkStdoutArg checks the `--stdout` to write the only file to stdout, which is exclusive with
+// the options saving the file under the path or writing the local file in place.
+func checkStdoutArg(args *TrzArgs) error {
+	if !args.Stdout {
+		return nil
+	}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{
+		{args.Directory, "-d"},
+		{len(args.Output) > 0, "--output"},
+		{args.Preserve, "-p"},
+		{args.Resume, "-r"},
+		{args.Update, "--update"},
+		{args.Checksum, "--checksum"},
+		{args.Patch || len(args.PatchBase) > 0, "--patch"},
+		{args.Audit || args.AuditPull, "--audit"},
+		{args.Atomic, "--atomic"},
+		{args.Dedup, "--dedup"},
+		{args.Parallel > 1, "--parallel"},
+		{args.Tar, "--tar"},
+		{args.Verify, "--verify"},
+		{args.NoTty, "--no-tty"},
+		{len(args.Manifest) > 0, "--manifest"},
+	} {
+		if opt.set {
+			return fmt.Errorf("--stdout can't be used with %s", opt.name)
+		}
+	}
 	return nil
 }
 
+// checkTrzTarArg checks the `--tar` of trz, where `--patch-base` implies `--patch`.
+func checkTrzTarArg(args *TrzArgs) error {
+	if args.Tar && len(args.PatchBase) > 0 {
+		return fmt.Errorf("--tar can't be used with --patch-base")
+	}
+	return checkTarArg(&args.TransferOptions)
+}
+
+// checkTrzAtomicArg checks the `--atomic` of trz, where `--patch-base` implies `--patch`.
+func checkTrzAtomicArg(args *TrzArgs) error {
+	if args.Atomic && len(args.PatchBase) > 0 {
+		return fmt.Errorf("--atomic can't be used with --patch-base")
+	}
+	return checkAtomicArg(&args.TransferOptions)
+}
+
 // TrzMain entry of recevie files from client
 func TrzMain() int {
 	var args TrzArgs
 	arg.MustParse(&args)
+	return runTrz(&args, os.Stdin, os.Stdout)
+}
 
+// runTrz receives the files by the stdin and stdout, which are a plain pipe or socket with --no-tty.
+func runTrz(args *TrzArgs, stdin, stdout *os.File) int {
 	var err error
 	args.Path, err = filepath.Abs(args.Path)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return -1
 	}
+	if err := checkOutputArg(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
+	if err := checkStdoutArg(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
+	if err := checkTrzTarArg(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
+	if err := checkTrzAtomicArg(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
 	if err := checkPathWritable(args.Path); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return -2
 	}
 
-	tmuxMode, realStdout, tmuxPaneWidth, err := checkTmux()
+	output := stdout
+	if args.Stdout {
+		if output, err = openTerminalOutput(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return -1
+		}
+		defer output.Close()
+	}
+
+	terminal, err := newServerTerminal(args.NoTty, output)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return -3
 	}
 
-	if args.Binary && tmuxMode != NoTmux {
-		os.Stdout.WriteString("Binary upload in tmux is not supported, auto switch to base64 mode.\n")
+	if args.Binary && terminal.tmuxMode != NoTmux {
+		output.WriteString("Binary upload in tmux is not supported, auto switch to base64 mode.\n")
 		args.Binary = false
 	}
 	if args.Binary && IsWindows() {
-		os.Stdout.WriteString("Binary upload on Windows is not supported, auto switch to base64 mode.\n")
+		output.WriteString("Binary upload on Windows is not supported, auto switch to base64 mode.\n")
 		args.Binary = false
 	}
 
-	uniqueID := strconv.FormatInt(time.Now().UnixMilli()%10e10, 10)
-	if IsWindows() {
-		if inMode, outMode, err := enableVirtualTerminal(); err == nil {
-			defer resetVirtualTerminal(inMode, outMode)
-		}
-		setupConsoleOutput()
-		uniqueID += "10"
-	} else if tmuxMode == TmuxNormalMode {
-		columns := getTerminalColumns()
-		if columns > 0 && columns < 40 {
-			os.Stdout.WriteString("\n\n\x1b[2A\x1b[0J")
-		} else {
-			os.Stdout.WriteString("\n\x1b[1A\x1b[0J")
-		}
-		uniqueID += "20"
-	} else {
-		uniqueID += "00"
-	}
-
-	mode := "R"
-	if args.Directory {
-		mode = "D"
-	}
-	os.Stdout.WriteString(fmt.Sprintf("\x1b7\x07::TRZSZ:TRANSFER:%s:%s:%s\r\n", mode, kTrzszVersion, uniqueID))
-	os.Stdout.Sync()
-
-	state, err := term.MakeRaw(int(os.Stdin.Fd()))
-	if err != nil {
+	terminal.setup(output, !args.Stdout)
+	defer terminal.reset()
+	if err := terminal.makeRaw(stdin); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return -4
 	}
-	defer func() { _ = term.Restore(int(os.Stdin.Fd()), state) }()
-
-	transfer := NewTransfer(realStdout, state, false)
-	defer func() {
-		if err := recover(); err != nil {
-			transfer.serverError(NewTrzszError(fmt.Sprintf("%v", err), "panic", true))
-		}
-	}()
-
-	go wrapStdinInput(transfer)
-	handleServerSignal(transfer)
 
-	if err := recvFiles(transfer, &args, tmuxMode, tmuxPaneWidth); err != nil {
-		transfer.serverError(err)
+	env := &receiveEnv{
+		output:        output,
+		stdinState:    terminal.state,
+		tmuxMode:      terminal.tmuxMode,
+		tmuxPaneWidth: terminal.tmuxPaneWidth,
+		uniqueSuffix:  terminal.uniqueSuffix,
+		handleSignal:  true,
+		errOutput:     os.Stderr,
+	}
+	if args.Stdout {
+		env.stdout = stdout
 	}
+	_, _ = receiveFiles(terminal.realStdout, stdin, args, env)
 
 	return 0
 }
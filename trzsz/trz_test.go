@@ -0,0 +1,617 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientOutputWriter feeds the output of the receiver to the client, except the magic key.
+type clientOutputWriter struct {
+	mutex  sync.Mutex
+	client *TrzszTransfer
+	output bytes.Buffer
+}
+
+func (w *clientOutputWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.output.Write(p)
+	if !bytes.Contains(p, []byte("::TRZSZ:TRANSFER:")) {
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		w.client.addReceivedData(buf)
+	}
+	return len(p), nil
+}
+
+func (w *clientOutputWriter) String() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.output.String()
+}
+
+func TestReceiveFilesAsLibrary(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	reader, inputWriter := io.Pipe()
+	client := NewTransfer(writerIO{inputWriter}, nil, false)
+	writer := &clientOutputWriter{client: client}
+	go func() {
+		assert.Nil(client.sendAction(true, false))
+		_, err := client.recvConfig()
+		assert.Nil(err)
+		_, err = client.sendFiles(files, nil)
+		assert.Nil(err)
+		assert.Nil(client.clientExit("Saved a.txt"))
+	}()
+
+	// the zero values of the args mean the same as trz, and the summary goes to the error writer
+	var errWriter bytes.Buffer
+	args := TrzArgs{Args: Args{SummaryFormat: "{files}f"}, Path: dest}
+	result, err := ReceiveFiles(ReceiveConfig{Reader: reader, Writer: writer, ErrWriter: &errWriter, Args: args})
+	require.Nil(t, err)
+	inputWriter.Close()
+	assert.Equal("1f\n", errWriter.String())
+
+	assert.Equal([]string{"a.txt"}, result.Names)
+	require.Equal(t, 1, len(result.Files))
+	assert.Equal(int64(len("hello trzsz")), result.Files[0].Size)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+	assert.True(strings.HasPrefix(writer.String(), "\x1b7\x07::TRZSZ:TRANSFER:R:"))
+	assert.Contains(writer.String(), "Received a.txt to "+dest)
+
+	// the options are given directly, without the args of trz
+	reader, inputWriter = io.Pipe()
+	client = NewTransfer(writerIO{inputWriter}, nil, false)
+	writer = &clientOutputWriter{client: client}
+	go func() {
+		assert.Nil(client.sendAction(true, false))
+		config, err := client.recvConfig()
+		assert.Nil(err)
+		assert.True(config.Binary)
+		assert.True(config.Overwrite)
+		_, err = client.sendFiles(files, nil)
+		assert.Nil(err)
+		assert.Nil(client.clientExit("Saved a.txt"))
+	}()
+	opts := NewTransferOptions()
+	opts.Binary = true
+	opts.Overwrite = true
+	result, err = ReceiveFilesWithOptions(ReceiveConfig{Reader: reader, Writer: writer}, dest, opts)
+	require.Nil(t, err)
+	inputWriter.Close()
+	assert.Equal([]string{"a.txt"}, result.Names)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+}
+
+func TestReceiveMagicReEmit(t *testing.T) {
+	assert := assert.New(t)
+	originalTimeNow := timeNowFunc
+	defer func() { timeNowFunc = originalTimeNow }()
+	// the clock moves 10s after the handshake is emitted, so the first attempt times out at once
+	var reads atomic.Int32
+	timeNowFunc = func() time.Time {
+		if reads.Add(1) <= 2 {
+			return time.UnixMilli(1646564135000)
+		}
+		return time.UnixMilli(1646564145000)
+	}
+
+	reader, inputWriter := io.Pipe()
+	defer inputWriter.Close()
+	client := NewTransfer(writerIO{inputWriter}, nil, false)
+	writer := &clientOutputWriter{client: client}
+	magicRegexp := regexp.MustCompile(`::TRZSZ:TRANSFER:R:[\d.]+:(\d+)`)
+	go func() {
+		// the first handshake is lost, and the client answers the re-emitted one
+		for len(magicRegexp.FindAllString(writer.String(), -1)) < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Nil(client.sendAction(false, false))
+	}()
+
+	args := NewTrzArgs(t.TempDir())
+	args.HandshakeRetries = 1
+	args.ConnectTimeout = 5
+	result, err := ReceiveFiles(ReceiveConfig{Reader: reader, Writer: writer, Args: args})
+	assert.Nil(err)
+	assert.Nil(result)
+
+	// the re-emitted handshake keeps the unique id, even though the clock has moved
+	matches := magicRegexp.FindAllStringSubmatch(writer.String(), -1)
+	require.Equal(t, 2, len(matches))
+	assert.Equal(matches[0][1], matches[1][1])
+}
+
+func TestReceiveManifest(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "b.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	receive := func(args TrzArgs) error {
+		reader, inputWriter := io.Pipe()
+		defer inputWriter.Close()
+		client := NewTransfer(writerIO{inputWriter}, nil, false)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.Nil(client.sendAction(true, false))
+			_, err := client.recvConfig()
+			assert.Nil(err)
+			_, err = client.sendFiles(files, nil)
+			assert.Nil(err)
+			assert.Nil(client.clientExit("Saved dir"))
+		}()
+		_, err := ReceiveFiles(ReceiveConfig{Reader: reader, Writer: &clientOutputWriter{client: client}, Args: args})
+		<-done
+		return err
+	}
+
+	// the digests are the same as verified with the hash algorithm negotiated
+	manifestPath := filepath.Join(t.TempDir(), "out.json")
+	args := TrzArgs{Args: Args{TransferOptions: TransferOptions{Directory: true, Hash: HashName{"sha256"}}},
+		Path: dest, Manifest: manifestPath}
+	require.Nil(t, receive(args))
+	content, err := os.ReadFile(manifestPath)
+	require.Nil(t, err)
+	assert.Equal(`[
+  {
+    "path": "dir/sub/b.txt",
+    "size": 11,
+    "algo": "sha256",
+    "hash": "984cf92daf4ffc0694b4526c61ec873ff5ecc9529a929ca29dce5b01346ebe2b"
+  },
+  {
+    "path": "dir/a.txt",
+    "size": 5,
+    "algo": "sha256",
+    "hash": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+  }
+]
+`, string(content))
+	_, err = os.Stat(manifestPath + ".tmp")
+	assert.True(os.IsNotExist(err))
+
+	// the files not verified are listed without the hash
+	args.Path = t.TempDir()
+	args.NoCheck = true
+	require.Nil(t, receive(args))
+	content, err = os.ReadFile(manifestPath)
+	require.Nil(t, err)
+	assert.NotContains(string(content), `"hash"`)
+	assert.Contains(string(content), `"path": "dir/sub/b.txt",
+    "size": 11
+  },`)
+
+	// the failure to write the manifest fails the transfer
+	args.Path = t.TempDir()
+	args.Manifest = filepath.Join(t.TempDir(), "not_exists", "out.json")
+	err = receive(args)
+	require.NotNil(t, err)
+	assert.True(strings.HasPrefix(err.Error(), "Write manifest error: "))
+
+	assert.EqualError(checkStdoutArg(&TrzArgs{Stdout: true, Manifest: manifestPath}), "--stdout can't be used with --manifest")
+}
+
+// noTtyClientForTest is the client of trz or tsz with `--no-tty`, over the os pipes instead of a tty.
+type noTtyClientForTest struct {
+	client *TrzszTransfer
+	stdin  *os.File
+	stdout *os.File
+	output bytes.Buffer
+	done   chan struct{}
+}
+
+// newNoTtyClientForTest feeds the stdout of the server to the client after the magic key line.
+func newNoTtyClientForTest(t *testing.T) *noTtyClientForTest {
+	t.Helper()
+	stdinReader, stdinWriter, err := os.Pipe()
+	require.Nil(t, err)
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	require.Nil(t, err)
+	c := &noTtyClientForTest{client: NewTransfer(stdinWriter, nil, false), stdin: stdinReader, stdout: stdoutWriter,
+		done: make(chan struct{})}
+	t.Cleanup(func() {
+		stdinReader.Close()
+		stdinWriter.Close()
+		stdoutReader.Close()
+		stdoutWriter.Close()
+	})
+	go func() {
+		defer close(c.done)
+		magicDone := false
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := stdoutReader.Read(buffer)
+			if err != nil {
+				return
+			}
+			c.output.Write(buffer[:n])
+			if magicDone {
+				c.client.addReceivedData(append([]byte(nil), buffer[:n]...))
+				continue
+			}
+			if idx := bytes.Index(c.output.Bytes(), []byte("\r\n")); idx >= 0 {
+				magicDone = true
+				if data := c.output.Bytes()[idx+2:]; len(data) > 0 {
+					c.client.addReceivedData(append([]byte(nil), data...))
+				}
+			}
+		}
+	}()
+	return c
+}
+
+// wait closes the stdout of the server, and returns all the output of it.
+func (c *noTtyClientForTest) wait() string {
+	c.stdout.Close()
+	<-c.done
+	return c.output.String()
+}
+
+func TestReceiveFilesNoTty(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	c := newNoTtyClientForTest(t)
+	go func() {
+		assert.Nil(c.client.sendAction(true, false))
+		_, err := c.client.recvConfig()
+		assert.Nil(err)
+		_, err = c.client.sendFiles(files, nil)
+		assert.Nil(err)
+		assert.Nil(c.client.clientExit("Saved a.txt"))
+	}()
+
+	args := NewTrzArgs(dest)
+	args.NoTty = true
+	assert.Equal(0, runTrz(&args, c.stdin, c.stdout))
+	output := c.wait()
+	assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+	assert.True(strings.HasPrefix(output, "\x1b7\x07::TRZSZ:TRANSFER:R:"))
+	assert.Contains(output, "Received a.txt to "+dest)
+
+	// there is no terminal for --stdout to write to
+	args = NewTrzArgs(dest)
+	args.NoTty = true
+	args.Stdout = true
+	assert.Equal("--stdout can't be used with --no-tty", checkStdoutArg(&args).Error())
+}
+
+func TestNewTrzArgs(t *testing.T) {
+	assert := assert.New(t)
+	args := NewTrzArgs("dest")
+	assert.Equal("dest", args.Path)
+	assert.Equal(int64(10*1024*1024), args.Bufsize.Size)
+	assert.Equal(20, args.Timeout)
+	assert.Equal(20, args.WriteTimeout)
+	assert.Equal(64, args.MaxDepth)
+	assert.Equal(255, args.MaxName)
+
+	// the zero timeout means never timeout, the same as on the command line
+	args = TrzArgs{}
+	args.setDefaults()
+	assert.Equal(0, args.Timeout)
+	assert.Equal(0, args.WriteTimeout)
+	assert.Equal(int64(10*1024*1024), args.Bufsize.Size)
+	assert.Equal(".", args.Path)
+
+	// the path limits are the defaults if 0, and no limit if negative, on the command line too
+	assert.Equal(kDefaultMaxDepth, getPathLimit(0, kDefaultMaxDepth))
+	assert.Equal(-1, getPathLimit(-1, kDefaultMaxDepth))
+	assert.Equal(3, getPathLimit(3, kDefaultMaxDepth))
+	args = TrzArgs{}
+	args.MaxDepth = -1
+	args.setDefaults()
+	assert.Equal(-1, args.MaxDepth)
+	assert.Equal(kDefaultMaxNameLen, args.MaxName)
+}
+
+func TestReceiveOutputName(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "bbb")
+
+	for _, protocol := range []int{1, 2} {
+		files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+		require.Nil(t, err)
+		dest := t.TempDir()
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		server.outputName = "new.txt"
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{"new.txt"}, result.localNames)
+		assertFileContent(t, filepath.Join(dest, "new.txt"), "aaa")
+
+		// more than one file is refused before creating any file
+		files, err = checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+		require.Nil(t, err)
+		dest = t.TempDir()
+		client, server = newLoopbackTransfers()
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		server.outputName = "new.txt"
+		result = runTransferForTest(client, server, files, dest)
+		require.NotNil(t, result.recvErr)
+		assert.Equal("--output expects exactly one file, but got 2", result.recvErr.Error())
+		require.NotNil(t, result.sendErr)
+		assertEmptyDir(t, dest)
+	}
+}
+
+func TestCheckOutputArg(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(checkOutputArg(&TrzArgs{}))
+	assert.Nil(checkOutputArg(&TrzArgs{Output: "new.txt"}))
+	assert.EqualError(checkOutputArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Directory: true}}, Output: "new.txt"}), "--output can't be used with -d")
+	assert.EqualError(checkOutputArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Tar: true}}, Output: "new.txt"}), "--output can't be used with --tar")
+	assert.EqualError(checkOutputArg(&TrzArgs{Output: filepath.Join("dir", "new.txt")}),
+		"--output should be a file name without directories: "+filepath.Join("dir", "new.txt"))
+	assert.NotNil(checkOutputArg(&TrzArgs{Output: ".."}))
+}
+
+func TestReceiveStdout(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "bbb")
+
+	for _, protocol := range []int{1, 2} {
+		files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+		require.Nil(t, err)
+		dest := t.TempDir()
+		stdoutPath := filepath.Join(t.TempDir(), "stdout")
+		stdout, err := os.Create(stdoutPath)
+		require.Nil(t, err)
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		server.outputFile = stdout
+		result := runTransferForTest(client, server, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{"a.txt"}, result.localNames)
+		assert.Equal(int64(1), server.verifiedCount)
+		assertFileContent(t, stdoutPath, "aaa")
+		assertEmptyDir(t, dest)
+		assert.Equal("a.txt", server.GetTransferResult().Files[0].Name)
+
+		// more than one file is refused before writing any data
+		files, err = checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+		require.Nil(t, err)
+		stdout, err = os.Create(stdoutPath)
+		require.Nil(t, err)
+		client, server = newLoopbackTransfers()
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		server.outputFile = stdout
+		result = runTransferForTest(client, server, files, dest)
+		stdout.Close()
+		require.NotNil(t, result.recvErr)
+		assert.Equal("--stdout expects exactly one file, but got 2", result.recvErr.Error())
+		require.NotNil(t, result.sendErr)
+		assertFileContent(t, stdoutPath, "")
+	}
+}
+
+func TestReceiveStdoutAsLibrary(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	reader, inputWriter := io.Pipe()
+	client := NewTransfer(writerIO{inputWriter}, nil, false)
+	writer := &clientOutputWriter{client: client}
+	go func() {
+		assert.Nil(client.sendAction(true, false))
+		_, err := client.recvConfig()
+		assert.Nil(err)
+		_, err = client.sendFiles(files, nil)
+		assert.Nil(err)
+		assert.Nil(client.clientExit("Saved a.txt"))
+	}()
+
+	// the data is copied to the writer completely before returning
+	var stdout bytes.Buffer
+	result, err := ReceiveFiles(ReceiveConfig{Reader: reader, Writer: writer, Stdout: &stdout, Args: NewTrzArgs(dest)})
+	require.Nil(t, err)
+	inputWriter.Close()
+	assert.Equal("hello trzsz", stdout.String())
+	assert.Equal([]string{"a.txt"}, result.Names)
+	assertEmptyDir(t, dest)
+	assert.Contains(writer.String(), "Received a.txt to stdout")
+
+	// the writer is required by the arg
+	_, err = ReceiveFiles(ReceiveConfig{Args: TrzArgs{Stdout: true, Path: dest}})
+	assert.EqualError(err, "the Stdout writer is required for --stdout")
+}
+
+func TestCheckStdoutArg(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(checkStdoutArg(&TrzArgs{}))
+	assert.Nil(checkStdoutArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Directory: true}}}))
+	assert.Nil(checkStdoutArg(&TrzArgs{Stdout: true}))
+	assert.EqualError(checkStdoutArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Directory: true}}, Stdout: true}), "--stdout can't be used with -d")
+	assert.EqualError(checkStdoutArg(&TrzArgs{Stdout: true, Output: "new.txt"}), "--stdout can't be used with --output")
+	assert.EqualError(checkStdoutArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Resume: true}}, Stdout: true}), "--stdout can't be used with -r")
+	assert.EqualError(checkStdoutArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Parallel: 2}}, Stdout: true}), "--stdout can't be used with --parallel")
+	assert.EqualError(checkStdoutArg(&TrzArgs{Args: Args{TransferOptions: TransferOptions{Tar: true}}, Stdout: true}), "--stdout can't be used with --tar")
+	assert.EqualError(checkStdoutArg(&TrzArgs{Verify: true, Stdout: true}), "--stdout can't be used with --verify")
+}
+
+func TestReceiveMaxTotal(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, filepath.Join(src, name), strings.Repeat(name, 1000))
+		paths = append(paths, filepath.Join(src, name))
+	}
+	files, err := checkPathsReadable(paths, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Bufsize = BufferSize{1024}
+		client, server := newLoopbackTransfers()
+		handshakeForTest(t, client, server, args, protocol)
+		server.maxTotal = 12000
+		result := runTransferForTest(client, server, files, dest)
+		require.NotNil(t, result.recvErr)
+		assert.Equal("Exceeded the max total size 11.7 KB: "+filepath.Join(dest, "c.txt"), result.recvErr.Error())
+		require.NotNil(t, result.sendErr)
+
+		// the batch is rejected partway, and the oversized file is removed
+		assertFileContent(t, filepath.Join(dest, "a.txt"), strings.Repeat("a.txt", 1000))
+		assertFileContent(t, filepath.Join(dest, "b.txt"), strings.Repeat("b.txt", 1000))
+		_, err := os.Stat(filepath.Join(dest, "c.txt"))
+		assert.True(os.IsNotExist(err))
+	}
+
+	// the discarded data of the skipped files is not counted
+	dest := t.TempDir()
+	writeTestFile(t, filepath.Join(dest, "b.txt"), "existing b")
+	writeTestFile(t, filepath.Join(dest, "c.txt"), "existing c")
+	args := newDefaultArgsForTest()
+	args.OnConflict = ConflictMode{"skip"}
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 2)
+	server.maxTotal = 6000
+	result := runTransferForTest(client, server, files, dest)
+	require.Nil(t, result.recvErr)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), strings.Repeat("a.txt", 1000))
+	assertFileContent(t, filepath.Join(dest, "b.txt"), "existing b")
+	assertFileContent(t, filepath.Join(dest, "c.txt"), "existing c")
+
+	var size QuotaSize
+	assert.Nil(size.UnmarshalText([]byte("5G")))
+	assert.Equal(int64(5*1024*1024*1024), size.Size)
+}
+
+func TestReceiveMaxFile(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "small file")
+	writeTestFile(t, filepath.Join(src, "b.txt"), strings.Repeat("large file", 500))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{1, 2} {
+		dest := t.TempDir()
+		client, server := newLoopbackTransfers()
+		var mutex sync.Mutex
+		dataAfterSize := false
+		largeSize := false
+		client.writer.(*loopbackWriter).hook = func(buf []byte) []byte {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if bytes.HasPrefix(buf, []byte("#SIZE:5000")) {
+				largeSize = true
+			} else if largeSize && bytes.HasPrefix(buf, []byte("#DATA:")) {
+				dataAfterSize = true
+			}
+			return buf
+		}
+		handshakeForTest(t, client, server, newDefaultArgsForTest(), protocol)
+		server.maxFile = 1000
+		result := runTransferForTest(client, server, files, dest)
+		require.NotNil(t, result.recvErr)
+		assert.Equal("File size 4.88 KB exceeds the max file size 1000 B", result.recvErr.Error())
+		require.NotNil(t, result.sendErr)
+		assert.Equal(result.recvErr.Error(), result.sendErr.Error())
+
+		// the sender stops before streaming the data of the large file
+		mutex.Lock()
+		assert.True(largeSize)
+		assert.False(dataAfterSize)
+		mutex.Unlock()
+		assertFileContent(t, filepath.Join(dest, "a.txt"), "small file")
+		_, err := os.Stat(filepath.Join(dest, "b.txt"))
+		assert.True(os.IsNotExist(err))
+	}
+
+	// the window of files is rejected before any file is created in parallel mode
+	dest := t.TempDir()
+	args := newDefaultArgsForTest()
+	args.Parallel = 2
+	client, server := newLoopbackTransfers()
+	handshakeForTest(t, client, server, args, 3)
+	server.maxFile = 1000
+	result := runTransferForTest(client, server, files, dest)
+	require.NotNil(t, result.recvErr)
+	assert.Equal("File size 4.88 KB exceeds the max file size 1000 B", result.recvErr.Error())
+	require.NotNil(t, result.sendErr)
+	assertEmptyDir(t, dest)
+
+	// the existing file to be skipped is rejected too, instead of receiving its data to be discarded
+	dest = t.TempDir()
+	writeTestFile(t, filepath.Join(dest, "b.txt"), "existing b")
+	args = newDefaultArgsForTest()
+	args.OnConflict = ConflictMode{"skip"}
+	client, server = newLoopbackTransfers()
+	require.Nil(t, client.sendAction(true, false))
+	action, err := server.recvAction()
+	require.Nil(t, err)
+	action.SupportVerdict = false
+	require.Nil(t, server.sendConfig(&args.TransferOptions, action, getEscapeChars(false), NoTmux, -1))
+	_, err = client.recvConfig()
+	require.Nil(t, err)
+	server.maxFile = 1000
+	result = runTransferForTest(client, server, files, dest)
+	require.NotNil(t, result.recvErr)
+	assert.Equal("File size 4.88 KB exceeds the max file size 1000 B", result.recvErr.Error())
+	assertFileContent(t, filepath.Join(dest, "b.txt"), "existing b")
+
+	// each file is checked on its own, an oversized one doesn't mark the later ones
+	assert.True(server.maxFileExceeded)
+	assert.Nil(server.checkMaxFileSize(1000))
+	assert.False(server.maxFileExceeded)
+}
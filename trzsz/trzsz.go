@@ -32,8 +32,8 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -45,13 +45,21 @@ import (
 )
 
 type TrzszArgs struct {
-	Help     bool
-	Version  bool
-	Relay    bool
-	TraceLog bool
-	DragFile bool
-	Name     string
-	Args     []string
+	Help        bool
+	Version     bool
+	Relay       bool
+	TraceLog    bool
+	DragFile    bool
+	NoColor     bool
+	UnsafeLinks bool
+	Preserve    bool
+	DirMode     os.FileMode
+	PatchBase   string
+	Refresh     *time.Duration
+	SizeUnit    SizeUnit
+	Progress    ProgressMode
+	Name        string
+	Args        []string
 }
 
 var gTrzszArgs TrzszArgs
@@ -73,7 +81,10 @@ func printVersion() {
 }
 
 func printHelp() {
-	fmt.Print("usage: trzsz [-h] [-v] [-r] [-t] [-d] command line\n\n" +
+	fmt.Print("usage: trzsz [-h] [-v] [-r] [-t] [-d] [-p] [--no-color] [--unsafe-links]\n" +
+		"             [--dir-mode MODE] [--patch-base DIR] [--refresh MS]\n" +
+		"             [--size-unit UNIT] [--progress MODE]\n" +
+		"             command line\n\n" +
 		"Wrapping command line to support trzsz ( trz / tsz ).\n\n" +
 		"positional arguments:\n" +
 		"  command line       the original command line\n\n" +
@@ -82,7 +93,22 @@ func printHelp() {
 		"  -v, --version      show version number and exit\n" +
 		"  -r, --relay        run as a trzsz relay server\n" +
 		"  -t, --tracelog     eanble trace log for debugging\n" +
-		"  -d, --dragfile     enable drag file(s) to upload\n")
+		"  -d, --dragfile     enable drag file(s) to upload\n" +
+		"  -p, --preserve     apply the owner, setuid and setgid bits of the downloaded\n" +
+		"                     file(s) preserved by tsz -p\n" +
+		"  --no-color         disable the colors of the progress bar\n" +
+		"  --unsafe-links     allow the downloaded symlinks pointing to absolute paths\n" +
+		"                     or outside of the transferred directories\n" +
+		"  --dir-mode MODE    create the missing directories of the downloaded file(s)\n" +
+		"                     with MODE, e.g., 0700. (default: 0755)\n" +
+		"  --patch-base DIR   compare with the prior versions in DIR instead of the\n" +
+		"                     existing files when tsz --patch\n" +
+		"  --refresh MS       redraw the progress bar at most every MS milliseconds,\n" +
+		"                     0 means on every step. (default: 200)\n" +
+		"  --size-unit UNIT   show the size and speed in binary (KiB/MiB) or\n" +
+		"                     decimal (1000-based KB/MB) units\n" +
+		"  --progress MODE    count the bytes of each file, or the files of the batch\n" +
+		"                     in the progress bar: bytes, files or auto. (default: auto)\n")
 }
 
 func parseTrzszArgs() {
@@ -100,6 +126,56 @@ func parseTrzszArgs() {
 			gTrzszArgs.TraceLog = true
 		} else if os.Args[i] == "-d" || os.Args[i] == "--dragfile" {
 			gTrzszArgs.DragFile = true
+		} else if os.Args[i] == "-p" || os.Args[i] == "--preserve" {
+			gTrzszArgs.Preserve = true
+		} else if os.Args[i] == "--no-color" {
+			gTrzszArgs.NoColor = true
+		} else if os.Args[i] == "--unsafe-links" {
+			gTrzszArgs.UnsafeLinks = true
+		} else if os.Args[i] == "--dir-mode" && i+1 < len(os.Args) {
+			i++
+			var mode DirMode
+			if err := mode.UnmarshalText([]byte(os.Args[i])); err != nil {
+				gTrzszArgs.Help = true
+				return
+			}
+			gTrzszArgs.DirMode = mode.Mode
+		} else if os.Args[i] == "--patch-base" && i+1 < len(os.Args) {
+			i++
+			gTrzszArgs.PatchBase = os.Args[i]
+		} else if os.Args[i] == "--refresh" && i+1 < len(os.Args) {
+			i++
+			ms, err := strconv.Atoi(os.Args[i])
+			if err != nil || ms < 0 {
+				gTrzszArgs.Help = true
+				return
+			}
+			refresh := time.Duration(ms) * time.Millisecond
+			gTrzszArgs.Refresh = &refresh
+		} else if os.Args[i] == "--size-unit" && i+1 < len(os.Args) {
+			i++
+			switch os.Args[i] {
+			case "binary":
+				gTrzszArgs.SizeUnit = SizeUnitBinary
+			case "decimal":
+				gTrzszArgs.SizeUnit = SizeUnitDecimal
+			default:
+				gTrzszArgs.Help = true
+				return
+			}
+		} else if os.Args[i] == "--progress" && i+1 < len(os.Args) {
+			i++
+			switch os.Args[i] {
+			case "auto":
+				gTrzszArgs.Progress = ProgressModeAuto
+			case "bytes":
+				gTrzszArgs.Progress = ProgressModeBytes
+			case "files":
+				gTrzszArgs.Progress = ProgressModeFiles
+			default:
+				gTrzszArgs.Help = true
+				return
+			}
 		} else {
 			break
 		}
@@ -225,15 +301,31 @@ func chooseUploadPaths(directory bool) ([]string, error) {
 	return files, nil
 }
 
-func newProgressBar(pty *TrzszPty, config *TransferConfig) (*TextProgressBar, error) {
+// newProgressBar returns the summary line only with `--verbosity 1` of trz or tsz,
+// returns the json progress instead of the text progress bar if `TRZSZ_PROGRESS=json`,
+// draws the text progress bar with ascii characters if `TRZSZ_ASCII=1`,
+// and without colors if `--no-color` or `NO_COLOR` is set.
+func newProgressBar(pty *TrzszPty, config *TransferConfig) (ProgressCallback, error) {
 	if config.Quiet {
 		return nil, nil
 	}
-	columns, err := pty.GetColumns()
-	if err != nil {
-		return nil, err
+	if config.Verbosity == kVerbositySummary {
+		return NewSummaryProgress(os.Stdout), nil
+	}
+	if strings.ToLower(os.Getenv("TRZSZ_PROGRESS")) == "json" {
+		return NewJSONProgress(os.Stdout), nil
+	}
+	// fall back to the default width if the columns are unknown
+	columns, _ := pty.GetColumns()
+	bar := NewTextProgressBar(os.Stdout, columns, config.TmuxPaneColumns)
+	bar.SetASCII(os.Getenv("TRZSZ_ASCII") == "1")
+	bar.SetNoColor(gTrzszArgs.NoColor || os.Getenv("NO_COLOR") != "")
+	if gTrzszArgs.Refresh != nil {
+		bar.SetRefreshInterval(*gTrzszArgs.Refresh)
 	}
-	return NewTextProgressBar(os.Stdout, columns, config.TmuxPaneColumns), nil
+	bar.SetSizeUnit(gTrzszArgs.SizeUnit)
+	bar.SetProgressMode(gTrzszArgs.Progress)
+	return bar, nil
 }
 
 func downloadFiles(pty *TrzszPty, transfer *TrzszTransfer, remoteIsWindows bool) error {
@@ -255,13 +347,17 @@ func downloadFiles(pty *TrzszPty, transfer *TrzszTransfer, remoteIsWindows bool)
 	if err != nil {
 		return err
 	}
+	transfer.unsafeLinks = gTrzszArgs.UnsafeLinks
+	transfer.preserveOwner = gTrzszArgs.Preserve
+	transfer.dirMode = gTrzszArgs.DirMode
+	transfer.patchBase = gTrzszArgs.PatchBase
 
 	progress, err := newProgressBar(pty, config)
 	if err != nil {
 		return err
 	}
-	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		pty.OnResize(func(cols int) { progress.setTerminalColumns(cols) })
+	if bar, ok := progress.(*TextProgressBar); ok {
+		pty.OnResize(func(cols int) { bar.setTerminalColumns(cols) })
 		defer pty.OnResize(nil)
 	}
 
@@ -270,7 +366,18 @@ func downloadFiles(pty *TrzszPty, transfer *TrzszTransfer, remoteIsWindows bool)
 		return err
 	}
 
-	return transfer.clientExit(fmt.Sprintf("Saved %s to %s", strings.Join(localNames, ", "), path))
+	msg := fmt.Sprintf("Saved %s to %s", strings.Join(localNames, ", "), path)
+	if config.Stats {
+		msg += "\n" + transfer.getStatsMessage()
+	}
+	msg += "\n" + transfer.getTotalsMessage()
+	if config.KeepGoing {
+		msg += "\n" + transfer.getFailedMessage()
+	}
+	if report := transfer.GetAuditReport(); report != nil {
+		msg += "\n" + report.String()
+	}
+	return transfer.clientExit(msg)
 }
 
 func uploadFiles(pty *TrzszPty, transfer *TrzszTransfer, directory, remoteIsWindows bool) error {
@@ -281,7 +388,9 @@ func uploadFiles(pty *TrzszPty, transfer *TrzszTransfer, directory, remoteIsWind
 	if err != nil {
 		return err
 	}
-	files, err := checkPathsReadable(paths, directory)
+	// the special files are reported after the config is received, if they are not to be skipped
+	lenient := newPathFilter(nil, nil, true)
+	files, err := checkPathsReadableWith(paths, pathOptions{directory: directory, filter: lenient})
 	if err != nil {
 		return err
 	}
@@ -294,6 +403,15 @@ func uploadFiles(pty *TrzszPty, transfer *TrzszTransfer, directory, remoteIsWind
 		return err
 	}
 
+	if (directory && (!config.Links || len(config.Exclude) > 0 || len(config.Include) > 0)) ||
+		(lenient.specialCount > 0 && !config.SkipSpecial) {
+		filter := newPathFilter(config.Exclude, config.Include, config.SkipSpecial)
+		opts := pathOptions{directory: directory, followLinks: !config.Links, filter: filter}
+		if files, err = checkPathsReadableWith(paths, opts); err != nil {
+			return err
+		}
+	}
+
 	if config.Overwrite {
 		if err := checkDuplicateNames(files); err != nil {
 			return err
@@ -304,8 +422,8 @@ func uploadFiles(pty *TrzszPty, transfer *TrzszTransfer, directory, remoteIsWind
 	if err != nil {
 		return err
 	}
-	if progress != nil && !reflect.ValueOf(progress).IsNil() {
-		pty.OnResize(func(cols int) { progress.setTerminalColumns(cols) })
+	if bar, ok := progress.(*TextProgressBar); ok {
+		pty.OnResize(func(cols int) { bar.setTerminalColumns(cols) })
 		defer pty.OnResize(nil)
 	}
 
@@ -314,11 +432,22 @@ func uploadFiles(pty *TrzszPty, transfer *TrzszTransfer, directory, remoteIsWind
 		return err
 	}
 
-	return transfer.clientExit(fmt.Sprintf("Received %s", strings.Join(remoteNames, ", ")))
+	msg := fmt.Sprintf("Received %s", strings.Join(remoteNames, ", "))
+	if config.Stats {
+		msg += "\n" + transfer.getStatsMessage()
+	}
+	msg += "\n" + transfer.getTotalsMessage()
+	if config.KeepGoing {
+		msg += "\n" + transfer.getFailedMessage()
+	}
+	return transfer.clientExit(msg)
 }
 
 func handleTrzsz(pty *TrzszPty, mode byte, remoteIsWindows bool) {
 	transfer := NewTransfer(pty.Stdin, nil, IsWindows() || remoteIsWindows)
+	transfer.traceLog = gTrzszArgs.TraceLog
+	transfer.confirmOutput = os.Stdout
+	transfer.confirmInput = make(chan []byte, 1)
 
 	gTransfer.Store(transfer)
 	defer func() {
@@ -450,6 +579,9 @@ func sendInput(pty *TrzszPty, buf []byte) {
 		writeTraceLog(buf, "stdin")
 	}
 	if transfer := gTransfer.Load(); transfer != nil {
+		if transfer.addConfirmInput(buf) {
+			return
+		}
 		if buf[0] == '\x03' { // `ctrl + c` to stop transferring files
 			transfer.stopTransferringFiles()
 		}
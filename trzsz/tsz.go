@@ -27,16 +27,22 @@ package trzsz
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/alexflint/go-arg"
-	"golang.org/x/term"
 )
 
 type TszArgs struct {
 	Args
-	File []string `arg:"positional,required" help:"file(s) to be sent"`
+	Glob       bool     `arg:"-g" help:"expand wildcards in file arguments, always enabled on Windows"`
+	OnSuccess  string   `arg:"--on-success" placeholder:"CMD" help:"run CMD with the absolute paths of the sent file(s) as\narguments after success. CMD is run by sh -c, and the paths\nare appended as \"$@\" without being interpreted. it runs with\nthe same privileges as tsz, so only use trusted CMD."`
+	OnFailure  string   `arg:"--on-failure" placeholder:"CMD" help:"run CMD with the file(s) as arguments after failure, the\nsame as --on-success. the error message is passed by env\nTRZSZ_ERROR, and the count of the file(s) by TRZSZ_FILE_COUNT."`
+	Name       string   `arg:"--name" placeholder:"NAME" help:"send the data from stdin as a file named NAME, e.g.,\ncmd | tsz --name out.bin, the terminal is read for the\nresponses then. not with -d, --parallel, --preview, --update,\n--checksum, -r, --patch, --audit, --dedup, --retries,\n--check-every, --start-at or --tar"`
+	RootParent bool     `arg:"--root-parent" help:"prefix each file argument with the name of its parent directory,\ne.g., /a/src and /b/src are received as a/src and b/src. with -d"`
+	RootLabel  []string `arg:"--root-label,separate" placeholder:"LABEL" help:"prefix the file arguments with the labels in order, e.g.,\n--root-label x --root-label y /a/src /b/src are received as\nx/src and y/src. the arguments of the same label are merged. with -d"`
+	File       []string `arg:"positional" help:"file(s) to be sent"`
 }
 
 func (TszArgs) Description() string {
@@ -47,8 +53,10 @@ func (TszArgs) Version() string {
 	return fmt.Sprintf("tsz (trzsz) go %s", kTrzszVersion)
 }
 
-func sendFiles(transfer *TrzszTransfer, files []*TrzszFile, args *TszArgs, tmuxMode TmuxMode, tmuxPaneWidth int) error {
-	action, err := transfer.recvAction()
+func sendFiles(transfer *TrzszTransfer, files []*TrzszFile, args *TszArgs, tmuxMode TmuxMode, tmuxPaneWidth int, emitMagic func()) error {
+	transfer.transferConfig.Timeout = args.Timeout
+	transfer.transferConfig.HandshakeTimeout = args.getHandshakeTimeout()
+	action, err := transfer.recvActionRetry(args.HandshakeRetries, args.getRetryTimeout(), emitMagic)
 	if err != nil {
 		return err
 	}
@@ -63,13 +71,35 @@ func sendFiles(transfer *TrzszTransfer, files []*TrzszFile, args *TszArgs, tmuxM
 		args.Binary = false
 	}
 
+	// check if the client doesn't support streaming
+	if args.Stream && action.Protocol < 4 {
+		return newTrzszError("The client doesn't support streaming")
+	}
+
 	// check if the client doesn't support transfer directory
 	if args.Directory && !action.SupportDirectory {
 		return newTrzszError("The client doesn't support transfer directory")
 	}
 
+	// transfer the targets of the symlinks if the client doesn't support links
+	if args.Directory && !args.FollowSymlinks && !action.SupportLink {
+		args.FollowSymlinks = true
+		if files, err = checkSendPaths(args); err != nil {
+			return err
+		}
+	}
+
+	// check if the client doesn't support audit
+	if (args.Audit || args.AuditPull) && !action.SupportAudit {
+		return newTrzszError("The client doesn't support audit")
+	}
+
+	// the terminal output is 8-bit clean mostly, only the extra bytes are escaped if any
 	var escapeChars [][]unicode
-	if err := transfer.sendConfig(&args.Args, action, escapeChars, tmuxMode, tmuxPaneWidth); err != nil {
+	if len(args.EscapeBytes.Bytes) > 0 {
+		escapeChars = appendEscapeBytes(getEscapeChars(args.Escape), args.EscapeBytes.Bytes)
+	}
+	if err := transfer.sendConfig(&args.TransferOptions, action, escapeChars, tmuxMode, tmuxPaneWidth); err != nil {
 		return err
 	}
 
@@ -82,16 +112,174 @@ func sendFiles(transfer *TrzszTransfer, files []*TrzszFile, args *TszArgs, tmuxM
 		return err
 	}
 
+	if hookResult := runSendHook(args, nil); len(hookResult) > 0 {
+		msg += "\n" + hookResult
+	}
 	transfer.serverExit(msg)
+	if err := writeSummary(args.SummaryFile, args.SummaryFormat, transfer.GetTransferResult(), os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
 	return nil
 }
 
+// runSendHook runs the `--on-success` or `--on-failure` command with the absolute paths of the file(s)
+// as arguments, and returns the exit status for the summary. The command is quoted as in the shell, but
+// the file names are passed as separate arguments, without being interpreted, see `newHookCommand`.
+func runSendHook(args *TszArgs, sendErr error) string {
+	command := args.OnSuccess
+	if sendErr != nil {
+		command = args.OnFailure
+	}
+	if len(strings.TrimSpace(command)) == 0 {
+		return ""
+	}
+	files := make([]string, 0, len(args.File))
+	for _, file := range args.File {
+		if path, err := filepath.Abs(file); err == nil {
+			file = path
+		}
+		files = append(files, file)
+	}
+	cmd, err := newHookCommand(command, files)
+	if err != nil {
+		return fmt.Sprintf("Run %s error: %v", command, err)
+	}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("TRZSZ_FILE_COUNT=%d", len(files)))
+	if sendErr != nil {
+		cmd.Env = append(cmd.Env, "TRZSZ_STATUS=failure", "TRZSZ_ERROR="+sendErr.Error())
+	} else {
+		cmd.Env = append(cmd.Env, "TRZSZ_STATUS=success")
+	}
+	if err := cmd.Run(); err != nil && cmd.ProcessState == nil {
+		return fmt.Sprintf("Run %s error: %v", command, err)
+	}
+	return fmt.Sprintf("Run %s exit status: %d", command, cmd.ProcessState.ExitCode())
+}
+
+// checkStreamArgs checks the `--name` to send the data from stdin, which is exclusive with the file(s)
+// and the options relying on the file size.
+func checkStreamArgs(args *TszArgs) error {
+	if len(args.Name) == 0 {
+		if len(args.File) == 0 {
+			return fmt.Errorf("file(s) to be sent or --name is required")
+		}
+		return nil
+	}
+	if len(args.File) > 0 {
+		return fmt.Errorf("--name can't be used with file(s)")
+	}
+	if args.Name != filepath.Base(args.Name) || args.Name == "." || args.Name == ".." {
+		return fmt.Errorf("--name should be a file name without directories: %s", args.Name)
+	}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{
+		{args.Directory, "-d"},
+		{args.Parallel > 1, "--parallel"},
+		{args.Preview, "--preview"},
+		{args.Update, "--update"},
+		{args.Checksum, "--checksum"},
+		{args.Resume, "-r"},
+		{args.Patch, "--patch"},
+		{args.Audit || args.AuditPull, "--audit"},
+		{args.Dedup, "--dedup"},
+		{args.ChunkRetries > 0, "--retries"},
+		{args.CheckEvery.Size > 0, "--check-every"},
+		{args.StartAt > 0, "--start-at"},
+		{args.Tar, "--tar"},
+		{args.NoTty, "--no-tty"},
+	} {
+		if opt.set {
+			return fmt.Errorf("--name can't be used with %s", opt.name)
+		}
+	}
+	args.Stream = true
+	return nil
+}
+
+// checkSendPaths checks the file(s) to be sent, and prefixes them with the labels of `--root-parent` or `--root-label`.
+func checkSendPaths(args *TszArgs) ([]*TrzszFile, error) {
+	labels, err := getRootLabels(args)
+	if err != nil {
+		return nil, err
+	}
+	files, err := checkPathsReadableWith(args.File, pathOptions{directory: args.Directory, followLinks: args.FollowSymlinks,
+		filter: newPathFilter(args.Exclude, args.Include, args.SkipSpecial)})
+	if err != nil || labels == nil {
+		return files, err
+	}
+	if err := prefixRootNames(files, labels); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// getRootLabels returns the label of each file argument, which is the name of its parent directory
+// with `--root-parent`, or the `--root-label` in order. It returns nil if the file(s) are not prefixed.
+func getRootLabels(args *TszArgs) ([]string, error) {
+	if !args.RootParent && len(args.RootLabel) == 0 {
+		return nil, nil
+	}
+	if args.RootParent && len(args.RootLabel) > 0 {
+		return nil, fmt.Errorf("--root-parent can't be used with --root-label")
+	}
+	if !args.Directory {
+		return nil, fmt.Errorf("--root-parent and --root-label require -d")
+	}
+	if len(args.RootLabel) > 0 {
+		if len(args.RootLabel) != len(args.File) {
+			return nil, fmt.Errorf("--root-label is given %d times for %d file(s)", len(args.RootLabel), len(args.File))
+		}
+		return args.RootLabel, nil
+	}
+	labels := make([]string, len(args.File))
+	for i, p := range args.File {
+		path, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		parent := filepath.Dir(path)
+		if filepath.Dir(parent) == parent {
+			return nil, fmt.Errorf("no parent directory name of %s", path)
+		}
+		labels[i] = filepath.Base(parent)
+	}
+	return labels, nil
+}
+
 // TszMain entry of send files to client
 func TszMain() int {
 	var args TszArgs
 	arg.MustParse(&args)
+	return runTsz(&args, os.Stdin, os.Stdout)
+}
 
-	files, err := checkPathsReadable(args.File, args.Directory)
+// runTsz sends the files by the stdin and stdout, which are a plain pipe or socket with --no-tty.
+func runTsz(args *TszArgs, stdin, stdout *os.File) int {
+	if err := checkStreamArgs(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
+	if err := checkTarArg(&args.TransferOptions); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
+	if err := checkAtomicArg(&args.TransferOptions); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
+
+	if args.Glob || IsWindows() {
+		paths, err := expandGlobPaths(args.File)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return -1
+		}
+		args.File = paths
+	}
+
+	files, err := checkSendPaths(args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return -1
@@ -103,62 +291,63 @@ func TszMain() int {
 		}
 	}
 
-	tmuxMode, realStdout, tmuxPaneWidth, err := checkTmux()
+	input := stdin
+	if args.Stream {
+		files = append(files, newStreamFile(args.Name, stdin))
+		if input, err = openTerminalInput(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return -1
+		}
+		defer input.Close()
+	}
+
+	terminal, err := newServerTerminal(args.NoTty, stdout)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return -3
 	}
 
-	if args.Binary && tmuxMode == TmuxControlMode {
-		os.Stdout.WriteString("Binary download in tmux control mode is slower, auto switch to base64 mode.\n")
+	if args.Binary && terminal.tmuxMode == TmuxControlMode {
+		stdout.WriteString("Binary download in tmux control mode is slower, auto switch to base64 mode.\n")
 		args.Binary = false
 	}
 	if args.Binary && IsWindows() {
-		os.Stdout.WriteString("Binary download on Windows is not supported, auto switch to base64 mode.\n")
+		stdout.WriteString("Binary download on Windows is not supported, auto switch to base64 mode.\n")
 		args.Binary = false
 	}
 
-	uniqueID := strconv.FormatInt(time.Now().UnixMilli()%10e10, 10)
-	if IsWindows() {
-		if inMode, outMode, err := enableVirtualTerminal(); err == nil {
-			defer resetVirtualTerminal(inMode, outMode)
-		}
-		setupConsoleOutput()
-		uniqueID += "10"
-	} else if tmuxMode == TmuxNormalMode {
-		columns := getTerminalColumns()
-		if columns > 0 && columns < 40 {
-			os.Stdout.WriteString("\n\n\x1b[2A\x1b[0J")
-		} else {
-			os.Stdout.WriteString("\n\x1b[1A\x1b[0J")
-		}
-		uniqueID += "20"
-	} else {
-		uniqueID += "00"
-	}
+	terminal.setup(stdout, true)
+	defer terminal.reset()
 
-	os.Stdout.WriteString(fmt.Sprintf("\x1b7\x07::TRZSZ:TRANSFER:S:%s:%s\r\n", kTrzszVersion, uniqueID))
-	os.Stdout.Sync()
+	// the re-emitted handshake keeps the same unique id, so the client knows it's the same transfer
+	uniqueID := strconv.FormatInt(timeNowFunc().UnixMilli()%10e10, 10) + terminal.uniqueSuffix
+	emitMagic := func() {
+		stdout.WriteString(fmt.Sprintf("\x1b7\x07::TRZSZ:TRANSFER:S:%s:%s\r\n", kTrzszVersion, uniqueID))
+		stdout.Sync()
+	}
+	emitMagic()
 
-	state, err := term.MakeRaw(int(os.Stdin.Fd()))
-	if err != nil {
+	if err := terminal.makeRaw(input); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return -4
 	}
-	defer func() { _ = term.Restore(int(os.Stdin.Fd()), state) }()
 
-	transfer := NewTransfer(realStdout, state, false)
+	transfer := NewTransfer(terminal.realStdout, terminal.state, false)
+	transfer.exitOutput = stdout
 	defer func() {
 		if err := recover(); err != nil {
 			transfer.serverError(NewTrzszError(fmt.Sprintf("%v", err), "panic", true))
 		}
 	}()
 
-	go wrapStdinInput(transfer)
+	go wrapTransferInput(transfer, input)
 	handleServerSignal(transfer)
 
-	if err := sendFiles(transfer, files, &args, tmuxMode, tmuxPaneWidth); err != nil {
+	if err := sendFiles(transfer, files, args, terminal.tmuxMode, terminal.tmuxPaneWidth, emitMagic); err != nil {
 		transfer.serverError(err)
+		if hookResult := runSendHook(args, err); len(hookResult) > 0 {
+			stdout.WriteString(hookResult + "\r\n")
+		}
 	}
 
 	return 0
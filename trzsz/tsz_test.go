@@ -0,0 +1,196 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeHookScript(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script is not supported on Windows")
+	}
+	script := filepath.Join(dir, "hook.sh")
+	output := filepath.Join(dir, "hook.out")
+	writeTestFile(t, script, "#!/bin/sh\nprintf '%s\\n' \"$TRZSZ_STATUS|$TRZSZ_ERROR|$TRZSZ_FILE_COUNT\" \"$@\" > "+output+"\nexit 3\n")
+	require.Nil(t, os.Chmod(script, 0755))
+	return script, output
+}
+
+func TestSendHookOnSuccess(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	script, output := writeHookScript(t, t.TempDir())
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	writeTestFile(t, filepath.Join(src, "b c.txt"), "hello world")
+	args := &TszArgs{Args: *newDefaultArgsForTest(), OnSuccess: "'" + script + "' --sent 'x y'",
+		File: []string{filepath.Join(src, "a.txt"), filepath.Join(src, "b c.txt")}}
+	files, err := checkPathsReadable(args.File, false)
+	require.Nil(t, err)
+
+	client, server := newLoopbackTransfers()
+	go func() {
+		require.Nil(t, client.sendAction(true, false))
+		_, err := client.recvConfig()
+		require.Nil(t, err)
+		_, err = client.recvFiles(dest, nil)
+		require.Nil(t, err)
+		require.Nil(t, client.clientExit("Received a.txt, b c.txt"))
+	}()
+	stdout := captureStdout(t, func() {
+		assert.Nil(sendFiles(server, files, args, NoTmux, -1, nil))
+	})
+	assert.Contains(stdout, "Received a.txt, b c.txt\nRun "+args.OnSuccess+" exit status: 3")
+
+	content, err := os.ReadFile(output)
+	assert.Nil(err)
+	assert.Equal("success||2\n--sent\nx y\n"+args.File[0]+"\n"+args.File[1]+"\n", string(content))
+}
+
+func TestSendHookOnFailure(t *testing.T) {
+	assert := assert.New(t)
+	script, output := writeHookScript(t, t.TempDir())
+	args := &TszArgs{OnSuccess: "/not/exists", OnFailure: script, File: []string{"a.txt", "$(id)"}}
+	cwd, err := os.Getwd()
+	require.Nil(t, err)
+
+	assert.Equal("Run "+script+" exit status: 3", runSendHook(args, newTrzszError("Stopped")))
+	content, err := os.ReadFile(output)
+	assert.Nil(err)
+	assert.Equal("failure|Stopped|2\n"+filepath.Join(cwd, "a.txt")+"\n"+filepath.Join(cwd, "$(id)")+"\n", string(content))
+
+	assert.Equal("Run /not/exists exit status: 127", runSendHook(args, nil))
+	args.OnSuccess = ""
+	assert.Equal("", runSendHook(args, nil))
+}
+
+func TestSendFilesNoTty(t *testing.T) {
+	assert := assert.New(t)
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello trzsz")
+	writeTestFile(t, filepath.Join(src, "b.bin"), string([]byte{0, 1, 2, 0xee, 0x7e, 0x1b, 0x03}))
+
+	c := newNoTtyClientForTest(t)
+	var localNames []string
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		assert.Nil(c.client.sendAction(true, false))
+		_, err := c.client.recvConfig()
+		assert.Nil(err)
+		localNames, err = c.client.recvFiles(dest, nil)
+		assert.Nil(err)
+		assert.Nil(c.client.clientExit("Saved 2 files"))
+	}()
+
+	args := TszArgs{Args: Args{TransferOptions: NewTransferOptions(), NoTty: true},
+		File: []string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.bin")}}
+	assert.Equal(0, runTsz(&args, c.stdin, c.stdout))
+	output := c.wait()
+	<-recvDone
+	assert.Equal([]string{"a.txt", "b.bin"}, localNames)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), "hello trzsz")
+	assertFileContent(t, filepath.Join(dest, "b.bin"), string([]byte{0, 1, 2, 0xee, 0x7e, 0x1b, 0x03}))
+	assert.True(strings.HasPrefix(output, "\x1b7\x07::TRZSZ:TRANSFER:S:"))
+	assert.Contains(output, "Saved 2 files")
+
+	// the terminal is required to read the responses while sending stdin
+	args = TszArgs{Args: Args{NoTty: true}, Name: "out.bin"}
+	assert.Equal("--name can't be used with --no-tty", checkStreamArgs(&args).Error())
+}
+
+func TestSendRootLabels(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a", "src", "x.txt"), "a x")
+	writeTestFile(t, filepath.Join(src, "b", "src", "x.txt"), "b x")
+	writeTestFile(t, filepath.Join(src, "b", "lib", "y.txt"), "b y")
+	newArgs := func(files ...string) *TszArgs {
+		args := &TszArgs{Args: *newDefaultArgsForTest()}
+		args.Directory = true
+		for _, f := range files {
+			args.File = append(args.File, filepath.Join(src, f))
+		}
+		return args
+	}
+
+	// the same basenames are received in the directories of their parents
+	for _, mode := range []string{"sequential", "parallel", "tar"} {
+		args := newArgs("a/src", "b/src")
+		args.RootParent = true
+		args.Parallel = map[string]int{"parallel": 2}[mode]
+		args.Tar = mode == "tar"
+		files, err := checkSendPaths(args)
+		require.Nil(t, err)
+		dest := t.TempDir()
+		result := transferFilesForTest(t, &args.Args, kProtocolVersion, files, dest)
+		require.Nil(t, result.sendErr, mode)
+		require.Nil(t, result.recvErr, mode)
+		assert.Equal([]string{"a", "b"}, result.localNames, mode)
+		assertFileContent(t, filepath.Join(dest, "a", "src", "x.txt"), "a x")
+		assertFileContent(t, filepath.Join(dest, "b", "src", "x.txt"), "b x")
+	}
+
+	// the arguments of the same label are merged, and the label is renamed once
+	args := newArgs("a/src", "b/lib")
+	args.RootLabel = []string{"x", "x"}
+	dest := t.TempDir()
+	for _, expected := range []string{"x", "x.0"} {
+		files, err := checkSendPaths(args)
+		require.Nil(t, err)
+		result := transferFilesForTest(t, &args.Args, 2, files, dest)
+		require.Nil(t, result.recvErr)
+		assert.Equal([]string{expected}, result.localNames)
+		assertFileContent(t, filepath.Join(dest, expected, "src", "x.txt"), "a x")
+		assertFileContent(t, filepath.Join(dest, expected, "lib", "y.txt"), "b y")
+	}
+
+	args = newArgs("a/src", "b/src")
+	args.RootLabel = []string{"x", "x"}
+	_, err := checkSendPaths(args)
+	assert.EqualError(err, "Duplicate name: x/src")
+	args.RootLabel = []string{"x", "../y"}
+	_, err = checkSendPaths(args)
+	assert.EqualError(err, "Invalid label: ../y")
+	args.RootLabel = []string{"x"}
+	_, err = checkSendPaths(args)
+	assert.EqualError(err, "--root-label is given 1 times for 2 file(s)")
+	args.RootParent = true
+	_, err = checkSendPaths(args)
+	assert.EqualError(err, "--root-parent can't be used with --root-label")
+	args = newArgs("a/src")
+	args.RootParent = true
+	args.Directory = false
+	_, err = checkSendPaths(args)
+	assert.EqualError(err, "--root-parent and --root-label require -d")
+}
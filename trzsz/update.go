@@ -0,0 +1,127 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// sendFileModTime sends the modification time before the name in update mode to the peer without the verdict,
+// it's included in the name otherwise, see hasModTimeInName.
+func (t *TrzszTransfer) sendFileModTime(f *TrzszFile) error {
+	if err := t.sendInteger("MTIME", f.ModTime); err != nil {
+		return err
+	}
+	return t.checkInteger(f.ModTime)
+}
+
+func (t *TrzszTransfer) recvFileModTime() (int64, error) {
+	modTime, err := t.recvInteger("MTIME", false, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.sendInteger("SUCC", modTime); err != nil {
+		return 0, err
+	}
+	return modTime, nil
+}
+
+// hasModTimeInName returns true if the name is sent as the json of the file in update mode, as in directory mode,
+// so that the modification time in nanoseconds is carried without another round trip.
+func (t *TrzszTransfer) hasModTimeInName() bool {
+	return t.transferConfig.Update && t.transferConfig.Verdict && !t.transferConfig.Directory
+}
+
+// parseModTimeName returns the name of the file sent by hasModTimeInName, and keeps its modification time.
+func (t *TrzszTransfer) parseModTimeName(name string) (string, error) {
+	var f TrzszFile
+	if err := json.Unmarshal([]byte(name), &f); err != nil {
+		return "", err
+	}
+	if len(f.RelPath) != 1 {
+		return "", newTrzszError(fmt.Sprintf("Invalid name: %s", name))
+	}
+	t.sourceModTime, t.sourceModTimeNs = f.ModTime, f.ModTimeNano
+	return f.RelPath[0], nil
+}
+
+// skipsByVerdict returns true if the existing files are skipped before the data in skip mode of `--on-conflict`,
+// when the client knows it. The tar stream is always received.
+func (t *TrzszTransfer) skipsByVerdict() bool {
+	c := &t.transferConfig
+	return c.Verdict && c.OverwriteMode == "skip" && !c.Overwrite && !t.useTar()
+}
+
+// hasFileVerdict returns true if the receiver tells whether it wants the file data before the size,
+// in update mode or if skipsByVerdict.
+func (t *TrzszTransfer) hasFileVerdict() bool {
+	return t.transferConfig.Update || t.skipsByVerdict()
+}
+
+// verdictType returns the line type of the verdict, the peer without the verdict support takes it as `SUCC`.
+func (t *TrzszTransfer) verdictType() string {
+	if t.transferConfig.Verdict {
+		return "VERDICT"
+	}
+	return "SUCC"
+}
+
+// recvFileSkipped returns true if the receiver skips the file, then the file is done without the data.
+func (t *TrzszTransfer) recvFileSkipped(f *TrzszFile, beginTime time.Time, progress ProgressCallback) (bool, error) {
+	if !t.hasFileVerdict() {
+		return false, nil
+	}
+	send, err := t.recvFileVerdict()
+	if err != nil || send {
+		return false, err
+	}
+	t.addSkippedResult(strings.Join(f.RelPath, "/"), beginTime, timeNowFunc())
+	if progress != nil && !reflect.ValueOf(progress).IsNil() {
+		progress.OnDone()
+	}
+	return true, nil
+}
+
+// recvFileVerdict returns whether the receiver wants the file data.
+func (t *TrzszTransfer) recvFileVerdict() (bool, error) {
+	verdict, err := t.recvString(t.verdictType(), false)
+	if err != nil {
+		return false, err
+	}
+	return verdict != "skip", nil
+}
+
+// sendFileVerdict tells the sender to skip the file, e.g., the local one is newer or equal in update mode.
+func (t *TrzszTransfer) sendFileVerdict(skip bool) error {
+	verdict := "send"
+	if skip {
+		verdict = "skip"
+	}
+	return t.sendString(t.verdictType(), verdict)
+}
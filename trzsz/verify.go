@@ -0,0 +1,93 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// diskDigest is the digest of a received file, which is verified again on disk after the transfer.
+type diskDigest struct {
+	path   string
+	digest []byte
+}
+
+// addDiskDigest records the digest of the file verified on receiving, if verifying on disk is enabled.
+// The data written to stdout can't be read back, and the files in a tar stream have no digest of their own.
+func (t *TrzszTransfer) addDiskDigest(localPath string, digest []byte) {
+	if t.verifyDisk && t.outputFile == nil {
+		t.diskDigests = append(t.diskDigests, &diskDigest{localPath, digest})
+	}
+}
+
+// verifyDiskFiles re-reads the received files from disk and hashes them again, to catch the corruption
+// after they are verified on receiving, e.g., by the disk or the file system. The corrupted files are
+// reported in the transfer result, and the returned `ErrChecksum` error, after all the files are verified.
+func (t *TrzszTransfer) verifyDiskFiles(path string) error {
+	for _, d := range t.diskDigests {
+		if err := t.verifyDiskFile(d); err != nil {
+			t.logger.Warnf("verify file %s on disk: %v", d.path, err)
+			t.transferResult.Corrupted = append(t.transferResult.Corrupted, localRelPath(path, d.path))
+		}
+	}
+	t.transferResult.Verified = len(t.diskDigests)
+	t.diskDigests = nil
+	if len(t.transferResult.Corrupted) > 0 {
+		return newTrzszErrorCode(ErrChecksum, t.getVerifyMessage())
+	}
+	return nil
+}
+
+func (t *TrzszTransfer) verifyDiskFile(d *diskDigest) error {
+	file, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hasher, err := hashNew(t.transferConfig.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, file); err != nil {
+		return err
+	}
+	if !bytes.Equal(hasher.Sum(nil), d.digest) {
+		return newTrzszErrorCode(ErrChecksum, fmt.Sprintf("Check %s failed", t.getHashName()))
+	}
+	return nil
+}
+
+func (t *TrzszTransfer) getVerifyMessage() string {
+	result := t.transferResult
+	if len(result.Corrupted) == 0 {
+		return fmt.Sprintf("Verified %d file(s) on disk", result.Verified)
+	}
+	return fmt.Sprintf("Verified %d file(s) on disk, %d corrupted: %s", result.Verified,
+		len(result.Corrupted), strings.Join(result.Corrupted, ", "))
+}
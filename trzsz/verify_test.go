@@ -0,0 +1,117 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fileCorrupter corrupts the received file by its base name once it's done, as the disk would do.
+type fileCorrupter struct {
+	*JSONProgress
+	t    *testing.T
+	name string
+}
+
+func (c *fileCorrupter) OnFileDone(localName string, size int64) {
+	if filepath.Base(localName) == c.name {
+		require.Nil(c.t, os.WriteFile(localName, []byte("corrupted"), 0644))
+	}
+}
+
+func TestVerifyDisk(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "dir", "b.txt"), "hello trzsz")
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	verifyDisk := func(protocol int, parallel int, verify bool, skip int) *TransferResult {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Parallel = parallel
+		args.Hash = HashName{"sha256"}
+		args.VerifySample = SampleRate{Skip: skip}
+		client, server := newLoopbackTransfers()
+		server.verifyDisk = verify
+		handshakeForTest(t, client, server, args, protocol)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := client.sendFiles(files, nil)
+			assert.Nil(err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := server.recvFiles(dest, &fileCorrupter{NewJSONProgress(io.Discard), t, "b.txt"})
+			// the corrupted file fails the transfer after all the files are verified
+			if verify && skip == 0 {
+				if assert.NotNil(err) {
+					assert.Equal(ErrChecksum, err.(*TrzszError).Code())
+					assert.Equal("Verified 2 file(s) on disk, 1 corrupted: dir/b.txt", err.Error())
+				}
+			} else {
+				assert.Nil(err)
+			}
+		}()
+		wg.Wait()
+		assertFileContent(t, filepath.Join(dest, "dir", "a.txt"), "hello")
+		return server.GetTransferResult()
+	}
+
+	for _, c := range []struct{ protocol, parallel int }{{1, 1}, {2, 1}, {3, 4}} {
+		result := verifyDisk(c.protocol, c.parallel, true, 0)
+		assert.Equal(2, result.Verified)
+		assert.Equal([]string{"dir/b.txt"}, result.Corrupted)
+
+		// not verified on receiving, nothing to verify on disk
+		result = verifyDisk(c.protocol, c.parallel, true, 100)
+		assert.Equal(0, result.Verified)
+		assert.Nil(result.Corrupted)
+
+		result = verifyDisk(c.protocol, c.parallel, false, 0)
+		assert.Equal(0, result.Verified)
+		assert.Nil(result.Corrupted)
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	assert := assert.New(t)
+	transfer := NewTransfer(nil, nil, false)
+	transfer.transferResult = &TransferResult{Verified: 3}
+	assert.Equal("Verified 3 file(s) on disk", transfer.getVerifyMessage())
+	transfer.transferResult.Corrupted = []string{"a.txt", "dir/b.txt"}
+	assert.Equal("Verified 3 file(s) on disk, 2 corrupted: a.txt, dir/b.txt", transfer.getVerifyMessage())
+}
@@ -0,0 +1,224 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// kMaxAckWindow limits the chunks in flight, both sides clamp the negotiated window by it.
+const kMaxAckWindow = 256
+
+// getAckWindow returns the max chunks in flight before waiting for the acks, or 1 if not windowed.
+// It's only used by the V2 pipeline, the V1 data path ignores the window.
+func (t *TrzszTransfer) getAckWindow() int {
+	if t.transferConfig.AckWindow <= 1 {
+		return 1
+	}
+	return minInt(t.transferConfig.AckWindow, kMaxAckWindow)
+}
+
+// rangeAck batches the acks of the received chunks in the windowed-ack mode.
+type rangeAck struct {
+	maxCount int
+	maxBytes int64
+	count    int
+	length   int64
+}
+
+// newRangeAck acks once half of the window, or half of the max buffer size, is pending. So there are
+// always some acks on the way when the sender is blocked by the window, and it never waits forever.
+func (t *TrzszTransfer) newRangeAck() *rangeAck {
+	return &rangeAck{maxCount: (t.getAckWindow() + 1) / 2, maxBytes: t.transferConfig.MaxBufSize / 2}
+}
+
+// pipelineSendRangeAck acks the pending chunks as `#SUCC:length/step/count`, where the length is the total
+// length of them. The finish flag, which is an empty chunk, is always acked at once.
+func (t *TrzszTransfer) pipelineSendRangeAck(a *rangeAck, length int) error {
+	a.count++
+	a.length += int64(length)
+	if length > 0 && a.count < a.maxCount && a.length < a.maxBytes {
+		return nil
+	}
+	step := t.savedSteps.Load()
+	ack := fmt.Sprintf("#SUCC:%d/%d/%d%s", a.length, step, a.count, t.transferConfig.Newline)
+	a.count = 0
+	a.length = 0
+	return t.writeAll([]byte(ack))
+}
+
+// windowChunk is a chunk sent but not acked yet.
+type windowChunk struct {
+	length    int64
+	beginTime time.Time
+}
+
+// sendWindow tracks the chunks in flight. The count is limited by the capacity of the channel,
+// and the bytes are limited by the max buffer size, the writer waits on released for them.
+type sendWindow struct {
+	inflight chan windowChunk
+	bytes    atomic.Int64
+	maxBytes int64
+	released chan struct{}
+}
+
+func (w *sendWindow) release(length int64) {
+	w.bytes.Add(-length)
+	select {
+	case w.released <- struct{}{}:
+	default:
+	}
+}
+
+// pipelineSendWindowData sends the chunks without waiting for the ack of each one, the receiver acks
+// them in ranges. The chunk being checked is out of the channel, so the capacity is one less than the window.
+func (t *TrzszTransfer) pipelineSendWindowData(ctx *PipelineContext, size int64, sendDataChan <-chan TrzszData, showProgress bool) <-chan int64 {
+	var progressChan chan int64
+	if showProgress {
+		progressChan = make(chan int64, 100)
+	}
+	window := &sendWindow{
+		inflight: make(chan windowChunk, t.getAckWindow()-1),
+		maxBytes: t.transferConfig.MaxBufSize,
+		released: make(chan struct{}, 1),
+	}
+	go t.pipelineRecvRangeAcks(ctx, size, window, progressChan)
+	go func() {
+		defer close(window.inflight)
+		limiter := t.newRateLimiter()
+		for data := range sendDataChan {
+			t.waitIfPaused(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			beginTime := time.Now()
+			for window.maxBytes > 0 && window.bytes.Load() >= window.maxBytes {
+				select {
+				case <-window.released:
+				case <-ctx.Done():
+					return
+				}
+			}
+			chunk := windowChunk{int64(data.length), time.Now()}
+			window.bytes.Add(chunk.length)
+			select {
+			case window.inflight <- chunk:
+			case <-ctx.Done():
+				return
+			}
+			if err := t.writeAll(data.buffer); err != nil {
+				ctx.cancel(err)
+				return
+			}
+			if limiter != nil {
+				if sleepContext(ctx, limiter.onChunk(int64(len(data.buffer)), time.Now().Sub(beginTime))) != nil {
+					return
+				}
+			}
+		}
+		if ctx.Err() == nil && ctx.truncated != "" {
+			ctx.cancel(t.sendTruncated(ctx.truncated))
+		}
+	}()
+	return progressChan
+}
+
+// pipelineRecvRangeAcks checks the acks of the chunks in flight, and releases them from the window.
+// The acks of the receivers which ack the chunks one by one are accepted as ranges of one chunk.
+func (t *TrzszTransfer) pipelineRecvRangeAcks(ctx *PipelineContext, size int64, window *sendWindow, progressChan chan<- int64) {
+	if progressChan != nil {
+		defer close(progressChan)
+	}
+	var throttle *adaptiveThrottle
+	if t.transferConfig.Adaptive {
+		throttle = &adaptiveThrottle{}
+	}
+	policy := t.getBufferPolicy()
+	var count int
+	var acked, length, step int64
+	var firstChunk windowChunk
+	for {
+		var chunk windowChunk
+		var ok bool
+		select {
+		case chunk, ok = <-window.inflight:
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			break
+		}
+		if count == 0 {
+			var err error
+			acked, step, count, err = t.pipelineRecvCurrentAck()
+			if err != nil {
+				ctx.cancel(err)
+				return
+			}
+			length = 0
+			firstChunk = chunk
+		}
+		length += chunk.length
+		count--
+		if count > 0 {
+			continue
+		}
+		if length != acked {
+			ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("SendData length check [%d] <> [%d]", acked, length)))
+			return
+		}
+		window.release(length)
+
+		if progressChan != nil {
+			select {
+			case progressChan <- step:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		now := time.Now()
+		chunkTime := now.Sub(chunk.beginTime)
+		if len(t.transferConfig.ChunkSizes) == 0 {
+			t.bufferSize.Store(policy.nextSize(t.bufferSize.Load(), chunk.length, chunkTime))
+		}
+		t.updateMaxChunkTime(chunkTime)
+		if throttle != nil {
+			if sleepContext(ctx, throttle.onChunk(length, now.Sub(firstChunk.beginTime))) != nil {
+				return
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if count > 0 {
+		ctx.cancel(newTrzszErrorCode(ErrChecksum, fmt.Sprintf("RecvRangeAck acked %d chunk(s) more than sent", count)))
+		return
+	}
+	t.pipelineRecvFinalAck(ctx, size, progressChan)
+}
@@ -0,0 +1,227 @@
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newWindowTransfersForTest creates a client and a server with the fixed chunk size, so that there are
+// enough chunks in flight, and counts the data chunks sent by the client and the acks sent by the server.
+func newWindowTransfersForTest(chunkSize int64, dataCount, ackCount *atomic.Int32) (*TrzszTransfer, *TrzszTransfer) {
+	policy := BufferPolicy{InitialSize: chunkSize, MaxSize: chunkSize}
+	client := NewTransfer(nil, nil, false, WithBufferPolicy(policy))
+	server := NewTransfer(nil, nil, false, WithBufferPolicy(policy))
+	client.writer = &loopbackWriter{peer: server, hook: func(buf []byte) []byte {
+		dataCount.Add(int32(bytes.Count(buf, []byte("#DATA:"))))
+		return buf
+	}}
+	server.writer = &loopbackWriter{peer: client, hook: func(buf []byte) []byte {
+		ackCount.Add(int32(bytes.Count(buf, []byte("#SUCC:"))))
+		return buf
+	}}
+	return client, server
+}
+
+func TestAckWindow(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("ack window\n", 20000)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	for _, protocol := range []int{2, 3, 4} {
+		for _, binary := range []bool{false, true} {
+			dest := t.TempDir()
+			args := newDefaultArgsForTest()
+			args.Binary = binary
+			args.NoCompress = true
+			args.Bufsize = BufferSize{64 * 1024}
+			args.AckWindow = 8
+			var dataCount, ackCount atomic.Int32
+			client, server := newWindowTransfersForTest(4096, &dataCount, &ackCount)
+			handshakeForTest(t, client, server, args, protocol)
+			assert.Equal(8, client.transferConfig.AckWindow)
+			result := runTransferForTest(client, server, files, dest)
+			require.Nil(t, result.sendErr)
+			require.Nil(t, result.recvErr)
+			assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+			// the chunks are acked in ranges of 4, besides the acks of the name, size and hash
+			assert.Greater(dataCount.Load(), int32(50))
+			assert.Less(ackCount.Load(), dataCount.Load()/2)
+		}
+	}
+}
+
+func TestAckWindowNegotiation(t *testing.T) {
+	assert := assert.New(t)
+	src := t.TempDir()
+	content := strings.Repeat("stop and wait\n", 10000)
+	writeTestFile(t, filepath.Join(src, "a.txt"), content)
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	require.Nil(t, err)
+
+	args := newDefaultArgsForTest()
+	args.NoCompress = true
+	args.AckWindow = 8
+
+	// the peers without the support keep stop-and-wait
+	var dataCount, ackCount atomic.Int32
+	client, server := newWindowTransfersForTest(4096, &dataCount, &ackCount)
+	require.Nil(t, client.sendAction(true, false))
+	action, err := server.recvAction()
+	require.Nil(t, err)
+	action.SupportAckWindow = false
+	require.Nil(t, server.sendConfig(&args.TransferOptions, action, nil, NoTmux, -1))
+	_, err = client.recvConfig()
+	require.Nil(t, err)
+	assert.Equal(0, client.transferConfig.AckWindow)
+	assert.Equal(1, client.getAckWindow())
+	dest := t.TempDir()
+	result := runTransferForTest(client, server, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+	assert.GreaterOrEqual(ackCount.Load(), dataCount.Load())
+
+	// the window is negotiated with the protocol 2 peers supporting it, and ignored by the V1 data path
+	client, server = newWindowTransfersForTest(4096, &dataCount, &ackCount)
+	handshakeForTest(t, client, server, args, 2)
+	assert.Equal(8, client.transferConfig.AckWindow)
+	client, server = newWindowTransfersForTest(4096, &dataCount, &ackCount)
+	handshakeForTest(t, client, server, args, 1)
+	assert.Equal(0, client.transferConfig.AckWindow)
+
+	// the acks of a receiver which acks the chunks one by one are accepted by a windowed sender
+	client, server = newWindowTransfersForTest(4096, &dataCount, &ackCount)
+	handshakeForTest(t, client, server, args, 3)
+	server.transferConfig.AckWindow = 0
+	dest = t.TempDir()
+	result = runTransferForTest(client, server, files, dest)
+	require.Nil(t, result.sendErr)
+	require.Nil(t, result.recvErr)
+	assertFileContent(t, filepath.Join(dest, "a.txt"), content)
+
+	// the window is clamped
+	client.transferConfig.AckWindow = 100000
+	assert.Equal(kMaxAckWindow, client.getAckWindow())
+}
+
+// latencyWriter delivers the data to the peer after the latency in order, like a high-latency link.
+type latencyWriter struct {
+	peer    *TrzszTransfer
+	latency time.Duration
+	queue   chan latencyData
+}
+
+type latencyData struct {
+	due time.Time
+	buf []byte
+}
+
+func newLatencyWriter(peer *TrzszTransfer, latency time.Duration) *latencyWriter {
+	w := &latencyWriter{peer: peer, latency: latency, queue: make(chan latencyData, 10000)}
+	go func() {
+		for data := range w.queue {
+			time.Sleep(time.Until(data.due))
+			w.peer.addReceivedData(data.buf)
+		}
+	}()
+	return w
+}
+
+func (w *latencyWriter) Read(b []byte) (int, error) {
+	return 0, nil
+}
+
+func (w *latencyWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	w.queue <- latencyData{time.Now().Add(w.latency), buf}
+	return len(p), nil
+}
+
+func (w *latencyWriter) Close() error {
+	close(w.queue)
+	return nil
+}
+
+func BenchmarkAckWindow(b *testing.B) {
+	src := b.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte(strings.Repeat("ack window\n", 100000)), 0644); err != nil {
+		b.Fatal(err)
+	}
+	files, err := checkPathsReadable([]string{filepath.Join(src, "a.txt")}, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, window := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("window-%d", window), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				policy := BufferPolicy{InitialSize: 16 * 1024, MaxSize: 16 * 1024}
+				client := NewTransfer(nil, nil, false, WithBufferPolicy(policy))
+				server := NewTransfer(nil, nil, false, WithBufferPolicy(policy))
+				clientWriter := newLatencyWriter(server, 5*time.Millisecond)
+				serverWriter := newLatencyWriter(client, 5*time.Millisecond)
+				client.writer = clientWriter
+				server.writer = serverWriter
+				args := newDefaultArgsForTest()
+				args.NoCompress = true
+				args.Bufsize = BufferSize{1024 * 1024}
+				args.AckWindow = window
+				if err := client.sendAction(true, false); err != nil {
+					b.Fatal(err)
+				}
+				action, err := server.recvAction()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := server.sendConfig(&args.TransferOptions, action, getEscapeChars(false), NoTmux, -1); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := client.recvConfig(); err != nil {
+					b.Fatal(err)
+				}
+				result := runTransferForTest(client, server, files, b.TempDir())
+				clientWriter.Close()
+				serverWriter.Close()
+				if result.sendErr != nil || result.recvErr != nil {
+					b.Fatal(result.sendErr, result.recvErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+//go:build linux || darwin || freebsd || netbsd
+
+/*
+MIT License
+
+Copyright (c) 2023 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestPreserveXattrs(t *testing.T) {
+	src := t.TempDir()
+	probe := filepath.Join(src, "probe")
+	writeTestFile(t, probe, "")
+	if err := unix.Setxattr(probe, "user.trzsz", []byte("probe"), 0); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	require.Nil(t, os.Remove(probe))
+
+	assert := assert.New(t)
+	writeTestFile(t, filepath.Join(src, "dir", "a.txt"), "hello")
+	writeTestFile(t, filepath.Join(src, "dir", "ro.txt"), "read only")
+	require.Nil(t, unix.Setxattr(filepath.Join(src, "dir"), "user.trzsz", []byte("dir"), 0))
+	require.Nil(t, unix.Setxattr(filepath.Join(src, "dir", "a.txt"), "user.trzsz", []byte("a"), 0))
+	require.Nil(t, unix.Setxattr(filepath.Join(src, "dir", "a.txt"), "user.empty", []byte{}, 0))
+	require.Nil(t, unix.Setxattr(filepath.Join(src, "dir", "ro.txt"), "user.trzsz", []byte{0, 1, 0xee}, 0))
+	require.Nil(t, os.Chmod(filepath.Join(src, "dir", "ro.txt"), 0444))
+	files, err := checkPathsReadable([]string{filepath.Join(src, "dir")}, true)
+	require.Nil(t, err)
+
+	getXattr := func(path, name string) []byte {
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil
+		}
+		value := make([]byte, size)
+		size, err = unix.Getxattr(path, name, value)
+		require.Nil(t, err)
+		return value[:size]
+	}
+
+	for _, tc := range []struct {
+		protocol int
+		parallel int
+		xattrs   bool
+	}{{2, 1, true}, {kProtocolVersion, 2, true}, {2, 1, false}} {
+		dest := t.TempDir()
+		args := newDefaultArgsForTest()
+		args.Directory = true
+		args.Preserve = true
+		args.Xattrs = tc.xattrs
+		args.Parallel = tc.parallel
+		result := transferFilesForTest(t, args, tc.protocol, files, dest)
+		require.Nil(t, result.sendErr)
+		require.Nil(t, result.recvErr)
+
+		if tc.xattrs {
+			assert.Equal([]byte("dir"), getXattr(filepath.Join(dest, "dir"), "user.trzsz"))
+			assert.Equal([]byte("a"), getXattr(filepath.Join(dest, "dir", "a.txt"), "user.trzsz"))
+			assert.Equal([]byte{}, getXattr(filepath.Join(dest, "dir", "a.txt"), "user.empty"))
+			// set before the file becomes read-only
+			assert.Equal([]byte{0, 1, 0xee}, getXattr(filepath.Join(dest, "dir", "ro.txt"), "user.trzsz"))
+		} else {
+			assert.Nil(getXattr(filepath.Join(dest, "dir", "a.txt"), "user.trzsz"))
+		}
+		info, err := os.Stat(filepath.Join(dest, "dir", "ro.txt"))
+		require.Nil(t, err)
+		assert.Equal(os.FileMode(0444), info.Mode().Perm())
+	}
+}